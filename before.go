@@ -0,0 +1,162 @@
+package gostry
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+
+	"github.com/mickamy/gostry/internal/query"
+)
+
+// captureBefore reports whether UPDATE statements should read their before-images.
+func (h *Handler) captureBefore() bool {
+	return h.cfg.CaptureBefore || h.cfg.SoftDeleteColumn != ""
+}
+
+// selectBefore reads the rows targeted by an UPDATE statement before it runs.
+// Statements that cannot be rewritten are logged and yield no before-images.
+// Only the columns configured in Config.CaptureColumns are read when set.
+func (tx *Tx) selectBefore(ctx context.Context, table, q string, args []any) ([]map[string]any, error) {
+	sel, ok := query.BuildBeforeSelectColumns(q, tx.h.captureColumns(table))
+	return tx.readBefore(ctx, q, sel, ok, args)
+}
+
+// selectDeleteIDs reads only the id column of the rows targeted by a DELETE statement before it runs.
+// It reports false when the statement cannot be rewritten.
+func (tx *Tx) selectDeleteIDs(ctx context.Context, table, q string, args []any) ([]map[string]any, bool, error) {
+	sel, ok := query.BuildDeleteSelect(q, []string{tx.h.idColumn(table)})
+	if !ok {
+		return nil, false, nil
+	}
+	if _, ok := bindBeforeArgs(sel, args); !ok {
+		return nil, false, nil
+	}
+	ids, err := tx.readBefore(ctx, q, sel, true, args)
+	return ids, true, err
+}
+
+// readBefore binds and runs a SELECT derived from q, honoring Config.LockBeforeRows.
+func (tx *Tx) readBefore(ctx context.Context, q string, sel query.BeforeSelect, ok bool, args []any) ([]map[string]any, error) {
+	if !ok {
+		tx.h.warn(ctx, "gostry: cannot derive before-image query; skipping before capture", slog.String("sql", q))
+		return nil, nil
+	}
+	bound, ok := bindBeforeArgs(sel, args)
+	if !ok {
+		tx.h.warn(ctx, "gostry: cannot bind before-image arguments; skipping before capture", slog.String("sql", q))
+		return nil, nil
+	}
+	stmt := sel.SQL
+	if tx.h.cfg.LockBeforeRows {
+		stmt += " FOR UPDATE"
+	}
+	rows, err := tx.Tx.QueryContext(ctx, stmt, bound...)
+	if err != nil {
+		return nil, fmt.Errorf("gostry: failed to query before-image: %w", err)
+	}
+	ms, _, err := scanAll(rows)
+	if err != nil {
+		return nil, withKind(ErrScan, fmt.Errorf("gostry: failed to scan before-image: %w", err))
+	}
+	return ms, nil
+}
+
+// bindBeforeArgs selects the arguments referenced by sel from the original statement args.
+// Positional placeholders pick args by ordinal (sql.NamedArg values are passed through unchanged),
+// and named placeholders pick the sql.NamedArg with the matching name.
+func bindBeforeArgs(sel query.BeforeSelect, args []any) ([]any, bool) {
+	bound := make([]any, 0, len(sel.ArgIndexes)+len(sel.ArgNames))
+	for _, i := range sel.ArgIndexes {
+		if i < 0 || i >= len(args) {
+			return nil, false
+		}
+		bound = append(bound, args[i])
+	}
+	for _, name := range sel.ArgNames {
+		found := false
+		for _, a := range args {
+			if na, ok := a.(sql.NamedArg); ok && na.Name == name {
+				bound = append(bound, na)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, false
+		}
+	}
+	return bound, true
+}
+
+// beforeIndex pairs before-images with the after-images returned by the same statement.
+type beforeIndex struct {
+	h     *Handler
+	table string
+	rows  []map[string]any
+	byID  map[string]map[string]any
+}
+
+func (h *Handler) newBeforeIndex(table string, befores []map[string]any) *beforeIndex {
+	idx := &beforeIndex{h: h, table: table, rows: befores, byID: make(map[string]map[string]any, len(befores))}
+	for _, b := range befores {
+		if id, _, _ := h.resolveID(table, b, nil); id != nil {
+			idx.byID[fmt.Sprint(id)] = b
+		}
+	}
+	return idx
+}
+
+// match returns the before-image for after, or nil when none can be identified.
+// Rows are paired by id; when no id matches and a single before-image was read, that one is used,
+// since after-images are streamed and their total count is not known up front.
+func (idx *beforeIndex) match(after map[string]any) map[string]any {
+	if id, _, _ := idx.h.resolveID(idx.table, nil, after); id != nil {
+		if b, ok := idx.byID[fmt.Sprint(id)]; ok {
+			return b
+		}
+	}
+	if len(idx.rows) == 1 {
+		return idx.rows[0]
+	}
+	return nil
+}
+
+// classifySoftDelete rewrites an UPDATE that moves SoftDeleteColumn from NULL to non-NULL into a DELETE.
+// It needs the before-image, which captureBefore turns on for SoftDeleteColumn.
+func (h *Handler) classifySoftDelete(e *entry) {
+	col := h.cfg.SoftDeleteColumn
+	if col == "" || e.op != "UPDATE" || e.before == nil || e.after == nil {
+		return
+	}
+	prev, hadPrev := e.before[col]
+	next, hasNext := e.after[col]
+	if hadPrev && prev == nil && hasNext && next != nil {
+		e.op = "DELETE"
+	}
+}
+
+// execIDOnlyDelete runs a DELETE configured in Config.IDOnlyDelete. The ids of the targeted rows are
+// read first and each deleted row is recorded with a before-image holding only its id, so memory
+// stays bounded by the id column instead of full rows. Statements that cannot be rewritten
+// (e.g. DELETE ... USING) fall back to a statement-only entry.
+func (tx *Tx) execIDOnlyDelete(ctx context.Context, dml query.DML, q string, args []any) (sql.Result, error) {
+	ids, ok, err := tx.selectDeleteIDs(ctx, dml.Table, q, args)
+	if err != nil {
+		return nil, err
+	}
+	res, err := tx.Tx.ExecContext(ctx, q, args...)
+	if err != nil {
+		return nil, err
+	}
+	meta := tx.h.meta(ctx)
+	if !ok {
+		tx.h.warn(ctx, "gostry: cannot derive id query for DELETE; recording statement only", slog.String("sql", q))
+		tx.capture(ctx, summaryEntry(dml, q, args, meta, res))
+		return res, nil
+	}
+	for _, id := range ids {
+		tx.capture(ctx, entry{table: dml.Table, op: dml.Op, sql: q, args: args, meta: meta, before: id})
+	}
+	return res, nil
+}
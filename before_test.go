@@ -0,0 +1,710 @@
+package gostry
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mickamy/gostry/internal/query"
+)
+
+func TestTx_SoftDelete(t *testing.T) {
+	t.Parallel()
+
+	deletedAt := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	tcs := []struct {
+		name       string
+		sql        string
+		beforeDel  driver.Value
+		afterDel   driver.Value
+		wantOp     string
+		wantBefore bool
+	}{
+		{
+			name:       "null to non-null is a delete",
+			sql:        `UPDATE orders SET deleted_at = now() WHERE id = $1 RETURNING *`,
+			beforeDel:  nil,
+			afterDel:   deletedAt,
+			wantOp:     "DELETE",
+			wantBefore: true,
+		},
+		{
+			name:       "normal update keeps deleted_at null",
+			sql:        `UPDATE orders SET status = 'paid' WHERE id = $1 RETURNING *`,
+			beforeDel:  nil,
+			afterDel:   nil,
+			wantOp:     "UPDATE",
+			wantBefore: true,
+		},
+		{
+			name:       "already deleted row stays an update",
+			sql:        `UPDATE orders SET deleted_at = now() WHERE id = $1 RETURNING *`,
+			beforeDel:  deletedAt,
+			afterDel:   deletedAt,
+			wantOp:     "UPDATE",
+			wantBefore: true,
+		},
+	}
+
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			cols := []string{"id", "status", "deleted_at"}
+			db, state := openFakeDB(t, func(q string, _ []any) (fakeResult, error) {
+				if strings.HasPrefix(q, "SELECT") {
+					return fakeResult{cols: cols, rows: [][]driver.Value{{int64(1), "new", tc.beforeDel}}}, nil
+				}
+				return fakeResult{cols: cols, rows: [][]driver.Value{{int64(1), "paid", tc.afterDel}}}, nil
+			})
+
+			ctx := context.Background()
+			tx, err := New(Config{SoftDeleteColumn: "deleted_at"}).Wrap(db).BeginTx(ctx, nil)
+			if err != nil {
+				t.Fatalf("BeginTx() error = %v", err)
+			}
+			if _, err := tx.ExecContext(ctx, tc.sql, int64(1)); err != nil {
+				t.Fatalf("ExecContext() error = %v", err)
+			}
+			if err := tx.Commit(); err != nil {
+				t.Fatalf("Commit() error = %v", err)
+			}
+
+			queries := state.Queries()
+			if len(queries) != 2 || queries[0].query != "SELECT * FROM orders WHERE id = $1" {
+				t.Fatalf("queries = %#v, want before SELECT then UPDATE", queries)
+			}
+			if len(queries[0].args) != 1 || queries[0].args[0] != int64(1) {
+				t.Fatalf("before SELECT args = %v, want [1]", queries[0].args)
+			}
+			execs := state.Execs()
+			if len(execs) != 1 {
+				t.Fatalf("history inserts = %d, want 1", len(execs))
+			}
+			if got := execs[0].args[1]; got != tc.wantOp {
+				t.Fatalf("history operation = %v, want %v", got, tc.wantOp)
+			}
+			if gotBefore := string(execs[0].args[5].([]byte)) != "null"; gotBefore != tc.wantBefore {
+				t.Fatalf("history before = %s, want present = %t", execs[0].args[5], tc.wantBefore)
+			}
+		})
+	}
+}
+
+func TestHandler_BeforeIndexMatchesByID(t *testing.T) {
+	t.Parallel()
+
+	h := New(Config{})
+	befores := []map[string]any{{"id": int64(2), "v": "b"}, {"id": int64(1), "v": "a"}}
+	idx := h.newBeforeIndex("orders", befores)
+
+	if got := idx.match(map[string]any{"id": int64(1)}); got["v"] != "a" {
+		t.Fatalf("match(id=1) = %v, want v=a", got)
+	}
+	if got := idx.match(map[string]any{"id": int64(2)}); got["v"] != "b" {
+		t.Fatalf("match(id=2) = %v, want v=b", got)
+	}
+	if got := idx.match(map[string]any{"id": int64(3)}); got != nil {
+		t.Fatalf("match(id=3) = %v, want nil", got)
+	}
+}
+
+func TestTx_CaptureBeforeNamedArgs(t *testing.T) {
+	t.Parallel()
+
+	cols := []string{"id", "status"}
+	db, state := openFakeDB(t, func(q string, _ []any) (fakeResult, error) {
+		if strings.HasPrefix(q, "SELECT") {
+			return fakeResult{cols: cols, rows: [][]driver.Value{{int64(7), "new"}}}, nil
+		}
+		return fakeResult{cols: cols, rows: [][]driver.Value{{int64(7), "paid"}}}, nil
+	})
+
+	ctx := context.Background()
+	tx, err := New(Config{CaptureBefore: true}).Wrap(db).BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatalf("BeginTx() error = %v", err)
+	}
+	_, err = tx.ExecContext(ctx, `UPDATE orders SET status = @status WHERE id = @id RETURNING *`,
+		sql.Named("status", "paid"), sql.Named("id", int64(7)))
+	if err != nil {
+		t.Fatalf("ExecContext() error = %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Commit() error = %v", err)
+	}
+
+	queries := state.Queries()
+	if len(queries) != 2 {
+		t.Fatalf("queries = %d, want 2", len(queries))
+	}
+	sel := queries[0]
+	if sel.query != "SELECT * FROM orders WHERE id = @id" {
+		t.Fatalf("before SELECT = %q", sel.query)
+	}
+	if len(sel.args) != 1 || !reflect.DeepEqual(sel.args[0], sql.Named("id", int64(7))) {
+		t.Fatalf("before SELECT args = %#v, want [id=7]", sel.args)
+	}
+	upd := queries[1]
+	if want := []any{sql.Named("status", "paid"), sql.Named("id", int64(7))}; !reflect.DeepEqual(upd.args, want) {
+		t.Fatalf("UPDATE args = %#v, want %#v", upd.args, want)
+	}
+
+	execs := state.Execs()
+	if len(execs) != 1 {
+		t.Fatalf("history inserts = %d, want 1", len(execs))
+	}
+	if got, want := string(execs[0].args[5].([]byte)), `{"id":7,"status":"new"}`; got != want {
+		t.Fatalf("history before = %s, want %s", got, want)
+	}
+}
+
+func TestBindBeforeArgs_MissingNamedArg(t *testing.T) {
+	t.Parallel()
+
+	sel := query.BeforeSelect{SQL: "SELECT * FROM orders WHERE id = @id", ArgNames: []string{"id"}}
+	if _, ok := bindBeforeArgs(sel, []any{sql.Named("other", 1)}); ok {
+		t.Fatal("bindBeforeArgs() ok = true, want false for missing named arg")
+	}
+}
+
+func TestTx_SkipNoOpUpdates(t *testing.T) {
+	t.Parallel()
+
+	tcs := []struct {
+		name        string
+		afterStatus string
+		wantInserts int
+	}{
+		{name: "no-op update is dropped", afterStatus: "new", wantInserts: 0},
+		{name: "real change is kept", afterStatus: "paid", wantInserts: 1},
+	}
+
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			cols := []string{"id", "status"}
+			db, state := openFakeDB(t, func(q string, _ []any) (fakeResult, error) {
+				if strings.HasPrefix(q, "SELECT") {
+					// The before-image reports the id as int32 to exercise numeric normalization.
+					return fakeResult{cols: cols, rows: [][]driver.Value{{int32(1), "new"}}}, nil
+				}
+				return fakeResult{cols: cols, rows: [][]driver.Value{{int64(1), tc.afterStatus}}}, nil
+			})
+
+			ctx := context.Background()
+			tx, err := New(Config{CaptureBefore: true, SkipNoOpUpdates: true}).Wrap(db).BeginTx(ctx, nil)
+			if err != nil {
+				t.Fatalf("BeginTx() error = %v", err)
+			}
+			if _, err := tx.ExecContext(ctx, `UPDATE orders SET status = $1 WHERE id = $2 RETURNING *`, tc.afterStatus, int64(1)); err != nil {
+				t.Fatalf("ExecContext() error = %v", err)
+			}
+			if err := tx.Commit(); err != nil {
+				t.Fatalf("Commit() error = %v", err)
+			}
+			if got := len(state.Execs()); got != tc.wantInserts {
+				t.Fatalf("history inserts = %d, want %d", got, tc.wantInserts)
+			}
+		})
+	}
+}
+
+func TestTx_WatchColumns(t *testing.T) {
+	t.Parallel()
+
+	tcs := []struct {
+		name        string
+		afterStatus string
+		wantInserts int
+	}{
+		{name: "watched change is kept", afterStatus: "paid", wantInserts: 1},
+		{name: "unwatched change is dropped", afterStatus: "new", wantInserts: 0},
+	}
+
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			cols := []string{"id", "status", "note"}
+			db, state := openFakeDB(t, func(q string, _ []any) (fakeResult, error) {
+				if strings.HasPrefix(q, "SELECT") {
+					return fakeResult{cols: cols, rows: [][]driver.Value{{int64(1), "new", "old note"}}}, nil
+				}
+				return fakeResult{cols: cols, rows: [][]driver.Value{{int64(1), tc.afterStatus, "new note"}}}, nil
+			})
+
+			ctx := context.Background()
+			h := New(Config{CaptureBefore: true, WatchColumns: map[string][]string{"orders": {"status"}}, SkipUnwatchedUpdates: true})
+			tx, err := h.Wrap(db).BeginTx(ctx, nil)
+			if err != nil {
+				t.Fatalf("BeginTx() error = %v", err)
+			}
+			if _, err := tx.ExecContext(ctx, `UPDATE orders SET status = $1, note = 'new note' WHERE id = 1 RETURNING *`, tc.afterStatus); err != nil {
+				t.Fatalf("ExecContext() error = %v", err)
+			}
+			if err := tx.Commit(); err != nil {
+				t.Fatalf("Commit() error = %v", err)
+			}
+			execs := state.Execs()
+			if len(execs) != tc.wantInserts {
+				t.Fatalf("history inserts = %d, want %d", len(execs), tc.wantInserts)
+			}
+			if tc.wantInserts == 0 {
+				return
+			}
+			for i, want := range []string{`{"id":1,"status":"new"}`, `{"id":1,"status":"paid"}`} {
+				if got := string(execs[0].args[5+i].([]byte)); got != want {
+					t.Errorf("image %d = %s, want %s", i, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestTx_LockBeforeRows(t *testing.T) {
+	t.Parallel()
+
+	tcs := []struct {
+		name string
+		lock bool
+		want string
+	}{
+		{name: "disabled", lock: false, want: "SELECT * FROM orders o WHERE o.id = $1"},
+		{name: "enabled", lock: true, want: "SELECT * FROM orders o WHERE o.id = $1 FOR UPDATE"},
+	}
+
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			db, state := openFakeDB(t, func(string, []any) (fakeResult, error) {
+				return fakeResult{cols: []string{"id"}, rows: [][]driver.Value{{int64(1)}}}, nil
+			})
+
+			ctx := context.Background()
+			tx, err := New(Config{CaptureBefore: true, LockBeforeRows: tc.lock}).Wrap(db).BeginTx(ctx, nil)
+			if err != nil {
+				t.Fatalf("BeginTx() error = %v", err)
+			}
+			if _, err := tx.ExecContext(ctx, `UPDATE orders o SET status = 'paid' WHERE o.id = $1 RETURNING *`, int64(1)); err != nil {
+				t.Fatalf("ExecContext() error = %v", err)
+			}
+			if err := tx.Commit(); err != nil {
+				t.Fatalf("Commit() error = %v", err)
+			}
+
+			queries := state.Queries()
+			if len(queries) != 2 || queries[0].query != tc.want {
+				t.Fatalf("before SELECT = %#v, want %q", queries, tc.want)
+			}
+		})
+	}
+}
+
+func TestTx_CaptureBeforeUpdateFrom(t *testing.T) {
+	t.Parallel()
+
+	cols := []string{"id", "status"}
+	db, state := openFakeDB(t, func(q string, _ []any) (fakeResult, error) {
+		if strings.HasPrefix(q, "SELECT") {
+			return fakeResult{cols: cols, rows: [][]driver.Value{{int64(1), "new"}, {int64(2), "new"}}}, nil
+		}
+		return fakeResult{cols: cols, rows: [][]driver.Value{{int64(2), "paid"}, {int64(1), "shipped"}}}, nil
+	})
+
+	ctx := context.Background()
+	tx, err := New(Config{CaptureBefore: true}).Wrap(db).BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatalf("BeginTx() error = %v", err)
+	}
+	q := `UPDATE orders o SET status = s.status FROM staging s WHERE s.order_id = o.id AND s.batch = $1 RETURNING o.*`
+	if _, err := tx.ExecContext(ctx, q, "b1"); err != nil {
+		t.Fatalf("ExecContext() error = %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Commit() error = %v", err)
+	}
+
+	queries := state.Queries()
+	want := "SELECT * FROM orders o WHERE EXISTS (SELECT 1 FROM staging s WHERE s.order_id = o.id AND s.batch = $1)"
+	if len(queries) != 2 || queries[0].query != want || !reflect.DeepEqual(queries[0].args, []any{"b1"}) {
+		t.Fatalf("before SELECT = %#v, want %q with [b1]", queries, want)
+	}
+	execs := state.Execs()
+	if len(execs) != 2 {
+		t.Fatalf("history inserts = %d, want 2", len(execs))
+	}
+	wantBefore := map[any]string{int64(2): `{"id":2,"status":"new"}`, int64(1): `{"id":1,"status":"new"}`}
+	for _, call := range execs {
+		if got := string(call.args[5].([]byte)); got != wantBefore[call.args[0]] {
+			t.Fatalf("before of id %v = %s, want %s", call.args[0], got, wantBefore[call.args[0]])
+		}
+	}
+}
+
+func TestTx_CaptureBeforeCurrentOf(t *testing.T) {
+	t.Parallel()
+
+	db, state := openFakeDB(t, func(string, []any) (fakeResult, error) {
+		return fakeResult{cols: []string{"id", "status"}, rows: [][]driver.Value{{int64(1), "paid"}}}, nil
+	})
+	var logs bytes.Buffer
+	h := New(Config{CaptureBefore: true, Logger: slog.New(slog.NewTextHandler(&logs, nil))})
+
+	ctx := context.Background()
+	tx, err := h.Wrap(db).BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatalf("BeginTx() error = %v", err)
+	}
+	q := `UPDATE orders SET status = $1 WHERE CURRENT OF order_cursor RETURNING *`
+	if _, err := tx.ExecContext(ctx, q, "paid"); err != nil {
+		t.Fatalf("ExecContext() error = %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Commit() error = %v", err)
+	}
+
+	if queries := state.Queries(); len(queries) != 1 || queries[0].query != q {
+		t.Fatalf("queries = %#v, want only the UPDATE (no before SELECT)", queries)
+	}
+	if !strings.Contains(logs.String(), "WHERE CURRENT OF cannot be before-captured") {
+		t.Fatalf("logs = %s, want a WHERE CURRENT OF warning", logs.String())
+	}
+	execs := state.Execs()
+	if len(execs) != 1 {
+		t.Fatalf("history inserts = %d, want 1", len(execs))
+	}
+	if got := string(execs[0].args[5].([]byte)); got != "null" {
+		t.Fatalf("history before = %s, want null", got)
+	}
+	if got, want := string(execs[0].args[6].([]byte)), `{"id":1,"status":"paid"}`; got != want {
+		t.Fatalf("history after = %s, want %s", got, want)
+	}
+}
+
+func TestBeginTx_WeakIsolationWarning(t *testing.T) {
+	t.Parallel()
+
+	tcs := []struct {
+		name     string
+		cfg      Config
+		opts     *sql.TxOptions
+		wantWarn bool
+	}{
+		{name: "read committed with before capture", cfg: Config{CaptureBefore: true}, opts: &sql.TxOptions{Isolation: sql.LevelReadCommitted}, wantWarn: true},
+		{name: "repeatable read", cfg: Config{CaptureBefore: true}, opts: &sql.TxOptions{Isolation: sql.LevelRepeatableRead}},
+		{name: "default level", cfg: Config{CaptureBefore: true}},
+		{name: "locked before rows", cfg: Config{CaptureBefore: true, LockBeforeRows: true}, opts: &sql.TxOptions{Isolation: sql.LevelReadCommitted}},
+		{name: "no before capture", opts: &sql.TxOptions{Isolation: sql.LevelReadCommitted}},
+	}
+
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			db, _ := openFakeDB(t, nil)
+			var logs bytes.Buffer
+			tc.cfg.Logger = slog.New(slog.NewTextHandler(&logs, nil))
+
+			tx, err := New(tc.cfg).Wrap(db).BeginTx(context.Background(), tc.opts)
+			if err != nil {
+				t.Fatalf("BeginTx() error = %v", err)
+			}
+			defer func() { _ = tx.Rollback() }()
+			if tc.opts != nil && tx.Isolation() != tc.opts.Isolation {
+				t.Fatalf("Isolation() = %v, want %v", tx.Isolation(), tc.opts.Isolation)
+			}
+			if gotWarn := strings.Contains(logs.String(), "REPEATABLE READ"); gotWarn != tc.wantWarn {
+				t.Fatalf("BeginTx() warned = %t, want %t (logs: %s)", gotWarn, tc.wantWarn, logs.String())
+			}
+		})
+	}
+}
+
+func TestTx_IDOnlyDelete(t *testing.T) {
+	t.Parallel()
+
+	db, state := openFakeDB(t, func(string, []any) (fakeResult, error) {
+		return fakeResult{cols: []string{"id"}, rows: [][]driver.Value{{int64(3)}, {int64(8)}}}, nil
+	})
+
+	ctx := context.Background()
+	h := New(Config{IDOnlyDelete: map[string]bool{"sessions": true}})
+	tx, err := h.Wrap(db).BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatalf("BeginTx() error = %v", err)
+	}
+	const del = `DELETE FROM sessions WHERE expires_at < $1`
+	if _, err := tx.ExecContext(ctx, del, "2025-01-01"); err != nil {
+		t.Fatalf("ExecContext() error = %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Commit() error = %v", err)
+	}
+
+	queries := state.Queries()
+	if len(queries) != 1 || queries[0].query != `SELECT "id" FROM sessions WHERE expires_at < $1` {
+		t.Fatalf("queries = %#v, want id SELECT only", queries)
+	}
+	execs := state.Execs()
+	if len(execs) != 3 || execs[0].query != del {
+		t.Fatalf("execs = %#v, want DELETE then 2 history inserts", execs)
+	}
+	for i, want := range []int64{3, 8} {
+		args := execs[i+1].args
+		if args[0] != want || args[1] != "DELETE" {
+			t.Fatalf("history row %d id/op = %v/%v, want %d/DELETE", i, args[0], args[1], want)
+		}
+		if got, wantBefore := string(args[5].([]byte)), fmt.Sprintf(`{"id":%d}`, want); got != wantBefore {
+			t.Fatalf("history row %d before = %s, want %s", i, got, wantBefore)
+		}
+		if got := string(args[6].([]byte)); got != "null" {
+			t.Fatalf("history row %d after = %s, want null", i, got)
+		}
+	}
+}
+
+func TestTx_GeneratedColumns(t *testing.T) {
+	t.Parallel()
+
+	// total is GENERATED ALWAYS AS (price * qty) STORED; like lib/pq, the driver returns NUMERIC and
+	// JSONB values as text bytes.
+	cols := []string{"id", "price", "qty", "total", "label", "attrs"}
+	types := []string{"INT8", "NUMERIC", "INT4", "NUMERIC", "TEXT", "JSONB"}
+	db, state := openFakeDB(t, func(q string, _ []any) (fakeResult, error) {
+		if strings.HasPrefix(q, "SELECT") {
+			return fakeResult{cols: cols, types: types, rows: [][]driver.Value{
+				{int64(1), []byte("2.50"), int64(2), []byte("5.00"), []byte("42"), []byte(`{"k":"v"}`)},
+			}}, nil
+		}
+		return fakeResult{cols: cols, types: types, rows: [][]driver.Value{
+			{int64(1), []byte("2.50"), int64(3), []byte("7.50"), []byte("true"), []byte(`{"k":"w"}`)},
+		}}, nil
+	})
+
+	ctx := context.Background()
+	tx, err := New(Config{CaptureBefore: true}).Wrap(db).BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatalf("BeginTx() error = %v", err)
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE orders SET qty = 3 WHERE id = $1 RETURNING *`, int64(1)); err != nil {
+		t.Fatalf("ExecContext() error = %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Commit() error = %v", err)
+	}
+
+	execs := state.Execs()
+	if len(execs) != 1 {
+		t.Fatalf("history inserts = %d, want 1", len(execs))
+	}
+	wantBefore := `{"attrs":{"k":"v"},"id":1,"label":"42","price":"2.50","qty":2,"total":"5.00"}`
+	if got := string(execs[0].args[5].([]byte)); got != wantBefore {
+		t.Fatalf("history before = %s, want %s", got, wantBefore)
+	}
+	wantAfter := `{"attrs":{"k":"w"},"id":1,"label":"true","price":"2.50","qty":3,"total":"7.50"}`
+	if got := string(execs[0].args[6].([]byte)); got != wantAfter {
+		t.Fatalf("history after = %s, want %s", got, wantAfter)
+	}
+}
+
+func TestTx_ArrayColumns(t *testing.T) {
+	t.Parallel()
+
+	// Array and hstore values arrive as Postgres text literals; malformed literals are kept verbatim.
+	cols := []string{"id", "tags", "scores", "ranges", "attrs"}
+	types := []string{"INT8", "_TEXT", "_INT4", "_INT4", "HSTORE"}
+	db, state := openFakeDB(t, func(string, []any) (fakeResult, error) {
+		return fakeResult{cols: cols, types: types, rows: [][]driver.Value{{
+			int64(1),
+			[]byte(`{red,"dark blue",NULL}`),
+			[]byte(`{1,2,3}`),
+			[]byte(`[0:1]={1,2}`),
+			[]byte(`"color"=>"red", "size"=>NULL`),
+		}}}, nil
+	})
+
+	ctx := context.Background()
+	tx, err := New(Config{}).Wrap(db).BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatalf("BeginTx() error = %v", err)
+	}
+	if _, err := tx.ExecContext(ctx, `INSERT INTO orders (tags) VALUES ('{}') RETURNING *`); err != nil {
+		t.Fatalf("ExecContext() error = %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Commit() error = %v", err)
+	}
+
+	execs := state.Execs()
+	if len(execs) != 1 {
+		t.Fatalf("history inserts = %d, want 1", len(execs))
+	}
+	want := `{"attrs":{"color":"red","size":null},"id":1,"ranges":"[0:1]={1,2}","scores":[1,2,3],"tags":["red","dark blue",null]}`
+	if got := string(execs[0].args[6].([]byte)); got != want {
+		t.Fatalf("history after = %s, want %s", got, want)
+	}
+}
+
+// textValuer stands in for driver types such as pgtype.Interval whose Value is their textual form.
+type textValuer struct{ text string }
+
+func (v textValuer) Value() (driver.Value, error) { return v.text, nil }
+
+func TestTx_DriverValueTypes(t *testing.T) {
+	t.Parallel()
+
+	// pgx scans these column types into Go structs and arrays when the destination is an any.
+	_, network, _ := net.ParseCIDR("10.0.0.0/8")
+	mac, _ := net.ParseMAC("08:00:2b:01:02:03")
+	cols := []string{"id", "uuid", "inet", "cidr", "macaddr", "interval"}
+	db, state := openFakeDB(t, func(string, []any) (fakeResult, error) {
+		return fakeResult{cols: cols, rows: [][]driver.Value{{
+			int64(1),
+			[16]byte{0x0b, 0x6f, 0x2f, 0x9e, 0x1c, 0x8e, 0x4d, 0x0a, 0x9b, 0x7a, 0x3f, 0x2d, 0x8c, 0x1e, 0x5a, 0x44},
+			netip.MustParsePrefix("192.168.0.1/32"),
+			*network,
+			mac,
+			textValuer{text: "1 day 02:00:00"},
+		}}}, nil
+	})
+
+	ctx := context.Background()
+	tx, err := New(Config{}).Wrap(db).BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatalf("BeginTx() error = %v", err)
+	}
+	if _, err := tx.ExecContext(ctx, `INSERT INTO devices DEFAULT VALUES RETURNING *`); err != nil {
+		t.Fatalf("ExecContext() error = %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Commit() error = %v", err)
+	}
+
+	execs := state.Execs()
+	if len(execs) != 1 {
+		t.Fatalf("history inserts = %d, want 1", len(execs))
+	}
+	want := `{"cidr":"10.0.0.0/8","id":1,"inet":"192.168.0.1/32","interval":"1 day 02:00:00","macaddr":"08:00:2b:01:02:03","uuid":"0b6f2f9e-1c8e-4d0a-9b7a-3f2d8c1e5a44"}`
+	if got := string(execs[0].args[6].([]byte)); got != want {
+		t.Fatalf("history after = %s, want %s", got, want)
+	}
+}
+
+func TestTx_CaptureColumns(t *testing.T) {
+	t.Parallel()
+
+	wide := []string{"id", "status", "amount", "blob"}
+	row := func(status string) []driver.Value { return []driver.Value{int64(1), status, int64(10), "xxxx"} }
+
+	tcs := []struct {
+		name       string
+		sql        string
+		wantQuery  []string
+		wantBefore string
+		wantAfter  string
+	}{
+		{
+			name: "auto-attached returning and before select are projected",
+			sql:  `UPDATE orders SET status = 'paid' WHERE id = $1`,
+			wantQuery: []string{
+				`SELECT "status", "id" FROM orders WHERE id = $1`,
+				"UPDATE orders SET status = 'paid' WHERE id = $1\nRETURNING \"status\", \"id\"",
+			},
+			wantBefore: `{"id":1,"status":"new"}`,
+			wantAfter:  `{"id":1,"status":"paid"}`,
+		},
+		{
+			name: "user-written returning star is trimmed",
+			sql:  `UPDATE orders SET status = 'paid' WHERE id = $1 RETURNING *`,
+			wantQuery: []string{
+				`SELECT "status", "id" FROM orders WHERE id = $1`,
+				`UPDATE orders SET status = 'paid' WHERE id = $1 RETURNING *`,
+			},
+			wantBefore: `{"id":1,"status":"new"}`,
+			wantAfter:  `{"id":1,"status":"paid"}`,
+		},
+	}
+
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			db, state := openFakeDB(t, func(q string, _ []any) (fakeResult, error) {
+				if strings.HasPrefix(q, "SELECT") {
+					return fakeResult{cols: []string{"status", "id"}, rows: [][]driver.Value{{"new", int64(1)}}}, nil
+				}
+				if strings.HasSuffix(q, "RETURNING *") {
+					return fakeResult{cols: wide, rows: [][]driver.Value{row("paid")}}, nil
+				}
+				return fakeResult{cols: []string{"status", "id"}, rows: [][]driver.Value{{"paid", int64(1)}}}, nil
+			})
+
+			ctx := context.Background()
+			h := New(Config{
+				AutoAttachReturning: true,
+				CaptureBefore:       true,
+				CaptureColumns:      map[string][]string{"orders": {"status"}},
+			})
+			tx, err := h.Wrap(db).BeginTx(ctx, nil)
+			if err != nil {
+				t.Fatalf("BeginTx() error = %v", err)
+			}
+			if _, err := tx.ExecContext(ctx, tc.sql, int64(1)); err != nil {
+				t.Fatalf("ExecContext() error = %v", err)
+			}
+			if err := tx.Commit(); err != nil {
+				t.Fatalf("Commit() error = %v", err)
+			}
+
+			var got []string
+			for _, q := range state.Queries() {
+				got = append(got, q.query)
+			}
+			if !reflect.DeepEqual(got, tc.wantQuery) {
+				t.Fatalf("queries = %q, want %q", got, tc.wantQuery)
+			}
+			execs := state.Execs()
+			if len(execs) != 1 {
+				t.Fatalf("history inserts = %d, want 1", len(execs))
+			}
+			if got := string(execs[0].args[5].([]byte)); got != tc.wantBefore {
+				t.Fatalf("history before = %s, want %s", got, tc.wantBefore)
+			}
+			if got := string(execs[0].args[6].([]byte)); got != tc.wantAfter {
+				t.Fatalf("history after = %s, want %s", got, tc.wantAfter)
+			}
+		})
+	}
+}
+
+func TestHandler_CaptureColumnsAlwaysIncludeKeys(t *testing.T) {
+	t.Parallel()
+
+	h := New(Config{
+		CaptureColumns:   map[string][]string{"orders": {"status", "order_no"}},
+		PrimaryKeyColumn: map[string]string{"orders": "order_no"},
+		CompositeKey:     map[string][]string{"orders": {"tenant_id", "order_no"}},
+		Promoted:         PromotedColumns{"orders": {{Name: "customer_id"}}},
+		SoftDeleteColumn: "deleted_at",
+	})
+	want := []string{"status", "order_no", "tenant_id", "customer_id", "deleted_at"}
+	if got := h.captureColumns("orders"); !reflect.DeepEqual(got, want) {
+		t.Fatalf("captureColumns(orders) = %v, want %v", got, want)
+	}
+	if got := h.captureColumns("users"); got != nil {
+		t.Fatalf("captureColumns(users) = %v, want nil", got)
+	}
+}
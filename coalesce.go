@@ -0,0 +1,88 @@
+package gostry
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/mickamy/gostry/internal/ident"
+)
+
+// coalesce collapses entries that touch the same row (same table and id) into a single entry.
+// The rules, applied in buffer order, are:
+//   - UPDATE + UPDATE -> UPDATE with the earliest before and the latest after
+//   - INSERT + UPDATE -> INSERT with the latest after
+//   - UPDATE + DELETE -> DELETE with the earliest before
+//   - INSERT + DELETE -> dropped entirely, unless Config.KeepInsertDelete is set
+//
+// Entries without a row image or id, and DELETE followed by INSERT, are left untouched.
+// The merged entry keeps the position of the first entry and the metadata of the latest one.
+func (h *Handler) coalesce(entries []entry) []entry {
+	out := make([]entry, 0, len(entries))
+	dropped := make([]bool, 0, len(entries))
+	last := make(map[string]int, len(entries))
+	for _, e := range entries {
+		key, ok := h.rowKey(e)
+		if !ok {
+			out = append(out, e)
+			dropped = append(dropped, false)
+			continue
+		}
+		if i, seen := last[key]; seen {
+			if merged, keep, ok := h.mergeEntries(out[i], e); ok {
+				out[i] = merged
+				if !keep {
+					dropped[i] = true
+					delete(last, key)
+				}
+				continue
+			}
+		}
+		last[key] = len(out)
+		out = append(out, e)
+		dropped = append(dropped, false)
+	}
+
+	kept := out[:0]
+	for i, e := range out {
+		if !dropped[i] {
+			kept = append(kept, e)
+		}
+	}
+	return kept
+}
+
+// mergeEntries folds next into prev. It returns ok=false when the pair must not be merged,
+// and keep=false when the merged result cancels out and should be dropped.
+func (h *Handler) mergeEntries(prev, next entry) (merged entry, keep bool, ok bool) {
+	merged = next
+	switch {
+	case prev.op == "INSERT" && next.op == "UPDATE":
+		merged.op = "INSERT"
+		merged.before = nil
+	case prev.op == "UPDATE" && (next.op == "UPDATE" || next.op == "DELETE"):
+		if prev.before != nil {
+			merged.before = prev.before
+		}
+	case prev.op == "INSERT" && next.op == "DELETE":
+		if h.cfg.KeepInsertDelete {
+			return entry{}, false, false
+		}
+		return entry{}, false, true
+	default:
+		return entry{}, false, false
+	}
+	return merged, true, true
+}
+
+// rowKey identifies the row an entry refers to. Entries without a row image or id are not keyed.
+func (h *Handler) rowKey(e entry) (string, bool) {
+	if e.before == nil && e.after == nil {
+		return "", false
+	}
+	id, _, _ := h.resolveID(e.table, e.before, e.after)
+	if id == nil {
+		return "", false
+	}
+	table := strings.Join(ident.SplitQualified(e.table), ".")
+	return fmt.Sprintf("%s\x00%v", table, id), true
+}
@@ -0,0 +1,109 @@
+package gostry
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestHandler_Coalesce(t *testing.T) {
+	t.Parallel()
+
+	row := func(status string) map[string]any { return map[string]any{"id": 1, "status": status} }
+
+	tcs := []struct {
+		name             string
+		keepInsertDelete bool
+		in               []entry
+		want             []entry
+	}{
+		{
+			name: "insert then update",
+			in: []entry{
+				{table: "orders", op: "INSERT", after: row("new")},
+				{table: "orders", op: "UPDATE", after: row("paid"), meta: meta{operator: "bob"}},
+			},
+			want: []entry{
+				{table: "orders", op: "INSERT", after: row("paid"), meta: meta{operator: "bob"}},
+			},
+		},
+		{
+			name: "update then update",
+			in: []entry{
+				{table: "orders", op: "UPDATE", before: row("new"), after: row("pending")},
+				{table: "orders", op: "UPDATE", before: row("pending"), after: row("paid")},
+				{table: "orders", op: "UPDATE", after: row("shipped")},
+			},
+			want: []entry{
+				{table: "orders", op: "UPDATE", before: row("new"), after: row("shipped")},
+			},
+		},
+		{
+			name: "insert then delete cancels out",
+			in: []entry{
+				{table: "orders", op: "INSERT", after: row("new")},
+				{table: "users", op: "INSERT", after: map[string]any{"id": 1}},
+				{table: "orders", op: "DELETE", before: row("new")},
+			},
+			want: []entry{
+				{table: "users", op: "INSERT", after: map[string]any{"id": 1}},
+			},
+		},
+		{
+			name:             "insert then delete kept",
+			keepInsertDelete: true,
+			in: []entry{
+				{table: "orders", op: "INSERT", after: row("new")},
+				{table: "orders", op: "DELETE", before: row("new")},
+			},
+			want: []entry{
+				{table: "orders", op: "INSERT", after: row("new")},
+				{table: "orders", op: "DELETE", before: row("new")},
+			},
+		},
+		{
+			name: "update then delete",
+			in: []entry{
+				{table: "orders", op: "UPDATE", after: row("paid")},
+				{table: "orders", op: "DELETE", before: row("paid")},
+			},
+			want: []entry{
+				{table: "orders", op: "DELETE", before: row("paid")},
+			},
+		},
+		{
+			name: "different rows and tables are not merged",
+			in: []entry{
+				{table: "orders", op: "UPDATE", after: row("paid")},
+				{table: "orders", op: "UPDATE", after: map[string]any{"id": 2}},
+				{table: "sales.orders", op: "UPDATE", after: row("paid")},
+			},
+			want: []entry{
+				{table: "orders", op: "UPDATE", after: row("paid")},
+				{table: "orders", op: "UPDATE", after: map[string]any{"id": 2}},
+				{table: "sales.orders", op: "UPDATE", after: row("paid")},
+			},
+		},
+		{
+			name: "metadata-only entries are untouched",
+			in: []entry{
+				{table: "orders", op: "UPDATE", sql: "UPDATE orders SET status = 'x'"},
+				{table: "orders", op: "UPDATE", sql: "UPDATE orders SET status = 'y'"},
+			},
+			want: []entry{
+				{table: "orders", op: "UPDATE", sql: "UPDATE orders SET status = 'x'"},
+				{table: "orders", op: "UPDATE", sql: "UPDATE orders SET status = 'y'"},
+			},
+		},
+	}
+
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			h := New(Config{CoalesceByRow: true, KeepInsertDelete: tc.keepInsertDelete})
+			if got := h.coalesce(tc.in); !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("coalesce() = %#v, want %#v", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,428 @@
+package gostry
+
+import (
+	"time"
+
+	"github.com/mickamy/gostry/internal/ident"
+)
+
+// historyColumns names the columns of a history table.
+type historyColumns struct {
+	historyID  string
+	id         string
+	operation  string
+	operatedAt string
+	operatedBy string
+	traceID    string
+	reason     string
+	before     string
+	after      string
+	beforeGzip string
+	afterGzip  string
+
+	compositeID   string
+	statementText string
+	argCount      string
+	rowsAffected  string
+	schemaVersion string
+	dbUser        string
+	txLabel       string
+	prevHash      string
+	rowHash       string
+}
+
+// defaultHistoryColumns is the column layout created by Migrate and written by flush.
+var defaultHistoryColumns = historyColumns{
+	historyID:  "history_id",
+	id:         "id",
+	operation:  "operation",
+	operatedAt: "operated_at",
+	operatedBy: "operated_by",
+	traceID:    "trace_id",
+	reason:     "reason",
+	before:     "before",
+	after:      "after",
+	beforeGzip: "before_gz",
+	afterGzip:  "after_gz",
+
+	compositeID:   "composite_id",
+	statementText: "statement_text",
+	argCount:      "arg_count",
+	rowsAffected:  "rows_affected",
+	schemaVersion: "schema_version",
+	dbUser:        "db_user",
+	txLabel:       "tx_label",
+	prevHash:      "prev_hash",
+	rowHash:       "row_hash",
+}
+
+// quoted returns a copy of c with every column name quoted as a SQL identifier.
+func (c historyColumns) quoted() historyColumns {
+	return historyColumns{
+		historyID:  ident.Quote(c.historyID),
+		id:         ident.Quote(c.id),
+		operation:  ident.Quote(c.operation),
+		operatedAt: ident.Quote(c.operatedAt),
+		operatedBy: ident.Quote(c.operatedBy),
+		traceID:    ident.Quote(c.traceID),
+		reason:     ident.Quote(c.reason),
+		before:     ident.Quote(c.before),
+		after:      ident.Quote(c.after),
+		beforeGzip: ident.Quote(c.beforeGzip),
+		afterGzip:  ident.Quote(c.afterGzip),
+
+		compositeID:   ident.Quote(c.compositeID),
+		statementText: ident.Quote(c.statementText),
+		argCount:      ident.Quote(c.argCount),
+		rowsAffected:  ident.Quote(c.rowsAffected),
+		schemaVersion: ident.Quote(c.schemaVersion),
+		dbUser:        ident.Quote(c.dbUser),
+		txLabel:       ident.Quote(c.txLabel),
+		prevHash:      ident.Quote(c.prevHash),
+		rowHash:       ident.Quote(c.rowHash),
+	}
+}
+
+// historyColumn is one built-in column of the history table layout.
+type historyColumn struct {
+	name    func(c historyColumns) string               // column name within c
+	typ     func(o historyDDLOptions) string            // SQL type and constraints
+	enabled func(o historyDDLOptions) bool              // nil: part of every history table; otherwise optional
+	write   func(o historyDDLOptions) string            // how flush writes it (nil: bindParam); "" leaves it to the column default
+	value   func(v *historyValues) any                  // argument bound when written with bindParam
+	trigger func(r triggerRow, img triggerImage) string // what the history trigger writes (nil: the column default)
+}
+
+// bindParam marks a history column whose value flush binds as a query argument.
+const bindParam = "?"
+
+// historyLayout lists the built-in history table columns in order. It is the single definition
+// behind Migrate's DDL (historyColumnDefs), the history trigger (buildTriggerDDL), and flush's INSERT
+// (newHistoryInsert), so a column is added here once; promoted columns follow it in all three.
+var historyLayout = []historyColumn{
+	{
+		name: func(c historyColumns) string { return c.historyID },
+		typ:  func(o historyDDLOptions) string { return o.historyIDType },
+		write: func(o historyDDLOptions) string {
+			if o.bindHistoryID {
+				return bindParam
+			}
+			return ""
+		},
+		value: func(v *historyValues) any { return v.historyID },
+	},
+	{
+		name:    func(c historyColumns) string { return c.id },
+		typ:     func(o historyDDLOptions) string { return o.idType },
+		value:   func(v *historyValues) any { return v.id },
+		trigger: func(r triggerRow, img triggerImage) string { return img.record + "." + ident.Quote(r.idColumn) },
+	},
+	{
+		name:    func(c historyColumns) string { return c.operation },
+		typ:     func(historyDDLOptions) string { return "TEXT NOT NULL" },
+		value:   func(v *historyValues) any { return v.operation },
+		trigger: func(triggerRow, triggerImage) string { return "TG_OP" },
+	},
+	{
+		name: func(c historyColumns) string { return c.operatedAt },
+		typ:  func(historyDDLOptions) string { return "TIMESTAMPTZ NOT NULL" },
+		write: func(o historyDDLOptions) string {
+			if o.bindOperatedAt {
+				return bindParam
+			}
+			return "now()"
+		},
+		value:   func(v *historyValues) any { return v.operatedAt },
+		trigger: func(triggerRow, triggerImage) string { return "now()" },
+	},
+	{
+		name:    func(c historyColumns) string { return c.operatedBy },
+		typ:     func(historyDDLOptions) string { return "TEXT" },
+		value:   func(v *historyValues) any { return v.operator },
+		trigger: func(triggerRow, triggerImage) string { return triggerSetting(settingOperator) },
+	},
+	{
+		name:    func(c historyColumns) string { return c.traceID },
+		typ:     func(historyDDLOptions) string { return "TEXT" },
+		value:   func(v *historyValues) any { return v.traceID },
+		trigger: func(triggerRow, triggerImage) string { return triggerSetting(settingTraceID) },
+	},
+	{
+		name:    func(c historyColumns) string { return c.reason },
+		typ:     func(historyDDLOptions) string { return "TEXT" },
+		value:   func(v *historyValues) any { return v.reason },
+		trigger: func(triggerRow, triggerImage) string { return triggerSetting(settingReason) },
+	},
+	{
+		name:    func(c historyColumns) string { return c.before },
+		typ:     func(o historyDDLOptions) string { return o.imageType },
+		value:   func(v *historyValues) any { return v.before },
+		trigger: func(_ triggerRow, img triggerImage) string { return img.before },
+	},
+	{
+		name:    func(c historyColumns) string { return c.after },
+		typ:     func(o historyDDLOptions) string { return o.imageType },
+		value:   func(v *historyValues) any { return v.after },
+		trigger: func(_ triggerRow, img triggerImage) string { return img.after },
+	},
+	{
+		name:    func(c historyColumns) string { return c.beforeGzip },
+		typ:     func(historyDDLOptions) string { return "BYTEA" },
+		enabled: func(o historyDDLOptions) bool { return o.compress },
+		value:   func(v *historyValues) any { return v.beforeGzip },
+	},
+	{
+		name:    func(c historyColumns) string { return c.afterGzip },
+		typ:     func(historyDDLOptions) string { return "BYTEA" },
+		enabled: func(o historyDDLOptions) bool { return o.compress },
+		value:   func(v *historyValues) any { return v.afterGzip },
+	},
+	{
+		name:    func(c historyColumns) string { return c.compositeID },
+		typ:     func(historyDDLOptions) string { return "JSONB" },
+		enabled: func(o historyDDLOptions) bool { return o.composite },
+		value:   func(v *historyValues) any { return v.compositeID },
+		trigger: triggerCompositeID,
+	},
+	{
+		name:    func(c historyColumns) string { return c.statementText },
+		typ:     func(historyDDLOptions) string { return "TEXT" },
+		enabled: func(o historyDDLOptions) bool { return o.statement },
+		value:   func(v *historyValues) any { return v.statementText },
+		trigger: func(triggerRow, triggerImage) string { return "current_query()" },
+	},
+	{
+		name:    func(c historyColumns) string { return c.argCount },
+		typ:     func(historyDDLOptions) string { return "INTEGER" },
+		enabled: func(o historyDDLOptions) bool { return o.statement },
+		value:   func(v *historyValues) any { return v.argCount },
+	},
+	{
+		name:    func(c historyColumns) string { return c.rowsAffected },
+		typ:     func(historyDDLOptions) string { return "BIGINT" },
+		enabled: func(o historyDDLOptions) bool { return o.statement },
+		value:   func(v *historyValues) any { return v.rowsAffected },
+	},
+	{
+		name:    func(c historyColumns) string { return c.schemaVersion },
+		typ:     func(historyDDLOptions) string { return "INTEGER" },
+		enabled: func(o historyDDLOptions) bool { return o.schemaVersion },
+		value:   func(v *historyValues) any { return v.schemaVersion },
+	},
+	{
+		name:    func(c historyColumns) string { return c.dbUser },
+		typ:     func(historyDDLOptions) string { return "TEXT" },
+		enabled: func(o historyDDLOptions) bool { return o.dbUser },
+		write: func(o historyDDLOptions) string {
+			if o.bindDBUser {
+				return bindParam
+			}
+			return "current_user"
+		},
+		value:   func(v *historyValues) any { return v.dbUser },
+		trigger: func(triggerRow, triggerImage) string { return "current_user" },
+	},
+	{
+		name:    func(c historyColumns) string { return c.txLabel },
+		typ:     func(historyDDLOptions) string { return "TEXT" },
+		enabled: func(o historyDDLOptions) bool { return o.txLabel },
+		value:   func(v *historyValues) any { return v.txLabel },
+	},
+	{
+		// Bound as NULL by flush and filled in by chainHistoryRows.
+		name:    func(c historyColumns) string { return c.prevHash },
+		typ:     func(historyDDLOptions) string { return "TEXT" },
+		enabled: func(o historyDDLOptions) bool { return o.hashChain },
+		value:   func(*historyValues) any { return nil },
+	},
+	{
+		name:    func(c historyColumns) string { return c.rowHash },
+		typ:     func(historyDDLOptions) string { return "TEXT" },
+		enabled: func(o historyDDLOptions) bool { return o.hashChain },
+		value:   func(*historyValues) any { return nil },
+	},
+}
+
+// historyValues are the values flush binds for one history row.
+type historyValues struct {
+	historyID     any
+	id            any
+	operation     string
+	operatedAt    time.Time
+	operator      string
+	traceID       string
+	reason        string
+	before        any
+	after         any
+	beforeGzip    any
+	afterGzip     any
+	compositeID   any
+	statementText any
+	argCount      int64
+	rowsAffected  any
+	schemaVersion int64
+	dbUser        any
+	txLabel       any
+	promoted      []any // values of the promoted columns passed to newHistoryInsert, in order
+}
+
+// historyLayoutColumns returns the columns of historyLayout present in a history table laid out by opts.
+func historyLayoutColumns(opts historyDDLOptions) []historyColumn {
+	out := make([]historyColumn, 0, len(historyLayout))
+	for _, c := range historyLayout {
+		if c.enabled == nil || c.enabled(opts) {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// historyLayoutNames returns the names of every column of historyLayout under cols, enabled or not.
+func historyLayoutNames(cols historyColumns) map[string]bool {
+	names := make(map[string]bool, len(historyLayout))
+	for _, c := range historyLayout {
+		names[c.name(cols)] = true
+	}
+	return names
+}
+
+// writeMode returns how flush writes c under opts: bindParam, a SQL expression, or "" to omit it.
+func (c historyColumn) writeMode(opts historyDDLOptions) string {
+	if c.write == nil {
+		return bindParam
+	}
+	return c.write(opts)
+}
+
+// historyArgs returns the arguments of an INSERT built by newHistoryInsert with the same opts, in
+// placeholder order.
+func historyArgs(opts historyDDLOptions, v *historyValues) []any {
+	args := make([]any, 0, len(historyLayout)+len(v.promoted))
+	for _, c := range historyLayoutColumns(opts) {
+		if c.writeMode(opts) == bindParam {
+			args = append(args, c.value(v))
+		}
+	}
+	return append(args, v.promoted...)
+}
+
+// historyFeatures are the settings that enable optional history columns. Config and SchemaConfig
+// expose them under their own field names; both reduce to this value, and options is the only place
+// it becomes a historyDDLOptions, so Migrate and flush enable each column under the same rule.
+type historyFeatures struct {
+	statement     bool
+	schemaVersion bool
+	dbUser        bool
+	txLabel       bool
+	hashChain     bool
+	compress      bool
+	compositeKey  map[string][]string
+}
+
+// historyFeatures returns the optional history columns flush writes under c.
+func (c Config) historyFeatures() historyFeatures {
+	return historyFeatures{
+		statement:     c.RecordStatement,
+		schemaVersion: c.SchemaVersion > 0,
+		dbUser:        c.RecordDBUser,
+		txLabel:       c.RecordTxLabel,
+		hashChain:     c.HashChain,
+		compress:      c.CompressThreshold > 0,
+		compositeKey:  c.CompositeKey,
+	}
+}
+
+// historyFeatures returns the optional history columns Migrate creates under c.
+func (c SchemaConfig) historyFeatures() historyFeatures {
+	return historyFeatures{
+		statement:     c.RecordStatement,
+		schemaVersion: c.SchemaVersion,
+		dbUser:        c.RecordDBUser,
+		txLabel:       c.RecordTxLabel,
+		hashChain:     c.HashChain,
+		compress:      c.CompressImages,
+		compositeKey:  c.CompositeKey,
+	}
+}
+
+// options returns the layout of the history table of table under f.
+func (f historyFeatures) options(table string) historyDDLOptions {
+	opts := historyDDLOptions{
+		statement:     f.statement,
+		schemaVersion: f.schemaVersion,
+		dbUser:        f.dbUser,
+		txLabel:       f.txLabel,
+		hashChain:     f.hashChain,
+		compress:      f.compress,
+	}
+	_, opts.composite = lookupTable(f.compositeKey, table)
+	return opts
+}
+
+// historyLayoutOptions returns the history table layout flush writes for table under the handler's
+// Config. It selects the same columns as a SchemaConfig with matching settings (see historyFeatures).
+func (h *Handler) historyLayoutOptions(table string) historyDDLOptions {
+	opts := h.cfg.historyFeatures().options(table)
+	opts.bindHistoryID = h.cfg.HistoryIDGenerator != nil
+	opts.bindOperatedAt = h.cfg.OutboxMode
+	// The drainer and the history database run as their own role; record the writer's.
+	opts.bindDBUser = h.cfg.OutboxMode || h.cfg.HistoryDB != nil
+	return opts
+}
+
+// captureColumns returns the projection configured for table in cfg.CaptureColumns, extended with
+// the columns gostry itself reads (id, composite key, promoted, soft-delete). It returns nil when
+// the table captures every column.
+func (h *Handler) captureColumns(table string) []string {
+	cols, ok := lookupTable(h.cfg.CaptureColumns, table)
+	if !ok || len(cols) == 0 {
+		return nil
+	}
+	out := make([]string, 0, len(cols)+2)
+	seen := make(map[string]bool, len(cols)+2)
+	add := func(c string) {
+		if c != "" && !seen[c] {
+			seen[c] = true
+			out = append(out, c)
+		}
+	}
+	for _, c := range cols {
+		add(c)
+	}
+	add(h.idColumn(table))
+	keyCols, _ := lookupTable(h.cfg.CompositeKey, table)
+	for _, c := range keyCols {
+		add(c)
+	}
+	for _, p := range h.cfg.Promoted.lookup(table) {
+		add(p.Name)
+	}
+	add(h.cfg.SoftDeleteColumn)
+	return out
+}
+
+// keyColumns returns the key columns configured for table through PrimaryKeyColumn and CompositeKey.
+// The default "id" is not included, since gostry cannot tell whether the table has such a column.
+func (h *Handler) keyColumns(table string) []string {
+	var cols []string
+	if col, ok := lookupTable(h.cfg.PrimaryKeyColumn, table); ok && col != "" {
+		cols = append(cols, col)
+	}
+	keyCols, _ := lookupTable(h.cfg.CompositeKey, table)
+	return append(cols, keyCols...)
+}
+
+// projectRow drops the columns of row that are outside the projection cols (see captureColumns),
+// so user-written RETURNING * is trimmed the same way as rewritten statements.
+func projectRow(cols []string, row map[string]any) map[string]any {
+	if cols == nil || row == nil {
+		return row
+	}
+	out := make(map[string]any, len(cols))
+	for _, c := range cols {
+		if v, ok := row[c]; ok {
+			out[c] = v
+		}
+	}
+	return out
+}
@@ -0,0 +1,62 @@
+package gostry
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+)
+
+// compressImage gzips an encoded image when it is larger than threshold bytes (Config.CompressThreshold).
+// It returns the plain image (nil when compressed) and the compressed image (nil when stored plain),
+// which goes to the before_gz/after_gz columns added by SchemaConfig.CompressImages.
+func compressImage(b []byte, threshold int) (plain, compressed []byte, err error) {
+	if threshold <= 0 || len(b) <= threshold {
+		return b, nil, nil
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(b); err != nil {
+		return nil, nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, nil, err
+	}
+	return nil, buf.Bytes(), nil
+}
+
+// decompressImage reverses compressImage.
+func decompressImage(b []byte) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	defer func(zr *gzip.Reader) {
+		_ = zr.Close()
+	}(zr)
+	return io.ReadAll(zr)
+}
+
+// storedImage returns the encoded image of a history row from its plain column (before/after) and
+// its compressed column (before_gz/after_gz); a non-NULL compressed column flags a gzipped image.
+func storedImage(plain, compressed []byte) ([]byte, error) {
+	if len(compressed) == 0 {
+		return plain, nil
+	}
+	b, err := decompressImage(compressed)
+	if err != nil {
+		return nil, fmt.Errorf("gostry: failed to decompress image: %w", err)
+	}
+	return b, nil
+}
+
+// ReadImage decodes a before/after image of a history row written with enc, given the values of
+// its plain column (before or after) and its compressed column (before_gz or after_gz, NULL unless
+// the image exceeded Config.CompressThreshold). Compressed images are decompressed transparently.
+func ReadImage(enc Encoding, plain, compressed []byte) (map[string]any, error) {
+	b, err := storedImage(plain, compressed)
+	if err != nil {
+		return nil, err
+	}
+	return DecodeImage(enc, b)
+}
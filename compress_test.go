@@ -0,0 +1,81 @@
+package gostry
+
+import (
+	"context"
+	"database/sql/driver"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTx_CompressThreshold(t *testing.T) {
+	t.Parallel()
+
+	tcs := []struct {
+		name           string
+		body           string
+		wantCompressed bool
+	}{
+		{name: "below threshold stays plain", body: "short"},
+		{name: "above threshold is gzipped", body: strings.Repeat("lorem ipsum ", 64), wantCompressed: true},
+	}
+
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			db, state := openFakeDB(t, func(string, []any) (fakeResult, error) {
+				return fakeResult{cols: []string{"id", "body"}, rows: [][]driver.Value{{int64(1), tc.body}}}, nil
+			})
+			ctx := context.Background()
+			tx, err := New(Config{CompressThreshold: 128}).Wrap(db).BeginTx(ctx, nil)
+			if err != nil {
+				t.Fatalf("BeginTx() error = %v", err)
+			}
+			if _, err := tx.ExecContext(ctx, `INSERT INTO documents (body) VALUES ($1) RETURNING *`, tc.body); err != nil {
+				t.Fatalf("ExecContext() error = %v", err)
+			}
+			if err := tx.Commit(); err != nil {
+				t.Fatalf("Commit() error = %v", err)
+			}
+
+			execs := state.Execs()
+			if len(execs) != 1 {
+				t.Fatalf("history inserts = %d, want 1", len(execs))
+			}
+			call := execs[0]
+			if !strings.Contains(call.query, `"before_gz", "after_gz"`) {
+				t.Fatalf("history insert = %s, want before_gz and after_gz columns", call.query)
+			}
+			plain, _ := call.args[6].([]byte)
+			compressed, _ := call.args[8].([]byte)
+			if gotCompressed := compressed != nil; gotCompressed != tc.wantCompressed {
+				t.Fatalf("after_gz set = %t, want %t", gotCompressed, tc.wantCompressed)
+			}
+			if tc.wantCompressed && plain != nil {
+				t.Fatalf("after = %s, want NULL when compressed", plain)
+			}
+
+			got, err := ReadImage(EncodingJSON, plain, compressed)
+			if err != nil {
+				t.Fatalf("ReadImage() error = %v", err)
+			}
+			want := map[string]any{"id": float64(1), "body": tc.body}
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("ReadImage() = %#v, want %#v", got, want)
+			}
+		})
+	}
+}
+
+func TestBuildHistoryDDL_CompressImages(t *testing.T) {
+	t.Parallel()
+
+	ddl := buildHistoryDDL(`"orders_history"`, "", defaultHistoryColumns, historyDDLOptions{compress: true})
+	for _, want := range []string{`"before" JSONB`, `"before_gz" BYTEA`, `"after_gz" BYTEA`} {
+		if !strings.Contains(ddl, want) {
+			t.Fatalf("buildHistoryDDL() = %s, want to contain %q", ddl, want)
+		}
+	}
+}
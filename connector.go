@@ -0,0 +1,553 @@
+package gostry
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+
+	"github.com/mickamy/gostry/internal/buffer"
+	"github.com/mickamy/gostry/internal/query"
+)
+
+// Connector wraps c so transactions on a *sql.DB opened with sql.OpenDB(h.Connector(c)) record DML
+// changes at the driver level, without the *DB/*Tx wrappers. It lets gostry sit in a chain of
+// driver.Connector middlewares (tracing, metrics, ...) next to other instrumentation.
+//
+// Capture follows Tx.ExecContext: statements executed inside a transaction are parsed with ParseDML,
+// rows are read through RETURNING (or AutoAttachReturning), and history rows are written on the same
+// connection right before the transaction commits. Prepared statements are captured too, and DML with
+// RETURNING run through QueryContext is captured from the rows the caller reads. Statements outside
+// transactions pass through uncaptured. Before-images (CaptureBeforeUpdate), IDOnlyDelete, HashChain,
+// and ReturnHistoryIDs are not supported at this level. The wrapped connections must implement
+// driver.ExecerContext and driver.QueryerContext, so that no statement reaches the driver uncaptured
+// through a prepared statement; Connect fails for other drivers.
+func (h *Handler) Connector(c driver.Connector) driver.Connector {
+	return &connector{Connector: c, h: h}
+}
+
+// WrapConnector is Handler.Connector in function form, for middleware chains built from
+// func(driver.Connector) driver.Connector values.
+func WrapConnector(base driver.Connector, h *Handler) driver.Connector {
+	return h.Connector(base)
+}
+
+// connector is the driver.Connector returned by Handler.Connector.
+type connector struct {
+	driver.Connector
+	h *Handler
+}
+
+// Connect opens a connection of the wrapped connector that captures DML in its transactions.
+func (c *connector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	_, execer := conn.(driver.ExecerContext)
+	_, queryer := conn.(driver.QueryerContext)
+	if !execer || !queryer {
+		_ = conn.Close()
+		return nil, errors.New("gostry: Connector requires a driver implementing driver.ExecerContext and driver.QueryerContext")
+	}
+	return &captureConn{Conn: conn, h: c.h}, nil
+}
+
+// captureConn is a driver connection capturing DML executed in its open transaction.
+// database/sql never uses a connection concurrently, so it needs no locking.
+type captureConn struct {
+	driver.Conn
+	h  *Handler
+	tx *captureTx // open transaction, or nil
+}
+
+// captureTx buffers the entries captured in a driver transaction until it commits.
+type captureTx struct {
+	driver.Tx
+	conn   *captureConn
+	buf    *buffer.Buffer[entry]
+	ctx    context.Context // most recent context seen, used by Commit
+	label  string          // transaction label from WithTxLabel on the BeginTx context
+	dbUser string          // current_user of the transaction once read for a bound db_user column
+}
+
+var (
+	_ driver.ConnBeginTx        = (*captureConn)(nil)
+	_ driver.ExecerContext      = (*captureConn)(nil)
+	_ driver.QueryerContext     = (*captureConn)(nil)
+	_ driver.NamedValueChecker  = (*captureConn)(nil)
+	_ driver.SessionResetter    = (*captureConn)(nil)
+	_ driver.Validator          = (*captureConn)(nil)
+	_ driver.Pinger             = (*captureConn)(nil)
+	_ driver.ConnPrepareContext = (*captureConn)(nil)
+)
+
+// BeginTx begins a transaction on the wrapped connection and starts capturing its DML.
+func (c *captureConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if c.h.cfg.HashChain || c.h.cfg.ReturnHistoryIDs {
+		return nil, errors.New("gostry: Connector does not support HashChain or ReturnHistoryIDs")
+	}
+	var (
+		tx  driver.Tx
+		err error
+	)
+	if b, ok := c.Conn.(driver.ConnBeginTx); ok {
+		tx, err = b.BeginTx(ctx, opts)
+	} else {
+		if opts.Isolation != driver.IsolationLevel(sql.LevelDefault) || opts.ReadOnly {
+			return nil, errors.New("gostry: driver does not support transaction options")
+		}
+		tx, err = c.Conn.Begin()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if c.h.cfg.SessionSettings || c.h.cfg.TriggerCapture {
+		if err := setSessionMeta(ctx, connExecer{c.Conn}, c.h.meta(ctx)); err != nil {
+			_ = tx.Rollback()
+			return nil, err
+		}
+	}
+	c.tx = &captureTx{Tx: tx, conn: c, buf: c.h.entries.NewBuffer(), ctx: ctx, label: extractTxLabel(ctx)}
+	return c.tx, nil
+}
+
+// PrepareContext prepares q on the wrapped connection. Inside a transaction the returned statement is
+// executed like a one-off statement on the connection, so it is captured as well.
+func (c *captureConn) PrepareContext(ctx context.Context, q string) (driver.Stmt, error) {
+	var (
+		stmt driver.Stmt
+		err  error
+	)
+	if p, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		stmt, err = p.PrepareContext(ctx, q)
+	} else {
+		stmt, err = c.Conn.Prepare(q)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &captureStmt{Stmt: stmt, conn: c, query: q}, nil
+}
+
+// Prepare is PrepareContext without a context.
+func (c *captureConn) Prepare(q string) (driver.Stmt, error) {
+	return c.PrepareContext(context.Background(), q)
+}
+
+// ExecContext captures DML executed inside a transaction; other statements pass through.
+func (c *captureConn) ExecContext(ctx context.Context, q string, args []driver.NamedValue) (driver.Result, error) {
+	if c.tx == nil || extractSkip(ctx) || c.h.cfg.TriggerCapture {
+		return c.exec(ctx, q, args)
+	}
+	c.tx.ctx = ctx
+	dml, ok := query.ParseDML(q)
+	if !ok {
+		return c.exec(ctx, q, args)
+	}
+	dml.Table = tenantTable(ctx, dml.Table)
+	vals := namedArgValues(args)
+	if c.h.cfg.Skip != nil && c.h.cfg.Skip(ctx, dml, q, vals) {
+		return c.exec(ctx, q, args)
+	}
+	if !c.h.capturesOp(dml.Table, dml.Op) {
+		return c.exec(ctx, q, args)
+	}
+
+	stmt := q
+	returning := dml.HasReturning && dml.Op != "COPY"
+	if !dml.HasReturning && dml.Op != "COPY" && c.h.cfg.AutoAttachReturning {
+		if augmented, ok := query.AppendReturningColumns(q, c.h.captureColumns(dml.Table)); ok {
+			stmt = augmented
+			returning = true
+		} else {
+			c.h.warn(ctx, "gostry: cannot append RETURNING; recording statement only", slog.String("sql", q))
+		}
+	}
+	if dml.HasReturning && (!dml.IsMultiTable() || dml.ReturningScoped) {
+		if augmented, ok := query.ExtendReturning(q, c.h.keyColumns(dml.Table)); ok {
+			stmt = augmented
+		}
+	}
+	if returning && ambiguous(dml) {
+		capture, err := c.h.checkMultiTable(ctx, dml, q)
+		if err != nil {
+			return nil, err
+		}
+		if !capture {
+			return c.exec(ctx, q, args)
+		}
+	}
+
+	if !returning {
+		res, err := c.exec(ctx, q, args)
+		if err == nil {
+			c.capture(ctx, summaryEntry(dml, q, vals, c.h.meta(ctx), res))
+		}
+		return res, err
+	}
+
+	if dml.Op == "UPDATE" && c.h.captureBefore() {
+		c.h.warn(ctx, "gostry: Connector cannot capture before-images; recording after-images only", slog.String("sql", q))
+	}
+	rows, err := c.Conn.(driver.QueryerContext).QueryContext(ctx, stmt, args)
+	if err != nil {
+		return nil, err
+	}
+	captureRow := c.rowCapture(ctx, dml, q, vals)
+	var firstID any
+	n, err := scanDriverRows(rows, func(m map[string]any) {
+		if firstID == nil && dml.Op == "INSERT" {
+			firstID = m[c.h.idColumn(dml.Table)]
+		}
+		captureRow(m)
+	})
+	if err != nil {
+		return nil, withKind(ErrScan, fmt.Errorf("gostry: failed to scan rows: %w", err))
+	}
+	if id, ok := integerID(firstID); ok {
+		return newInsertResult(n, id), nil
+	}
+	return newAffectedRows(n), nil
+}
+
+// rowCapture returns a function capturing each row returned by dml as an entry of the open transaction.
+func (c *captureConn) rowCapture(ctx context.Context, dml query.DML, q string, vals []any) func(map[string]any) {
+	meta := c.h.meta(ctx)
+	projection := c.h.captureColumns(dml.Table)
+	return func(m map[string]any) {
+		m = projectRow(projection, m)
+		e := entry{table: dml.Table, op: dml.Op, sql: q, args: vals, meta: meta}
+		if dml.Op == "DELETE" {
+			e.before = m
+		} else {
+			e.after = m
+		}
+		c.h.classifySoftDelete(&e)
+		c.capture(ctx, e)
+	}
+}
+
+// QueryContext runs q on the wrapped connection. Inside a transaction, DML with RETURNING is
+// captured from the returned rows (rows left unread are read on Close); other DML is not captured
+// and logs a warning, like Tx.QueryContext.
+func (c *captureConn) QueryContext(ctx context.Context, q string, args []driver.NamedValue) (driver.Rows, error) {
+	qc := c.Conn.(driver.QueryerContext)
+	if c.tx == nil || extractSkip(ctx) || c.h.cfg.TriggerCapture {
+		return qc.QueryContext(ctx, q, args)
+	}
+	c.tx.ctx = ctx
+	dml, ok := query.ParseDML(q)
+	if !ok {
+		return qc.QueryContext(ctx, q, args)
+	}
+	dml.Table = tenantTable(ctx, dml.Table)
+	vals := namedArgValues(args)
+	if c.h.cfg.Skip != nil && c.h.cfg.Skip(ctx, dml, q, vals) {
+		return qc.QueryContext(ctx, q, args)
+	}
+	if !c.h.capturesOp(dml.Table, dml.Op) {
+		return qc.QueryContext(ctx, q, args)
+	}
+	if !dml.HasReturning || dml.Op == "COPY" {
+		c.h.warnUncapturedQuery(ctx, q)
+		return qc.QueryContext(ctx, q, args)
+	}
+	if ambiguous(dml) {
+		capture, err := c.h.checkMultiTable(ctx, dml, q)
+		if err != nil {
+			return nil, err
+		}
+		if !capture {
+			return qc.QueryContext(ctx, q, args)
+		}
+	}
+	rows, err := qc.QueryContext(ctx, q, args)
+	if err != nil {
+		return nil, err
+	}
+	return newCaptureRows(rows, c.rowCapture(ctx, dml, q, vals)), nil
+}
+
+// CheckNamedValue defers argument conversion to the wrapped connection.
+func (c *captureConn) CheckNamedValue(nv *driver.NamedValue) error {
+	if checker, ok := c.Conn.(driver.NamedValueChecker); ok {
+		return checker.CheckNamedValue(nv)
+	}
+	return driver.ErrSkip
+}
+
+// ResetSession forwards to the wrapped connection.
+func (c *captureConn) ResetSession(ctx context.Context) error {
+	if r, ok := c.Conn.(driver.SessionResetter); ok {
+		return r.ResetSession(ctx)
+	}
+	return nil
+}
+
+// IsValid forwards to the wrapped connection.
+func (c *captureConn) IsValid() bool {
+	if v, ok := c.Conn.(driver.Validator); ok {
+		return v.IsValid()
+	}
+	return true
+}
+
+// Ping forwards to the wrapped connection, so sql.DB.PingContext reaches the server.
+func (c *captureConn) Ping(ctx context.Context) error {
+	if p, ok := c.Conn.(driver.Pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+// exec runs q on the wrapped connection.
+func (c *captureConn) exec(ctx context.Context, q string, args []driver.NamedValue) (driver.Result, error) {
+	return c.Conn.(driver.ExecerContext).ExecContext(ctx, q, args)
+}
+
+// capture buffers e in the open transaction.
+func (c *captureConn) capture(ctx context.Context, e entry) {
+	c.h.capture(ctx, c.tx.buf, c.tx.label, e)
+}
+
+// Commit writes the captured history rows on the connection and commits. If the history cannot be
+// written the transaction is rolled back, since database/sql does not roll back after a failed Commit.
+// With Config.HistoryDB set, history is written there after the commit on a best-effort basis.
+func (tx *captureTx) Commit() error {
+	defer func() { tx.conn.tx = nil }()
+	ctx := tx.ctx
+	if tx.conn.h.cfg.HistoryDB != nil {
+		if tx.conn.h.cfg.RecordDBUser && tx.buf.Len() > 0 {
+			// History is written after the commit; read the writer's role while the transaction is open.
+			if _, err := tx.currentUser(ctx); err != nil {
+				_ = tx.Tx.Rollback()
+				return err
+			}
+		}
+		if err := tx.Tx.Commit(); err != nil {
+			tx.buf.Reset()
+			return err
+		}
+		records, err := tx.flush(ctx)
+		if err != nil {
+			tx.conn.h.warn(ctx, "gostry: failed to write history to HistoryDB", slog.Any("error", err))
+		}
+		return tx.afterCommit(ctx, records)
+	}
+	records, err := tx.flush(ctx)
+	if err != nil {
+		_ = tx.Tx.Rollback()
+		return err
+	}
+	if err := tx.Tx.Commit(); err != nil {
+		return err
+	}
+	return tx.afterCommit(ctx, records)
+}
+
+// Rollback discards the captured entries and rolls back the transaction.
+func (tx *captureTx) Rollback() error {
+	defer func() { tx.conn.tx = nil }()
+	tx.buf.Reset()
+	return tx.Tx.Rollback()
+}
+
+// flush writes the buffered entries through the connection like Tx.flush and returns the written records.
+func (tx *captureTx) flush(ctx context.Context) ([]Record, error) {
+	rows, err := tx.conn.h.flushBuffer(ctx, tx.buf, connExecer{tx.conn.Conn}, tx.currentUser)
+	return historyRecords(rows), err
+}
+
+// currentUser reads current_user on the business transaction, once per transaction.
+func (tx *captureTx) currentUser(ctx context.Context) (string, error) {
+	if tx.dbUser != "" {
+		return tx.dbUser, nil
+	}
+	rows, err := tx.conn.Conn.(driver.QueryerContext).QueryContext(ctx, `SELECT current_user`, nil)
+	if err != nil {
+		return "", fmt.Errorf("gostry: failed to read current_user: %w", err)
+	}
+	var user string
+	n, err := scanDriverRows(rows, func(m map[string]any) {
+		switch v := m["current_user"].(type) {
+		case string:
+			user = v
+		case []byte:
+			user = string(v)
+		}
+	})
+	if err != nil {
+		return "", fmt.Errorf("gostry: failed to read current_user: %w", err)
+	}
+	if n != 1 {
+		return "", fmt.Errorf("gostry: failed to read current_user: got %d rows", n)
+	}
+	tx.dbUser = user
+	return user, nil
+}
+
+// afterCommit hands the committed records to cfg.AfterCommit.
+func (tx *captureTx) afterCommit(ctx context.Context, records []Record) error {
+	h := tx.conn.h
+	if h.cfg.AfterCommit == nil || len(records) == 0 {
+		return nil
+	}
+	if err := h.cfg.AfterCommit(ctx, records); err != nil {
+		return fmt.Errorf("gostry: after-commit hook failed (transaction is committed): %w", err)
+	}
+	return nil
+}
+
+// connExecer runs statements directly on a driver connection, converting arguments the way
+// database/sql would. The connection must implement driver.ExecerContext, as Connect ensures.
+type connExecer struct {
+	conn driver.Conn
+}
+
+func (c connExecer) ExecContext(ctx context.Context, q string, args ...any) (sql.Result, error) {
+	named := make([]driver.NamedValue, len(args))
+	checker, _ := c.conn.(driver.NamedValueChecker)
+	for i, a := range args {
+		nv := driver.NamedValue{Ordinal: i + 1, Value: a}
+		err := driver.ErrSkip
+		if checker != nil {
+			err = checker.CheckNamedValue(&nv)
+		}
+		if errors.Is(err, driver.ErrSkip) {
+			nv.Value, err = driver.DefaultParameterConverter.ConvertValue(a)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("gostry: failed to convert argument $%d: %w", i+1, err)
+		}
+		named[i] = nv
+	}
+	return c.conn.(driver.ExecerContext).ExecContext(ctx, q, named)
+}
+
+// namedArgValues returns the values of args, as recorded in history.
+func namedArgValues(args []driver.NamedValue) []any {
+	vals := make([]any, len(args))
+	for i, a := range args {
+		vals[i] = a.Value
+	}
+	return vals
+}
+
+// scanDriverRows reads every row of rows as a map, like scanEach does for *sql.Rows, and returns
+// the number of rows read.
+func scanDriverRows(rows driver.Rows, fn func(map[string]any)) (int, error) {
+	defer func() { _ = rows.Close() }()
+
+	cols := rows.Columns()
+	dbTypes := make([]string, len(cols))
+	if typed, ok := rows.(driver.RowsColumnTypeDatabaseTypeName); ok {
+		for i := range cols {
+			dbTypes[i] = typed.ColumnTypeDatabaseTypeName(i)
+		}
+	}
+	dest := make([]driver.Value, len(cols))
+	vals := make([]any, len(cols))
+	n := 0
+	for {
+		if err := rows.Next(dest); err != nil {
+			if errors.Is(err, io.EOF) {
+				return n, nil
+			}
+			return n, err
+		}
+		for i, v := range dest {
+			vals[i] = v
+		}
+		fn(rowToMap(cols, dbTypes, vals))
+		n++
+	}
+}
+
+// captureStmt is a prepared statement of a captureConn.
+type captureStmt struct {
+	driver.Stmt
+	conn  *captureConn
+	query string
+}
+
+// ExecContext captures the statement like captureConn.ExecContext while a transaction is open.
+func (s *captureStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	if s.conn.tx != nil {
+		return s.conn.ExecContext(ctx, s.query, args)
+	}
+	if e, ok := s.Stmt.(driver.StmtExecContext); ok {
+		return e.ExecContext(ctx, args)
+	}
+	return s.Stmt.Exec(driverValues(args))
+}
+
+// QueryContext captures the statement like captureConn.QueryContext while a transaction is open.
+func (s *captureStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	if s.conn.tx != nil {
+		return s.conn.QueryContext(ctx, s.query, args)
+	}
+	if q, ok := s.Stmt.(driver.StmtQueryContext); ok {
+		return q.QueryContext(ctx, args)
+	}
+	return s.Stmt.Query(driverValues(args))
+}
+
+// driverValues drops the names of args for drivers without context-aware statements.
+func driverValues(args []driver.NamedValue) []driver.Value {
+	vals := make([]driver.Value, len(args))
+	for i, a := range args {
+		vals[i] = a.Value
+	}
+	return vals
+}
+
+// captureRows passes each row read by the caller to capture.
+type captureRows struct {
+	driver.Rows
+	capture func(map[string]any)
+	cols    []string
+	dbTypes []string
+	vals    []any
+	done    bool
+}
+
+func newCaptureRows(rows driver.Rows, capture func(map[string]any)) *captureRows {
+	cols := rows.Columns()
+	dbTypes := make([]string, len(cols))
+	if typed, ok := rows.(driver.RowsColumnTypeDatabaseTypeName); ok {
+		for i := range cols {
+			dbTypes[i] = typed.ColumnTypeDatabaseTypeName(i)
+		}
+	}
+	return &captureRows{Rows: rows, capture: capture, cols: cols, dbTypes: dbTypes, vals: make([]any, len(cols))}
+}
+
+func (r *captureRows) Next(dest []driver.Value) error {
+	if err := r.Rows.Next(dest); err != nil {
+		r.done = true
+		return err
+	}
+	for i, v := range dest {
+		r.vals[i] = v
+	}
+	r.capture(rowToMap(r.cols, r.dbTypes, r.vals))
+	return nil
+}
+
+// Close reads the rows the caller left unread, so every returned row is captured, then closes rows.
+func (r *captureRows) Close() error {
+	dest := make([]driver.Value, len(r.cols))
+	for !r.done {
+		_ = r.Next(dest)
+	}
+	return r.Rows.Close()
+}
+
+// ColumnTypeDatabaseTypeName reports the database type name of the wrapped rows.
+func (r *captureRows) ColumnTypeDatabaseTypeName(i int) string {
+	return r.dbTypes[i]
+}
@@ -0,0 +1,288 @@
+package gostry
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestConnector(t *testing.T) {
+	t.Parallel()
+
+	returnOrder := func(string, []any) (fakeResult, error) {
+		return fakeResult{cols: []string{"id", "status"}, rows: [][]driver.Value{{int64(7), "paid"}}}, nil
+	}
+
+	t.Run("commit writes history on the same connection", func(t *testing.T) {
+		t.Parallel()
+
+		connector, state := openFakeConnector(t, returnOrder)
+		var flushed []Record
+		h := New(Config{OnFlush: func(_ context.Context, records []Record) { flushed = append(flushed, records...) }})
+		db := sql.OpenDB(h.Connector(connector))
+		t.Cleanup(func() { _ = db.Close() })
+
+		ctx := WithOperator(context.Background(), "alice")
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			t.Fatalf("BeginTx() error = %v", err)
+		}
+		res, err := tx.ExecContext(ctx, `UPDATE orders SET status = $1 WHERE id = $2 RETURNING *`, "paid", int64(7))
+		if err != nil {
+			t.Fatalf("ExecContext() error = %v", err)
+		}
+		if n, _ := res.RowsAffected(); n != 1 {
+			t.Errorf("RowsAffected() = %d, want 1", n)
+		}
+		if execs := state.Execs(); len(execs) != 0 {
+			t.Fatalf("history written before commit: %v", execs)
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatalf("Commit() error = %v", err)
+		}
+
+		execs := state.Execs()
+		if len(execs) != 1 || !strings.Contains(execs[0].query, `INSERT INTO "orders_history"`) {
+			t.Fatalf("execs = %v, want one history insert", execs)
+		}
+		if got := execs[0].args[1]; got != "UPDATE" {
+			t.Errorf("operation = %v, want UPDATE", got)
+		}
+		if got := execs[0].args[2]; got != "alice" {
+			t.Errorf("operator = %v, want alice", got)
+		}
+		if commits, _ := state.Outcome(); commits != 1 {
+			t.Errorf("commits = %d, want 1", commits)
+		}
+		if len(flushed) != 1 || flushed[0].After["status"] != "paid" {
+			t.Errorf("flushed = %+v, want the captured row", flushed)
+		}
+	})
+
+	t.Run("statements outside transactions pass through", func(t *testing.T) {
+		t.Parallel()
+
+		connector, state := openFakeConnector(t, returnOrder)
+		db := sql.OpenDB(New(Config{}).Connector(connector))
+		t.Cleanup(func() { _ = db.Close() })
+
+		if _, err := db.ExecContext(context.Background(), `UPDATE orders SET status = 'paid' RETURNING *`); err != nil {
+			t.Fatalf("ExecContext() error = %v", err)
+		}
+		if execs := state.Execs(); len(execs) != 1 || strings.Contains(execs[0].query, "orders_history") {
+			t.Fatalf("execs = %v, want only the statement", execs)
+		}
+	})
+
+	t.Run("rollback discards captured rows", func(t *testing.T) {
+		t.Parallel()
+
+		connector, state := openFakeConnector(t, returnOrder)
+		db := sql.OpenDB(New(Config{}).Connector(connector))
+		t.Cleanup(func() { _ = db.Close() })
+
+		ctx := context.Background()
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			t.Fatalf("BeginTx() error = %v", err)
+		}
+		if _, err := tx.ExecContext(ctx, `DELETE FROM orders WHERE id = 7 RETURNING *`); err != nil {
+			t.Fatalf("ExecContext() error = %v", err)
+		}
+		if err := tx.Rollback(); err != nil {
+			t.Fatalf("Rollback() error = %v", err)
+		}
+		if execs := state.Execs(); len(execs) != 0 {
+			t.Fatalf("execs = %v, want none", execs)
+		}
+		if _, rollbacks := state.Outcome(); rollbacks != 1 {
+			t.Errorf("rollbacks = %d, want 1", rollbacks)
+		}
+	})
+
+	t.Run("history failure rolls back", func(t *testing.T) {
+		t.Parallel()
+
+		connector, state := openFakeConnector(t, returnOrder)
+		state.execErr = func(q string) error {
+			if strings.Contains(q, "orders_history") {
+				return errors.New("permission denied")
+			}
+			return nil
+		}
+		db := sql.OpenDB(New(Config{}).Connector(connector))
+		t.Cleanup(func() { _ = db.Close() })
+
+		ctx := context.Background()
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			t.Fatalf("BeginTx() error = %v", err)
+		}
+		if _, err := tx.ExecContext(ctx, `INSERT INTO orders (status) VALUES ('paid') RETURNING *`); err != nil {
+			t.Fatalf("ExecContext() error = %v", err)
+		}
+		if err := tx.Commit(); err == nil {
+			t.Fatal("Commit() error = nil, want history insert failure")
+		}
+		if commits, rollbacks := state.Outcome(); commits != 0 || rollbacks != 1 {
+			t.Errorf("commits, rollbacks = %d, %d, want 0, 1", commits, rollbacks)
+		}
+	})
+
+	t.Run("prepared statements and queries are captured", func(t *testing.T) {
+		t.Parallel()
+
+		connector, state := openFakeConnector(t, func(string, []any) (fakeResult, error) {
+			return fakeResult{cols: []string{"id", "status"}, rows: [][]driver.Value{{int64(7), "paid"}, {int64(8), "paid"}}}, nil
+		})
+		db := sql.OpenDB(WrapConnector(connector, New(Config{})))
+		t.Cleanup(func() { _ = db.Close() })
+
+		ctx := context.Background()
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			t.Fatalf("BeginTx() error = %v", err)
+		}
+		stmt, err := tx.PrepareContext(ctx, `UPDATE orders SET status = $1 RETURNING *`)
+		if err != nil {
+			t.Fatalf("PrepareContext() error = %v", err)
+		}
+		if _, err := stmt.ExecContext(ctx, "paid"); err != nil {
+			t.Fatalf("stmt.ExecContext() error = %v", err)
+		}
+		_ = stmt.Close()
+		rows, err := tx.QueryContext(ctx, `DELETE FROM orders WHERE status = 'paid' RETURNING *`)
+		if err != nil {
+			t.Fatalf("QueryContext() error = %v", err)
+		}
+		if !rows.Next() { // leave the second row unread
+			t.Fatalf("rows.Next() = false, err = %v", rows.Err())
+		}
+		if err := rows.Close(); err != nil {
+			t.Fatalf("rows.Close() error = %v", err)
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatalf("Commit() error = %v", err)
+		}
+
+		var ops []any
+		for _, call := range state.Execs() {
+			if strings.Contains(call.query, `INSERT INTO "orders_history"`) {
+				ops = append(ops, call.args[1])
+			}
+		}
+		if want := []any{"UPDATE", "UPDATE", "DELETE", "DELETE"}; !reflect.DeepEqual(ops, want) {
+			t.Errorf("history operations = %v, want %v", ops, want)
+		}
+	})
+
+	t.Run("flush shares the bulk writer", func(t *testing.T) {
+		t.Parallel()
+
+		connector, state := openFakeConnector(t, func(string, []any) (fakeResult, error) {
+			return fakeResult{cols: []string{"id", "status"}, rows: [][]driver.Value{{int64(7), "paid"}, {int64(8), "paid"}, {int64(9), "paid"}}}, nil
+		})
+		db := sql.OpenDB(New(Config{BulkInsertThreshold: 2}).Connector(connector))
+		t.Cleanup(func() { _ = db.Close() })
+
+		ctx := context.Background()
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			t.Fatalf("BeginTx() error = %v", err)
+		}
+		if _, err := tx.ExecContext(ctx, `UPDATE orders SET status = 'paid' RETURNING *`); err != nil {
+			t.Fatalf("ExecContext() error = %v", err)
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatalf("Commit() error = %v", err)
+		}
+		execs := state.Execs()
+		if len(execs) != 1 || len(execs[0].args) != 3*len(historyArgs(historyDDLOptions{}, &historyValues{})) {
+			t.Fatalf("execs = %v, want one multi-row history insert", execs)
+		}
+	})
+
+	t.Run("canceled context stops the flush", func(t *testing.T) {
+		t.Parallel()
+
+		connector, state := openFakeConnector(t, returnOrder)
+		db := sql.OpenDB(New(Config{}).Connector(connector))
+		t.Cleanup(func() { _ = db.Close() })
+
+		ctx, cancel := context.WithCancel(context.Background())
+		tx, err := db.BeginTx(context.Background(), nil)
+		if err != nil {
+			t.Fatalf("BeginTx() error = %v", err)
+		}
+		if _, err := tx.ExecContext(ctx, `UPDATE orders SET status = 'paid' RETURNING *`); err != nil {
+			t.Fatalf("ExecContext() error = %v", err)
+		}
+		cancel()
+		if err := tx.Commit(); !errors.Is(err, context.Canceled) {
+			t.Fatalf("Commit() error = %v, want context.Canceled", err)
+		}
+		for _, call := range state.Execs() {
+			if strings.Contains(call.query, "orders_history") {
+				t.Fatalf("history written after cancel: %v", call)
+			}
+		}
+	})
+
+	t.Run("ping reaches the driver", func(t *testing.T) {
+		t.Parallel()
+
+		connector, state := openFakeConnector(t, returnOrder)
+		db := sql.OpenDB(New(Config{}).Connector(connector))
+		t.Cleanup(func() { _ = db.Close() })
+
+		if err := db.PingContext(context.Background()); err != nil {
+			t.Fatalf("PingContext() error = %v", err)
+		}
+		state.mu.Lock()
+		pings := state.pings
+		state.mu.Unlock()
+		if pings != 1 {
+			t.Fatalf("driver pings = %d, want 1", pings)
+		}
+	})
+
+	t.Run("drivers without ExecerContext are refused", func(t *testing.T) {
+		t.Parallel()
+
+		connector, state := openFakeConnector(t, returnOrder)
+		db := sql.OpenDB(New(Config{}).Connector(prepareOnlyConnector{connector}))
+		t.Cleanup(func() { _ = db.Close() })
+
+		ctx := context.Background()
+		if tx, err := db.BeginTx(ctx, nil); err == nil {
+			_ = tx.Rollback()
+			t.Fatal("BeginTx() error = nil, want the driver refused")
+		} else if !strings.Contains(err.Error(), "driver.ExecerContext") {
+			t.Fatalf("BeginTx() error = %v, want the missing interface", err)
+		}
+		if _, err := db.ExecContext(ctx, `UPDATE orders SET status = 'paid' RETURNING *`); err == nil {
+			t.Fatal("ExecContext() error = nil, want the driver refused")
+		}
+		if execs := state.Execs(); len(execs) != 0 {
+			t.Fatalf("execs = %v, want none", execs)
+		}
+	})
+}
+
+// prepareOnlyConnector connects like fakeConnector but hides every optional interface of the
+// connection, so statements reach the driver only through Prepare.
+type prepareOnlyConnector struct {
+	fakeConnector
+}
+
+func (c prepareOnlyConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.fakeConnector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return struct{ driver.Conn }{conn}, nil
+}
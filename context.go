@@ -2,11 +2,15 @@ package gostry
 
 import (
 	"context"
+
+	"github.com/mickamy/gostry/internal/ident"
 )
 
 // metaKey is an unexported context key type.
 type metaKey struct{}
 type skipKey struct{}
+type txLabelKey struct{}
+type historyOverrideKey struct{}
 
 // WithOperator attaches an operator identifier to the context.
 func WithOperator(ctx context.Context, v string) context.Context {
@@ -29,6 +33,66 @@ func WithReason(ctx context.Context, v string) context.Context {
 	return context.WithValue(ctx, metaKey{}, m)
 }
 
+// ReasonSeparator joins the reasons combined by WithReasonAppend.
+const ReasonSeparator = "; "
+
+// WithReasonAppend adds v to the reason already attached to ctx, joined by ReasonSeparator, so an inner
+// layer can add detail ("retry 2") to an outer one's reason ("nightly batch"). Without an existing
+// reason it behaves like WithReason; an empty v leaves the reason unchanged.
+func WithReasonAppend(ctx context.Context, v string) context.Context {
+	m := extractMeta(ctx)
+	switch {
+	case v == "":
+		return ctx
+	case m.reason == "":
+		m.reason = v
+	default:
+		m.reason = m.reason + ReasonSeparator + v
+	}
+	return context.WithValue(ctx, metaKey{}, m)
+}
+
+// WithTxLabel labels the logical transaction (e.g. "checkout", "refund") begun with ctx. The label is read
+// once by BeginTx and applies to every history row of that transaction; labels set on the contexts of
+// individual statements are ignored.
+func WithTxLabel(ctx context.Context, label string) context.Context {
+	return context.WithValue(ctx, txLabelKey{}, label)
+}
+
+// extractTxLabel extracts the transaction label from context.
+func extractTxLabel(ctx context.Context) string {
+	if v, ok := ctx.Value(txLabelKey{}).(string); ok {
+		return v
+	}
+	return ""
+}
+
+// WithHistoryTableOverride routes the history of base, for statements executed with the returned
+// context, to history (a dot-joined, unquoted identifier such as "audit.orders_v1_history") instead of
+// the table derived from HistorySuffix. base is matched like the per-table Config maps, and the
+// override is snapshotted when a change is captured, so it holds even if the transaction is flushed
+// or committed with another context. Overrides for different tables accumulate.
+func WithHistoryTableOverride(ctx context.Context, base, history string) context.Context {
+	prev, _ := ctx.Value(historyOverrideKey{}).(map[string]string)
+	overrides := make(map[string]string, len(prev)+1)
+	for k, v := range prev {
+		overrides[k] = v
+	}
+	overrides[base] = history
+	return context.WithValue(ctx, historyOverrideKey{}, overrides)
+}
+
+// extractHistoryOverride returns the identifier parts of the history table that WithHistoryTableOverride
+// assigned to table in ctx, or nil when there is none.
+func extractHistoryOverride(ctx context.Context, table string) []string {
+	overrides, _ := ctx.Value(historyOverrideKey{}).(map[string]string)
+	history, ok := lookupTable(overrides, table)
+	if !ok {
+		return nil
+	}
+	return ident.SplitQualified(history)
+}
+
 // WithSkip marks the context so gostry bypasses capture for subsequent statements.
 func WithSkip(ctx context.Context) context.Context {
 	return context.WithValue(ctx, skipKey{}, true)
@@ -51,3 +115,19 @@ func extractSkip(ctx context.Context) bool {
 	}
 	return false
 }
+
+// meta returns the metadata attached to ctx, filling fields that were not set explicitly from
+// cfg.OperatorExtractor, cfg.TraceIDExtractor, and cfg.ReasonExtractor.
+func (h *Handler) meta(ctx context.Context) meta {
+	m := extractMeta(ctx)
+	if m.operator == "" && h.cfg.OperatorExtractor != nil {
+		m.operator = h.cfg.OperatorExtractor(ctx)
+	}
+	if m.traceID == "" && h.cfg.TraceIDExtractor != nil {
+		m.traceID = h.cfg.TraceIDExtractor(ctx)
+	}
+	if m.reason == "" && h.cfg.ReasonExtractor != nil {
+		m.reason = h.cfg.ReasonExtractor(ctx)
+	}
+	return m
+}
@@ -0,0 +1,177 @@
+package gostry
+
+import (
+	"context"
+	"database/sql/driver"
+	"strings"
+	"testing"
+)
+
+type authUserKey struct{}
+
+func TestTx_OperatorExtractor(t *testing.T) {
+	t.Parallel()
+
+	fromAuth := func(ctx context.Context) string {
+		user, _ := ctx.Value(authUserKey{}).(string)
+		return user
+	}
+
+	tcs := []struct {
+		name string
+		ctx  func(context.Context) context.Context
+		want string
+	}{
+		{
+			name: "operator only from extractor",
+			ctx:  func(ctx context.Context) context.Context { return ctx },
+			want: "alice",
+		},
+		{
+			name: "explicit operator wins",
+			ctx:  func(ctx context.Context) context.Context { return WithOperator(ctx, "batch") },
+			want: "batch",
+		},
+	}
+
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			db, state := openFakeDB(t, func(string, []any) (fakeResult, error) {
+				return fakeResult{cols: []string{"id"}, rows: [][]driver.Value{{int64(1)}}}, nil
+			})
+			h := New(Config{
+				OperatorExtractor: fromAuth,
+				TraceIDExtractor:  func(context.Context) string { return "trace-1" },
+			})
+
+			ctx := tc.ctx(context.WithValue(context.Background(), authUserKey{}, "alice"))
+			tx, err := h.Wrap(db).BeginTx(ctx, nil)
+			if err != nil {
+				t.Fatalf("BeginTx() error = %v", err)
+			}
+			if _, err := tx.ExecContext(ctx, `UPDATE orders SET status = 'paid' WHERE id = 1 RETURNING *`); err != nil {
+				t.Fatalf("ExecContext() error = %v", err)
+			}
+			if err := tx.Commit(); err != nil {
+				t.Fatalf("Commit() error = %v", err)
+			}
+
+			execs := state.Execs()
+			if len(execs) != 1 {
+				t.Fatalf("history inserts = %d, want 1", len(execs))
+			}
+			if got := execs[0].args[2]; got != tc.want {
+				t.Fatalf("operated_by = %v, want %s", got, tc.want)
+			}
+			if got := execs[0].args[3]; got != "trace-1" {
+				t.Fatalf("trace_id = %v, want trace-1", got)
+			}
+			if got := execs[0].args[4]; got != "" {
+				t.Fatalf("reason = %v, want empty", got)
+			}
+		})
+	}
+}
+
+func TestWithReasonAppend(t *testing.T) {
+	t.Parallel()
+
+	tcs := []struct {
+		name string
+		ctx  func(context.Context) context.Context
+		want string
+	}{
+		{
+			name: "append from empty",
+			ctx:  func(ctx context.Context) context.Context { return WithReasonAppend(ctx, "retry 2") },
+			want: "retry 2",
+		},
+		{
+			name: "append over existing reason",
+			ctx: func(ctx context.Context) context.Context {
+				return WithReasonAppend(WithReason(ctx, "nightly batch"), "retry 2")
+			},
+			want: "nightly batch; retry 2",
+		},
+		{
+			name: "append twice",
+			ctx: func(ctx context.Context) context.Context {
+				return WithReasonAppend(WithReasonAppend(WithReason(ctx, "nightly batch"), "retry 2"), "order 7")
+			},
+			want: "nightly batch; retry 2; order 7",
+		},
+		{
+			name: "append empty keeps reason",
+			ctx: func(ctx context.Context) context.Context {
+				return WithReasonAppend(WithReason(ctx, "nightly batch"), "")
+			},
+			want: "nightly batch",
+		},
+		{
+			name: "replace after append",
+			ctx: func(ctx context.Context) context.Context {
+				return WithReason(WithReasonAppend(WithReason(ctx, "nightly batch"), "retry 2"), "manual fix")
+			},
+			want: "manual fix",
+		},
+	}
+
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			outer := WithOperator(context.Background(), "batch")
+			ctx := tc.ctx(outer)
+			m := extractMeta(ctx)
+			if m.reason != tc.want {
+				t.Fatalf("reason = %q, want %q", m.reason, tc.want)
+			}
+			if m.operator != "batch" {
+				t.Fatalf("operator = %q, want batch", m.operator)
+			}
+			if got := extractMeta(outer).reason; got != "" {
+				t.Fatalf("outer reason = %q, want it untouched", got)
+			}
+		})
+	}
+}
+
+func TestTx_HistoryTableOverride(t *testing.T) {
+	t.Parallel()
+
+	db, state := openFakeDB(t, func(string, []any) (fakeResult, error) {
+		return fakeResult{cols: []string{"id"}, rows: [][]driver.Value{{int64(1)}}}, nil
+	})
+	ctx := context.Background()
+	tx, err := New(Config{}).Wrap(db).BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatalf("BeginTx() error = %v", err)
+	}
+	overridden := WithHistoryTableOverride(ctx, "orders", "audit.orders_v1_history")
+	if _, err := tx.ExecContext(overridden, `UPDATE orders SET status = 'paid' WHERE id = 1 RETURNING *`); err != nil {
+		t.Fatalf("ExecContext() error = %v", err)
+	}
+	// the override only applies to the table it names
+	if _, err := tx.ExecContext(overridden, `UPDATE users SET name = 'a' WHERE id = 1 RETURNING *`); err != nil {
+		t.Fatalf("ExecContext() error = %v", err)
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE orders SET status = 'shipped' WHERE id = 1 RETURNING *`); err != nil {
+		t.Fatalf("ExecContext() error = %v", err)
+	}
+	// committed with a context that carries no override
+	if err := tx.CommitContext(ctx); err != nil {
+		t.Fatalf("Commit() error = %v", err)
+	}
+
+	execs := state.Execs()
+	if len(execs) != 3 {
+		t.Fatalf("history inserts = %d, want 3", len(execs))
+	}
+	for i, want := range []string{`INSERT INTO "audit"."orders_v1_history"`, `INSERT INTO "users_history"`, `INSERT INTO "orders_history"`} {
+		if !strings.Contains(execs[i].query, want) {
+			t.Fatalf("history insert %d = %s, want to contain %q", i, execs[i].query, want)
+		}
+	}
+}
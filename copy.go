@@ -0,0 +1,27 @@
+package gostry
+
+import (
+	"context"
+)
+
+// RecordCopy buffers a statement-level history entry noting that rows rows were loaded into table
+// with COPY ... FROM. Drivers run COPY FROM STDIN outside ExecContext (e.g. pgx CopyFrom or lib/pq
+// CopyIn), so gostry cannot observe it; call RecordCopy on the same transaction once the copy
+// completes. The entry carries the operator, trace id, and reason of ctx and honors WithSkip,
+// WithTenant, and Config.CaptureOps ("COPY").
+func RecordCopy(ctx context.Context, tx *Tx, table string, rows int64) {
+	if extractSkip(ctx) || tx.h.cfg.TriggerCapture {
+		return
+	}
+	table = tenantTable(ctx, table)
+	if !tx.h.capturesOp(table, "COPY") {
+		return
+	}
+	tx.capture(ctx, entry{
+		table:        table,
+		op:           "COPY",
+		meta:         tx.h.meta(ctx),
+		summary:      true,
+		rowsAffected: rows,
+	})
+}
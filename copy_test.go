@@ -0,0 +1,121 @@
+package gostry
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestRecordCopy(t *testing.T) {
+	t.Parallel()
+
+	db, state := openFakeDB(t, nil)
+	h := New(Config{RecordStatement: true})
+
+	ctx := WithOperator(context.Background(), "loader")
+	tx, err := h.Wrap(db).BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatalf("BeginTx() error = %v", err)
+	}
+	RecordCopy(ctx, tx, "orders", 250)
+	RecordCopy(WithSkip(ctx), tx, "orders", 10)
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Commit() error = %v", err)
+	}
+
+	execs := state.Execs()
+	if len(execs) != 1 {
+		t.Fatalf("history inserts = %d, want 1", len(execs))
+	}
+	args := execs[0].args
+	if args[0] != nil || args[1] != "COPY" || args[2] != "loader" {
+		t.Fatalf("history args = %v, want [nil COPY loader ...]", args)
+	}
+	if got := args[len(args)-1]; got != int64(250) {
+		t.Fatalf("rows_affected = %v, want 250", got)
+	}
+}
+
+func TestTx_CopyFromExec(t *testing.T) {
+	t.Parallel()
+
+	db, state := openFakeDB(t, nil)
+	state.affected = func(string) int64 { return 42 }
+	ctx := context.Background()
+	tx, err := New(Config{AutoAttachReturning: true, RecordStatement: true}).Wrap(db).BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatalf("BeginTx() error = %v", err)
+	}
+	if _, err := tx.ExecContext(ctx, `COPY orders FROM '/tmp/orders.csv'`); err != nil {
+		t.Fatalf("ExecContext() error = %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Commit() error = %v", err)
+	}
+
+	execs := state.Execs()
+	if len(execs) != 2 || execs[0].query != `COPY orders FROM '/tmp/orders.csv'` {
+		t.Fatalf("execs = %#v, want the COPY unchanged followed by one history insert", execs)
+	}
+	if got := execs[1].args[1]; got != "COPY" {
+		t.Fatalf("history operation = %v, want COPY", got)
+	}
+	if got := execs[1].args[len(execs[1].args)-1]; got != int64(42) {
+		t.Fatalf("rows_affected = %v, want 42", got)
+	}
+}
+
+func TestFlush_AllowedOperations(t *testing.T) {
+	t.Parallel()
+
+	tcs := []struct {
+		name    string
+		cfg     Config
+		op      string
+		wantErr bool
+	}{
+		{name: "copy allowed by default", op: "COPY"},
+		{name: "copy outside configured set", cfg: Config{AllowedOperations: []string{"INSERT", "UPDATE", "DELETE"}}, op: "COPY", wantErr: true},
+		{name: "configured custom op", cfg: Config{AllowedOperations: []string{"TRUNCATE"}}, op: "TRUNCATE"},
+		{name: "arbitrary op", op: "DELETE'); DROP TABLE orders; --", wantErr: true},
+	}
+
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			db, state := openFakeDB(t, nil)
+			ctx := context.Background()
+			tx, err := New(tc.cfg).Wrap(db).BeginTx(ctx, nil)
+			if err != nil {
+				t.Fatalf("BeginTx() error = %v", err)
+			}
+			if tc.op == "COPY" {
+				RecordCopy(ctx, tx, "orders", 3)
+			} else {
+				tx.capture(ctx, entry{table: "orders", op: tc.op, summary: true, rowsAffected: 3})
+			}
+			err = tx.Commit()
+
+			if !tc.wantErr {
+				if err != nil {
+					t.Fatalf("Commit() error = %v", err)
+				}
+				if execs := state.Execs(); len(execs) != 1 || execs[0].args[1] != tc.op {
+					t.Fatalf("execs = %v, want one history insert with op %q", execs, tc.op)
+				}
+				return
+			}
+			var invalid *InvalidOperationError
+			if !errors.As(err, &invalid) || invalid.Operation != tc.op || invalid.Table != "orders" {
+				t.Fatalf("Commit() error = %v, want *InvalidOperationError for %q", err, tc.op)
+			}
+			if !errors.Is(err, ErrInvalidOperation) {
+				t.Fatalf("Commit() error = %v, want ErrInvalidOperation", err)
+			}
+			if execs := state.Execs(); len(execs) != 0 {
+				t.Fatalf("execs = %v, want none", execs)
+			}
+		})
+	}
+}
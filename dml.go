@@ -0,0 +1,41 @@
+package gostry
+
+import (
+	"github.com/mickamy/gostry/internal/query"
+)
+
+// DMLInfo describes a data-changing statement recognized by ParseDML.
+type DMLInfo struct {
+	Op              string // INSERT, UPDATE, DELETE, or COPY (COPY ... FROM)
+	Table           string // target table as written, possibly schema-qualified and quoted
+	HasReturning    bool   // the statement mentions RETURNING
+	HasFrom         bool   // UPDATE ... FROM joins other tables
+	HasUsing        bool   // DELETE ... USING joins other tables
+	ReturningScoped bool   // every RETURNING item is qualified by the target table or its alias
+	CurrentOf       bool   // UPDATE/DELETE ... WHERE CURRENT OF cursor
+}
+
+// ParseDML recognizes a single top-level INSERT, UPDATE, DELETE, or COPY ... FROM statement the same
+// way gostry does when capturing, and reports false for anything else.
+func ParseDML(sql string) (DMLInfo, bool) {
+	dml, ok := query.ParseDML(sql)
+	if !ok {
+		return DMLInfo{}, false
+	}
+	return DMLInfo{
+		Op:              dml.Op,
+		Table:           dml.Table,
+		HasReturning:    dml.HasReturning,
+		HasFrom:         dml.HasFrom,
+		HasUsing:        dml.HasUsing,
+		ReturningScoped: dml.ReturningScoped,
+		CurrentOf:       dml.CurrentOf,
+	}, true
+}
+
+// AppendReturning appends "RETURNING *" to sql as Config.AutoAttachReturning does, keeping a
+// trailing semicolon at the end. It reports false for empty statements and for statements the clause
+// cannot be appended to safely, such as several statements in one string or an unterminated literal.
+func AppendReturning(sql string) (string, bool) {
+	return query.AppendReturningAll(sql)
+}
@@ -0,0 +1,78 @@
+package gostry_test
+
+import (
+	"testing"
+
+	"github.com/mickamy/gostry"
+)
+
+func TestParseDML(t *testing.T) {
+	t.Parallel()
+
+	tcs := []struct {
+		name   string
+		sql    string
+		want   gostry.DMLInfo
+		wantOK bool
+	}{
+		{
+			name:   "insert",
+			sql:    `INSERT INTO public.orders (id) VALUES ($1) RETURNING *`,
+			want:   gostry.DMLInfo{Op: "INSERT", Table: "public.orders", HasReturning: true},
+			wantOK: true,
+		},
+		{
+			name:   "update from scoped",
+			sql:    `UPDATE orders o SET total = s.total FROM staging s WHERE o.id = s.id RETURNING o.*`,
+			want:   gostry.DMLInfo{Op: "UPDATE", Table: "orders", HasReturning: true, HasFrom: true, ReturningScoped: true},
+			wantOK: true,
+		},
+		{
+			name:   "delete using",
+			sql:    `DELETE FROM orders o USING customers c WHERE o.customer_id = c.id`,
+			want:   gostry.DMLInfo{Op: "DELETE", Table: "orders", HasUsing: true},
+			wantOK: true,
+		},
+		{name: "select", sql: `SELECT * FROM orders`, wantOK: false},
+	}
+
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			got, ok := gostry.ParseDML(tc.sql)
+			if ok != tc.wantOK {
+				t.Fatalf("ParseDML() ok = %t, want %t", ok, tc.wantOK)
+			}
+			if got != tc.want {
+				t.Fatalf("ParseDML(%q) = %#v, want %#v", tc.sql, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestAppendReturning(t *testing.T) {
+	t.Parallel()
+
+	tcs := []struct {
+		name   string
+		sql    string
+		want   string
+		wantOK bool
+	}{
+		{name: "semicolon", sql: "DELETE FROM orders WHERE id = $1;", want: "DELETE FROM orders WHERE id = $1\nRETURNING *;", wantOK: true},
+		{name: "plain", sql: "UPDATE orders SET status = 'x'", want: "UPDATE orders SET status = 'x'\nRETURNING *", wantOK: true},
+		{name: "empty", sql: "  ", want: "  ", wantOK: false},
+	}
+
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			got, ok := gostry.AppendReturning(tc.sql)
+			if ok != tc.wantOK || got != tc.want {
+				t.Fatalf("AppendReturning(%q) = %q, %t, want %q, %t", tc.sql, got, ok, tc.want, tc.wantOK)
+			}
+		})
+	}
+}
@@ -0,0 +1,52 @@
+package gostry
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// dumpLine is the JSON form of a buffered entry written by DumpBuffer.
+type dumpLine struct {
+	Table        string         `json:"table"`
+	Operation    string         `json:"op"`
+	ID           any            `json:"id"`
+	Before       map[string]any `json:"before"`
+	After        map[string]any `json:"after"`
+	Operator     string         `json:"operator,omitempty"`
+	TraceID      string         `json:"trace_id,omitempty"`
+	Reason       string         `json:"reason,omitempty"`
+	SQL          string         `json:"sql,omitempty"`
+	RowsAffected *int64         `json:"rows_affected,omitempty"` // statement-level entries only
+}
+
+// DumpBuffer writes the entries captured by tx but not yet flushed to w, one JSON object per line,
+// with TransformRow, Redact, and MaxValueBytes applied as at flush. It is a debugging aid: the buffer
+// is left untouched, so the entries are still written on Commit or Flush.
+func (tx *Tx) DumpBuffer(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	for _, e := range tx.buf.Snapshot() {
+		before, after := tx.h.images(e)
+		id, _, _ := tx.h.resolveID(e.table, before, after)
+		before, after = tx.h.withholdImages(e.table, before, after)
+		line := dumpLine{
+			Table:     e.table,
+			Operation: e.op,
+			ID:        id,
+			Before:    before,
+			After:     after,
+			Operator:  e.meta.operator,
+			TraceID:   e.meta.traceID,
+			Reason:    e.meta.reason,
+			SQL:       e.sql,
+		}
+		if e.summary {
+			n := e.rowsAffected
+			line.RowsAffected = &n
+		}
+		if err := enc.Encode(line); err != nil {
+			return fmt.Errorf("gostry: failed to dump buffer: %w", err)
+		}
+	}
+	return nil
+}
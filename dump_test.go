@@ -0,0 +1,59 @@
+package gostry
+
+import (
+	"bytes"
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestTx_DumpBuffer(t *testing.T) {
+	t.Parallel()
+
+	db, state := openFakeDB(t, func(string, []any) (fakeResult, error) {
+		return fakeResult{cols: []string{"id", "email"}, rows: [][]driver.Value{{int64(1), "a@example.com"}}}, nil
+	})
+	h := New(Config{Redact: RedactMap{"email": func(string, any) any { return "***" }}})
+	ctx := WithOperator(context.Background(), "alice")
+	tx, err := h.Wrap(db).BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatalf("BeginTx() error = %v", err)
+	}
+	if _, err := tx.ExecContext(ctx, `INSERT INTO users (email) VALUES ($1) RETURNING *`, "a@example.com"); err != nil {
+		t.Fatalf("ExecContext() error = %v", err)
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM users WHERE id = 1 RETURNING *`); err != nil {
+		t.Fatalf("ExecContext() error = %v", err)
+	}
+
+	var out bytes.Buffer
+	if err := tx.DumpBuffer(&out); err != nil {
+		t.Fatalf("DumpBuffer() error = %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("DumpBuffer() lines = %d, want 2:\n%s", len(lines), out.String())
+	}
+	var first dumpLine
+	if err := json.Unmarshal([]byte(lines[0]), &first); err != nil {
+		t.Fatalf("json.Unmarshal() error = %v", err)
+	}
+	if first.Table != "users" || first.Operation != "INSERT" || first.Operator != "alice" || first.After["email"] != "***" {
+		t.Fatalf("first dump line = %s, want redacted INSERT into users by alice", lines[0])
+	}
+	if !strings.Contains(lines[1], `"op":"DELETE"`) {
+		t.Fatalf("second dump line = %s, want DELETE", lines[1])
+	}
+
+	if got := len(tx.buf.Snapshot()); got != 2 {
+		t.Fatalf("buffered entries after dump = %d, want 2", got)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Commit() error = %v", err)
+	}
+	if got := len(state.Execs()); got != 2 {
+		t.Fatalf("history inserts = %d, want 2", got)
+	}
+}
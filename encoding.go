@@ -0,0 +1,109 @@
+package gostry
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/mickamy/gostry/internal/cbor"
+)
+
+// Encoding selects how before/after row images are stored in history tables. Config.Encoding
+// encodes the images and SchemaConfig.Encoding creates the matching columns, so set both alike.
+type Encoding string
+
+const (
+	// EncodingJSON stores images as JSONB (default).
+	EncodingJSON Encoding = "json"
+	// EncodingCBOR stores images as CBOR (RFC 8949) in BYTEA columns, with map keys in deterministic order.
+	EncodingCBOR Encoding = "cbor"
+)
+
+// imageEncoder encodes and decodes row images for one Encoding.
+type imageEncoder interface {
+	columnType() string
+	encode(v map[string]any) ([]byte, error)
+	decode(b []byte) (map[string]any, error)
+}
+
+type jsonEncoder struct{}
+
+func (jsonEncoder) columnType() string { return "JSONB" }
+
+func (jsonEncoder) encode(v map[string]any) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonEncoder) decode(b []byte) (map[string]any, error) {
+	var m map[string]any
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+type cborEncoder struct{}
+
+func (cborEncoder) columnType() string { return "BYTEA" }
+
+func (cborEncoder) encode(v map[string]any) ([]byte, error) {
+	if v == nil {
+		return nil, nil
+	}
+	return cbor.Marshal(v)
+}
+
+func (cborEncoder) decode(b []byte) (map[string]any, error) {
+	v, err := cbor.Unmarshal(b)
+	if err != nil {
+		return nil, err
+	}
+	switch m := v.(type) {
+	case nil:
+		return nil, nil
+	case map[string]any:
+		return m, nil
+	default:
+		return nil, fmt.Errorf("expected a map, got %T", v)
+	}
+}
+
+// encoderFor returns the encoder of enc; the empty Encoding selects JSON.
+func encoderFor(enc Encoding) (imageEncoder, error) {
+	switch enc {
+	case "", EncodingJSON:
+		return jsonEncoder{}, nil
+	case EncodingCBOR:
+		return cborEncoder{}, nil
+	default:
+		return nil, fmt.Errorf("gostry: unknown encoding %q", enc)
+	}
+}
+
+// DecodeImage decodes a before/after column value read from a history table written with enc.
+// SQL NULL (nil or empty b) and a stored null image decode to a nil map.
+func DecodeImage(enc Encoding, b []byte) (map[string]any, error) {
+	e, err := encoderFor(enc)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		return nil, nil
+	}
+	m, err := e.decode(b)
+	if err != nil {
+		return nil, fmt.Errorf("gostry: failed to decode %s image: %w", enc, err)
+	}
+	return m, nil
+}
+
+// imageJSON converts a stored image to JSON so hash chains cover the same document regardless of encoding.
+func imageJSON(enc Encoding, b []byte) ([]byte, error) {
+	if enc == "" || enc == EncodingJSON {
+		return b, nil
+	}
+	m, err := DecodeImage(enc, b)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(m)
+}
@@ -0,0 +1,93 @@
+package gostry
+
+import (
+	"context"
+	"database/sql/driver"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTx_EncodingCBOR(t *testing.T) {
+	t.Parallel()
+
+	db, state := openFakeDB(t, func(string, []any) (fakeResult, error) {
+		return fakeResult{cols: []string{"id", "name", "price"}, rows: [][]driver.Value{{int64(1), "widget", 12.5}}}, nil
+	})
+	ctx := context.Background()
+	tx, err := New(Config{Encoding: EncodingCBOR}).Wrap(db).BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatalf("BeginTx() error = %v", err)
+	}
+	if _, err := tx.ExecContext(ctx, `INSERT INTO products (name, price) VALUES ($1, $2) RETURNING *`, "widget", 12.5); err != nil {
+		t.Fatalf("ExecContext() error = %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Commit() error = %v", err)
+	}
+
+	execs := state.Execs()
+	if len(execs) != 1 {
+		t.Fatalf("history inserts = %d, want 1", len(execs))
+	}
+	if before := execs[0].args[5]; before != nil {
+		t.Fatalf("history before = %v, want NULL", before)
+	}
+	stored, ok := execs[0].args[6].([]byte)
+	if !ok || len(stored) == 0 || stored[0] == '{' {
+		t.Fatalf("history after = %v, want CBOR bytes", execs[0].args[6])
+	}
+	got, err := DecodeImage(EncodingCBOR, stored)
+	if err != nil {
+		t.Fatalf("DecodeImage() error = %v", err)
+	}
+	want := map[string]any{"id": int64(1), "name": "widget", "price": 12.5}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("DecodeImage() = %#v, want %#v", got, want)
+	}
+}
+
+func TestDecodeImage(t *testing.T) {
+	t.Parallel()
+
+	tcs := []struct {
+		name    string
+		enc     Encoding
+		in      []byte
+		want    map[string]any
+		wantErr bool
+	}{
+		{name: "json", enc: EncodingJSON, in: []byte(`{"id":1}`), want: map[string]any{"id": float64(1)}},
+		{name: "default is json", in: []byte(`{"id":1}`), want: map[string]any{"id": float64(1)}},
+		{name: "json null", enc: EncodingJSON, in: []byte(`null`)},
+		{name: "cbor", enc: EncodingCBOR, in: []byte{0xa1, 0x62, 'i', 'd', 0x01}, want: map[string]any{"id": int64(1)}},
+		{name: "sql null", enc: EncodingCBOR},
+		{name: "cbor non-map", enc: EncodingCBOR, in: []byte{0x01}, wantErr: true},
+		{name: "unknown encoding", enc: "msgpack", in: []byte{0x80}, wantErr: true},
+	}
+
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			got, err := DecodeImage(tc.enc, tc.in)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("DecodeImage() error = %v, wantErr %t", err, tc.wantErr)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("DecodeImage() = %#v, want %#v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestBuildHistoryDDL_EncodingCBOR(t *testing.T) {
+	t.Parallel()
+
+	ddl := buildHistoryDDL(`"orders_history"`, "", defaultHistoryColumns, historyDDLOptions{imageType: cborEncoder{}.columnType()})
+	for _, want := range []string{`"before" BYTEA`, `"after" BYTEA`} {
+		if !strings.Contains(ddl, want) {
+			t.Fatalf("buildHistoryDDL() = %s, want to contain %q", ddl, want)
+		}
+	}
+}
@@ -1,5 +1,11 @@
 package gostry
 
+import (
+	"database/sql"
+
+	"github.com/mickamy/gostry/internal/query"
+)
+
 // entry represents a captured change for a single row or statement.
 type entry struct {
 	table  string
@@ -9,6 +15,10 @@ type entry struct {
 	before map[string]any // optional (DELETE/advanced UPDATE)
 	after  map[string]any // optional (INSERT/UPDATE)
 	meta   meta
+
+	history      []string // history table from WithHistoryTableOverride, set by Tx.capture; nil means derived from table
+	summary      bool     // statement-level entry without row images
+	rowsAffected int64    // rows changed by a summary entry's statement; -1 when the driver does not report it
 }
 
 // meta carries operational context for audit trails.
@@ -16,4 +26,14 @@ type meta struct {
 	operator string
 	traceID  string
 	reason   string
+	txLabel  string // transaction label from WithTxLabel, set by Tx.capture
+}
+
+// summaryEntry builds a statement-level entry for DML executed without row images.
+func summaryEntry(dml query.DML, q string, args []any, m meta, res sql.Result) entry {
+	n, err := res.RowsAffected()
+	if err != nil {
+		n = -1
+	}
+	return entry{table: dml.Table, op: dml.Op, sql: q, args: args, meta: m, summary: true, rowsAffected: n}
 }
@@ -0,0 +1,90 @@
+package gostry
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Sentinel errors wrapped by gostry failures; match them with errors.Is. The original cause stays
+// in the chain, so errors.As still reaches driver errors.
+var (
+	// ErrHistoryTableMissing reports that a history table does not exist (SQLSTATE 42P01); run Migrate
+	// or set Config.SkipIfNotExists.
+	ErrHistoryTableMissing = errors.New("gostry: history table does not exist")
+	// ErrScan reports a failure reading the rows returned by a captured statement or a gostry query.
+	ErrScan = errors.New("gostry: failed to scan rows")
+	// ErrMarshal reports a failure encoding a row image, key, or notification payload.
+	ErrMarshal = errors.New("gostry: failed to marshal")
+	// ErrInvalidIdentifier reports a table or history table name that cannot be quoted as an identifier.
+	ErrInvalidIdentifier = errors.New("gostry: invalid identifier")
+	// ErrInvalidHistoryIdentifier reports a table whose history table identifier cannot be derived,
+	// which usually means a migration was missed. Errors matching it are *InvalidIdentifierError values
+	// and also match ErrInvalidIdentifier.
+	ErrInvalidHistoryIdentifier = errors.New("gostry: invalid history table identifier")
+	// ErrInvalidOperation reports a captured change whose operation is not one history may store
+	// (see Config.AllowedOperations). Errors matching it are *InvalidOperationError values.
+	ErrInvalidOperation = errors.New("gostry: invalid operation")
+)
+
+// InvalidIdentifierError is returned by flush, Migrate, and VerifyHistory when the history table
+// identifier of Table cannot be derived. Extract it with errors.As to, e.g., run Migrate for Table.
+type InvalidIdentifierError struct {
+	Table string // table name as written in the statement or passed as a target
+}
+
+func (e *InvalidIdentifierError) Error() string {
+	return fmt.Sprintf("gostry: invalid history table identifier for %q", e.Table)
+}
+
+// Is reports whether target is ErrInvalidHistoryIdentifier or ErrInvalidIdentifier.
+func (e *InvalidIdentifierError) Is(target error) bool {
+	return target == ErrInvalidHistoryIdentifier || target == ErrInvalidIdentifier
+}
+
+// InvalidOperationError is returned by flush when a captured change carries an operation outside
+// Config.AllowedOperations; nothing of the flush is written.
+type InvalidOperationError struct {
+	Table     string // table of the rejected change
+	Operation string // operation as captured
+}
+
+func (e *InvalidOperationError) Error() string {
+	return fmt.Sprintf("gostry: operation %q on %q is not allowed in history", e.Operation, e.Table)
+}
+
+// Is reports whether target is ErrInvalidOperation.
+func (e *InvalidOperationError) Is(target error) bool {
+	return target == ErrInvalidOperation
+}
+
+// kindError tags err with one of the sentinel errors while keeping err's message.
+type kindError struct {
+	kind error
+	err  error
+}
+
+func (e *kindError) Error() string { return e.err.Error() }
+
+func (e *kindError) Unwrap() []error { return []error{e.kind, e.err} }
+
+// withKind wraps err so that errors.Is(err, kind) reports true.
+func withKind(kind, err error) error {
+	return &kindError{kind: kind, err: err}
+}
+
+// sqlState returns the SQLSTATE code carried by err, or "" when the driver does not expose one.
+func sqlState(err error) string {
+	var se sqlStateError
+	if !errors.As(err, &se) {
+		return ""
+	}
+	return se.SQLState()
+}
+
+// historyTableError tags err with ErrHistoryTableMissing when the database reports an undefined table.
+func historyTableError(err error) error {
+	if sqlState(err) == "42P01" {
+		return withKind(ErrHistoryTableMissing, err)
+	}
+	return err
+}
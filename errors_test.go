@@ -0,0 +1,175 @@
+package gostry
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestErrors_Is(t *testing.T) {
+	t.Parallel()
+
+	returning := func(string, []any) (fakeResult, error) {
+		return fakeResult{cols: []string{"id"}, rows: [][]driver.Value{{int64(1)}}}, nil
+	}
+	missingTable := fakePgError{code: "42P01"}
+
+	tcs := []struct {
+		name  string
+		query fakeQueryFunc
+		cfg   Config
+		setup func(s *fakeState)
+		run   func(ctx context.Context, db *DB) error
+		want  error
+	}{
+		{
+			name:  "history table missing",
+			query: returning,
+			setup: func(s *fakeState) {
+				s.execErr = func(q string) error {
+					if strings.Contains(q, "orders_history") {
+						return missingTable
+					}
+					return nil
+				}
+			},
+			run: func(ctx context.Context, db *DB) error {
+				tx, err := db.BeginTx(ctx, nil)
+				if err != nil {
+					return err
+				}
+				if _, err := tx.ExecContext(ctx, `DELETE FROM orders RETURNING *`); err != nil {
+					return err
+				}
+				return tx.Commit()
+			},
+			want: ErrHistoryTableMissing,
+		},
+		{
+			name: "scan failed",
+			query: func(string, []any) (fakeResult, error) {
+				return fakeResult{cols: []string{"id"}, rows: [][]driver.Value{{int64(1)}}, err: errors.New("connection reset")}, nil
+			},
+			run: func(ctx context.Context, db *DB) error {
+				tx, err := db.BeginTx(ctx, nil)
+				if err != nil {
+					return err
+				}
+				defer func() { _ = tx.Rollback() }()
+				_, err = tx.ExecContext(ctx, `DELETE FROM orders RETURNING *`)
+				return err
+			},
+			want: ErrScan,
+		},
+		{
+			name:  "marshal failed",
+			query: returning,
+			cfg: Config{JSONMarshaler: func(any) ([]byte, error) {
+				return nil, errors.New("unsupported value")
+			}},
+			run: func(ctx context.Context, db *DB) error {
+				tx, err := db.BeginTx(ctx, nil)
+				if err != nil {
+					return err
+				}
+				if _, err := tx.ExecContext(ctx, `DELETE FROM orders RETURNING *`); err != nil {
+					return err
+				}
+				return tx.Commit()
+			},
+			want: ErrMarshal,
+		},
+		{
+			name:  "invalid identifier",
+			query: returning,
+			run: func(ctx context.Context, db *DB) error {
+				return Migrate(ctx, db, SchemaConfig{}, "a.b.c")
+			},
+			want: ErrInvalidIdentifier,
+		},
+	}
+
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			db, state := openFakeDB(t, tc.query)
+			if tc.setup != nil {
+				tc.setup(state)
+			}
+			err := tc.run(context.Background(), New(tc.cfg).Wrap(db))
+			if !errors.Is(err, tc.want) {
+				t.Fatalf("error = %v, want errors.Is(%v)", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestErrors_KeepCause(t *testing.T) {
+	t.Parallel()
+
+	err := historyTableError(errors.Join(errors.New("insert failed"), fakePgError{code: "42P01"}))
+	var pgErr fakePgError
+	if !errors.Is(err, ErrHistoryTableMissing) || !errors.As(err, &pgErr) {
+		t.Fatalf("historyTableError() = %v, want ErrHistoryTableMissing wrapping the driver error", err)
+	}
+	if other := historyTableError(fakePgError{code: "23505"}); errors.Is(other, ErrHistoryTableMissing) {
+		t.Fatalf("historyTableError(23505) matched ErrHistoryTableMissing")
+	}
+}
+
+func TestInvalidIdentifierError(t *testing.T) {
+	t.Parallel()
+
+	const table = "sales..orders"
+	tcs := []struct {
+		name string
+		run  func(ctx context.Context, db *DB) error
+	}{
+		{
+			name: "flush",
+			run: func(ctx context.Context, db *DB) error {
+				tx, err := db.BeginTx(ctx, nil)
+				if err != nil {
+					return err
+				}
+				RecordCopy(ctx, tx, table, 3)
+				return tx.Commit()
+			},
+		},
+		{
+			name: "create history table",
+			run: func(ctx context.Context, db *DB) error {
+				_, err := createHistoryTable(ctx, db, SchemaConfig{HistorySuffix: "_history"}, tableInfo{ident: table}, table)
+				return err
+			},
+		},
+		{
+			name: "verify history",
+			run: func(ctx context.Context, db *DB) error {
+				_, _, err := VerifyHistory(ctx, db, Config{}, table)
+				return err
+			},
+		},
+	}
+
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			db, _ := openFakeDB(t, func(string, []any) (fakeResult, error) {
+				return fakeResult{}, nil
+			})
+			err := tc.run(context.Background(), New(Config{}).Wrap(db))
+			var invalid *InvalidIdentifierError
+			if !errors.As(err, &invalid) || invalid.Table != table {
+				t.Fatalf("error = %v, want *InvalidIdentifierError for %q", err, table)
+			}
+			if !errors.Is(err, ErrInvalidHistoryIdentifier) || !errors.Is(err, ErrInvalidIdentifier) {
+				t.Fatalf("error = %v, want ErrInvalidHistoryIdentifier and ErrInvalidIdentifier", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,66 @@
+package gostry
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+
+	"github.com/mickamy/gostry/internal/query"
+)
+
+// Execer is the statement interface shared by *DB and *Tx, so repository code written against it
+// is audited whichever of the two it is given. *sql.DB and *sql.Tx satisfy it too (without capture).
+type Execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+}
+
+var (
+	_ Execer = (*DB)(nil)
+	_ Execer = (*Tx)(nil)
+)
+
+// ExecContext runs a data-changing statement in its own capturing transaction (see WithinTx), so
+// the change and its history commit together; other statements run directly on the pool.
+func (db *DB) ExecContext(ctx context.Context, q string, args ...any) (sql.Result, error) {
+	if _, ok := query.ParseDML(q); !ok || extractSkip(ctx) {
+		return db.DB.ExecContext(ctx, q, args...)
+	}
+	var res sql.Result
+	err := db.WithinTx(ctx, func(tx *Tx) error {
+		var err error
+		res, err = tx.ExecContext(ctx, q, args...)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// QueryContext runs q on the pool. Rows returned through *sql.Rows cannot be read by gostry, so a
+// data-changing statement run here is not captured and a warning is logged; use ExecContext instead.
+func (db *DB) QueryContext(ctx context.Context, q string, args ...any) (*sql.Rows, error) {
+	db.h.warnUncapturedQuery(ctx, q)
+	return db.DB.QueryContext(ctx, q, args...)
+}
+
+// QueryContext runs q in the transaction. Like DB.QueryContext, it does not capture data-changing
+// statements and logs a warning for them; use ExecContext instead.
+func (tx *Tx) QueryContext(ctx context.Context, q string, args ...any) (*sql.Rows, error) {
+	tx.h.warnUncapturedQuery(ctx, q)
+	return tx.Tx.QueryContext(ctx, q, args...)
+}
+
+// warnUncapturedQuery logs a warning when q is a DML statement that would be captured by ExecContext.
+func (h *Handler) warnUncapturedQuery(ctx context.Context, q string) {
+	if extractSkip(ctx) || h.cfg.TriggerCapture {
+		return
+	}
+	dml, ok := query.ParseDML(q)
+	if !ok || !h.capturesOp(tenantTable(ctx, dml.Table), dml.Op) {
+		return
+	}
+	h.warn(ctx, "gostry: DML run through QueryContext is not captured; use ExecContext",
+		slog.String("table", dml.Table), slog.String("operation", dml.Op))
+}
@@ -0,0 +1,93 @@
+package gostry
+
+import (
+	"bytes"
+	"context"
+	"database/sql/driver"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+// deleteOrder is repository code written against Execer.
+func deleteOrder(ctx context.Context, e Execer, id int64) error {
+	_, err := e.ExecContext(ctx, `DELETE FROM orders WHERE id = $1 RETURNING *`, id)
+	return err
+}
+
+func TestExecer_Captures(t *testing.T) {
+	t.Parallel()
+
+	returning := func(string, []any) (fakeResult, error) {
+		return fakeResult{cols: []string{"id"}, rows: [][]driver.Value{{int64(1)}}}, nil
+	}
+
+	t.Run("db", func(t *testing.T) {
+		t.Parallel()
+		db, state := openFakeDB(t, returning)
+		ctx := context.Background()
+		if err := deleteOrder(ctx, New(Config{}).Wrap(db), 1); err != nil {
+			t.Fatalf("deleteOrder() error = %v", err)
+		}
+		execs := state.Execs()
+		if len(execs) != 1 || !strings.Contains(execs[0].query, `"orders_history"`) {
+			t.Fatalf("execs = %#v, want one history insert", execs)
+		}
+		if commits, _ := state.Outcome(); commits != 1 {
+			t.Fatalf("commits = %d, want 1", commits)
+		}
+	})
+
+	t.Run("tx", func(t *testing.T) {
+		t.Parallel()
+		db, state := openFakeDB(t, returning)
+		ctx := context.Background()
+		tx, err := New(Config{}).Wrap(db).BeginTx(ctx, nil)
+		if err != nil {
+			t.Fatalf("BeginTx() error = %v", err)
+		}
+		if err := deleteOrder(ctx, tx, 1); err != nil {
+			t.Fatalf("deleteOrder() error = %v", err)
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatalf("Commit() error = %v", err)
+		}
+		if execs := state.Execs(); len(execs) != 1 {
+			t.Fatalf("history inserts = %d, want 1", len(execs))
+		}
+	})
+
+	t.Run("db passes other statements through", func(t *testing.T) {
+		t.Parallel()
+		db, state := openFakeDB(t, returning)
+		ctx := context.Background()
+		if _, err := New(Config{}).Wrap(db).ExecContext(ctx, `SET search_path TO app`); err != nil {
+			t.Fatalf("ExecContext() error = %v", err)
+		}
+		if commits, _ := state.Outcome(); commits != 0 || len(state.Execs()) != 1 {
+			t.Fatalf("commits = %d, execs = %d, want a single direct exec", commits, len(state.Execs()))
+		}
+	})
+}
+
+func TestExecer_QueryContextWarnsOnDML(t *testing.T) {
+	t.Parallel()
+
+	db, _ := openFakeDB(t, func(string, []any) (fakeResult, error) {
+		return fakeResult{cols: []string{"id"}, rows: [][]driver.Value{{int64(1)}}}, nil
+	})
+	var logs bytes.Buffer
+	wrapped := New(Config{Logger: slog.New(slog.NewTextHandler(&logs, nil))}).Wrap(db)
+	ctx := context.Background()
+
+	for _, q := range []string{`SELECT id FROM orders`, `UPDATE orders SET status = 'paid' RETURNING id`} {
+		rows, err := wrapped.QueryContext(ctx, q)
+		if err != nil {
+			t.Fatalf("QueryContext(%q) error = %v", q, err)
+		}
+		_ = rows.Close()
+	}
+	if got := strings.Count(logs.String(), "not captured"); got != 1 {
+		t.Fatalf("warnings = %d, want 1 (for the UPDATE only):\n%s", got, logs.String())
+	}
+}
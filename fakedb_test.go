@@ -0,0 +1,270 @@
+package gostry
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// fakeCall records a statement executed against the fake driver.
+type fakeCall struct {
+	query string
+	args  []any
+}
+
+// fakeResult is the result set returned by a fakeQueryFunc.
+type fakeResult struct {
+	cols  []string
+	rows  [][]driver.Value
+	next  func(row int) // optional hook called before row is handed to database/sql
+	types []string      // optional database type names reported per column
+	err   error         // optional error reported by rows.Err after the last row
+}
+
+// fakeQueryFunc answers a query issued through QueryContext.
+type fakeQueryFunc func(query string, args []any) (fakeResult, error)
+
+// fakeState is shared by every connection opened with the same DSN.
+type fakeState struct {
+	mu        sync.Mutex
+	execs     []fakeCall
+	queries   []fakeCall
+	query     fakeQueryFunc
+	execErr   func(query string) error
+	commitErr error // returned by Commit when set
+	// affected reports RowsAffected for an exec; nil reports 1.
+	affected func(query string) int64
+
+	commits   int
+	rollbacks int
+	pings     int
+}
+
+func (s *fakeState) Execs() []fakeCall {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]fakeCall(nil), s.execs...)
+}
+
+// Outcome returns how many transactions were committed and rolled back.
+func (s *fakeState) Outcome() (commits, rollbacks int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.commits, s.rollbacks
+}
+
+func (s *fakeState) Queries() []fakeCall {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]fakeCall(nil), s.queries...)
+}
+
+var (
+	fakeRegisterOnce sync.Once
+	fakeStates       sync.Map // dsn -> *fakeState
+	fakeSeq          atomic.Int64
+)
+
+type fakeDriver struct{}
+
+func (fakeDriver) Open(dsn string) (driver.Conn, error) {
+	v, ok := fakeStates.Load(dsn)
+	if !ok {
+		return nil, errors.New("fake: unknown dsn")
+	}
+	return &fakeConn{state: v.(*fakeState)}, nil
+}
+
+// openFakeDB opens a *sql.DB backed by an in-memory driver that records statements.
+func openFakeDB(t testing.TB, query fakeQueryFunc) (*sql.DB, *fakeState) {
+	t.Helper()
+	fakeRegisterOnce.Do(func() { sql.Register("gostry-fake", fakeDriver{}) })
+
+	connector, state := openFakeConnector(t, query)
+	db, err := sql.Open("gostry-fake", connector.dsn)
+	if err != nil {
+		t.Fatalf("sql.Open() error = %v", err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	return db, state
+}
+
+// fakeConnector connects to the fake driver state registered under dsn.
+type fakeConnector struct {
+	dsn string
+}
+
+func (c fakeConnector) Connect(context.Context) (driver.Conn, error) { return fakeDriver{}.Open(c.dsn) }
+
+func (c fakeConnector) Driver() driver.Driver { return fakeDriver{} }
+
+// openFakeConnector registers a fake driver state and returns a connector for it, for use with sql.OpenDB.
+func openFakeConnector(t testing.TB, query fakeQueryFunc) (fakeConnector, *fakeState) {
+	t.Helper()
+	state := &fakeState{query: query}
+	dsn := fmt.Sprintf("%s#%d", t.Name(), fakeSeq.Add(1))
+	fakeStates.Store(dsn, state)
+	t.Cleanup(func() { fakeStates.Delete(dsn) })
+	return fakeConnector{dsn: dsn}, state
+}
+
+type fakeConn struct {
+	state *fakeState
+}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeStmt{conn: c, query: query}, nil
+}
+
+func (c *fakeConn) Close() error { return nil }
+
+func (c *fakeConn) Ping(context.Context) error {
+	c.state.mu.Lock()
+	defer c.state.mu.Unlock()
+	c.state.pings++
+	return nil
+}
+
+func (c *fakeConn) Begin() (driver.Tx, error) { return fakeTx{state: c.state}, nil }
+
+func (c *fakeConn) BeginTx(context.Context, driver.TxOptions) (driver.Tx, error) {
+	return fakeTx{state: c.state}, nil
+}
+
+func (c *fakeConn) ExecContext(_ context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	c.state.mu.Lock()
+	c.state.execs = append(c.state.execs, fakeCall{query: query, args: namedValues(args)})
+	execErr := c.state.execErr
+	affected := c.state.affected
+	c.state.mu.Unlock()
+	if execErr != nil {
+		if err := execErr(query); err != nil {
+			return nil, err
+		}
+	}
+	if affected != nil {
+		return driver.RowsAffected(affected(query)), nil
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func (c *fakeConn) QueryContext(_ context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	vals := namedValues(args)
+	c.state.mu.Lock()
+	c.state.queries = append(c.state.queries, fakeCall{query: query, args: vals})
+	fn := c.state.query
+	c.state.mu.Unlock()
+	if fn == nil {
+		return &fakeRows{}, nil
+	}
+	res, err := fn(query, vals)
+	if err != nil {
+		return nil, err
+	}
+	return &fakeRows{cols: res.cols, rows: res.rows, next: res.next, types: res.types, err: res.err}, nil
+}
+
+// CheckNamedValue accepts any argument, including sql.NamedArg.
+func (c *fakeConn) CheckNamedValue(*driver.NamedValue) error { return nil }
+
+// namedValues unwraps driver args, keeping named ones as sql.NamedArg.
+func namedValues(args []driver.NamedValue) []any {
+	out := make([]any, len(args))
+	for i, a := range args {
+		if a.Name != "" {
+			out[i] = sql.Named(a.Name, a.Value)
+			continue
+		}
+		out[i] = a.Value
+	}
+	return out
+}
+
+// fakeStmt runs its query through the connection each time it is executed.
+type fakeStmt struct {
+	conn  *fakeConn
+	query string
+}
+
+func (s *fakeStmt) Close() error { return nil }
+
+func (s *fakeStmt) NumInput() int { return -1 }
+
+func (s *fakeStmt) Exec([]driver.Value) (driver.Result, error) {
+	return nil, errors.New("fake: use ExecContext")
+}
+
+func (s *fakeStmt) Query([]driver.Value) (driver.Rows, error) {
+	return nil, errors.New("fake: use QueryContext")
+}
+
+func (s *fakeStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	return s.conn.ExecContext(ctx, s.query, args)
+}
+
+func (s *fakeStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	return s.conn.QueryContext(ctx, s.query, args)
+}
+
+type fakeTx struct {
+	state *fakeState
+}
+
+func (t fakeTx) Commit() error {
+	t.state.mu.Lock()
+	defer t.state.mu.Unlock()
+	if t.state.commitErr != nil {
+		return t.state.commitErr
+	}
+	t.state.commits++
+	return nil
+}
+
+func (t fakeTx) Rollback() error {
+	t.state.mu.Lock()
+	defer t.state.mu.Unlock()
+	t.state.rollbacks++
+	return nil
+}
+
+type fakeRows struct {
+	cols  []string
+	rows  [][]driver.Value
+	next  func(row int)
+	types []string
+	err   error
+	pos   int
+}
+
+func (r *fakeRows) Columns() []string { return r.cols }
+
+func (r *fakeRows) Close() error { return nil }
+
+// ColumnTypeDatabaseTypeName reports the configured type name, or "" when none was set.
+func (r *fakeRows) ColumnTypeDatabaseTypeName(i int) string {
+	if i < len(r.types) {
+		return r.types[i]
+	}
+	return ""
+}
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if r.pos >= len(r.rows) {
+		if r.err != nil {
+			return r.err
+		}
+		return io.EOF
+	}
+	if r.next != nil {
+		r.next(r.pos)
+	}
+	copy(dest, r.rows[r.pos])
+	r.pos++
+	return nil
+}
@@ -0,0 +1,736 @@
+package gostry
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mickamy/gostry/internal/buffer"
+	"github.com/mickamy/gostry/internal/canonjson"
+	"github.com/mickamy/gostry/internal/ident"
+)
+
+// FlushErrorFunc receives history records that could not be written to Config.HistoryDB.
+type FlushErrorFunc func(ctx context.Context, err error, records []Record)
+
+// execer is satisfied by *sql.Tx, *sql.DB, and connExecer.
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+// historyRow is a prepared history INSERT along with the record it represents.
+type historyRow struct {
+	record   Record
+	history  []string          // history table identifier parts
+	layout   historyDDLOptions // layout insert was built from
+	promoted []string          // promoted columns written after the layout columns
+	insert   historyInsert
+	stmt     string // insert rendered for this row alone
+	args     []any
+	chain    *chainLink // set when Config.HashChain is enabled
+}
+
+// flush writes buffered entries into their corresponding history tables.
+// Rows go into the business transaction unless Config.HistoryDB is set.
+func (tx *Tx) flush(ctx context.Context) error {
+	rows, err := tx.h.flushBuffer(ctx, tx.buf, tx.Tx, tx.currentUser)
+	tx.recordFlushed(rows)
+	return err
+}
+
+// flushBuffer drains buf and writes its entries to the outbox or the history tables through exec,
+// the business transaction, or to Config.HistoryDB. It is the flush of both Tx and the connector's
+// captureTx, which pass their *sql.Tx or driver connection as exec and a currentUser reading the
+// same transaction. It returns the written rows; after a HistoryDB failure the rows are returned
+// along with the error, since the business transaction has already committed.
+func (h *Handler) flushBuffer(ctx context.Context, buf *buffer.Buffer[entry], exec execer, currentUser func(context.Context) (string, error)) ([]historyRow, error) {
+	entries := buf.Drain()
+	if len(entries) == 0 {
+		return nil, nil
+	}
+	defer buf.Recycle(entries)
+	if h.cfg.CoalesceByRow {
+		entries = h.coalesce(entries)
+	}
+	if h.cfg.SkipNoOpUpdates {
+		entries = dropNoOpUpdates(entries)
+	}
+	if h.cfg.SkipUnwatchedUpdates {
+		entries = h.dropUnwatchedUpdates(entries)
+	}
+
+	rows, err := h.prepareHistoryRows(ctx, entries, currentUser)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case h.cfg.DryRun:
+		for _, r := range rows {
+			h.info(ctx, "gostry: dry run; skipping history insert",
+				slog.String("table", r.record.Table), slog.String("operation", r.record.Operation), slog.Any("id", r.record.ID))
+		}
+	case h.cfg.OutboxMode:
+		if err := h.checkOutboxConfig(); err != nil {
+			return nil, err
+		}
+		if err := writeOutbox(ctx, exec, rows); err != nil {
+			return nil, err
+		}
+	case h.cfg.HistoryDB != nil:
+		if err := writeHistoryDB(ctx, h.cfg.HistoryDB, rows, h.cfg.NotifyChannel, h.writeOptions()); err != nil {
+			if h.cfg.OnFlushError != nil {
+				h.cfg.OnFlushError(ctx, err, historyRecords(rows))
+			}
+			return rows, err
+		}
+	default:
+		if err := writeHistoryRows(ctx, exec, rows, h.writeOptions()); err != nil {
+			return nil, err
+		}
+		if err := notifyHistory(ctx, exec, h.cfg.NotifyChannel, rows); err != nil {
+			return nil, err
+		}
+	}
+
+	if h.cfg.OnFlush != nil && len(rows) > 0 {
+		h.cfg.OnFlush(ctx, historyRecords(rows))
+	}
+	return rows, nil
+}
+
+// historyRecords returns the records of rows, nil when there are none.
+func historyRecords(rows []historyRow) []Record {
+	if len(rows) == 0 {
+		return nil
+	}
+	records := make([]Record, len(rows))
+	for i, r := range rows {
+		records[i] = r.record
+	}
+	return records
+}
+
+// recordFlushed keeps the records of the flushed rows for Config.AfterCommit and their history ids
+// for LastHistoryIDs.
+func (tx *Tx) recordFlushed(rows []historyRow) {
+	if tx.h.cfg.ReturnHistoryIDs {
+		for _, r := range rows {
+			tx.historyIDs = append(tx.historyIDs, r.record.HistoryID)
+		}
+	}
+	if tx.h.cfg.AfterCommit != nil {
+		tx.flushed = append(tx.flushed, historyRecords(rows)...)
+	}
+}
+
+// LastHistoryIDs returns the history_id of every row written by the transaction's flushes so far,
+// in write order, so callers can reference audit rows (e.g. from an outbox). It requires
+// Config.ReturnHistoryIDs; rows guarded by SkipIfNotExists and dry-run rows report 0.
+func (tx *Tx) LastHistoryIDs() []int64 {
+	return append([]int64(nil), tx.historyIDs...)
+}
+
+// currentUser reads current_user on the business transaction, once per transaction.
+func (tx *Tx) currentUser(ctx context.Context) (string, error) {
+	if tx.dbUser != "" {
+		return tx.dbUser, nil
+	}
+	if err := tx.Tx.QueryRowContext(ctx, `SELECT current_user`).Scan(&tx.dbUser); err != nil {
+		return "", fmt.Errorf("gostry: failed to read current_user: %w", err)
+	}
+	return tx.dbUser, nil
+}
+
+// prepareHistoryRows redacts the entries and renders their history INSERT statements. currentUser
+// reads current_user on the business transaction; it is called at most once, and only when db_user
+// is bound rather than evaluated by the history INSERT.
+func (h *Handler) prepareHistoryRows(ctx context.Context, entries []entry, currentUser func(context.Context) (string, error)) ([]historyRow, error) {
+	if h.cfgErr != nil {
+		return nil, h.cfgErr
+	}
+	if h.cfg.HistoryIDGenerator != nil && h.cfg.ReturnHistoryIDs {
+		return nil, errors.New("gostry: ReturnHistoryIDs cannot be combined with HistoryIDGenerator")
+	}
+	rows := make([]historyRow, 0, len(entries))
+	var dbUser any
+	for _, e := range entries {
+		if !h.allowsOp(e.op) {
+			return nil, &InvalidOperationError{Table: e.table, Operation: e.op}
+		}
+		keyBefore, keyAfter := h.images(e)
+		id := h.pickID(ctx, e.table, keyBefore, keyAfter)
+		before, after := h.withholdImages(e.table, keyBefore, keyAfter)
+		row := historyRow{record: e.record(id, before, after)}
+		if h.cfg.DryRun {
+			rows = append(rows, row)
+			continue
+		}
+
+		var beforeImage, afterImage []byte
+		if !h.metadataOnly(e.table) {
+			var err error
+			if beforeImage, err = h.encodeImage(before); err != nil {
+				return nil, withKind(ErrMarshal, fmt.Errorf("gostry: failed to marshal before: %w", err))
+			}
+			if afterImage, err = h.encodeImage(after); err != nil {
+				return nil, withKind(ErrMarshal, fmt.Errorf("gostry: failed to marshal after: %w", err))
+			}
+		}
+
+		historyParts := e.history
+		if historyParts == nil {
+			historyParts = h.HistoryTableIdentifier(e.table)
+		}
+		historyIdent := ident.QuoteQualified(historyParts)
+		if historyIdent == "" {
+			return nil, &InvalidIdentifierError{Table: e.table}
+		}
+		opts := h.historyLayoutOptions(e.table)
+		vals := historyValues{
+			id:        id,
+			operation: e.op,
+			operator:  e.meta.operator,
+			traceID:   e.meta.traceID,
+			reason:    e.meta.reason,
+			before:    imageArg(beforeImage),
+			after:     imageArg(afterImage),
+		}
+		promotedNames, promotedArgs := promotedValues(h.cfg.Promoted.lookup(e.table), before, after)
+		vals.promoted = promotedArgs
+		if opts.composite {
+			keyCols, _ := lookupTable(h.cfg.CompositeKey, e.table)
+			compositeJSON, err := h.compositeID(ctx, e.table, keyCols, keyBefore, keyAfter)
+			if err != nil {
+				return nil, err
+			}
+			vals.compositeID = compositeJSON
+		}
+		if opts.bindOperatedAt {
+			// The rows are inserted later by DrainOutbox; keep the time of the change, not of the drain.
+			vals.operatedAt = time.Now()
+		}
+		if opts.schemaVersion {
+			vals.schemaVersion = int64(h.cfg.SchemaVersion)
+		}
+		if opts.dbUser && opts.bindDBUser {
+			if dbUser == nil {
+				user, err := currentUser(ctx)
+				if err != nil {
+					return nil, err
+				}
+				dbUser = user
+			}
+			vals.dbUser = dbUser
+		}
+		if opts.txLabel && e.meta.txLabel != "" {
+			vals.txLabel = e.meta.txLabel
+		}
+		if opts.bindHistoryID {
+			vals.historyID = h.cfg.HistoryIDGenerator()
+		}
+		if opts.statement {
+			vals.statementText = h.statementText(e.sql)
+			vals.argCount = int64(len(e.args))
+			if e.summary && e.rowsAffected >= 0 {
+				vals.rowsAffected = e.rowsAffected
+			}
+		}
+		if opts.compress {
+			beforePlain, beforeGzip, err := compressImage(beforeImage, h.cfg.CompressThreshold)
+			if err != nil {
+				return nil, withKind(ErrMarshal, fmt.Errorf("gostry: failed to compress before: %w", err))
+			}
+			afterPlain, afterGzip, err := compressImage(afterImage, h.cfg.CompressThreshold)
+			if err != nil {
+				return nil, withKind(ErrMarshal, fmt.Errorf("gostry: failed to compress after: %w", err))
+			}
+			vals.before, vals.after = imageArg(beforePlain), imageArg(afterPlain)
+			vals.beforeGzip, vals.afterGzip = imageArg(beforeGzip), imageArg(afterGzip)
+		}
+		row.history, row.layout, row.promoted = historyParts, opts, promotedNames
+		row.insert = newHistoryInsert(historyParts, defaultHistoryColumns, opts, promotedNames, h.cfg.SkipIfNotExists)
+		if h.cfg.ReturnHistoryIDs {
+			row.insert.returning = ident.Quote(defaultHistoryColumns.historyID)
+		}
+		row.stmt = row.insert.statement()
+		row.args = historyArgs(opts, &vals)
+		if opts.hashChain {
+			beforeJSON, err := imageJSON(h.cfg.Encoding, beforeImage)
+			if err != nil {
+				return nil, err
+			}
+			afterJSON, err := imageJSON(h.cfg.Encoding, afterImage)
+			if err != nil {
+				return nil, err
+			}
+			row.chain = &chainLink{
+				historyParts: historyParts,
+				operation:    e.op,
+				id:           id,
+				before:       beforeJSON,
+				after:        afterJSON,
+				argIndex:     row.insert.paramIndex(defaultHistoryColumns.prevHash),
+			}
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// dropNoOpUpdates removes UPDATE entries whose before and after images are equal (Config.SkipNoOpUpdates,
+// which needs the before-images of Config.CaptureBefore). Images are compared
+// by their JSON encoding, so numeric values that differ only in Go type (int64 vs float64) compare equal.
+// Entries without both images are kept.
+func dropNoOpUpdates(entries []entry) []entry {
+	kept := make([]entry, 0, len(entries))
+	for _, e := range entries {
+		if e.op == "UPDATE" && e.before != nil && e.after != nil && sameImage(e.before, e.after) {
+			continue
+		}
+		kept = append(kept, e)
+	}
+	return kept
+}
+
+// sameImage reports whether two row images encode to the same JSON document.
+func sameImage(a, b map[string]any) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	ja, err := json.Marshal(a)
+	if err != nil {
+		return false
+	}
+	jb, err := json.Marshal(b)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(ja, jb)
+}
+
+// encodeImage encodes a row image for storage according to cfg.Encoding.
+func (h *Handler) encodeImage(v map[string]any) ([]byte, error) {
+	if h.cfg.Encoding == "" || h.cfg.Encoding == EncodingJSON {
+		return h.marshalJSON(v)
+	}
+	enc, err := encoderFor(h.cfg.Encoding)
+	if err != nil {
+		return nil, err
+	}
+	return enc.encode(v)
+}
+
+// imageArg binds an encoded image, passing a missing (nil) image as SQL NULL.
+func imageArg(b []byte) any {
+	if b == nil {
+		return nil
+	}
+	return b
+}
+
+// marshalJSON encodes a row image with cfg.JSONMarshaler, falling back to encoding/json.
+// The output always has object keys sorted at every nesting level; encoding/json already sorts
+// map keys, so only custom marshaler output is canonicalized.
+func (h *Handler) marshalJSON(v map[string]any) ([]byte, error) {
+	if h.cfg.JSONMarshaler == nil {
+		return json.Marshal(v)
+	}
+	b, err := h.cfg.JSONMarshaler(v)
+	if err != nil {
+		return nil, err
+	}
+	return canonjson.Canonicalize(b)
+}
+
+// historyWriteOptions selects how writeHistoryRows batches the history rows of a flush.
+type historyWriteOptions struct {
+	bulkThreshold  int // Config.BulkInsertThreshold
+	stageThreshold int // Config.StageThreshold
+}
+
+// writeOptions returns the batching configured for the handler's flushes.
+func (h *Handler) writeOptions() historyWriteOptions {
+	return historyWriteOptions{bulkThreshold: h.cfg.BulkInsertThreshold, stageThreshold: h.cfg.StageThreshold}
+}
+
+// writeHistoryRows executes the prepared INSERTs, stopping as soon as ctx is canceled.
+// Hash-chained rows are linked to their table's chain first. When opts.stageThreshold > 0 and there
+// are at least that many rows, long runs of rows sharing an INSERT go through a temporary table (see
+// writeHistoryRowsStaged). Otherwise, when opts.bulkThreshold > 0 and there are at least that many rows,
+// consecutive rows sharing an INSERT are written with multi-row INSERTs; else each row is inserted on
+// its own.
+func writeHistoryRows(ctx context.Context, exec execer, rows []historyRow, opts historyWriteOptions) error {
+	if err := chainHistoryRows(ctx, exec, rows); err != nil {
+		return err
+	}
+	if opts.stageThreshold > 0 && len(rows) >= opts.stageThreshold {
+		return writeHistoryRowsStaged(ctx, exec, rows, opts.stageThreshold)
+	}
+	if opts.bulkThreshold > 0 && len(rows) >= opts.bulkThreshold {
+		return writeHistoryRowsBulk(ctx, exec, rows)
+	}
+	for i, r := range rows {
+		if err := insertHistory(ctx, exec, r.stmt, r.args, rows[i:i+1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeHistoryRowsStaged writes every run of at least threshold consecutive rows sharing an INSERT
+// through stageTable: a temporary table dropped on commit is created with the types of the bound
+// columns, loaded with multi-row INSERTs, and moved into the history table with a single
+// INSERT ... SELECT ordered like the rows, so history_id is assigned in row order. Shorter runs, and
+// rows writeHistoryRowsBulk writes one by one, are passed to writeHistoryRowsBulk.
+func writeHistoryRowsStaged(ctx context.Context, exec execer, rows []historyRow, threshold int) error {
+	for start := 0; start < len(rows); {
+		r := rows[start]
+		end := start + 1
+		for end < len(rows) && rows[end].stmt == r.stmt {
+			end++
+		}
+		if end-start < threshold || r.insert.regclass != "" || r.insert.returning != "" || len(r.args) == 0 {
+			if err := writeHistoryRowsBulk(ctx, exec, rows[start:end]); err != nil {
+				return err
+			}
+			start = end
+			continue
+		}
+		if err := stageHistoryRows(ctx, exec, rows[start:end]); err != nil {
+			return err
+		}
+		start = end
+	}
+	return nil
+}
+
+// stageHistoryRows moves rows, which share one INSERT, into their history table through stageTable.
+func stageHistoryRows(ctx context.Context, exec execer, rows []historyRow) error {
+	hi := rows[0].insert
+	if _, err := exec.ExecContext(ctx, hi.stageCreate()); err != nil {
+		return historyTableError(fmt.Errorf("gostry: failed to create history stage table: %w", err))
+	}
+	argsPerRow := len(rows[0].args) + 1
+	for start := 0; start < len(rows); {
+		end := start + maxBindParams/argsPerRow
+		if end > len(rows) {
+			end = len(rows)
+		}
+		args := make([]any, 0, (end-start)*argsPerRow)
+		for i, row := range rows[start:end] {
+			args = append(args, int64(start+i))
+			args = append(args, row.args...)
+		}
+		if err := insertHistory(ctx, exec, hi.stageLoad(end-start), args, rows[start:end]); err != nil {
+			return err
+		}
+		start = end
+	}
+	if err := insertHistory(ctx, exec, hi.stageMove(), nil, rows); err != nil {
+		return err
+	}
+	if _, err := exec.ExecContext(ctx, `DROP TABLE `+ident.Quote(stageTable)); err != nil {
+		return fmt.Errorf("gostry: failed to drop history stage table: %w", err)
+	}
+	return nil
+}
+
+// writeHistoryRowsBulk groups consecutive rows with the same INSERT and writes each group with as few
+// multi-row INSERTs as PostgreSQL's bind parameter limit allows, preserving the row order. Rows guarded
+// by SkipIfNotExists are written one by one, since their DO block cannot take parameters for many rows,
+// and so are rows returning history_id, since PostgreSQL does not order RETURNING by the VALUES list.
+func writeHistoryRowsBulk(ctx context.Context, exec execer, rows []historyRow) error {
+	for start := 0; start < len(rows); {
+		r := rows[start]
+		argsPerRow := len(r.args)
+		if r.insert.regclass != "" || r.insert.returning != "" || argsPerRow == 0 {
+			if err := insertHistory(ctx, exec, r.stmt, r.args, rows[start:start+1]); err != nil {
+				return err
+			}
+			start++
+			continue
+		}
+		end := start + 1
+		limit := start + maxBindParams/argsPerRow
+		for end < len(rows) && end < limit && rows[end].stmt == r.stmt {
+			end++
+		}
+		if end-start == 1 {
+			if err := insertHistory(ctx, exec, r.stmt, r.args, rows[start:end]); err != nil {
+				return err
+			}
+			start = end
+			continue
+		}
+		args := make([]any, 0, (end-start)*argsPerRow)
+		for _, row := range rows[start:end] {
+			args = append(args, row.args...)
+		}
+		if err := insertHistory(ctx, exec, r.insert.batchStatement(end-start, argsPerRow), args, rows[start:end]); err != nil {
+			return err
+		}
+		start = end
+	}
+	return nil
+}
+
+// maxBindParams is the number of bind parameters PostgreSQL accepts in a single statement.
+const maxBindParams = 65535
+
+// insertHistory executes one history INSERT writing dest unless ctx has been canceled. When the INSERT
+// returns history_id (Config.ReturnHistoryIDs), the ids are stored on the records of dest in order.
+func insertHistory(ctx context.Context, exec execer, stmt string, args []any, dest []historyRow) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+	}
+	if dest[0].insert.returning == "" || dest[0].insert.regclass != "" {
+		if _, err := exec.ExecContext(ctx, stmt, args...); err != nil {
+			return historyTableError(fmt.Errorf("gostry: failed to insert history table: %w", err))
+		}
+		return nil
+	}
+	q, ok := exec.(historyTx)
+	if !ok {
+		return errors.New("gostry: ReturnHistoryIDs requires a database/sql transaction")
+	}
+	rows, err := q.QueryContext(ctx, stmt, args...)
+	if err != nil {
+		return historyTableError(fmt.Errorf("gostry: failed to insert history table: %w", err))
+	}
+	defer func() { _ = rows.Close() }()
+	n := 0
+	for rows.Next() {
+		if n == len(dest) {
+			return fmt.Errorf("gostry: history insert returned more than %d ids", len(dest))
+		}
+		if err := rows.Scan(&dest[n].record.HistoryID); err != nil {
+			return withKind(ErrScan, fmt.Errorf("gostry: failed to scan history_id: %w", err))
+		}
+		n++
+	}
+	if err := rows.Err(); err != nil {
+		return historyTableError(fmt.Errorf("gostry: failed to insert history table: %w", err))
+	}
+	if n != len(dest) {
+		return fmt.Errorf("gostry: history insert returned %d ids, want %d", n, len(dest))
+	}
+	return nil
+}
+
+// notifyPayload is the JSON payload sent on Config.NotifyChannel for each history row.
+type notifyPayload struct {
+	Table     string `json:"table"`
+	Operation string `json:"op"`
+	ID        any    `json:"id"`
+}
+
+// notifyHistory issues one pg_notify per written row on channel, inside the same transaction as
+// the history INSERTs so PostgreSQL delivers the notifications only when it commits. The payload is
+// {"table":...,"op":...,"id":...}; PostgreSQL rejects payloads of 8000 bytes or more.
+// It does nothing when channel is empty.
+func notifyHistory(ctx context.Context, exec execer, channel string, rows []historyRow) error {
+	if channel == "" {
+		return nil
+	}
+	for _, r := range rows {
+		payload, err := json.Marshal(notifyPayload{Table: r.record.Table, Operation: r.record.Operation, ID: r.record.ID})
+		if err != nil {
+			return withKind(ErrMarshal, fmt.Errorf("gostry: failed to marshal notification: %w", err))
+		}
+		if _, err := exec.ExecContext(ctx, `SELECT pg_notify($1, $2)`, channel, string(payload)); err != nil {
+			return fmt.Errorf("gostry: failed to notify %s: %w", channel, err)
+		}
+	}
+	return nil
+}
+
+// writeHistoryDB writes the prepared rows (and their notifications on channel, if any) to a
+// separate database in their own transaction.
+func writeHistoryDB(ctx context.Context, db *sql.DB, rows []historyRow, channel string, opts historyWriteOptions) error {
+	htx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("gostry: failed to begin history transaction: %w", err)
+	}
+	if err := writeHistoryRows(ctx, htx, rows, opts); err != nil {
+		_ = htx.Rollback()
+		return err
+	}
+	if err := notifyHistory(ctx, htx, channel, rows); err != nil {
+		_ = htx.Rollback()
+		return err
+	}
+	if err := htx.Commit(); err != nil {
+		return fmt.Errorf("gostry: failed to commit history transaction: %w", err)
+	}
+	return nil
+}
+
+// historyInsert is the INSERT writing a history row, kept in parts so rows sharing it can be
+// combined into one multi-row statement.
+type historyInsert struct {
+	ident     string   // quoted history table
+	regclass  string   // to_regclass literal guarding the INSERT when SkipIfNotExists is set
+	returning string   // quoted history_id column returned by the INSERT (Config.ReturnHistoryIDs), or ""
+	columns   []string // quoted column names
+	values    []string // $n placeholders and expressions, one per column
+	params    []string // unquoted names of the columns bound to $1, $2, ... in order
+}
+
+// newHistoryInsert assembles the INSERT of a history table laid out by opts: the columns of
+// historyLayout that flush writes, in layout order, followed by the promoted columns present in
+// the row. Bound columns take $1 onward in that order, matching historyArgs.
+func newHistoryInsert(historyParts []string, cols historyColumns, opts historyDDLOptions, promoted []string, skipIfNotExists bool) historyInsert {
+	hi := historyInsert{ident: ident.QuoteQualified(historyParts)}
+	bind := func(name string) {
+		hi.params = append(hi.params, name)
+		hi.columns = append(hi.columns, ident.Quote(name))
+		hi.values = append(hi.values, fmt.Sprintf("$%d", len(hi.params)))
+	}
+	for _, c := range historyLayoutColumns(opts) {
+		switch mode := c.writeMode(opts); mode {
+		case "":
+		case bindParam:
+			bind(c.name(cols))
+		default:
+			hi.columns = append(hi.columns, ident.Quote(c.name(cols)))
+			hi.values = append(hi.values, mode)
+		}
+	}
+	for _, name := range promoted {
+		bind(name)
+	}
+	if skipIfNotExists {
+		hi.regclass = ident.QualifiedRegclassLiteral(historyParts)
+	}
+	return hi
+}
+
+// paramIndex returns the argument index bound to column name, or -1 when the INSERT does not bind it.
+func (hi historyInsert) paramIndex(name string) int {
+	for i, p := range hi.params {
+		if p == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// statement renders the INSERT for a single row.
+func (hi historyInsert) statement() string {
+	if hi.regclass != "" {
+		return fmt.Sprintf(`
+DO $$
+BEGIN
+    IF to_regclass(%s) IS NOT NULL THEN
+        INSERT INTO %s (%s)
+        VALUES (%s);
+    END IF;
+END $$;
+`, hi.regclass, hi.ident, strings.Join(hi.columns, ", "), strings.Join(hi.values, ", "))
+	}
+	return fmt.Sprintf(`
+INSERT INTO %s (%s)
+VALUES (%s)
+%s`, hi.ident, strings.Join(hi.columns, ", "), strings.Join(hi.values, ", "), hi.returningClause())
+}
+
+// returningClause renders the RETURNING clause of the INSERT, or "" when nothing is returned.
+func (hi historyInsert) returningClause() string {
+	if hi.returning == "" {
+		return ""
+	}
+	return "RETURNING " + hi.returning + "\n"
+}
+
+// batchStatement renders the INSERT for n rows whose arguments are bound one row after another,
+// argsPerRow at a time, by shifting the placeholders of each following row.
+func (hi historyInsert) batchStatement(n, argsPerRow int) string {
+	tuples := make([]string, n)
+	values := make([]string, len(hi.values))
+	for r := range tuples {
+		for i, v := range hi.values {
+			values[i] = v
+			if !strings.HasPrefix(v, "$") {
+				continue
+			}
+			if p, err := strconv.Atoi(v[1:]); err == nil {
+				values[i] = "$" + strconv.Itoa(p+r*argsPerRow)
+			}
+		}
+		tuples[r] = "(" + strings.Join(values, ", ") + ")"
+	}
+	return fmt.Sprintf(`
+INSERT INTO %s (%s)
+VALUES %s
+%s`, hi.ident, strings.Join(hi.columns, ", "), strings.Join(tuples, ",\n       "), hi.returningClause())
+}
+
+// stageTable and stageOrdinal name the temporary table used by stageHistoryRows and its column
+// keeping the order of the staged rows.
+const (
+	stageTable   = "gostry_history_stage"
+	stageOrdinal = "gostry_ord"
+)
+
+// stageCreate renders the CREATE TEMP TABLE holding the bound columns of hi, typed like the history
+// table, plus stageOrdinal.
+func (hi historyInsert) stageCreate() string {
+	cols := make([]string, 0, len(hi.params)+1)
+	cols = append(cols, "0::bigint AS "+ident.Quote(stageOrdinal))
+	for _, p := range hi.params {
+		cols = append(cols, ident.Quote(p))
+	}
+	return fmt.Sprintf(`CREATE TEMP TABLE %s ON COMMIT DROP AS SELECT %s FROM %s WITH NO DATA`,
+		ident.Quote(stageTable), strings.Join(cols, ", "), hi.ident)
+}
+
+// stageLoad renders the INSERT of n rows into the stage table; each row binds its ordinal followed by
+// the arguments of hi.
+func (hi historyInsert) stageLoad(n int) string {
+	cols := make([]string, 0, len(hi.params)+1)
+	cols = append(cols, ident.Quote(stageOrdinal))
+	for _, p := range hi.params {
+		cols = append(cols, ident.Quote(p))
+	}
+	tuples := make([]string, n)
+	values := make([]string, len(cols))
+	for r := range tuples {
+		for i := range values {
+			values[i] = "$" + strconv.Itoa(r*len(cols)+i+1)
+		}
+		tuples[r] = "(" + strings.Join(values, ", ") + ")"
+	}
+	return fmt.Sprintf(`
+INSERT INTO %s (%s)
+VALUES %s
+`, ident.Quote(stageTable), strings.Join(cols, ", "), strings.Join(tuples, ",\n       "))
+}
+
+// stageMove renders the INSERT ... SELECT moving the staged rows into the history table in ordinal
+// order; bound values are read from the stage columns and expressions such as now() are kept.
+func (hi historyInsert) stageMove() string {
+	values := make([]string, len(hi.values))
+	for i, v := range hi.values {
+		values[i] = v
+		if !strings.HasPrefix(v, "$") {
+			continue
+		}
+		if p, err := strconv.Atoi(v[1:]); err == nil && p >= 1 && p <= len(hi.params) {
+			values[i] = ident.Quote(hi.params[p-1])
+		}
+	}
+	return fmt.Sprintf(`
+INSERT INTO %s (%s)
+SELECT %s FROM %s ORDER BY %s
+`, hi.ident, strings.Join(hi.columns, ", "), strings.Join(values, ", "), ident.Quote(stageTable), ident.Quote(stageOrdinal))
+}
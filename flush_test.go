@@ -0,0 +1,890 @@
+package gostry
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTx_HistoryDB(t *testing.T) {
+	t.Parallel()
+
+	returning := func(string, []any) (fakeResult, error) {
+		return fakeResult{cols: []string{"id"}, rows: [][]driver.Value{{int64(1)}}}, nil
+	}
+
+	t.Run("rows land in history db", func(t *testing.T) {
+		t.Parallel()
+		db, business := openFakeDB(t, returning)
+		historyDB, history := openFakeDB(t, nil)
+
+		ctx := context.Background()
+		tx, err := New(Config{HistoryDB: historyDB}).Wrap(db).BeginTx(ctx, nil)
+		if err != nil {
+			t.Fatalf("BeginTx() error = %v", err)
+		}
+		if _, err := tx.ExecContext(ctx, `UPDATE orders SET status = 'paid' WHERE id = 1 RETURNING *`); err != nil {
+			t.Fatalf("ExecContext() error = %v", err)
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatalf("Commit() error = %v", err)
+		}
+
+		if got := len(business.Execs()); got != 0 {
+			t.Fatalf("business history inserts = %d, want 0", got)
+		}
+		if got := len(history.Execs()); got != 1 {
+			t.Fatalf("history db inserts = %d, want 1", got)
+		}
+		if commits, _ := business.Outcome(); commits != 1 {
+			t.Fatalf("business commits = %d, want 1", commits)
+		}
+		if commits, _ := history.Outcome(); commits != 1 {
+			t.Fatalf("history db commits = %d, want 1", commits)
+		}
+	})
+
+	t.Run("rollback writes nothing", func(t *testing.T) {
+		t.Parallel()
+		db, _ := openFakeDB(t, returning)
+		historyDB, history := openFakeDB(t, nil)
+
+		ctx := context.Background()
+		tx, err := New(Config{HistoryDB: historyDB}).Wrap(db).BeginTx(ctx, nil)
+		if err != nil {
+			t.Fatalf("BeginTx() error = %v", err)
+		}
+		if _, err := tx.ExecContext(ctx, `UPDATE orders SET status = 'paid' WHERE id = 1 RETURNING *`); err != nil {
+			t.Fatalf("ExecContext() error = %v", err)
+		}
+		if err := tx.Rollback(); err != nil {
+			t.Fatalf("Rollback() error = %v", err)
+		}
+		if got := len(history.Execs()); got != 0 {
+			t.Fatalf("history db inserts = %d, want 0", got)
+		}
+	})
+
+	t.Run("write failure reported to OnFlushError", func(t *testing.T) {
+		t.Parallel()
+		db, business := openFakeDB(t, returning)
+		historyDB, history := openFakeDB(t, nil)
+		history.execErr = func(string) error { return errors.New("history unavailable") }
+
+		var failed []Record
+		var flushErr error
+		h := New(Config{
+			HistoryDB: historyDB,
+			OnFlushError: func(_ context.Context, err error, records []Record) {
+				flushErr = err
+				failed = records
+			},
+		})
+
+		ctx := context.Background()
+		tx, err := h.Wrap(db).BeginTx(ctx, nil)
+		if err != nil {
+			t.Fatalf("BeginTx() error = %v", err)
+		}
+		if _, err := tx.ExecContext(ctx, `UPDATE orders SET status = 'paid' WHERE id = 1 RETURNING *`); err != nil {
+			t.Fatalf("ExecContext() error = %v", err)
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatalf("Commit() error = %v, want nil (best-effort)", err)
+		}
+		if commits, _ := business.Outcome(); commits != 1 {
+			t.Fatalf("business commits = %d, want 1", commits)
+		}
+		if flushErr == nil || len(failed) != 1 || failed[0].ID != int64(1) {
+			t.Fatalf("OnFlushError got err=%v records=%#v", flushErr, failed)
+		}
+		if _, rollbacks := history.Outcome(); rollbacks != 1 {
+			t.Fatalf("history db rollbacks = %d, want 1", rollbacks)
+		}
+	})
+}
+
+func TestTx_DBUserFromBusinessTx(t *testing.T) {
+	t.Parallel()
+
+	tcs := []struct {
+		name   string
+		outbox bool
+	}{
+		{name: "outbox mode", outbox: true},
+		{name: "history db"},
+	}
+
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			db, business := openFakeDB(t, func(q string, _ []any) (fakeResult, error) {
+				if strings.Contains(q, "current_user") {
+					return fakeResult{cols: []string{"current_user"}, rows: [][]driver.Value{{"app"}}}, nil
+				}
+				return fakeResult{cols: []string{"id"}, rows: [][]driver.Value{{int64(1)}, {int64(2)}}}, nil
+			})
+			historyDB, history := openFakeDB(t, nil)
+			cfg := Config{RecordDBUser: true, HistoryDB: historyDB}
+			if tc.outbox {
+				cfg = Config{RecordDBUser: true, OutboxMode: true}
+			}
+
+			ctx := context.Background()
+			tx, err := New(cfg).Wrap(db).BeginTx(ctx, nil)
+			if err != nil {
+				t.Fatalf("BeginTx() error = %v", err)
+			}
+			if _, err := tx.ExecContext(ctx, `DELETE FROM orders RETURNING id`); err != nil {
+				t.Fatalf("ExecContext() error = %v", err)
+			}
+			if err := tx.Commit(); err != nil {
+				t.Fatalf("Commit() error = %v", err)
+			}
+
+			reads := 0
+			for _, call := range business.Queries() {
+				if strings.Contains(call.query, "current_user") {
+					reads++
+				}
+			}
+			if reads != 1 {
+				t.Fatalf("current_user reads on the business tx = %d, want 1", reads)
+			}
+
+			type written struct {
+				stmt string
+				args []any
+			}
+			var rows []written
+			if tc.outbox {
+				execs := business.Execs()
+				outbox, err := decodeOutbox(execs[len(execs)-1].args[0].([]byte))
+				if err != nil {
+					t.Fatalf("decodeOutbox() error = %v", err)
+				}
+				for _, r := range outbox {
+					row, err := r.historyRow(Config{})
+					if err != nil {
+						t.Fatalf("historyRow() error = %v", err)
+					}
+					rows = append(rows, written{stmt: row.stmt, args: row.args})
+				}
+			} else {
+				for _, call := range history.Execs() {
+					rows = append(rows, written{stmt: call.query, args: call.args})
+				}
+			}
+			if len(rows) != 2 {
+				t.Fatalf("history rows = %d, want 2", len(rows))
+			}
+			for i, r := range rows {
+				if !strings.Contains(r.stmt, `"db_user"`) || strings.Contains(r.stmt, "current_user") {
+					t.Fatalf("rows[%d] = %s, want db_user bound instead of current_user", i, r.stmt)
+				}
+				if got := r.args[len(r.args)-1]; got != "app" {
+					t.Fatalf("rows[%d] db_user = %v, want app", i, got)
+				}
+			}
+		})
+	}
+}
+
+func TestTx_FlushCanceled(t *testing.T) {
+	t.Parallel()
+
+	db, state := openFakeDB(t, func(string, []any) (fakeResult, error) {
+		return fakeResult{cols: []string{"id"}, rows: [][]driver.Value{{int64(1)}, {int64(2)}, {int64(3)}}}, nil
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// Cancel while the first history row is being written.
+	state.execErr = func(string) error {
+		cancel()
+		return nil
+	}
+
+	tx, err := New(Config{}).Wrap(db).BeginTx(context.Background(), nil)
+	if err != nil {
+		t.Fatalf("BeginTx() error = %v", err)
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM orders RETURNING *`); err != nil {
+		t.Fatalf("ExecContext() error = %v", err)
+	}
+	if err := tx.CommitContext(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("CommitContext() error = %v, want context.Canceled", err)
+	}
+	if got := len(state.Execs()); got != 1 {
+		t.Fatalf("history inserts = %d, want 1 (stopped after cancellation)", got)
+	}
+	if commits, _ := state.Outcome(); commits != 0 {
+		t.Fatalf("commits = %d, want 0", commits)
+	}
+}
+
+func TestTx_JSONMarshaler(t *testing.T) {
+	t.Parallel()
+
+	dropNulls := func(v any) ([]byte, error) {
+		m, _ := v.(map[string]any)
+		if m == nil {
+			return json.Marshal(v)
+		}
+		out := make(map[string]any, len(m))
+		for k, val := range m {
+			if val != nil {
+				out[k] = val
+			}
+		}
+		return json.Marshal(out)
+	}
+
+	db, state := openFakeDB(t, func(string, []any) (fakeResult, error) {
+		return fakeResult{cols: []string{"id", "status", "note"}, rows: [][]driver.Value{{int64(1), "paid", nil}}}, nil
+	})
+	ctx := context.Background()
+	tx, err := New(Config{JSONMarshaler: dropNulls}).Wrap(db).BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatalf("BeginTx() error = %v", err)
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE orders SET status = 'paid', note = NULL WHERE id = 1 RETURNING *`); err != nil {
+		t.Fatalf("ExecContext() error = %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Commit() error = %v", err)
+	}
+
+	execs := state.Execs()
+	if len(execs) != 1 {
+		t.Fatalf("history inserts = %d, want 1", len(execs))
+	}
+	if got, want := string(execs[0].args[5].([]byte)), "null"; got != want {
+		t.Fatalf("history before = %s, want %s", got, want)
+	}
+	if got, want := string(execs[0].args[6].([]byte)), `{"id":1,"status":"paid"}`; got != want {
+		t.Fatalf("history after = %s, want %s", got, want)
+	}
+}
+
+func TestHandler_MarshalJSONSortsKeys(t *testing.T) {
+	t.Parallel()
+
+	// A marshaler that writes keys in reverse order, as a streaming encoder might.
+	reversed := func(any) ([]byte, error) {
+		return []byte(`{"z":{"b":[{"y":1,"x":2}],"a":true},"id":1}`), nil
+	}
+	h := New(Config{JSONMarshaler: reversed})
+	got, err := h.marshalJSON(map[string]any{})
+	if err != nil {
+		t.Fatalf("marshalJSON() error = %v", err)
+	}
+	if want := `{"id":1,"z":{"a":true,"b":[{"x":2,"y":1}]}}`; string(got) != want {
+		t.Fatalf("marshalJSON() = %s, want %s", got, want)
+	}
+}
+
+func TestTx_MaxValueBytes(t *testing.T) {
+	t.Parallel()
+
+	big := strings.Repeat("x", 64)
+	db, state := openFakeDB(t, func(string, []any) (fakeResult, error) {
+		return fakeResult{cols: []string{"id", "note", "body"}, rows: [][]driver.Value{{int64(1), "short", big}}}, nil
+	})
+	ctx := context.Background()
+	tx, err := New(Config{MaxValueBytes: 16}).Wrap(db).BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatalf("BeginTx() error = %v", err)
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE documents SET body = $1 WHERE id = 1 RETURNING *`, big); err != nil {
+		t.Fatalf("ExecContext() error = %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Commit() error = %v", err)
+	}
+
+	execs := state.Execs()
+	if len(execs) != 1 {
+		t.Fatalf("history inserts = %d, want 1", len(execs))
+	}
+	want := `{"body":{"__truncated__":true,"bytes":64},"id":1,"note":"short"}`
+	if got := string(execs[0].args[6].([]byte)); got != want {
+		t.Fatalf("history after = %s, want %s", got, want)
+	}
+}
+
+func TestTx_TransformRow(t *testing.T) {
+	t.Parallel()
+
+	db, state := openFakeDB(t, func(string, []any) (fakeResult, error) {
+		return fakeResult{cols: []string{"id", "price", "qty", "internal_rev"}, rows: [][]driver.Value{{int64(1), int64(250), int64(4), int64(9)}}}, nil
+	})
+	ctx := context.Background()
+	cfg := Config{
+		TransformRow: func(table, op string, before, after map[string]any) (map[string]any, map[string]any) {
+			if table != "order_items" || op != "INSERT" {
+				t.Errorf("TransformRow(%s, %s), want (order_items, INSERT)", table, op)
+			}
+			delete(after, "internal_rev")
+			after["total"] = after["price"].(int64) * after["qty"].(int64)
+			return before, after
+		},
+		Redact: RedactMap{"total": func(string, any) any { return "***" }},
+	}
+	tx, err := New(cfg).Wrap(db).BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatalf("BeginTx() error = %v", err)
+	}
+	if _, err := tx.ExecContext(ctx, `INSERT INTO order_items (price, qty) VALUES (250, 4) RETURNING *`); err != nil {
+		t.Fatalf("ExecContext() error = %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Commit() error = %v", err)
+	}
+
+	execs := state.Execs()
+	if len(execs) != 1 {
+		t.Fatalf("history inserts = %d, want 1", len(execs))
+	}
+	// the computed column is added before redaction, so Redact applies to it
+	want := `{"id":1,"price":250,"qty":4,"total":"***"}`
+	if got := string(execs[0].args[6].([]byte)); got != want {
+		t.Fatalf("history after = %s, want %s", got, want)
+	}
+}
+
+func TestTx_MetadataOnlyTables(t *testing.T) {
+	t.Parallel()
+
+	db, state := openFakeDB(t, func(string, []any) (fakeResult, error) {
+		return fakeResult{cols: []string{"id", "name", "value"}, rows: [][]driver.Value{{int64(7), "api_key", "s3cr3t"}}}, nil
+	})
+	var captured []Record
+	cfg := Config{
+		MetadataOnlyTables: map[string]bool{"secrets": true},
+		Promoted:           PromotedColumns{"secrets": {{Name: "name"}}},
+		OnCapture:          func(_ context.Context, r Record) { captured = append(captured, r) },
+	}
+	ctx := WithOperator(context.Background(), "alice")
+	tx, err := New(cfg).Wrap(db).BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatalf("BeginTx() error = %v", err)
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE secrets SET value = $1 WHERE id = 7 RETURNING *`, "s3cr3t"); err != nil {
+		t.Fatalf("ExecContext() error = %v", err)
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE settings SET value = $1 WHERE id = 7 RETURNING *`, "s3cr3t"); err != nil {
+		t.Fatalf("ExecContext() error = %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Commit() error = %v", err)
+	}
+
+	execs := state.Execs()
+	if len(execs) != 2 {
+		t.Fatalf("history inserts = %d, want 2", len(execs))
+	}
+	secret := execs[0]
+	if secret.args[0] != int64(7) || secret.args[1] != "UPDATE" || secret.args[2] != "alice" {
+		t.Fatalf("history id/op/operator = %v, want 7, UPDATE, alice", secret.args[:3])
+	}
+	if secret.args[5] != nil || secret.args[6] != nil {
+		t.Fatalf("history before/after = %v/%v, want NULL", secret.args[5], secret.args[6])
+	}
+	if len(secret.args) != 7 || strings.Contains(secret.query, `"name"`) {
+		t.Fatalf("history insert = %s %v, want no promoted name column", secret.query, secret.args)
+	}
+	if got := string(execs[1].args[6].([]byte)); !strings.Contains(got, "s3cr3t") {
+		t.Fatalf("settings history after = %s, want the row image", got)
+	}
+	if len(captured) != 2 || captured[0].ID != int64(7) || captured[0].Before != nil || captured[0].After != nil {
+		t.Fatalf("OnCapture records = %+v, want the secrets record with an id and no images", captured)
+	}
+}
+
+func TestTx_NotifyChannel(t *testing.T) {
+	t.Parallel()
+
+	db, state := openFakeDB(t, func(string, []any) (fakeResult, error) {
+		return fakeResult{cols: []string{"id"}, rows: [][]driver.Value{{int64(1)}, {int64(2)}}}, nil
+	})
+	ctx := context.Background()
+	tx, err := New(Config{NotifyChannel: "audit_events"}).Wrap(db).BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatalf("BeginTx() error = %v", err)
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM orders RETURNING *`); err != nil {
+		t.Fatalf("ExecContext() error = %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Commit() error = %v", err)
+	}
+
+	execs := state.Execs()
+	if len(execs) != 4 {
+		t.Fatalf("execs = %d, want 4 (2 inserts + 2 notifications)", len(execs))
+	}
+	for i, want := range []string{`{"table":"orders","op":"DELETE","id":1}`, `{"table":"orders","op":"DELETE","id":2}`} {
+		call := execs[2+i]
+		if call.query != `SELECT pg_notify($1, $2)` {
+			t.Fatalf("exec %d = %s, want pg_notify", 2+i, call.query)
+		}
+		if call.args[0] != "audit_events" || call.args[1] != want {
+			t.Fatalf("pg_notify args = %v, want [audit_events %s]", call.args, want)
+		}
+	}
+}
+
+// captureOrders runs an UPDATE capturing n rows of orders in a transaction of h and commits it.
+func captureOrders(tb testing.TB, h *Handler, n int) []fakeCall {
+	tb.Helper()
+	rows := make([][]driver.Value, n)
+	for i := range rows {
+		rows[i] = []driver.Value{int64(i + 1), "paid"}
+	}
+	db, state := openFakeDB(tb, func(string, []any) (fakeResult, error) {
+		return fakeResult{cols: []string{"id", "status"}, rows: rows}, nil
+	})
+	ctx := context.Background()
+	tx, err := h.Wrap(db).BeginTx(ctx, nil)
+	if err != nil {
+		tb.Fatalf("BeginTx() error = %v", err)
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE orders SET status = 'paid' RETURNING *`); err != nil {
+		tb.Fatalf("ExecContext() error = %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		tb.Fatalf("Commit() error = %v", err)
+	}
+	return state.Execs()
+}
+
+func TestTx_BulkInsertThreshold(t *testing.T) {
+	t.Parallel()
+
+	const n = 50000
+	perRow := captureOrders(t, New(Config{}), n)
+	bulk := captureOrders(t, New(Config{BulkInsertThreshold: 1000}), n)
+
+	if len(perRow) != n {
+		t.Fatalf("per-row inserts = %d, want %d", len(perRow), n)
+	}
+	const argsPerRow = 7
+	perStmt := 65535 / argsPerRow
+	if want := (n + perStmt - 1) / perStmt; len(bulk) != want {
+		t.Fatalf("bulk inserts = %d, want %d", len(bulk), want)
+	}
+
+	var got [][]any
+	for _, call := range bulk {
+		if !strings.HasPrefix(strings.TrimSpace(call.query), `INSERT INTO "orders_history"`) {
+			t.Fatalf("bulk insert = %.80s, want INSERT INTO orders_history", call.query)
+		}
+		if len(call.args)%argsPerRow != 0 {
+			t.Fatalf("bulk insert args = %d, want a multiple of %d", len(call.args), argsPerRow)
+		}
+		for i := 0; i < len(call.args); i += argsPerRow {
+			got = append(got, call.args[i:i+argsPerRow])
+		}
+	}
+	if len(got) != n {
+		t.Fatalf("bulk rows = %d, want %d", len(got), n)
+	}
+	for i, call := range perRow {
+		if !reflect.DeepEqual(got[i], call.args) {
+			t.Fatalf("bulk row %d = %v, want per-row %v", i, got[i], call.args)
+		}
+	}
+}
+
+func TestTx_StageThreshold(t *testing.T) {
+	t.Parallel()
+
+	const n = 50000
+	perRow := captureOrders(t, New(Config{}), n)
+	staged := captureOrders(t, New(Config{StageThreshold: 1000, BulkInsertThreshold: 1000}), n)
+
+	const argsPerRow = 7
+	perStmt := 65535 / (argsPerRow + 1)
+	loads := (n + perStmt - 1) / perStmt
+	if len(staged) != loads+3 {
+		t.Fatalf("staged statements = %d, want create, %d loads, move, and drop", len(staged), loads)
+	}
+	create, move, drop := staged[0].query, staged[len(staged)-2].query, staged[len(staged)-1].query
+	if want := `CREATE TEMP TABLE "gostry_history_stage" ON COMMIT DROP AS SELECT 0::bigint AS "gostry_ord", "id", "operation", "operated_by", "trace_id", "reason", "before", "after" FROM "orders_history" WITH NO DATA`; create != want {
+		t.Fatalf("create = %s, want %s", create, want)
+	}
+	if want := `SELECT "id", "operation", now(), "operated_by", "trace_id", "reason", "before", "after" FROM "gostry_history_stage" ORDER BY "gostry_ord"`; !strings.Contains(move, `INSERT INTO "orders_history"`) || !strings.Contains(move, want) {
+		t.Fatalf("move = %s, want to contain %s", move, want)
+	}
+	if drop != `DROP TABLE "gostry_history_stage"` {
+		t.Fatalf("drop = %s", drop)
+	}
+
+	var got [][]any
+	for _, call := range staged[1 : len(staged)-2] {
+		if !strings.Contains(call.query, `INSERT INTO "gostry_history_stage"`) {
+			t.Fatalf("load = %.80s, want INSERT INTO gostry_history_stage", call.query)
+		}
+		for i := 0; i < len(call.args); i += argsPerRow + 1 {
+			if call.args[i] != int64(len(got)) {
+				t.Fatalf("ordinal = %v, want %d", call.args[i], len(got))
+			}
+			got = append(got, call.args[i+1:i+argsPerRow+1])
+		}
+	}
+	if len(got) != n {
+		t.Fatalf("staged rows = %d, want %d", len(got), n)
+	}
+	for i, call := range perRow {
+		if !reflect.DeepEqual(got[i], call.args) {
+			t.Fatalf("staged row %d = %v, want per-row %v", i, got[i], call.args)
+		}
+	}
+
+	t.Run("smaller flushes use bulk inserts", func(t *testing.T) {
+		t.Parallel()
+		execs := captureOrders(t, New(Config{StageThreshold: 10, BulkInsertThreshold: 1}), 5)
+		if len(execs) != 1 || !strings.Contains(execs[0].query, `INSERT INTO "orders_history"`) || len(execs[0].args) != 5*argsPerRow {
+			t.Fatalf("execs = %v, want one multi-row history insert", execs)
+		}
+	})
+}
+
+func TestHistoryInsert_BatchStatement(t *testing.T) {
+	t.Parallel()
+
+	hi := newHistoryInsert([]string{"orders_history"}, defaultHistoryColumns, historyDDLOptions{dbUser: true}, []string{"status"}, false)
+	got := hi.batchStatement(2, 8)
+	for _, want := range []string{
+		`($1, $2, now(), $3, $4, $5, $6, $7, current_user, $8)`,
+		`($9, $10, now(), $11, $12, $13, $14, $15, current_user, $16)`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Fatalf("batchStatement() = %s, want to contain %q", got, want)
+		}
+	}
+}
+
+func BenchmarkTx_Flush(b *testing.B) {
+	for _, bc := range []struct {
+		name string
+		cfg  Config
+	}{
+		{name: "per-row", cfg: Config{}},
+		{name: "bulk", cfg: Config{BulkInsertThreshold: 100}},
+		{name: "staged", cfg: Config{StageThreshold: 100}},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			h := New(bc.cfg)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				captureOrders(b, h, 10000)
+			}
+		})
+	}
+}
+
+func TestTx_ReturnHistoryIDs(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		bulk int
+	}{
+		{name: "per row"},
+		{name: "bulk", bulk: 2},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			var nextID int64
+			db, state := openFakeDB(t, func(query string, args []any) (fakeResult, error) {
+				if strings.Contains(query, `INSERT INTO "orders_history"`) {
+					res := fakeResult{cols: []string{"history_id"}}
+					for i := 0; i < len(args)/7; i++ {
+						nextID++
+						res.rows = append(res.rows, []driver.Value{nextID})
+					}
+					return res, nil
+				}
+				return fakeResult{cols: []string{"id", "status"}, rows: [][]driver.Value{{int64(1), "paid"}, {int64(2), "paid"}, {int64(3), "paid"}}}, nil
+			})
+			var flushed []Record
+			h := New(Config{
+				ReturnHistoryIDs:    true,
+				BulkInsertThreshold: tt.bulk,
+				OnFlush:             func(_ context.Context, records []Record) { flushed = append(flushed, records...) },
+			})
+			ctx := context.Background()
+			tx, err := h.Wrap(db).BeginTx(ctx, nil)
+			if err != nil {
+				t.Fatalf("BeginTx() error = %v", err)
+			}
+			if _, err := tx.ExecContext(ctx, `UPDATE orders SET status = 'paid' RETURNING *`); err != nil {
+				t.Fatalf("ExecContext() error = %v", err)
+			}
+			if err := tx.Commit(); err != nil {
+				t.Fatalf("Commit() error = %v", err)
+			}
+
+			if execs := state.Execs(); len(execs) != 0 {
+				t.Errorf("history inserts went through Exec: %d", len(execs))
+			}
+			inserts := state.Queries()[1:]
+			if len(inserts) != 3 {
+				t.Errorf("history inserts = %d, want one per row", len(inserts))
+			}
+			for _, q := range inserts {
+				if !strings.Contains(q.query, `RETURNING "history_id"`) {
+					t.Errorf("history insert = %q, want RETURNING history_id", q.query)
+				}
+			}
+			got := tx.LastHistoryIDs()
+			if want := []int64{1, 2, 3}; !reflect.DeepEqual(got, want) {
+				t.Fatalf("LastHistoryIDs() = %v, want %v", got, want)
+			}
+			if len(flushed) != len(got) {
+				t.Fatalf("flushed %d records, want %d", len(flushed), len(got))
+			}
+			for i, r := range flushed {
+				if r.HistoryID == 0 || r.HistoryID != got[i] {
+					t.Errorf("records[%d].HistoryID = %d, want %d", i, r.HistoryID, got[i])
+				}
+			}
+		})
+	}
+}
+
+func TestTx_HistoryIDGenerator(t *testing.T) {
+	t.Parallel()
+
+	ids := []string{"0190b6a4-7c1e-7000-8000-000000000001", "0190b6a4-7c1e-7000-8000-000000000002"}
+	next := 0
+	h := New(Config{HistoryIDGenerator: func() any {
+		id := ids[next]
+		next++
+		return id
+	}})
+	execs := captureOrders(t, h, 2)
+	if len(execs) != 2 {
+		t.Fatalf("execs = %d, want 2", len(execs))
+	}
+	for i, call := range execs {
+		if !strings.Contains(call.query, `("history_id", "id", `) || !strings.Contains(call.query, "($1, $2, ") {
+			t.Errorf("execs[%d] = %q, want history_id bound as $1", i, call.query)
+		}
+		if got := call.args[0]; got != ids[i] {
+			t.Errorf("execs[%d] history_id = %v, want %s", i, got, ids[i])
+		}
+	}
+
+	t.Run("conflicts with ReturnHistoryIDs", func(t *testing.T) {
+		t.Parallel()
+
+		db, _ := openFakeDB(t, func(string, []any) (fakeResult, error) {
+			return fakeResult{cols: []string{"id"}, rows: [][]driver.Value{{int64(1)}}}, nil
+		})
+		ctx := context.Background()
+		tx, err := New(Config{HistoryIDGenerator: func() any { return "id" }, ReturnHistoryIDs: true}).Wrap(db).BeginTx(ctx, nil)
+		if err != nil {
+			t.Fatalf("BeginTx() error = %v", err)
+		}
+		if _, err := tx.ExecContext(ctx, `DELETE FROM orders RETURNING id`); err != nil {
+			t.Fatalf("ExecContext() error = %v", err)
+		}
+		if err := tx.Commit(); err == nil {
+			t.Fatal("Commit() error = nil, want a configuration conflict")
+		}
+	})
+}
+
+func TestTx_DeleteRowPlacement(t *testing.T) {
+	t.Parallel()
+
+	tcs := []struct {
+		name       string
+		placement  DeleteRowPlacement
+		wantBefore bool
+	}{
+		{name: "default", wantBefore: true},
+		{name: "before", placement: DeleteRowBefore, wantBefore: true},
+		{name: "after", placement: DeleteRowAfter},
+	}
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			db, state := openFakeDB(t, func(string, []any) (fakeResult, error) {
+				return fakeResult{cols: []string{"id", "status"}, rows: [][]driver.Value{{int64(1), "paid"}}}, nil
+			})
+			var captured Record
+			h := New(Config{DeleteRowPlacement: tc.placement, OnCapture: func(_ context.Context, r Record) { captured = r }})
+			ctx := context.Background()
+			tx, err := h.Wrap(db).BeginTx(ctx, nil)
+			if err != nil {
+				t.Fatalf("BeginTx() error = %v", err)
+			}
+			if _, err := tx.ExecContext(ctx, `DELETE FROM orders WHERE id = 1 RETURNING *`); err != nil {
+				t.Fatalf("ExecContext() error = %v", err)
+			}
+			if err := tx.Commit(); err != nil {
+				t.Fatalf("Commit() error = %v", err)
+			}
+
+			execs := state.Execs()
+			if len(execs) != 1 {
+				t.Fatalf("execs = %d, want 1", len(execs))
+			}
+			if execs[0].args[0] != int64(1) {
+				t.Errorf("id = %v, want 1", execs[0].args[0])
+			}
+			row, empty, hookRow := execs[0].args[5], execs[0].args[6], captured.Before
+			if !tc.wantBefore {
+				row, empty, hookRow = empty, row, captured.After
+			}
+			if b, ok := row.([]byte); !ok || string(b) != `{"id":1,"status":"paid"}` {
+				t.Errorf("deleted row image = %v, want the row", row)
+			}
+			if b, ok := empty.([]byte); !ok || string(b) != "null" {
+				t.Errorf("other image = %v, want null", empty)
+			}
+			if hookRow["status"] != "paid" {
+				t.Errorf("OnCapture record = %+v, want the row on the same side", captured)
+			}
+		})
+	}
+}
+
+func TestTx_DeleteTombstone(t *testing.T) {
+	t.Parallel()
+
+	tcs := []struct {
+		name       string
+		cfg        Config
+		cols       []string
+		wantBefore string
+		wantAfter  string
+	}{
+		{
+			name:       "id tombstone",
+			cfg:        Config{DeleteTombstone: true},
+			cols:       []string{"id", "status"},
+			wantBefore: `{"id":1,"status":"paid"}`,
+			wantAfter:  `{"deleted":true,"id":1}`,
+		},
+		{
+			name:       "configured key columns",
+			cfg:        Config{DeleteTombstone: true, PrimaryKeyColumn: map[string]string{"orders": "order_id"}, CompositeKey: map[string][]string{"orders": {"order_id", "tenant"}}},
+			cols:       []string{"order_id", "tenant", "status"},
+			wantBefore: `{"order_id":1,"status":"paid","tenant":"paid"}`,
+			wantAfter:  `{"deleted":true,"order_id":1,"tenant":"paid"}`,
+		},
+		{
+			name:       "disabled",
+			cols:       []string{"id", "status"},
+			wantBefore: `{"id":1,"status":"paid"}`,
+			wantAfter:  `null`,
+		},
+		{
+			name:       "ignored when deleted rows go to after",
+			cfg:        Config{DeleteTombstone: true, DeleteRowPlacement: DeleteRowAfter},
+			cols:       []string{"id", "status"},
+			wantBefore: `null`,
+			wantAfter:  `{"id":1,"status":"paid"}`,
+		},
+	}
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			db, state := openFakeDB(t, func(string, []any) (fakeResult, error) {
+				row := []driver.Value{int64(1)}
+				for range tc.cols[1:] {
+					row = append(row, "paid")
+				}
+				return fakeResult{cols: tc.cols, rows: [][]driver.Value{row}}, nil
+			})
+			ctx := context.Background()
+			tx, err := New(tc.cfg).Wrap(db).BeginTx(ctx, nil)
+			if err != nil {
+				t.Fatalf("BeginTx() error = %v", err)
+			}
+			if _, err := tx.ExecContext(ctx, `DELETE FROM orders RETURNING *`); err != nil {
+				t.Fatalf("ExecContext() error = %v", err)
+			}
+			if err := tx.Commit(); err != nil {
+				t.Fatalf("Commit() error = %v", err)
+			}
+			execs := state.Execs()
+			if len(execs) != 1 {
+				t.Fatalf("execs = %d, want 1", len(execs))
+			}
+			if got := string(execs[0].args[5].([]byte)); got != tc.wantBefore {
+				t.Errorf("before = %s, want %s", got, tc.wantBefore)
+			}
+			if got := string(execs[0].args[6].([]byte)); got != tc.wantAfter {
+				t.Errorf("after = %s, want %s", got, tc.wantAfter)
+			}
+		})
+	}
+}
+
+func TestTx_SameTableAcrossSchemas(t *testing.T) {
+	t.Parallel()
+
+	db, state := openFakeDB(t, func(q string, _ []any) (fakeResult, error) {
+		status := "paid"
+		if strings.Contains(q, "tenant_1") {
+			status = "shipped"
+		}
+		return fakeResult{cols: []string{"order_id", "status"}, rows: [][]driver.Value{{int64(7), status}}}, nil
+	})
+	ctx := context.Background()
+	tx, err := New(Config{CoalesceByRow: true}).Wrap(db).BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatalf("BeginTx() error = %v", err)
+	}
+	for _, q := range []string{
+		`UPDATE public.orders SET status = 'paid' WHERE order_id = 7 RETURNING *`,
+		`UPDATE tenant_1.orders SET status = 'shipped' WHERE order_id = 7 RETURNING *`,
+	} {
+		if _, err := tx.ExecContext(ctx, q); err != nil {
+			t.Fatalf("ExecContext(%q) error = %v", q, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Commit() error = %v", err)
+	}
+
+	want := map[string]string{
+		`INSERT INTO "public"."orders_history"`:   "paid",
+		`INSERT INTO "tenant_1"."orders_history"`: "shipped",
+	}
+	var inserts int
+	for _, call := range state.Execs() {
+		for prefix, status := range want {
+			if !strings.Contains(call.query, prefix) {
+				continue
+			}
+			inserts++
+			if call.args[0] != int64(7) {
+				t.Errorf("%s id = %v, want 7 from order_id", prefix, call.args[0])
+			}
+			var after map[string]any
+			if err := json.Unmarshal(call.args[6].([]byte), &after); err != nil || after["status"] != status {
+				t.Errorf("%s after = %s, want status %q", prefix, call.args[6], status)
+			}
+			delete(want, prefix)
+		}
+	}
+	if inserts != 2 || len(want) != 0 {
+		t.Fatalf("execs = %v, want one insert into each schema's history table", state.Execs())
+	}
+}
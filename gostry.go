@@ -4,8 +4,13 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log/slog"
+	"maps"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/jinzhu/inflection"
 
@@ -20,51 +25,291 @@ type RedactFunc func(key string, v any) any
 // RedactMap maps key names to specific redaction functions.
 type RedactMap map[string]RedactFunc
 
+// RedactSQLFunc rewrites statement text before it is stored in history. It only applies with
+// Config.RecordStatement, as statement text is not stored otherwise.
+type RedactSQLFunc func(sql string) string
+
+// JSONMarshalFunc encodes a before/after row image for storage with EncodingJSON; EncodingCBOR
+// images ignore it. The default is encoding/json.Marshal.
+type JSONMarshalFunc func(v any) ([]byte, error)
+
+// TransformRowFunc reshapes the before/after images of a captured row before redaction, the
+// Config.MaxValueBytes limit, and storage.
+// It receives copies of the images and returns the ones to store; a nil map stores NULL.
+type TransformRowFunc func(table string, op string, before, after map[string]any) (map[string]any, map[string]any)
+
+// DeleteRowPlacement selects the image column that stores the row removed by a DELETE.
+type DeleteRowPlacement string
+
+const (
+	// DeleteRowBefore stores deleted rows in before, leaving after NULL (default).
+	DeleteRowBefore DeleteRowPlacement = "before"
+	// DeleteRowAfter stores deleted rows in after, so after is always the row the event is about.
+	DeleteRowAfter DeleteRowPlacement = "after"
+)
+
+// IDResolverFunc derives a history id for a row when neither the configured primary key column nor the
+// built-in heuristics find one. Returning nil stores NULL.
+type IDResolverFunc func(table string, before, after map[string]any) any
+
+// ContextExtractor derives a metadata value (operator, trace id, or reason) from a context,
+// returning "" when it has none, e.g. the user stored by an authentication middleware.
+type ContextExtractor func(ctx context.Context) string
+
 // SkipFunc returns true when a DML statement should bypass gostry capture.
 type SkipFunc func(ctx context.Context, dml query.DML, rawSQL string, args []any) bool
 
 // Config defines the main configuration options for gostry.
 type Config struct {
-	HistorySuffix       string    // e.g. "_history" (default)
-	Redact              RedactMap // optional key-based redaction
-	SkipIfNotExists     bool      // skip insertion to history table if it does not exists
-	AutoAttachReturning bool      // attempt to append RETURNING * for DML without RETURNING (PostgreSQL only)
-	Skip                SkipFunc  // optional predicate to skip capturing for matching statements
+	HistorySuffix               string              // e.g. "_history" (default)
+	TableNameFunc               TableNameFunc       // naming hook used by RegisterModels
+	SingularTableNames          bool                // RegisterModels derives table names without pluralizing
+	TransformRow                TransformRowFunc    // optional hook reshaping before/after images
+	Redact                      RedactMap           // optional key-based redaction
+	JSONMarshaler               JSONMarshalFunc     // optional encoder for JSON images (default: encoding/json.Marshal)
+	Encoding                    Encoding            // storage encoding of before/after images (default: EncodingJSON)
+	CompressThreshold           int                 // when > 0, gzip images larger than this many bytes
+	MaxValueBytes               int                 // when > 0, truncate captured values larger than this many bytes
+	SkipIfNotExists             bool                // skip insertion to history table if it does not exists
+	AutoAttachReturning         bool                // attempt to append RETURNING * for DML without RETURNING (PostgreSQL only)
+	DeleteRowPlacement          DeleteRowPlacement  // image column holding rows removed by DELETE (default: DeleteRowBefore)
+	DeleteTombstone             bool                // store a tombstone as the after image of DELETE entries
+	MultiTable                  MultiTablePolicy    // handling of multi-table UPDATE/DELETE statements (default: MultiTableSkip)
+	Skip                        SkipFunc            // optional predicate to skip capturing for matching statements
+	CaptureOps                  []string            // operations to capture (INSERT, UPDATE, DELETE); empty means all
+	TableCaptureOps             map[string][]string // optional table -> operations, overriding CaptureOps
+	AllowedOperations           []string            // operations history may store (default: INSERT, UPDATE, DELETE, COPY)
+	Promoted                    PromotedColumns     // optional per-table fields stored in their own typed columns
+	PrimaryKeyColumn            map[string]string   // optional table -> id column used before pickID heuristics
+	IDResolver                  IDResolverFunc      // optional fallback deriving an id for a row
+	CompositeKey                map[string][]string // optional table -> key columns stored in composite_id
+	CaptureColumns              map[string][]string // optional table -> columns to capture
+	RecordStatement             bool                // store the SQL text and arg count of each statement
+	SchemaVersion               int                 // when > 0, written to schema_version
+	RecordDBUser                bool                // store current_user in db_user
+	RecordTxLabel               bool                // store the WithTxLabel label in tx_label
+	HashChain                   bool                // chain history rows with SHA-256 hashes for tamper detection
+	RedactSQL                   RedactSQLFunc       // optional rewrite of stored statement text
+	CaptureBefore               bool                // read before-images of UPDATE statements
+	SkipNoOpUpdates             bool                // drop UPDATE entries that changed nothing
+	WatchColumns                map[string][]string // optional table -> columns whose changes are recorded
+	SkipUnwatchedUpdates        bool                // drop UPDATE entries that changed no watched column
+	SoftDeleteColumn            string              // column whose NULL -> non-NULL UPDATE is recorded as DELETE
+	IDOnlyDelete                map[string]bool     // optional table -> capture DELETE without RETURNING by id
+	MetadataOnlyTables          map[string]bool     // optional table -> store metadata without images
+	LockBeforeRows              bool                // read before-images with SELECT ... FOR UPDATE
+	CoalesceByRow               bool                // collapse changes to the same row at flush
+	KeepInsertDelete            bool                // keep INSERT+DELETE pairs when coalescing
+	RetryOnSerializationFailure RetryPolicy         // retry WithinTx on 40001/40P01
+	OutboxMode                  bool                // write flushes to gostry_outbox for DrainOutbox
+	HistoryIDGenerator          func() any          // optional application-generated history_id
+	DrainOutboxEvery            time.Duration       // interval of the outbox drainer started by Wrap
+	ReturnHistoryIDs            bool                // expose written history_ids as Record.HistoryID
+	BulkInsertThreshold         int                 // when > 0, use multi-row INSERTs for flushes of this many rows
+	StageThreshold              int                 // when > 0, stage runs of this many rows in a temporary table
+	OwnHistoryDB                bool                // DB.Close also closes HistoryDB
+	HistoryDB                   *sql.DB             // write history here after commit (best-effort)
+	OnFlushError                FlushErrorFunc      // optional hook receiving records HistoryDB could not store
+	NotifyChannel               string              // pg_notify channel announcing each history row
+	DryRun                      bool                // capture and run hooks, but never write history rows
+	TriggerCapture              bool                // history is written by database triggers
+	SessionSettings             bool                // publish metadata as gostry.* settings in BeginTx
+	OnCapture                   CaptureFunc         // optional hook invoked for every captured change
+	OnFlush                     FlushFunc           // optional hook invoked with the records of each flush
+	AfterCommit                 AfterCommitFunc     // optional hook run with the flushed records after commit
+	OperatorExtractor           ContextExtractor    // optional fallback for the operator when WithOperator was not used
+	TraceIDExtractor            ContextExtractor    // optional fallback for the trace id when WithTraceID was not used
+	ReasonExtractor             ContextExtractor    // optional fallback for the reason when WithReason was not used
+	Logger                      *slog.Logger        // optional logger for non-fatal warnings
 }
 
+// defaultHistorySuffix is applied when Config.HistorySuffix or SchemaConfig.HistorySuffix is empty.
+const defaultHistorySuffix = "_history"
+
+// HistoryTableName returns the dot-joined (unquoted) history table name for base.
 func (c Config) HistoryTableName(base string) string {
-	parts := ident.HistoryParts(base, c.HistorySuffix)
+	parts := c.HistoryTableIdentifier(base)
 	if len(parts) == 0 {
 		return ""
 	}
 	return strings.Join(parts, ".")
 }
 
+// HistoryTableIdentifier returns the unquoted identifier parts of the history table for base,
+// preserving any schema qualifier. An empty suffix falls back to the default "_history".
+func (c Config) HistoryTableIdentifier(base string) []string {
+	suffix := c.HistorySuffix
+	if suffix == "" {
+		suffix = defaultHistorySuffix
+	}
+	return ident.HistoryParts(base, suffix)
+}
+
+// HistoryTableNameFor returns the quoted, schema-qualified history table identifier for target,
+// ready to splice into SQL. Targets are resolved like Migrate resolves them: strings are used as
+// written, and structs go through TableName, cfg.TableNameFunc, and cfg.SingularTableNames.
+// Unqualified names stay unqualified, as Migrate's catalog lookup is not performed.
+func HistoryTableNameFor(cfg Config, target any) (string, error) {
+	name, err := resolveTableName(target, cfg.TableNameFunc, cfg.SingularTableNames)
+	if err != nil {
+		return "", err
+	}
+	if len(ident.SplitQualified(name)) == 0 {
+		return "", &InvalidIdentifierError{Table: name}
+	}
+	q := ident.QuoteQualified(cfg.HistoryTableIdentifier(name))
+	if q == "" {
+		return "", &InvalidIdentifierError{Table: name}
+	}
+	return q, nil
+}
+
 // Handler is the main entry point that manages gostry behavior.
 type Handler struct {
-	cfg Config
+	cfg     Config
+	cfgErr  error // invalid configuration detected by New, reported by BeginTx and flush
+	models  modelRegistry
+	entries buffer.Pool[entry] // reuses capture buffers across transactions
 }
 
 // New creates a new Handler instance with sensible defaults.
 func New(cfg Config) *Handler {
 	if cfg.HistorySuffix == "" {
-		cfg.HistorySuffix = "_history"
+		cfg.HistorySuffix = defaultHistorySuffix
 	}
 	if cfg.Redact == nil {
 		cfg.Redact = RedactMap{}
 	}
-	return &Handler{cfg: cfg}
+	return &Handler{cfg: cfg, cfgErr: cfg.validate()}
+}
+
+// validate reports configuration that New accepts but no transaction can run with.
+func (cfg Config) validate() error {
+	if cfg.HashChain && cfg.HistoryIDGenerator != nil {
+		return errors.New("gostry: HashChain orders the chain by the history_id sequence and cannot be combined with HistoryIDGenerator")
+	}
+	return cfg.Promoted.validate()
+}
+
+// HistoryTableIdentifier returns the unquoted identifier parts of the history table that
+// the handler writes for base, e.g. []string{"sales", "orders_history"} for "sales.orders".
+func (h *Handler) HistoryTableIdentifier(base string) []string {
+	return h.cfg.HistoryTableIdentifier(base)
 }
 
 // DB wraps a *sql.DB instance to enable history tracking on transactions.
 type DB struct {
 	*sql.DB
 	h *Handler
+
+	stopDrain  context.CancelFunc // stops the outbox drainer started for cfg.DrainOutboxEvery, or nil
+	drainDone  chan struct{}      // closed when the outbox drainer has returned
+	closeOnce  sync.Once
+	closeError error
 }
 
-// Wrap attaches gostry to a *sql.DB connection.
+// Wrap attaches gostry to a *sql.DB connection. With Config.OutboxMode and Config.DrainOutboxEvery
+// set, it also starts a background outbox drainer on db, stopped by Close.
 func (h *Handler) Wrap(db *sql.DB) *DB {
-	return &DB{DB: db, h: h}
+	w := &DB{DB: db, h: h}
+	if h.cfg.OutboxMode && h.cfg.DrainOutboxEvery > 0 {
+		w.startDrainer(h.cfg.DrainOutboxEvery)
+	}
+	return w
+}
+
+// Close stops the background workers started by Wrap, closes Config.HistoryDB when
+// Config.OwnHistoryDB is set (so wrap a single *sql.DB per Handler then), and then closes the
+// underlying *sql.DB. No history is flushed:
+// open transactions are not committed. Calling Close more than once returns the first result.
+func (db *DB) Close() error {
+	db.closeOnce.Do(func() {
+		if db.stopDrain != nil {
+			db.stopDrain()
+			<-db.drainDone
+		}
+		var errs []error
+		if db.h.cfg.OwnHistoryDB && db.h.cfg.HistoryDB != nil {
+			if err := db.h.cfg.HistoryDB.Close(); err != nil {
+				errs = append(errs, fmt.Errorf("gostry: failed to close history database: %w", err))
+			}
+		}
+		if err := db.DB.Close(); err != nil {
+			errs = append(errs, err)
+		}
+		db.closeError = errors.Join(errs...)
+	})
+	return db.closeError
+}
+
+// Unwrap returns the underlying *sql.DB for interop with code that expects the exact type.
+// Transactions started on it directly are not captured.
+func (db *DB) Unwrap() *sql.DB {
+	return db.DB
+}
+
+// warn reports a non-fatal condition through cfg.Logger, if configured.
+func (h *Handler) warn(ctx context.Context, msg string, args ...any) {
+	if h.cfg.Logger == nil {
+		return
+	}
+	h.cfg.Logger.WarnContext(ctx, msg, args...)
+}
+
+// info reports an informational event through cfg.Logger, if configured.
+func (h *Handler) info(ctx context.Context, msg string, args ...any) {
+	if h.cfg.Logger == nil {
+		return
+	}
+	h.cfg.Logger.InfoContext(ctx, msg, args...)
+}
+
+// images returns the before/after images of e as they are stored: placed per cfg.DeleteRowPlacement
+// (or completed with a cfg.DeleteTombstone), transformed by cfg.TransformRow, pruned to
+// cfg.WatchColumns, then redacted, then truncated to cfg.MaxValueBytes.
+func (h *Handler) images(e entry) (before, after map[string]any) {
+	before, after = e.before, e.after
+	if e.op == "DELETE" {
+		switch {
+		case h.cfg.DeleteRowPlacement == DeleteRowAfter:
+			before, after = nil, before
+		case h.cfg.DeleteTombstone && before != nil && after == nil:
+			after = h.tombstone(e.table, before)
+		}
+	}
+	if h.cfg.TransformRow != nil {
+		before, after = h.cfg.TransformRow(e.table, e.op, maps.Clone(before), maps.Clone(after))
+	}
+	before, after = h.pruneWatched(e.table, before), h.pruneWatched(e.table, after)
+	return h.applyLimits(h.applyRedact(before)), h.applyLimits(h.applyRedact(after))
+}
+
+// tombstone returns the after image recorded for a deleted row with cfg.DeleteTombstone: the row's
+// id and composite key columns, and "deleted": true. It is only used with DeleteRowBefore, since
+// DeleteRowAfter already stores the row in after.
+func (h *Handler) tombstone(table string, row map[string]any) map[string]any {
+	out := map[string]any{"deleted": true}
+	for _, c := range append([]string{h.idColumn(table)}, h.keyColumns(table)...) {
+		if v, ok := row[c]; ok {
+			out[c] = v
+		}
+	}
+	return out
+}
+
+// metadataOnly reports whether table is listed in cfg.MetadataOnlyTables. Such tables store only the
+// id, composite id, and metadata; before, after, and promoted columns are always NULL.
+func (h *Handler) metadataOnly(table string) bool {
+	only, _ := lookupTable(h.cfg.MetadataOnlyTables, table)
+	return only
+}
+
+// withholdImages drops the row images of metadata-only tables once the id has been resolved from them.
+func (h *Handler) withholdImages(table string, before, after map[string]any) (map[string]any, map[string]any) {
+	if h.metadataOnly(table) {
+		return nil, nil
+	}
+	return before, after
 }
 
 // applyRedact returns a redacted copy of the given map using cfg.Redact.
@@ -89,6 +334,12 @@ type Tx struct {
 	h   *Handler
 	buf *buffer.Buffer[entry]
 	ctx context.Context
+
+	flushed    []Record      // records flushed so far, kept for Config.AfterCommit
+	historyIDs []int64       // history_id of every flushed row, kept for LastHistoryIDs (Config.ReturnHistoryIDs)
+	opts       sql.TxOptions // options the transaction was begun with
+	label      string        // transaction label from WithTxLabel on the BeginTx context
+	dbUser     string        // current_user of the transaction once read for a bound db_user column
 }
 
 // BeginTx starts a wrapped transaction that records DML changes.
@@ -97,7 +348,85 @@ func (db *DB) BeginTx(ctx context.Context, opts *sql.TxOptions) (*Tx, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &Tx{Tx: tx, h: db.h, buf: buffer.NewBuffer[entry](), ctx: ctx}, nil
+	return db.h.startTx(ctx, tx, opts)
+}
+
+// Conn wraps a *sql.Conn so transactions begun on a pinned connection record DML changes.
+type Conn struct {
+	*sql.Conn
+	h *Handler
+}
+
+// WrapConn attaches gostry to a single *sql.Conn.
+func (h *Handler) WrapConn(conn *sql.Conn) *Conn {
+	return &Conn{Conn: conn, h: h}
+}
+
+// Unwrap returns the underlying *sql.Conn. Transactions started on it directly are not captured.
+func (c *Conn) Unwrap() *sql.Conn {
+	return c.Conn
+}
+
+// BeginTx starts a wrapped transaction on the pinned connection that records DML changes.
+func (c *Conn) BeginTx(ctx context.Context, opts *sql.TxOptions) (*Tx, error) {
+	tx, err := c.Conn.BeginTx(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	return c.h.startTx(ctx, tx, opts)
+}
+
+// newTx wraps tx with an empty capture buffer.
+func (h *Handler) newTx(ctx context.Context, tx *sql.Tx, opts *sql.TxOptions) *Tx {
+	t := &Tx{Tx: tx, h: h, buf: h.entries.NewBuffer(), ctx: ctx, label: extractTxLabel(ctx)}
+	if opts != nil {
+		t.opts = *opts
+	}
+	return t
+}
+
+// startTx wraps a freshly begun transaction, publishing session settings when cfg.SessionSettings
+// or cfg.TriggerCapture is set. The transaction is rolled back if that fails.
+func (h *Handler) startTx(ctx context.Context, tx *sql.Tx, opts *sql.TxOptions) (*Tx, error) {
+	if h.cfgErr != nil {
+		_ = tx.Rollback()
+		return nil, h.cfgErr
+	}
+	if h.cfg.HashChain && opts != nil && !chainIsolation(opts.Isolation) {
+		_ = tx.Rollback()
+		return nil, fmt.Errorf("gostry: HashChain requires READ COMMITTED, got %s", opts.Isolation)
+	}
+	if h.cfg.SessionSettings || h.cfg.TriggerCapture {
+		if err := setSessionMeta(ctx, tx, h.meta(ctx)); err != nil {
+			_ = tx.Rollback()
+			return nil, err
+		}
+	}
+	t := h.newTx(ctx, tx, opts)
+	if h.captureBefore() && !h.cfg.LockBeforeRows && weakIsolation(t.opts.Isolation) {
+		h.warn(ctx, "gostry: before-image capture under an isolation level weaker than REPEATABLE READ may read a different snapshot than the UPDATE; consider LockBeforeRows",
+			slog.String("isolation", t.opts.Isolation.String()))
+	}
+	return t, nil
+}
+
+// Isolation returns the isolation level requested when the transaction was begun
+// (sql.LevelDefault when no options were given).
+func (tx *Tx) Isolation() sql.IsolationLevel {
+	return tx.opts.Isolation
+}
+
+// weakIsolation reports whether level was explicitly requested below REPEATABLE READ.
+// sql.LevelDefault is left alone since the effective level depends on the server configuration.
+func weakIsolation(level sql.IsolationLevel) bool {
+	return level == sql.LevelReadUncommitted || level == sql.LevelReadCommitted
+}
+
+// chainIsolation reports whether level lets chainHistoryRows see the chain tail committed while it waited
+// for the advisory lock. A snapshot taken at REPEATABLE READ or above predates the lock and would fork the
+// chain. sql.LevelDefault is accepted since PostgreSQL defaults to READ COMMITTED.
+func chainIsolation(level sql.IsolationLevel) bool {
+	return level == sql.LevelDefault || level == sql.LevelReadUncommitted || level == sql.LevelReadCommitted
 }
 
 // ExecContext intercepts ExecContext to capture and log DML operations.
@@ -106,50 +435,115 @@ func (db *DB) BeginTx(ctx context.Context, opts *sql.TxOptions) (*Tx, error) {
 // - Otherwise, pass-through and record only SQL/args metadata for later (future resolvers).
 func (tx *Tx) ExecContext(ctx context.Context, q string, args ...any) (sql.Result, error) {
 	tx.ctx = ctx
-	if extractSkip(ctx) {
+	if extractSkip(ctx) || tx.h.cfg.TriggerCapture {
 		return tx.Tx.ExecContext(ctx, q, args...)
 	}
 	if dml, ok := query.ParseDML(q); ok {
+		dml.Table = tenantTable(ctx, dml.Table)
 		if tx.h.cfg.Skip != nil {
 			if tx.h.cfg.Skip(ctx, dml, q, args) {
 				return tx.Tx.ExecContext(ctx, q, args...)
 			}
 		}
 
+		if !tx.h.capturesOp(dml.Table, dml.Op) {
+			return tx.Tx.ExecContext(ctx, q, args...)
+		}
+
+		if dml.Op == "COPY" {
+			res, err := tx.Tx.ExecContext(ctx, q, args...)
+			if err == nil {
+				tx.capture(ctx, summaryEntry(dml, q, args, tx.h.meta(ctx), res))
+			}
+			return res, err
+		}
+
+		if dml.Op == "DELETE" && !dml.HasReturning {
+			if idOnly, _ := lookupTable(tx.h.cfg.IDOnlyDelete, dml.Table); idOnly {
+				return tx.execIDOnlyDelete(ctx, dml, q, args)
+			}
+		}
+
 		stmt := q
 		forcedReturning := false
 		if !dml.HasReturning && tx.h.cfg.AutoAttachReturning {
-			if augmented, ok := query.AppendReturningAll(q); ok {
+			if augmented, ok := query.AppendReturningColumns(q, tx.h.captureColumns(dml.Table)); ok {
 				stmt = augmented
 				forcedReturning = true
+			} else {
+				tx.h.warn(ctx, "gostry: cannot append RETURNING; recording statement only", slog.String("sql", q))
+			}
+		}
+		// A caller-written RETURNING that omits the configured key still yields the history id.
+		if dml.HasReturning && (!dml.IsMultiTable() || dml.ReturningScoped) {
+			if augmented, ok := query.ExtendReturning(q, tx.h.keyColumns(dml.Table)); ok {
+				stmt = augmented
+			}
+		}
+
+		if (dml.HasReturning || forcedReturning) && ambiguous(dml) {
+			capture, err := tx.h.checkMultiTable(ctx, dml, q)
+			if err != nil {
+				return nil, err
+			}
+			if !capture {
+				return tx.Tx.ExecContext(ctx, q, args...)
 			}
 		}
 
 		if dml.HasReturning || forcedReturning {
+			var befores []map[string]any
+			switch {
+			case dml.Op == "UPDATE" && dml.CurrentOf && tx.h.captureBefore():
+				// The cursor positions the row for this statement only; no SELECT can target it again.
+				tx.h.warn(ctx, "gostry: WHERE CURRENT OF cannot be before-captured; recording after-images only", slog.String("sql", q))
+			case dml.Op == "UPDATE" && tx.h.captureBefore():
+				var err error
+				if befores, err = tx.selectBefore(ctx, dml.Table, q, args); err != nil {
+					return nil, err
+				}
+			}
 			rows, err := tx.Tx.QueryContext(ctx, stmt, args...)
 			if err != nil {
 				return nil, err
 			}
-			ms, n, err := scanAll(rows)
-			if err != nil {
-				return nil, fmt.Errorf("gostry: failed to scan rows: %w", err)
+			meta := tx.h.meta(ctx)
+			var beforeIdx *beforeIndex
+			if len(befores) > 0 {
+				beforeIdx = tx.h.newBeforeIndex(dml.Table, befores)
 			}
-			meta := extractMeta(ctx)
-			for _, m := range ms {
-				e := entry{table: dml.Table, op: dml.Op, meta: meta}
+			projection := tx.h.captureColumns(dml.Table)
+			var firstID any
+			n, err := scanEach(rows, func(m map[string]any) error {
+				if firstID == nil && dml.Op == "INSERT" {
+					firstID = m[tx.h.idColumn(dml.Table)]
+				}
+				m = projectRow(projection, m)
+				e := entry{table: dml.Table, op: dml.Op, sql: q, args: args, meta: meta}
 				if dml.Op == "DELETE" {
 					e.before = m
 				} else {
 					e.after = m
 				}
-				tx.buf.Add(e)
+				if beforeIdx != nil {
+					e.before = beforeIdx.match(m)
+				}
+				tx.h.classifySoftDelete(&e)
+				tx.capture(ctx, e)
+				return nil
+			})
+			if err != nil {
+				return nil, withKind(ErrScan, fmt.Errorf("gostry: failed to scan rows: %w", err))
+			}
+			if id, ok := integerID(firstID); ok {
+				return newInsertResult(n, id), nil
 			}
 			return newAffectedRows(n), nil
 		}
 
 		res, err := tx.Tx.ExecContext(ctx, q, args...)
 		if err == nil {
-			tx.buf.Add(entry{table: dml.Table, op: dml.Op, sql: q, args: args, meta: extractMeta(ctx)})
+			tx.capture(ctx, summaryEntry(dml, q, args, tx.h.meta(ctx), res))
 		}
 		return res, err
 	}
@@ -157,83 +551,196 @@ func (tx *Tx) ExecContext(ctx context.Context, q string, args ...any) (sql.Resul
 	return tx.Tx.ExecContext(ctx, q, args...)
 }
 
+// Unwrap returns the underlying *sql.Tx for interop with code that expects the exact type.
+// Statements executed on it bypass capture, and committing it directly skips the history flush.
+func (tx *Tx) Unwrap() *sql.Tx {
+	return tx.Tx
+}
+
 // Commit reuses the most recent context captured during Exec/Commit calls.
 func (tx *Tx) Commit() error {
 	return tx.CommitContext(tx.ctx)
 }
 
 // CommitContext flushes buffered history records into history tables before commit.
+// When Config.HistoryDB is set, the business transaction is committed first and history is
+// written afterwards on a best-effort basis; failures are reported to Config.OnFlushError.
+// Config.AfterCommit runs only once the commit has succeeded; its error is returned, but the
+// transaction stays committed.
 func (tx *Tx) CommitContext(ctx context.Context) error {
+	if tx.h.cfg.HistoryDB != nil {
+		if tx.h.cfg.RecordDBUser && tx.buf.Len() > 0 {
+			// History is written after the commit; read the writer's role while the transaction is open.
+			if _, err := tx.currentUser(ctx); err != nil {
+				return err
+			}
+		}
+		if err := tx.Tx.Commit(); err != nil {
+			tx.buf.Reset()
+			tx.flushed = nil
+			return err
+		}
+		if err := tx.flush(ctx); err != nil {
+			tx.h.warn(ctx, "gostry: failed to write history to HistoryDB", slog.Any("error", err))
+		}
+		return tx.afterCommit(ctx)
+	}
 	if err := tx.flush(ctx); err != nil {
 		return err
 	}
-	return tx.Tx.Commit()
+	if err := tx.Tx.Commit(); err != nil {
+		tx.flushed = nil
+		return err
+	}
+	return tx.afterCommit(ctx)
 }
 
-// flush writes buffered entries into their corresponding history tables within the same transaction.
-func (tx *Tx) flush(ctx context.Context) error {
-	rows := tx.buf.Drain()
-	if len(rows) == 0 {
+// afterCommit hands every record flushed during the transaction to cfg.AfterCommit.
+func (tx *Tx) afterCommit(ctx context.Context) error {
+	records := tx.flushed
+	tx.flushed = nil
+	if tx.h.cfg.AfterCommit == nil || len(records) == 0 {
 		return nil
 	}
+	if err := tx.h.cfg.AfterCommit(ctx, records); err != nil {
+		return fmt.Errorf("gostry: after-commit hook failed (transaction is committed): %w", err)
+	}
+	return nil
+}
+
+// Flush drains the captured entries and writes them into history tables without committing.
+// The history rows live in the same transaction, so a later Rollback discards them as well.
+// With Config.HistoryDB set, the rows are written to that database immediately instead and are
+// not affected by a later Rollback.
+func (tx *Tx) Flush(ctx context.Context) error {
+	return tx.flush(ctx)
+}
+
+// Rollback clears buffered history entries and rolls back the transaction.
+func (tx *Tx) Rollback() error {
+	tx.buf.Reset()
+	tx.flushed = nil
+	return tx.Tx.Rollback()
+}
+
+// pickID chooses the history id, preferring the configured primary key column
+// and falling back to the built-in heuristics.
+func (h *Handler) pickID(ctx context.Context, table string, before, after map[string]any) any {
+	id, col, missing := h.resolveID(table, before, after)
+	if missing {
+		h.warn(ctx, "gostry: configured primary key column not found in row; falling back to heuristics",
+			slog.String("table", table), slog.String("column", col))
+	}
+	return id
+}
 
-	for _, e := range rows {
-		before := tx.h.applyRedact(e.before)
-		after := tx.h.applyRedact(e.after)
-		id := pickID(e.table, before, after)
-		beforeJSON, err := json.Marshal(before)
-		if err != nil {
-			return fmt.Errorf("gostry: failed to marshal before: %w", err)
+// resolveID is pickID without logging. It reports the configured column and
+// whether it was missing from the row so callers can decide to warn.
+func (h *Handler) resolveID(table string, before, after map[string]any) (id any, col string, missing bool) {
+	if col, ok := lookupTable(h.cfg.PrimaryKeyColumn, table); ok {
+		if v, ok := before[col]; ok {
+			return v, col, false
 		}
-		afterJSON, err := json.Marshal(after)
-		if err != nil {
-			return fmt.Errorf("gostry: failed to marshal after: %w", err)
+		if v, ok := after[col]; ok {
+			return v, col, false
 		}
+		return h.fallbackID(table, before, after), col, true
+	}
+	return h.fallbackID(table, before, after), "", false
+}
 
-		// Simple per-row INSERT for MVP; can be batched later.
-		historyParts := ident.HistoryParts(e.table, tx.h.cfg.HistorySuffix)
-		historyIdent := ident.QuoteQualified(historyParts)
-		if historyIdent == "" {
-			return fmt.Errorf("gostry: invalid history table identifier for %q", e.table)
-		}
-		stmt := fmt.Sprintf(`
-INSERT INTO %s (id, operation, operated_at, operated_by, trace_id, reason, before, after)
-VALUES ($1, $2, now(), $3, $4, $5, $6, $7)
-`, historyIdent)
-		if tx.h.cfg.SkipIfNotExists {
-			regclass := ident.QualifiedRegclassLiteral(historyParts)
-			stmt = fmt.Sprintf(`
-DO $$
-BEGIN
-    IF to_regclass(%s) IS NOT NULL THEN
-        INSERT INTO %s (id, operation, operated_at, operated_by, trace_id, reason, before, after)
-        VALUES ($1, $2, now(), $3, $4, $5, $6, $7);
-    END IF;
-END $$;
-`, regclass, historyIdent)
+// fallbackID applies the pickID heuristics and then cfg.IDResolver when they find nothing.
+func (h *Handler) fallbackID(table string, before, after map[string]any) any {
+	if id := pickID(table, before, after); id != nil {
+		return id
+	}
+	if h.cfg.IDResolver != nil && (before != nil || after != nil) {
+		return h.cfg.IDResolver(table, before, after)
+	}
+	return nil
+}
+
+// defaultAllowedOperations are the operations gostry itself records.
+var defaultAllowedOperations = []string{"INSERT", "UPDATE", "DELETE", "COPY"}
+
+// allowsOp reports whether op may be stored in history according to cfg.AllowedOperations.
+func (h *Handler) allowsOp(op string) bool {
+	ops := h.cfg.AllowedOperations
+	if len(ops) == 0 {
+		ops = defaultAllowedOperations
+	}
+	for _, o := range ops {
+		if strings.EqualFold(o, op) {
+			return true
 		}
+	}
+	return false
+}
 
-		if _, err := tx.Tx.ExecContext(
-			ctx,
-			stmt,
-			id,
-			e.op,
-			e.meta.operator,
-			e.meta.traceID,
-			e.meta.reason,
-			beforeJSON,
-			afterJSON,
-		); err != nil {
-			return fmt.Errorf("gostry: failed to insert history table: %w", err)
+// capturesOp reports whether op on table is audited according to cfg.TableCaptureOps and cfg.CaptureOps.
+func (h *Handler) capturesOp(table, op string) bool {
+	ops, ok := lookupTable(h.cfg.TableCaptureOps, table)
+	if !ok {
+		ops = h.cfg.CaptureOps
+	}
+	if len(ops) == 0 {
+		return true
+	}
+	for _, o := range ops {
+		if strings.EqualFold(o, op) {
+			return true
 		}
 	}
-	return nil
+	return false
 }
 
-// Rollback clears buffered history entries and rolls back the transaction.
-func (tx *Tx) Rollback() error {
-	tx.buf.Reset()
-	return tx.Tx.Rollback()
+// idColumn returns the configured primary key column for table, or "id".
+func (h *Handler) idColumn(table string) string {
+	if col, ok := lookupTable(h.cfg.PrimaryKeyColumn, table); ok {
+		return col
+	}
+	return "id"
+}
+
+// statementText returns the SQL text to store for an entry, applying cfg.RedactSQL.
+// It returns nil (NULL) when the entry carries no statement.
+func (h *Handler) statementText(q string) any {
+	if q == "" {
+		return nil
+	}
+	if h.cfg.RedactSQL != nil {
+		q = h.cfg.RedactSQL(q)
+	}
+	return q
+}
+
+// compositeID renders the configured key columns of a row as a JSON object.
+// Key values are taken from before first and then after, mirroring pickID.
+// It returns nil (NULL) when none of the key columns are present.
+func (h *Handler) compositeID(ctx context.Context, table string, keyCols []string, before, after map[string]any) ([]byte, error) {
+	key := make(map[string]any, len(keyCols))
+	var missing []string
+	for _, col := range keyCols {
+		if v, ok := before[col]; ok {
+			key[col] = v
+		} else if v, ok := after[col]; ok {
+			key[col] = v
+		} else {
+			missing = append(missing, col)
+		}
+	}
+	if len(missing) > 0 {
+		h.warn(ctx, "gostry: composite key columns not found in row",
+			slog.String("table", table), slog.Any("columns", missing))
+	}
+	if len(key) == 0 {
+		return nil, nil
+	}
+	b, err := json.Marshal(key)
+	if err != nil {
+		return nil, withKind(ErrMarshal, fmt.Errorf("gostry: failed to marshal composite id: %w", err))
+	}
+	return b, nil
 }
 
 // pickID attempts to choose a sensible primary key from before/after maps.
@@ -0,0 +1,1214 @@
+package gostry
+
+import (
+	"bytes"
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestBuildHistoryInsert_QuotesColumns(t *testing.T) {
+	t.Parallel()
+
+	cols := defaultHistoryColumns
+	cols.id = "order"
+
+	tcs := []struct {
+		name            string
+		skipIfNotExists bool
+	}{
+		{name: "plain insert", skipIfNotExists: false},
+		{name: "guarded insert", skipIfNotExists: true},
+	}
+
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			stmt := newHistoryInsert([]string{"public", "orders_history"}, cols, historyDDLOptions{}, nil, tc.skipIfNotExists).statement()
+			want := `INSERT INTO "public"."orders_history" ("order", "operation", "operated_at", "operated_by", "trace_id", "reason", "before", "after")`
+			if !strings.Contains(stmt, want) {
+				t.Fatalf("statement() = %s, want to contain %q", stmt, want)
+			}
+		})
+	}
+}
+
+func TestTx_InsertSelectReturning(t *testing.T) {
+	t.Parallel()
+
+	cols := []string{"status", "amount", "id"}
+	db, state := openFakeDB(t, func(string, []any) (fakeResult, error) {
+		res := fakeResult{cols: cols}
+		for i := 1; i <= 5; i++ {
+			res.rows = append(res.rows, []driver.Value{"new", int64(i * 10), int64(i)})
+		}
+		return res, nil
+	})
+
+	ctx := context.Background()
+	tx, err := New(Config{}).Wrap(db).BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatalf("BeginTx() error = %v", err)
+	}
+	res, err := tx.ExecContext(ctx, `INSERT INTO orders (status, amount, id) SELECT status, amount, id FROM staging RETURNING *`)
+	if err != nil {
+		t.Fatalf("ExecContext() error = %v", err)
+	}
+	if n, _ := res.RowsAffected(); n != 5 {
+		t.Fatalf("RowsAffected() = %d, want 5", n)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Commit() error = %v", err)
+	}
+
+	execs := state.Execs()
+	if len(execs) != 5 {
+		t.Fatalf("history inserts = %d, want 5", len(execs))
+	}
+	for i, call := range execs {
+		if want := int64(i + 1); call.args[0] != want {
+			t.Fatalf("history row %d id = %v, want %v", i, call.args[0], want)
+		}
+		if call.args[1] != "INSERT" {
+			t.Fatalf("history row %d operation = %v, want INSERT", i, call.args[1])
+		}
+		var after map[string]any
+		if err := json.Unmarshal(call.args[6].([]byte), &after); err != nil {
+			t.Fatalf("unmarshal after: %v", err)
+		}
+		if got, want := after["amount"], float64((i+1)*10); got != want {
+			t.Fatalf("history row %d after.amount = %v, want %v", i, got, want)
+		}
+	}
+}
+
+func TestTx_InsertSelectReturningNoRows(t *testing.T) {
+	t.Parallel()
+
+	db, state := openFakeDB(t, func(string, []any) (fakeResult, error) {
+		return fakeResult{cols: []string{"id"}}, nil
+	})
+
+	ctx := context.Background()
+	tx, err := New(Config{}).Wrap(db).BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatalf("BeginTx() error = %v", err)
+	}
+	res, err := tx.ExecContext(ctx, `INSERT INTO orders (id) SELECT id FROM staging WHERE false RETURNING *`)
+	if err != nil {
+		t.Fatalf("ExecContext() error = %v", err)
+	}
+	if n, _ := res.RowsAffected(); n != 0 {
+		t.Fatalf("RowsAffected() = %d, want 0", n)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Commit() error = %v", err)
+	}
+	if execs := state.Execs(); len(execs) != 0 {
+		t.Fatalf("history inserts = %d, want 0", len(execs))
+	}
+}
+
+func TestTx_InsertOnConflictDoNothing(t *testing.T) {
+	t.Parallel()
+
+	tcs := []struct {
+		name     string
+		rows     [][]driver.Value
+		wantRows int64
+	}{
+		{name: "conflict skips the insert", rows: nil, wantRows: 0},
+		{name: "no conflict inserts the row", rows: [][]driver.Value{{int64(7), "new"}}, wantRows: 1},
+	}
+
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			db, state := openFakeDB(t, func(string, []any) (fakeResult, error) {
+				return fakeResult{cols: []string{"id", "status"}, rows: tc.rows}, nil
+			})
+
+			ctx := context.Background()
+			tx, err := New(Config{}).Wrap(db).BeginTx(ctx, nil)
+			if err != nil {
+				t.Fatalf("BeginTx() error = %v", err)
+			}
+			res, err := tx.ExecContext(ctx, `INSERT INTO orders (id, status) VALUES ($1, $2) ON CONFLICT (id) DO NOTHING RETURNING *`, 7, "new")
+			if err != nil {
+				t.Fatalf("ExecContext() error = %v", err)
+			}
+			if n, _ := res.RowsAffected(); n != tc.wantRows {
+				t.Fatalf("RowsAffected() = %d, want %d", n, tc.wantRows)
+			}
+			if err := tx.Commit(); err != nil {
+				t.Fatalf("Commit() error = %v", err)
+			}
+			if got := int64(len(state.Execs())); got != tc.wantRows {
+				t.Fatalf("history inserts = %d, want %d", got, tc.wantRows)
+			}
+		})
+	}
+}
+
+func TestTx_InsertReturningSubset(t *testing.T) {
+	t.Parallel()
+
+	tcs := []struct {
+		name      string
+		cfg       Config
+		sql       string
+		wantQuery string
+		wantAfter string
+	}{
+		{
+			name:      "user-written RETURNING id",
+			sql:       `INSERT INTO orders (amount) VALUES ($1) RETURNING id`,
+			wantQuery: `INSERT INTO orders (amount) VALUES ($1) RETURNING id`,
+			wantAfter: `{"id":42}`,
+		},
+		{
+			name:      "auto-attached RETURNING *",
+			cfg:       Config{AutoAttachReturning: true},
+			sql:       `INSERT INTO orders (amount) VALUES ($1)`,
+			wantQuery: "INSERT INTO orders (amount) VALUES ($1)\nRETURNING *",
+			wantAfter: `{"amount":100,"id":42,"status":"new"}`,
+		},
+	}
+
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			// status is filled by a column DEFAULT; only RETURNING * reports it.
+			db, state := openFakeDB(t, func(q string, _ []any) (fakeResult, error) {
+				if strings.HasSuffix(q, "RETURNING id") {
+					return fakeResult{cols: []string{"id"}, rows: [][]driver.Value{{int64(42)}}}, nil
+				}
+				return fakeResult{cols: []string{"id", "amount", "status"}, rows: [][]driver.Value{{int64(42), int64(100), "new"}}}, nil
+			})
+
+			ctx := context.Background()
+			tx, err := New(tc.cfg).Wrap(db).BeginTx(ctx, nil)
+			if err != nil {
+				t.Fatalf("BeginTx() error = %v", err)
+			}
+			if _, err := tx.ExecContext(ctx, tc.sql, int64(100)); err != nil {
+				t.Fatalf("ExecContext() error = %v", err)
+			}
+			if err := tx.Commit(); err != nil {
+				t.Fatalf("Commit() error = %v", err)
+			}
+
+			if queries := state.Queries(); len(queries) != 1 || queries[0].query != tc.wantQuery {
+				t.Fatalf("queries = %#v, want %q", queries, tc.wantQuery)
+			}
+			execs := state.Execs()
+			if len(execs) != 1 {
+				t.Fatalf("history inserts = %d, want 1", len(execs))
+			}
+			if got := execs[0].args[0]; got != int64(42) {
+				t.Fatalf("history id = %v, want 42", got)
+			}
+			if got := string(execs[0].args[6].([]byte)); got != tc.wantAfter {
+				t.Fatalf("history after = %s, want %s", got, tc.wantAfter)
+			}
+		})
+	}
+}
+
+func TestTx_ReturningAddsKey(t *testing.T) {
+	t.Parallel()
+
+	tcs := []struct {
+		name      string
+		cfg       Config
+		sql       string
+		wantQuery string
+		wantID    any
+	}{
+		{
+			name:      "configured primary key",
+			cfg:       Config{PrimaryKeyColumn: map[string]string{"orders": "order_no"}},
+			sql:       `UPDATE orders SET status = $1 WHERE order_no = 7 RETURNING status`,
+			wantQuery: `UPDATE orders SET status = $1 WHERE order_no = 7 RETURNING status, "order_no"`,
+			wantID:    int64(7),
+		},
+		{
+			name:      "key already returned",
+			cfg:       Config{PrimaryKeyColumn: map[string]string{"orders": "order_no"}},
+			sql:       `UPDATE orders SET status = $1 WHERE order_no = 7 RETURNING order_no, status`,
+			wantQuery: `UPDATE orders SET status = $1 WHERE order_no = 7 RETURNING order_no, status`,
+			wantID:    int64(7),
+		},
+		{
+			name:      "default id is not assumed",
+			sql:       `UPDATE orders SET status = $1 WHERE order_no = 7 RETURNING status`,
+			wantQuery: `UPDATE orders SET status = $1 WHERE order_no = 7 RETURNING status`,
+		},
+	}
+
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			db, state := openFakeDB(t, func(q string, _ []any) (fakeResult, error) {
+				if strings.Contains(q, "order_no") && !strings.HasSuffix(q, "RETURNING status") {
+					return fakeResult{cols: []string{"order_no", "status"}, rows: [][]driver.Value{{int64(7), "paid"}}}, nil
+				}
+				return fakeResult{cols: []string{"status"}, rows: [][]driver.Value{{"paid"}}}, nil
+			})
+
+			ctx := context.Background()
+			tx, err := New(tc.cfg).Wrap(db).BeginTx(ctx, nil)
+			if err != nil {
+				t.Fatalf("BeginTx() error = %v", err)
+			}
+			if _, err := tx.ExecContext(ctx, tc.sql, "paid"); err != nil {
+				t.Fatalf("ExecContext() error = %v", err)
+			}
+			if err := tx.Commit(); err != nil {
+				t.Fatalf("Commit() error = %v", err)
+			}
+
+			if queries := state.Queries(); len(queries) != 1 || queries[0].query != tc.wantQuery {
+				t.Fatalf("queries = %#v, want %q", queries, tc.wantQuery)
+			}
+			execs := state.Execs()
+			if len(execs) != 1 {
+				t.Fatalf("history inserts = %d, want 1", len(execs))
+			}
+			if got := execs[0].args[0]; got != tc.wantID {
+				t.Fatalf("history id = %v, want %v", got, tc.wantID)
+			}
+		})
+	}
+}
+
+func TestTx_AutoAttachReturningFallback(t *testing.T) {
+	t.Parallel()
+
+	tcs := []struct {
+		name string
+		sql  string
+	}{
+		{name: "several statements", sql: `UPDATE orders SET status = 'paid' WHERE id = 1; UPDATE orders SET status = 'paid' WHERE id = 2`},
+		{name: "comment after semicolon", sql: "DELETE FROM orders WHERE id = 1; -- cleanup"},
+	}
+
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			db, state := openFakeDB(t, nil)
+			var logs bytes.Buffer
+			h := New(Config{AutoAttachReturning: true, Logger: slog.New(slog.NewTextHandler(&logs, nil))})
+			ctx := context.Background()
+			tx, err := h.Wrap(db).BeginTx(ctx, nil)
+			if err != nil {
+				t.Fatalf("BeginTx() error = %v", err)
+			}
+			if _, err := tx.ExecContext(ctx, tc.sql); err != nil {
+				t.Fatalf("ExecContext() error = %v", err)
+			}
+			if err := tx.Commit(); err != nil {
+				t.Fatalf("Commit() error = %v", err)
+			}
+
+			if queries := state.Queries(); len(queries) != 0 {
+				t.Fatalf("queries = %#v, want none (no RETURNING appended)", queries)
+			}
+			execs := state.Execs()
+			if len(execs) != 2 || execs[0].query != tc.sql {
+				t.Fatalf("execs = %#v, want the original statement and one history row", execs)
+			}
+			if got := execs[1].args[0]; got != nil {
+				t.Fatalf("history id = %v, want nil for a statement-level entry", got)
+			}
+			if !strings.Contains(logs.String(), "cannot append RETURNING") {
+				t.Fatalf("logs = %s, want a fallback warning", logs.String())
+			}
+		})
+	}
+}
+
+func TestTx_CaptureOps(t *testing.T) {
+	t.Parallel()
+
+	tcs := []struct {
+		name string
+		cfg  Config
+		want []string // operations recorded for INSERT, UPDATE, DELETE on orders
+	}{
+		{name: "default captures all", cfg: Config{}, want: []string{"INSERT", "UPDATE", "DELETE"}},
+		{name: "update and delete only", cfg: Config{CaptureOps: []string{"UPDATE", "DELETE"}}, want: []string{"UPDATE", "DELETE"}},
+		{
+			name: "per-table override",
+			cfg: Config{
+				CaptureOps:      []string{"UPDATE", "DELETE"},
+				TableCaptureOps: map[string][]string{"orders": {"insert"}},
+			},
+			want: []string{"INSERT"},
+		},
+		{
+			name: "override for another table",
+			cfg: Config{
+				CaptureOps:      []string{"UPDATE"},
+				TableCaptureOps: map[string][]string{"users": {"INSERT"}},
+			},
+			want: []string{"UPDATE"},
+		},
+	}
+
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			db, state := openFakeDB(t, func(string, []any) (fakeResult, error) {
+				return fakeResult{cols: []string{"id"}, rows: [][]driver.Value{{int64(1)}}}, nil
+			})
+			ctx := context.Background()
+			tx, err := New(tc.cfg).Wrap(db).BeginTx(ctx, nil)
+			if err != nil {
+				t.Fatalf("BeginTx() error = %v", err)
+			}
+			for _, q := range []string{
+				`INSERT INTO orders (id) VALUES (1) RETURNING *`,
+				`UPDATE orders SET status = 'paid' WHERE id = 1 RETURNING *`,
+				`DELETE FROM orders WHERE id = 1 RETURNING *`,
+			} {
+				if _, err := tx.ExecContext(ctx, q); err != nil {
+					t.Fatalf("ExecContext(%q) error = %v", q, err)
+				}
+			}
+			if err := tx.Commit(); err != nil {
+				t.Fatalf("Commit() error = %v", err)
+			}
+
+			var got []string
+			for _, call := range state.Execs() {
+				if strings.Contains(call.query, "orders_history") {
+					got = append(got, call.args[1].(string))
+				}
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("recorded operations = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestTx_LastInsertID(t *testing.T) {
+	t.Parallel()
+
+	tcs := []struct {
+		name   string
+		sql    string
+		ids    []driver.Value
+		wantID int64
+	}{
+		{name: "insert returning id", sql: `INSERT INTO orders (amount) VALUES (1) RETURNING id`, ids: []driver.Value{int64(42)}, wantID: 42},
+		{name: "multi-row insert reports first id", sql: `INSERT INTO orders (amount) VALUES (1), (2) RETURNING id`, ids: []driver.Value{int64(7), int64(8)}, wantID: 7},
+		{name: "uuid id", sql: `INSERT INTO orders (amount) VALUES (1) RETURNING id`, ids: []driver.Value{"0b6f2f9e-1c8e-4d0a-9b7a-3f2d8c1e5a44"}},
+		{name: "update", sql: `UPDATE orders SET amount = 2 WHERE id = 42 RETURNING id`, ids: []driver.Value{int64(42)}},
+	}
+
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			db, _ := openFakeDB(t, func(string, []any) (fakeResult, error) {
+				res := fakeResult{cols: []string{"id"}}
+				for _, id := range tc.ids {
+					res.rows = append(res.rows, []driver.Value{id})
+				}
+				return res, nil
+			})
+			ctx := context.Background()
+			tx, err := New(Config{}).Wrap(db).BeginTx(ctx, nil)
+			if err != nil {
+				t.Fatalf("BeginTx() error = %v", err)
+			}
+			defer func() { _ = tx.Rollback() }()
+
+			res, err := tx.ExecContext(ctx, tc.sql)
+			if err != nil {
+				t.Fatalf("ExecContext() error = %v", err)
+			}
+			if n, _ := res.RowsAffected(); n != int64(len(tc.ids)) {
+				t.Fatalf("RowsAffected() = %d, want %d", n, len(tc.ids))
+			}
+			id, err := res.LastInsertId()
+			if err != nil {
+				t.Fatalf("LastInsertId() error = %v, want nil", err)
+			}
+			if id != tc.wantID {
+				t.Fatalf("LastInsertId() = %d, want %d", id, tc.wantID)
+			}
+		})
+	}
+}
+
+func TestTx_MultiTupleInsert(t *testing.T) {
+	t.Parallel()
+
+	const insert = `INSERT INTO orders (id, amount) VALUES (1, 10), (2, 20), (3, 30)`
+
+	t.Run("auto-attached returning records each row", func(t *testing.T) {
+		t.Parallel()
+		db, state := openFakeDB(t, func(string, []any) (fakeResult, error) {
+			return fakeResult{cols: []string{"id", "amount"}, rows: [][]driver.Value{
+				{int64(1), int64(10)}, {int64(2), int64(20)}, {int64(3), int64(30)},
+			}}, nil
+		})
+		ctx := context.Background()
+		tx, err := New(Config{AutoAttachReturning: true}).Wrap(db).BeginTx(ctx, nil)
+		if err != nil {
+			t.Fatalf("BeginTx() error = %v", err)
+		}
+		res, err := tx.ExecContext(ctx, insert)
+		if err != nil {
+			t.Fatalf("ExecContext() error = %v", err)
+		}
+		if n, _ := res.RowsAffected(); n != 3 {
+			t.Fatalf("RowsAffected() = %d, want 3", n)
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatalf("Commit() error = %v", err)
+		}
+		execs := state.Execs()
+		if len(execs) != 3 {
+			t.Fatalf("history inserts = %d, want 3", len(execs))
+		}
+		for i, call := range execs {
+			if want := int64(i + 1); call.args[0] != want || call.args[1] != "INSERT" {
+				t.Fatalf("history row %d id/op = %v/%v, want %d/INSERT", i, call.args[0], call.args[1], want)
+			}
+		}
+	})
+
+	t.Run("without returning records one summary row", func(t *testing.T) {
+		t.Parallel()
+		db, state := openFakeDB(t, nil)
+		state.affected = func(q string) int64 {
+			if q == insert {
+				return 3
+			}
+			return 1
+		}
+		var captured []Record
+		h := New(Config{
+			RecordStatement: true,
+			OnCapture:       func(_ context.Context, r Record) { captured = append(captured, r) },
+		})
+		ctx := context.Background()
+		tx, err := h.Wrap(db).BeginTx(ctx, nil)
+		if err != nil {
+			t.Fatalf("BeginTx() error = %v", err)
+		}
+		if _, err := tx.ExecContext(ctx, insert); err != nil {
+			t.Fatalf("ExecContext() error = %v", err)
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatalf("Commit() error = %v", err)
+		}
+
+		if len(captured) != 1 || captured[0].RowsAffected != 3 {
+			t.Fatalf("captured = %#v, want one record with RowsAffected 3", captured)
+		}
+		execs := state.Execs()
+		if len(execs) != 2 {
+			t.Fatalf("execs = %d, want INSERT and one summary history row", len(execs))
+		}
+		call := execs[1]
+		if !strings.Contains(call.query, `"statement_text", "arg_count", "rows_affected"`) {
+			t.Fatalf("history insert = %s, want rows_affected column", call.query)
+		}
+		if call.args[1] != "INSERT" || call.args[9] != int64(3) {
+			t.Fatalf("history args = %v, want op INSERT and rows_affected 3", call.args)
+		}
+	})
+}
+
+func TestTx_ReturningStreamsRows(t *testing.T) {
+	t.Parallel()
+
+	const total = 4
+	var mu sync.Mutex
+	captured := 0
+	var seen []int
+
+	db, _ := openFakeDB(t, func(string, []any) (fakeResult, error) {
+		res := fakeResult{cols: []string{"id"}, next: func(row int) {
+			mu.Lock()
+			defer mu.Unlock()
+			seen = append(seen, captured)
+		}}
+		for i := 1; i <= total; i++ {
+			res.rows = append(res.rows, []driver.Value{int64(i)})
+		}
+		return res, nil
+	})
+
+	h := New(Config{OnCapture: func(context.Context, Record) {
+		mu.Lock()
+		defer mu.Unlock()
+		captured++
+	}})
+	ctx := context.Background()
+	tx, err := h.Wrap(db).BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatalf("BeginTx() error = %v", err)
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM orders RETURNING *`); err != nil {
+		t.Fatalf("ExecContext() error = %v", err)
+	}
+
+	// Each row must be captured before the next one is read from the driver.
+	if want := []int{0, 1, 2, 3}; !reflect.DeepEqual(seen, want) {
+		t.Fatalf("captured count when reading each row = %v, want %v", seen, want)
+	}
+	if captured != total {
+		t.Fatalf("captured = %d, want %d", captured, total)
+	}
+}
+
+func TestHandler_PickID(t *testing.T) {
+	t.Parallel()
+
+	tcs := []struct {
+		name     string
+		pk       map[string]string
+		table    string
+		before   map[string]any
+		after    map[string]any
+		want     any
+		wantWarn bool
+	}{
+		{
+			name:  "configured key present",
+			pk:    map[string]string{"orders": "order_no"},
+			table: "public.orders",
+			after: map[string]any{"id": 1, "order_no": "A-1"},
+			want:  "A-1",
+		},
+		{
+			name:     "configured key missing falls back to heuristics",
+			pk:       map[string]string{"orders": "order_no"},
+			table:    "orders",
+			before:   map[string]any{"order_id": 7},
+			want:     7,
+			wantWarn: true,
+		},
+		{
+			name:     "configured key missing and no heuristic match",
+			pk:       map[string]string{"orders": "order_no"},
+			table:    "orders",
+			after:    map[string]any{"status": "paid"},
+			want:     nil,
+			wantWarn: true,
+		},
+		{
+			name:  "heuristic fallback without configuration",
+			table: "order_items",
+			after: map[string]any{"order_item_id": 3},
+			want:  3,
+		},
+	}
+
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			var logs bytes.Buffer
+			h := New(Config{PrimaryKeyColumn: tc.pk, Logger: slog.New(slog.NewTextHandler(&logs, nil))})
+			if got := h.pickID(context.Background(), tc.table, tc.before, tc.after); got != tc.want {
+				t.Fatalf("pickID() = %v, want %v", got, tc.want)
+			}
+			if gotWarn := strings.Contains(logs.String(), "level=WARN"); gotWarn != tc.wantWarn {
+				t.Fatalf("pickID() warned = %t, want %t (logs: %s)", gotWarn, tc.wantWarn, logs.String())
+			}
+		})
+	}
+}
+
+func TestTx_IDResolver(t *testing.T) {
+	t.Parallel()
+
+	db, state := openFakeDB(t, func(string, []any) (fakeResult, error) {
+		return fakeResult{cols: []string{"tenant", "code", "label"}, rows: [][]driver.Value{{"acme", "X1", "first"}}}, nil
+	})
+	var gotTable string
+	h := New(Config{IDResolver: func(table string, _, after map[string]any) any {
+		gotTable = table
+		return fmt.Sprintf("%v/%v", after["tenant"], after["code"])
+	}})
+
+	ctx := context.Background()
+	tx, err := h.Wrap(db).BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatalf("BeginTx() error = %v", err)
+	}
+	if _, err := tx.ExecContext(ctx, `INSERT INTO labels (tenant, code, label) VALUES ('acme', 'X1', 'first') RETURNING *`); err != nil {
+		t.Fatalf("ExecContext() error = %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Commit() error = %v", err)
+	}
+
+	execs := state.Execs()
+	if len(execs) != 1 {
+		t.Fatalf("history inserts = %d, want 1", len(execs))
+	}
+	if got := execs[0].args[0]; got != "acme/X1" {
+		t.Fatalf("history id = %v, want acme/X1", got)
+	}
+	if gotTable != "labels" {
+		t.Fatalf("IDResolver table = %q, want labels", gotTable)
+	}
+}
+
+func TestTx_CompositeKey(t *testing.T) {
+	t.Parallel()
+
+	db, state := openFakeDB(t, func(string, []any) (fakeResult, error) {
+		return fakeResult{
+			cols: []string{"tenant_id", "order_id", "status"},
+			rows: [][]driver.Value{{int64(1), int64(2), "paid"}},
+		}, nil
+	})
+
+	ctx := context.Background()
+	h := New(Config{CompositeKey: map[string][]string{"order_lines": {"tenant_id", "order_id"}}})
+	tx, err := h.Wrap(db).BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatalf("BeginTx() error = %v", err)
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE public.order_lines SET status = 'paid' RETURNING *`); err != nil {
+		t.Fatalf("ExecContext() error = %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Commit() error = %v", err)
+	}
+
+	execs := state.Execs()
+	if len(execs) != 1 {
+		t.Fatalf("history inserts = %d, want 1", len(execs))
+	}
+	call := execs[0]
+	if !strings.Contains(call.query, `"after", "composite_id")`) {
+		t.Fatalf("history insert = %s, want composite_id column", call.query)
+	}
+	if call.args[0] != nil {
+		t.Fatalf("history id = %v, want nil", call.args[0])
+	}
+	if got, want := string(call.args[7].([]byte)), `{"order_id":2,"tenant_id":1}`; got != want {
+		t.Fatalf("composite_id = %s, want %s", got, want)
+	}
+}
+
+func TestHandler_CompositeIDMissingColumns(t *testing.T) {
+	t.Parallel()
+
+	h := New(Config{})
+	got, err := h.compositeID(context.Background(), "orders", []string{"tenant_id", "order_id"}, nil, map[string]any{"status": "paid"})
+	if err != nil {
+		t.Fatalf("compositeID() error = %v", err)
+	}
+	if got != nil {
+		t.Fatalf("compositeID() = %s, want nil", got)
+	}
+}
+
+func TestTx_Flush(t *testing.T) {
+	t.Parallel()
+
+	returning := func(string, []any) (fakeResult, error) {
+		return fakeResult{cols: []string{"id"}, rows: [][]driver.Value{{int64(1)}}}, nil
+	}
+
+	t.Run("flush then commit", func(t *testing.T) {
+		t.Parallel()
+		db, state := openFakeDB(t, returning)
+		ctx := context.Background()
+		tx, err := New(Config{}).Wrap(db).BeginTx(ctx, nil)
+		if err != nil {
+			t.Fatalf("BeginTx() error = %v", err)
+		}
+		if _, err := tx.ExecContext(ctx, `INSERT INTO orders (id) VALUES (1) RETURNING *`); err != nil {
+			t.Fatalf("ExecContext() error = %v", err)
+		}
+		if err := tx.Flush(ctx); err != nil {
+			t.Fatalf("Flush() error = %v", err)
+		}
+		if got := len(state.Execs()); got != 1 {
+			t.Fatalf("history inserts after Flush = %d, want 1", got)
+		}
+		if err := tx.Flush(ctx); err != nil {
+			t.Fatalf("second Flush() error = %v", err)
+		}
+		if got := len(state.Execs()); got != 1 {
+			t.Fatalf("history inserts after empty Flush = %d, want 1", got)
+		}
+		if _, err := tx.ExecContext(ctx, `UPDATE orders SET status = 'paid' RETURNING *`); err != nil {
+			t.Fatalf("ExecContext() error = %v", err)
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatalf("Commit() error = %v", err)
+		}
+		execs := state.Execs()
+		if len(execs) != 2 {
+			t.Fatalf("history inserts = %d, want 2", len(execs))
+		}
+		if execs[0].args[1] != "INSERT" || execs[1].args[1] != "UPDATE" {
+			t.Fatalf("history operations = %v, %v, want INSERT, UPDATE", execs[0].args[1], execs[1].args[1])
+		}
+		if commits, rollbacks := state.Outcome(); commits != 1 || rollbacks != 0 {
+			t.Fatalf("commits, rollbacks = %d, %d, want 1, 0", commits, rollbacks)
+		}
+	})
+
+	t.Run("flush then rollback", func(t *testing.T) {
+		t.Parallel()
+		db, state := openFakeDB(t, returning)
+		ctx := context.Background()
+		tx, err := New(Config{}).Wrap(db).BeginTx(ctx, nil)
+		if err != nil {
+			t.Fatalf("BeginTx() error = %v", err)
+		}
+		if _, err := tx.ExecContext(ctx, `INSERT INTO orders (id) VALUES (1) RETURNING *`); err != nil {
+			t.Fatalf("ExecContext() error = %v", err)
+		}
+		if err := tx.Flush(ctx); err != nil {
+			t.Fatalf("Flush() error = %v", err)
+		}
+		if _, err := tx.ExecContext(ctx, `DELETE FROM orders RETURNING *`); err != nil {
+			t.Fatalf("ExecContext() error = %v", err)
+		}
+		if err := tx.Rollback(); err != nil {
+			t.Fatalf("Rollback() error = %v", err)
+		}
+		if got := len(state.Execs()); got != 1 {
+			t.Fatalf("history inserts = %d, want 1 (flushed inside the rolled back tx)", got)
+		}
+		if commits, rollbacks := state.Outcome(); commits != 0 || rollbacks != 1 {
+			t.Fatalf("commits, rollbacks = %d, %d, want 0, 1", commits, rollbacks)
+		}
+	})
+}
+
+func TestTx_RecordStatement(t *testing.T) {
+	t.Parallel()
+
+	const stmt = `UPDATE orders SET token = 'secret' WHERE id = $1 RETURNING *`
+	returning := func(string, []any) (fakeResult, error) {
+		return fakeResult{cols: []string{"id"}, rows: [][]driver.Value{{int64(1)}}}, nil
+	}
+
+	tcs := []struct {
+		name     string
+		cfg      Config
+		wantText any
+	}{
+		{
+			name:     "enabled",
+			cfg:      Config{RecordStatement: true},
+			wantText: stmt,
+		},
+		{
+			name: "enabled with redaction",
+			cfg: Config{RecordStatement: true, RedactSQL: func(q string) string {
+				return strings.ReplaceAll(q, "'secret'", "'***'")
+			}},
+			wantText: `UPDATE orders SET token = '***' WHERE id = $1 RETURNING *`,
+		},
+		{
+			name: "disabled",
+			cfg:  Config{},
+		},
+	}
+
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			db, state := openFakeDB(t, returning)
+			ctx := context.Background()
+			tx, err := New(tc.cfg).Wrap(db).BeginTx(ctx, nil)
+			if err != nil {
+				t.Fatalf("BeginTx() error = %v", err)
+			}
+			if _, err := tx.ExecContext(ctx, stmt, int64(1)); err != nil {
+				t.Fatalf("ExecContext() error = %v", err)
+			}
+			if err := tx.Commit(); err != nil {
+				t.Fatalf("Commit() error = %v", err)
+			}
+
+			execs := state.Execs()
+			if len(execs) != 1 {
+				t.Fatalf("history inserts = %d, want 1", len(execs))
+			}
+			call := execs[0]
+			hasColumn := strings.Contains(call.query, `"statement_text", "arg_count"`)
+			if !tc.cfg.RecordStatement {
+				if hasColumn || len(call.args) != 7 {
+					t.Fatalf("history insert = %s (%d args), want no statement columns", call.query, len(call.args))
+				}
+				return
+			}
+			if !hasColumn {
+				t.Fatalf("history insert = %s, want statement columns", call.query)
+			}
+			if call.args[7] != tc.wantText {
+				t.Fatalf("statement_text = %v, want %v", call.args[7], tc.wantText)
+			}
+			if call.args[8] != int64(1) {
+				t.Fatalf("arg_count = %v, want 1", call.args[8])
+			}
+		})
+	}
+}
+
+func TestTx_SchemaVersion(t *testing.T) {
+	t.Parallel()
+
+	db, state := openFakeDB(t, func(string, []any) (fakeResult, error) {
+		return fakeResult{cols: []string{"id"}, rows: [][]driver.Value{{int64(1)}}}, nil
+	})
+	ctx := context.Background()
+	tx, err := New(Config{SchemaVersion: 3, RecordStatement: true}).Wrap(db).BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatalf("BeginTx() error = %v", err)
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE orders SET status = 'paid' WHERE id = 1 RETURNING *`); err != nil {
+		t.Fatalf("ExecContext() error = %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Commit() error = %v", err)
+	}
+
+	execs := state.Execs()
+	if len(execs) != 1 {
+		t.Fatalf("history inserts = %d, want 1", len(execs))
+	}
+	call := execs[0]
+	if !strings.Contains(call.query, `"statement_text", "arg_count", "rows_affected", "schema_version"`) {
+		t.Fatalf("history insert = %s, want schema_version column", call.query)
+	}
+	if got := call.args[len(call.args)-1]; got != int64(3) {
+		t.Fatalf("schema_version = %v, want 3", got)
+	}
+}
+
+func TestTx_RecordDBUser(t *testing.T) {
+	t.Parallel()
+
+	db, state := openFakeDB(t, func(string, []any) (fakeResult, error) {
+		return fakeResult{cols: []string{"id"}, rows: [][]driver.Value{{int64(1)}}}, nil
+	})
+	ctx := context.Background()
+	tx, err := New(Config{RecordDBUser: true, SchemaVersion: 2}).Wrap(db).BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatalf("BeginTx() error = %v", err)
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE orders SET status = 'paid' WHERE id = 1 RETURNING *`); err != nil {
+		t.Fatalf("ExecContext() error = %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Commit() error = %v", err)
+	}
+
+	execs := state.Execs()
+	if len(execs) != 1 {
+		t.Fatalf("history inserts = %d, want 1", len(execs))
+	}
+	call := execs[0]
+	for _, want := range []string{`"schema_version", "db_user")`, `$8, current_user)`} {
+		if !strings.Contains(call.query, want) {
+			t.Fatalf("history insert = %s, want to contain %q", call.query, want)
+		}
+	}
+	if got := len(call.args); got != 8 {
+		t.Fatalf("history insert args = %d, want 8 (db_user is not bound)", got)
+	}
+}
+
+func TestTx_RecordTxLabel(t *testing.T) {
+	t.Parallel()
+
+	tcs := []struct {
+		name  string
+		begin func(context.Context) context.Context
+		want  any
+	}{
+		{name: "labeled transaction", begin: func(ctx context.Context) context.Context { return WithTxLabel(ctx, "checkout") }, want: "checkout"},
+		{name: "unlabeled transaction", begin: func(ctx context.Context) context.Context { return ctx }, want: nil},
+	}
+
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			db, state := openFakeDB(t, func(string, []any) (fakeResult, error) {
+				return fakeResult{cols: []string{"id"}, rows: [][]driver.Value{{int64(1)}}}, nil
+			})
+			var flushed []Record
+			h := New(Config{RecordTxLabel: true, OnFlush: func(_ context.Context, records []Record) { flushed = records }})
+			ctx := tc.begin(context.Background())
+			tx, err := h.Wrap(db).BeginTx(ctx, nil)
+			if err != nil {
+				t.Fatalf("BeginTx() error = %v", err)
+			}
+			if _, err := tx.ExecContext(ctx, `UPDATE orders SET status = 'paid' WHERE id = 1 RETURNING *`); err != nil {
+				t.Fatalf("ExecContext() error = %v", err)
+			}
+			// a label on a statement context does not change the transaction's label
+			stmtCtx := WithTxLabel(ctx, "refund")
+			if _, err := tx.ExecContext(stmtCtx, `DELETE FROM order_items WHERE order_id = 1 RETURNING *`); err != nil {
+				t.Fatalf("ExecContext() error = %v", err)
+			}
+			if err := tx.Commit(); err != nil {
+				t.Fatalf("Commit() error = %v", err)
+			}
+
+			execs := state.Execs()
+			if len(execs) != 2 {
+				t.Fatalf("history inserts = %d, want 2", len(execs))
+			}
+			for i, call := range execs {
+				if !strings.Contains(call.query, `"tx_label")`) {
+					t.Fatalf("history insert %d = %s, want tx_label column", i, call.query)
+				}
+				if got := call.args[7]; got != tc.want {
+					t.Fatalf("history insert %d tx_label = %v, want %v", i, got, tc.want)
+				}
+			}
+			for _, r := range flushed {
+				if want, _ := tc.want.(string); r.TxLabel != want {
+					t.Fatalf("Record.TxLabel = %q, want %q", r.TxLabel, want)
+				}
+			}
+		})
+	}
+}
+
+func TestTx_DryRun(t *testing.T) {
+	t.Parallel()
+
+	db, state := openFakeDB(t, func(string, []any) (fakeResult, error) {
+		return fakeResult{cols: []string{"id", "status"}, rows: [][]driver.Value{{int64(1), "paid"}}}, nil
+	})
+
+	var logs bytes.Buffer
+	var captured []Record
+	var flushed []Record
+	h := New(Config{
+		DryRun:    true,
+		Logger:    slog.New(slog.NewTextHandler(&logs, nil)),
+		OnCapture: func(_ context.Context, r Record) { captured = append(captured, r) },
+		OnFlush:   func(_ context.Context, rs []Record) { flushed = append(flushed, rs...) },
+	})
+
+	ctx := WithOperator(context.Background(), "alice")
+	tx, err := h.Wrap(db).BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatalf("BeginTx() error = %v", err)
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE orders SET status = 'paid' WHERE id = 1 RETURNING *`); err != nil {
+		t.Fatalf("ExecContext() error = %v", err)
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM orders WHERE id = 2`); err != nil {
+		t.Fatalf("ExecContext() error = %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Commit() error = %v", err)
+	}
+
+	execs := state.Execs()
+	if len(execs) != 1 || execs[0].query != `DELETE FROM orders WHERE id = 2` {
+		t.Fatalf("execs = %#v, want only the business DELETE", execs)
+	}
+	if commits, _ := state.Outcome(); commits != 1 {
+		t.Fatalf("commits = %d, want 1", commits)
+	}
+	if len(captured) != 2 {
+		t.Fatalf("OnCapture records = %d, want 2", len(captured))
+	}
+	if len(flushed) != 2 {
+		t.Fatalf("OnFlush records = %d, want 2", len(flushed))
+	}
+	if r := flushed[0]; r.Operation != "UPDATE" || r.ID != int64(1) || r.Operator != "alice" || r.After["status"] != "paid" {
+		t.Fatalf("OnFlush record = %#v", r)
+	}
+	if !strings.Contains(logs.String(), "dry run") {
+		t.Fatalf("logs = %q, want dry run message", logs.String())
+	}
+}
+
+func TestConn_BeginTx(t *testing.T) {
+	t.Parallel()
+
+	db, state := openFakeDB(t, func(string, []any) (fakeResult, error) {
+		return fakeResult{cols: []string{"id", "status"}, rows: [][]driver.Value{{int64(1), "paid"}}}, nil
+	})
+	ctx := WithOperator(context.Background(), "alice")
+
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatalf("Conn() error = %v", err)
+	}
+	defer func() { _ = conn.Close() }()
+
+	tx, err := New(Config{}).WrapConn(conn).BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatalf("BeginTx() error = %v", err)
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE orders SET status = 'paid' WHERE id = 1 RETURNING *`); err != nil {
+		t.Fatalf("ExecContext() error = %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Commit() error = %v", err)
+	}
+
+	execs := state.Execs()
+	if len(execs) != 1 {
+		t.Fatalf("history inserts = %d, want 1", len(execs))
+	}
+	if !strings.Contains(execs[0].query, `INSERT INTO "orders_history"`) {
+		t.Fatalf("history insert = %s", execs[0].query)
+	}
+	if got := execs[0].args; got[0] != int64(1) || got[1] != "UPDATE" || got[2] != "alice" {
+		t.Fatalf("history args = %v", got)
+	}
+}
+
+func TestUnwrap(t *testing.T) {
+	t.Parallel()
+
+	db, state := openFakeDB(t, func(string, []any) (fakeResult, error) {
+		return fakeResult{cols: []string{"id"}, rows: [][]driver.Value{{int64(1)}}}, nil
+	})
+	ctx := context.Background()
+	h := New(Config{})
+
+	wrapped := h.Wrap(db)
+	if got := wrapped.Unwrap(); got != db {
+		t.Fatalf("DB.Unwrap() = %p, want %p", got, db)
+	}
+
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatalf("Conn() error = %v", err)
+	}
+	defer func() { _ = conn.Close() }()
+	if got := h.WrapConn(conn).Unwrap(); got != conn {
+		t.Fatalf("Conn.Unwrap() = %p, want %p", got, conn)
+	}
+
+	tx, err := wrapped.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatalf("BeginTx() error = %v", err)
+	}
+	raw := tx.Unwrap()
+	if raw != tx.Tx {
+		t.Fatalf("Tx.Unwrap() = %p, want %p", raw, tx.Tx)
+	}
+	// Statements on the unwrapped transaction bypass capture.
+	if _, err := raw.ExecContext(ctx, `UPDATE orders SET status = 'paid' WHERE id = 1 RETURNING *`); err != nil {
+		t.Fatalf("ExecContext() error = %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Commit() error = %v", err)
+	}
+	if execs := state.Execs(); len(execs) != 1 || strings.Contains(execs[0].query, "orders_history") {
+		t.Fatalf("execs = %#v, want only the uncaptured UPDATE", execs)
+	}
+}
+
+func TestTx_AfterCommit(t *testing.T) {
+	t.Parallel()
+
+	returning := func(string, []any) (fakeResult, error) {
+		return fakeResult{cols: []string{"id"}, rows: [][]driver.Value{{int64(1)}}}, nil
+	}
+
+	tcs := []struct {
+		name      string
+		commitErr error
+		hookErr   error
+		flushMid  bool
+		wantCalls int
+		wantIDs   []any
+		wantErr   string
+	}{
+		{name: "called after commit", wantCalls: 1, wantIDs: []any{int64(1), int64(1)}},
+		{name: "includes records of earlier flushes", flushMid: true, wantCalls: 1, wantIDs: []any{int64(1), int64(1)}},
+		{name: "not called when commit fails", commitErr: errors.New("commit failed"), wantErr: "commit failed"},
+		{name: "hook error is returned", hookErr: errors.New("publish failed"), wantCalls: 1, wantIDs: []any{int64(1), int64(1)}, wantErr: "(transaction is committed): publish failed"},
+	}
+
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			db, state := openFakeDB(t, returning)
+			state.commitErr = tc.commitErr
+
+			calls := 0
+			var ids []any
+			h := New(Config{AfterCommit: func(_ context.Context, records []Record) error {
+				calls++
+				for _, r := range records {
+					ids = append(ids, r.ID)
+				}
+				return tc.hookErr
+			}})
+
+			ctx := context.Background()
+			tx, err := h.Wrap(db).BeginTx(ctx, nil)
+			if err != nil {
+				t.Fatalf("BeginTx() error = %v", err)
+			}
+			for _, q := range []string{
+				`INSERT INTO orders (id) VALUES (1) RETURNING *`,
+				`UPDATE orders SET status = 'paid' WHERE id = 1 RETURNING *`,
+			} {
+				if _, err := tx.ExecContext(ctx, q); err != nil {
+					t.Fatalf("ExecContext() error = %v", err)
+				}
+				if tc.flushMid {
+					if err := tx.Flush(ctx); err != nil {
+						t.Fatalf("Flush() error = %v", err)
+					}
+				}
+			}
+			err = tx.Commit()
+			if tc.wantErr == "" && err != nil {
+				t.Fatalf("Commit() error = %v", err)
+			}
+			if tc.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tc.wantErr)) {
+				t.Fatalf("Commit() error = %v, want containing %q", err, tc.wantErr)
+			}
+			if calls != tc.wantCalls {
+				t.Fatalf("AfterCommit calls = %d, want %d", calls, tc.wantCalls)
+			}
+			if !reflect.DeepEqual(ids, tc.wantIDs) {
+				t.Fatalf("AfterCommit ids = %v, want %v", ids, tc.wantIDs)
+			}
+			if tc.hookErr != nil {
+				if commits, _ := state.Outcome(); commits != 1 {
+					t.Fatalf("commits = %d, want 1", commits)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,228 @@
+package gostry
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mickamy/gostry/internal/canonjson"
+	"github.com/mickamy/gostry/internal/ident"
+)
+
+// historyTx is the subset of *sql.Tx used to write history rows.
+type historyTx interface {
+	execer
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// chainLink carries the content of a history row that is covered by its row_hash.
+type chainLink struct {
+	historyParts []string
+	operation    string
+	id           any
+	before       []byte
+	after        []byte
+	argIndex     int // index of the prev_hash argument; row_hash follows it
+}
+
+// chainContent is the document hashed into row_hash. Before and after are canonicalized so the
+// hash survives the key reordering and whitespace normalization applied by JSONB.
+type chainContent struct {
+	PrevHash   string          `json:"prev_hash"`
+	Table      string          `json:"table"`
+	Operation  string          `json:"operation"`
+	ID         string          `json:"id"`
+	Before     json.RawMessage `json:"before"`
+	After      json.RawMessage `json:"after"`
+	OperatedAt string          `json:"operated_at"`
+}
+
+// chainHash computes the row_hash of a history row of historyTable (the unqualified history table
+// name) from the previous row's hash and the row content. It is shared by flush and VerifyHistory.
+func chainHash(prevHash, historyTable, operation string, id any, before, after []byte, operatedAt time.Time) (string, error) {
+	c := chainContent{
+		PrevHash:   prevHash,
+		Table:      historyTable,
+		Operation:  operation,
+		ID:         chainID(id),
+		OperatedAt: operatedAt.UTC().Truncate(time.Microsecond).Format(time.RFC3339Nano),
+	}
+	var err error
+	if c.Before, err = canonicalImage(before); err != nil {
+		return "", fmt.Errorf("gostry: failed to canonicalize before: %w", err)
+	}
+	if c.After, err = canonicalImage(after); err != nil {
+		return "", fmt.Errorf("gostry: failed to canonicalize after: %w", err)
+	}
+	b, err := json.Marshal(c)
+	if err != nil {
+		return "", withKind(ErrMarshal, fmt.Errorf("gostry: failed to encode hash content: %w", err))
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// chainID renders a history id the same way whether it was bound by flush or read back from the table.
+func chainID(id any) string {
+	switch v := id.(type) {
+	case nil:
+		return ""
+	case []byte:
+		return string(v)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// canonicalImage canonicalizes a before/after document; SQL NULL and empty input hash as JSON null.
+func canonicalImage(b []byte) ([]byte, error) {
+	if len(b) == 0 {
+		return []byte("null"), nil
+	}
+	return canonjson.Canonicalize(b)
+}
+
+// chainHistoryRows fills prev_hash and row_hash of every chained row in rows. Each history table is
+// locked with a transaction-scoped advisory lock before its latest row_hash is read, so concurrent
+// writers extend the chain one after another; the lock is released when tx commits or rolls back.
+// The chain is only linear under READ COMMITTED, where the read sees rows committed while waiting;
+// startTx rejects stronger isolation levels when HashChain is set. The tail is the row with the
+// highest history_id, which is only the latest row when ids come from the BIGSERIAL sequence, so New
+// rejects HistoryIDGenerator and Migrate rejects any other HistoryIDType when HashChain is set.
+func chainHistoryRows(ctx context.Context, exec execer, rows []historyRow) error {
+	type tail struct {
+		hash string
+		now  time.Time
+	}
+	tails := map[string]*tail{}
+	for i := range rows {
+		link := rows[i].chain
+		if link == nil {
+			continue
+		}
+		table := link.historyParts[len(link.historyParts)-1]
+		t, ok := tails[table]
+		if !ok {
+			tx, ok := exec.(historyTx)
+			if !ok {
+				return errors.New("gostry: HashChain requires a database/sql transaction")
+			}
+			if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock(hashtext($1))`, "gostry:"+table); err != nil {
+				return fmt.Errorf("gostry: failed to lock history chain of %s: %w", table, err)
+			}
+			q := defaultHistoryColumns.quoted()
+			var prev sql.NullString
+			t = &tail{}
+			err := tx.QueryRowContext(ctx, fmt.Sprintf(`SELECT now(), (SELECT %s FROM %s ORDER BY %s DESC LIMIT 1)`,
+				q.rowHash, ident.QuoteQualified(link.historyParts), q.historyID)).Scan(&t.now, &prev)
+			if err != nil {
+				return historyTableError(fmt.Errorf("gostry: failed to read history chain of %s: %w", table, err))
+			}
+			t.hash = prev.String
+			tails[table] = t
+		}
+		hash, err := chainHash(t.hash, table, link.operation, link.id, link.before, link.after, t.now)
+		if err != nil {
+			return err
+		}
+		rows[i].args[link.argIndex] = nullIfEmpty(t.hash)
+		rows[i].args[link.argIndex+1] = hash
+		t.hash = hash
+	}
+	return nil
+}
+
+// nullIfEmpty maps "" to NULL, e.g. the prev_hash of the first row of a chain.
+func nullIfEmpty(s string) any {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// VerifyHistory walks the history table of table in history_id order and recomputes every row_hash
+// written with Config.HashChain. It returns true when the chain is intact; otherwise it returns false
+// and the history_id of the first row whose prev_hash does not match the preceding row or whose
+// row_hash does not match its content (an int64, as HashChain requires BIGSERIAL ids; nil when the
+// chain is intact). Rows written before the chain started (NULL row_hash) are skipped.
+func VerifyHistory(ctx context.Context, db DBExecQuerier, cfg Config, table string) (bool, any, error) {
+	historyParts := cfg.HistoryTableIdentifier(table)
+	historyIdent := ident.QuoteQualified(historyParts)
+	if historyIdent == "" {
+		return false, nil, &InvalidIdentifierError{Table: table}
+	}
+	historyTable := historyParts[len(historyParts)-1]
+	q := defaultHistoryColumns.quoted()
+	columns := []string{q.historyID, q.id, q.operation, q.operatedAt, q.before, q.after, q.prevHash, q.rowHash}
+	if cfg.CompressThreshold > 0 {
+		columns = append(columns, q.beforeGzip, q.afterGzip)
+	}
+	rows, err := db.QueryContext(ctx, fmt.Sprintf(`SELECT %s FROM %s ORDER BY %s`,
+		strings.Join(columns, ", "), historyIdent, q.historyID))
+	if err != nil {
+		return false, nil, historyTableError(fmt.Errorf("gostry: failed to read %s: %w", historyIdent, err))
+	}
+	defer func(rows *sql.Rows) {
+		_ = rows.Close()
+	}(rows)
+
+	started := false
+	var expectPrev string
+	for rows.Next() {
+		var (
+			historyID         any
+			id                any
+			operation         string
+			operatedAt        time.Time
+			before, after     []byte
+			beforeGz, afterGz []byte
+			prevHash, rowHash sql.NullString
+		)
+		dest := []any{&historyID, &id, &operation, &operatedAt, &before, &after, &prevHash, &rowHash}
+		if cfg.CompressThreshold > 0 {
+			dest = append(dest, &beforeGz, &afterGz)
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return false, nil, withKind(ErrScan, fmt.Errorf("gostry: failed to scan %s: %w", historyIdent, err))
+		}
+		historyID = historyIDValue(historyID)
+		if !rowHash.Valid && !started {
+			continue
+		}
+		started = true
+		if !rowHash.Valid || prevHash.String != expectPrev {
+			return false, historyID, nil
+		}
+		if before, err = storedImage(before, beforeGz); err != nil {
+			return false, historyID, err
+		}
+		if after, err = storedImage(after, afterGz); err != nil {
+			return false, historyID, err
+		}
+		if before, err = imageJSON(cfg.Encoding, before); err != nil {
+			return false, historyID, err
+		}
+		if after, err = imageJSON(cfg.Encoding, after); err != nil {
+			return false, historyID, err
+		}
+		want, err := chainHash(prevHash.String, historyTable, operation, id, before, after, operatedAt)
+		if err != nil {
+			return false, historyID, err
+		}
+		if rowHash.String != want {
+			return false, historyID, nil
+		}
+		expectPrev = rowHash.String
+	}
+	if err := rows.Err(); err != nil {
+		return false, nil, fmt.Errorf("gostry: failed to read %s: %w", historyIdent, err)
+	}
+	return true, nil, nil
+}
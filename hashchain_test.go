@@ -0,0 +1,241 @@
+package gostry
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeChainDB answers the hash-chain tail query with the row_hash of the latest history insert.
+func fakeChainDB(t *testing.T, now time.Time) (*fakeState, *DB) {
+	t.Helper()
+	var state *fakeState
+	db, st := openFakeDB(t, func(q string, _ []any) (fakeResult, error) {
+		if strings.Contains(q, "SELECT now()") {
+			var last driver.Value
+			for _, call := range state.Execs() {
+				if strings.Contains(call.query, "INSERT INTO") {
+					last = call.args[len(call.args)-1]
+				}
+			}
+			return fakeResult{cols: []string{"now", "row_hash"}, rows: [][]driver.Value{{now, last}}}, nil
+		}
+		return fakeResult{cols: []string{"id", "status"}, rows: [][]driver.Value{{int64(1), "paid"}}}, nil
+	})
+	state = st
+	return state, New(Config{HashChain: true}).Wrap(db)
+}
+
+func TestTx_HashChain(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2026, 1, 2, 3, 4, 5, 678901000, time.UTC)
+	state, db := fakeChainDB(t, now)
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			t.Fatalf("BeginTx() error = %v", err)
+		}
+		if _, err := tx.ExecContext(ctx, `UPDATE orders SET status = 'paid' WHERE id = 1 RETURNING *`); err != nil {
+			t.Fatalf("ExecContext() error = %v", err)
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatalf("Commit() error = %v", err)
+		}
+	}
+
+	var inserts []fakeCall
+	locks := 0
+	for _, call := range state.Execs() {
+		switch {
+		case strings.Contains(call.query, "pg_advisory_xact_lock"):
+			locks++
+		case strings.Contains(call.query, "INSERT INTO"):
+			if !strings.Contains(call.query, `"prev_hash", "row_hash")`) {
+				t.Fatalf("history insert = %s, want prev_hash and row_hash columns", call.query)
+			}
+			inserts = append(inserts, call)
+		}
+	}
+	if len(inserts) != 2 || locks != 2 {
+		t.Fatalf("history inserts = %d, locks = %d, want 2 and 2", len(inserts), locks)
+	}
+
+	first, second := inserts[0].args, inserts[1].args
+	n := len(first)
+	if first[n-2] != nil {
+		t.Fatalf("first prev_hash = %v, want NULL", first[n-2])
+	}
+	want, err := chainHash("", "orders_history", "UPDATE", int64(1), first[5].([]byte), first[6].([]byte), now)
+	if err != nil {
+		t.Fatalf("chainHash() error = %v", err)
+	}
+	if first[n-1] != want {
+		t.Fatalf("first row_hash = %v, want %s", first[n-1], want)
+	}
+	if second[n-2] != first[n-1] {
+		t.Fatalf("second prev_hash = %v, want first row_hash %v", second[n-2], first[n-1])
+	}
+	want, err = chainHash(want, "orders_history", "UPDATE", int64(1), second[5].([]byte), second[6].([]byte), now)
+	if err != nil {
+		t.Fatalf("chainHash() error = %v", err)
+	}
+	if second[n-1] != want {
+		t.Fatalf("second row_hash = %v, want %s", second[n-1], want)
+	}
+}
+
+func TestTx_HashChainIsolation(t *testing.T) {
+	t.Parallel()
+
+	tcs := []struct {
+		name    string
+		opts    *sql.TxOptions
+		wantErr bool
+	}{
+		{name: "default", opts: nil},
+		{name: "read committed", opts: &sql.TxOptions{Isolation: sql.LevelReadCommitted}},
+		{name: "repeatable read", opts: &sql.TxOptions{Isolation: sql.LevelRepeatableRead}, wantErr: true},
+		{name: "serializable", opts: &sql.TxOptions{Isolation: sql.LevelSerializable}, wantErr: true},
+	}
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			state, db := fakeChainDB(t, time.Now())
+			tx, err := db.BeginTx(context.Background(), tc.opts)
+			if !tc.wantErr {
+				if err != nil {
+					t.Fatalf("BeginTx() error = %v", err)
+				}
+				_ = tx.Rollback()
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), "HashChain requires READ COMMITTED") {
+				t.Fatalf("BeginTx() error = %v, want HashChain isolation error", err)
+			}
+			if _, rollbacks := state.Outcome(); rollbacks != 1 {
+				t.Fatalf("rollbacks = %d, want 1", rollbacks)
+			}
+		})
+	}
+}
+
+func TestTx_HashChainRejectsHistoryIDGenerator(t *testing.T) {
+	t.Parallel()
+
+	db, state := openFakeDB(t, func(string, []any) (fakeResult, error) {
+		return fakeResult{}, nil
+	})
+	h := New(Config{HashChain: true, HistoryIDGenerator: func() any { return "id" }})
+	_, err := h.Wrap(db).BeginTx(context.Background(), nil)
+	if err == nil || !strings.Contains(err.Error(), "cannot be combined with HistoryIDGenerator") {
+		t.Fatalf("BeginTx() error = %v, want HistoryIDGenerator conflict", err)
+	}
+	if _, rollbacks := state.Outcome(); rollbacks != 1 {
+		t.Fatalf("rollbacks = %d, want 1", rollbacks)
+	}
+}
+
+func TestChainHash_StableAcrossJSONBNormalization(t *testing.T) {
+	t.Parallel()
+
+	at := time.Date(2026, 1, 2, 3, 4, 5, 678901234, time.FixedZone("JST", 9*3600))
+	written, err := chainHash("prev", "orders_history", "UPDATE", int64(7), nil, []byte(`{"status":"paid","id":7}`), at)
+	if err != nil {
+		t.Fatalf("chainHash() error = %v", err)
+	}
+	read, err := chainHash("prev", "orders_history", "UPDATE", []byte("7"), []byte("null"), []byte(`{"id": 7, "status": "paid"}`), at.UTC().Truncate(time.Microsecond))
+	if err != nil {
+		t.Fatalf("chainHash() error = %v", err)
+	}
+	if written != read {
+		t.Fatalf("chainHash() differs after JSONB round trip: %s != %s", written, read)
+	}
+}
+
+func TestVerifyHistory(t *testing.T) {
+	t.Parallel()
+
+	at := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	// chain builds history rows 1..n linked the same way flush links them.
+	chain := func(t *testing.T, afters ...string) [][]driver.Value {
+		t.Helper()
+		var rows [][]driver.Value
+		prev := ""
+		for i, after := range afters {
+			hash, err := chainHash(prev, "orders_history", "UPDATE", int64(1), nil, []byte(after), at)
+			if err != nil {
+				t.Fatalf("chainHash() error = %v", err)
+			}
+			var prevValue driver.Value
+			if prev != "" {
+				prevValue = prev
+			}
+			rows = append(rows, []driver.Value{int64(i + 1), int64(1), "UPDATE", at, nil, []byte(after), prevValue, hash})
+			prev = hash
+		}
+		return rows
+	}
+	legacy := []driver.Value{int64(0), int64(1), "INSERT", at, nil, []byte(`{"id":1}`), nil, nil}
+
+	tcs := []struct {
+		name   string
+		rows   func(t *testing.T) [][]driver.Value
+		wantOK bool
+		wantID any
+	}{
+		{
+			name: "intact chain after unchained rows",
+			rows: func(t *testing.T) [][]driver.Value {
+				return append([][]driver.Value{legacy}, chain(t, `{"id":1,"status":"new"}`, `{"id": 1, "status": "paid"}`)...)
+			},
+			wantOK: true,
+		},
+		{
+			name: "edited after image",
+			rows: func(t *testing.T) [][]driver.Value {
+				rows := chain(t, `{"id":1,"status":"new"}`, `{"id":1,"status":"paid"}`, `{"id":1,"status":"shipped"}`)
+				rows[1][5] = []byte(`{"id":1,"status":"refunded"}`)
+				return rows
+			},
+			wantID: int64(2),
+		},
+		{
+			name: "deleted row",
+			rows: func(t *testing.T) [][]driver.Value {
+				rows := chain(t, `{"id":1,"status":"new"}`, `{"id":1,"status":"paid"}`, `{"id":1,"status":"shipped"}`)
+				return append(rows[:1], rows[2])
+			},
+			wantID: int64(3),
+		},
+	}
+
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			rows := tc.rows(t)
+			db, state := openFakeDB(t, func(string, []any) (fakeResult, error) {
+				return fakeResult{
+					cols: []string{"history_id", "id", "operation", "operated_at", "before", "after", "prev_hash", "row_hash"},
+					rows: rows,
+				}, nil
+			})
+			ok, badID, err := VerifyHistory(context.Background(), db, Config{}, "orders")
+			if err != nil {
+				t.Fatalf("VerifyHistory() error = %v", err)
+			}
+			if ok != tc.wantOK || badID != tc.wantID {
+				t.Fatalf("VerifyHistory() = (%t, %v), want (%t, %v)", ok, badID, tc.wantOK, tc.wantID)
+			}
+			if q := state.Queries()[0].query; !strings.Contains(q, `FROM "orders_history" ORDER BY "history_id"`) {
+				t.Fatalf("VerifyHistory() query = %s", q)
+			}
+		})
+	}
+}
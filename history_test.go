@@ -0,0 +1,89 @@
+package gostry_test
+
+import (
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/mickamy/gostry"
+)
+
+func TestHistoryTableIdentifier(t *testing.T) {
+	t.Parallel()
+
+	tcs := []struct {
+		name     string
+		suffix   string
+		base     string
+		want     []string
+		wantName string
+	}{
+		{name: "default suffix", base: "orders", want: []string{"orders_history"}, wantName: "orders_history"},
+		{name: "custom suffix", suffix: "_audit", base: "orders", want: []string{"orders_audit"}, wantName: "orders_audit"},
+		{name: "schema qualified", base: "sales.orders", want: []string{"sales", "orders_history"}, wantName: "sales.orders_history"},
+		{name: "quoted", base: `"Sales"."Order Items"`, want: []string{"Sales", "Order Items_history"}, wantName: "Sales.Order Items_history"},
+		{name: "empty", base: "", want: []string{"_history"}, wantName: "_history"},
+	}
+
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			cfg := gostry.Config{HistorySuffix: tc.suffix}
+			if got := cfg.HistoryTableIdentifier(tc.base); !slices.Equal(got, tc.want) {
+				t.Fatalf("Config.HistoryTableIdentifier(%q) = %#v, want %#v", tc.base, got, tc.want)
+			}
+			if got := gostry.New(cfg).HistoryTableIdentifier(tc.base); !slices.Equal(got, tc.want) {
+				t.Fatalf("Handler.HistoryTableIdentifier(%q) = %#v, want %#v", tc.base, got, tc.want)
+			}
+			if got := cfg.HistoryTableName(tc.base); got != tc.wantName {
+				t.Fatalf("Config.HistoryTableName(%q) = %q, want %q", tc.base, got, tc.wantName)
+			}
+		})
+	}
+}
+
+type historyTestOrderItem struct{}
+
+type historyTestNamed struct{}
+
+func (historyTestNamed) TableName() string { return "billing.invoices" }
+
+func TestHistoryTableNameFor(t *testing.T) {
+	t.Parallel()
+
+	tcs := []struct {
+		name   string
+		cfg    gostry.Config
+		target any
+		want   string
+	}{
+		{name: "string", target: "orders", want: `"orders_history"`},
+		{name: "schema qualified string", target: "sales.orders", want: `"sales"."orders_history"`},
+		{name: "custom suffix", cfg: gostry.Config{HistorySuffix: "_audit"}, target: "orders", want: `"orders_audit"`},
+		{name: "struct", target: historyTestOrderItem{}, want: `"history_test_order_items_history"`},
+		{name: "struct pointer singular", cfg: gostry.Config{SingularTableNames: true}, target: &historyTestOrderItem{}, want: `"history_test_order_item_history"`},
+		{name: "table namer", target: historyTestNamed{}, want: `"billing"."invoices_history"`},
+	}
+
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			got, err := gostry.HistoryTableNameFor(tc.cfg, tc.target)
+			if err != nil {
+				t.Fatalf("HistoryTableNameFor(%v) error = %v", tc.target, err)
+			}
+			if got != tc.want {
+				t.Fatalf("HistoryTableNameFor(%v) = %s, want %s", tc.target, got, tc.want)
+			}
+		})
+	}
+
+	if _, err := gostry.HistoryTableNameFor(gostry.Config{}, "a..b"); !errors.Is(err, gostry.ErrInvalidIdentifier) {
+		t.Fatalf("HistoryTableNameFor(invalid) error = %v, want ErrInvalidIdentifier", err)
+	}
+	if _, err := gostry.HistoryTableNameFor(gostry.Config{}, 42); err == nil {
+		t.Fatal("HistoryTableNameFor(int) error = nil, want error")
+	}
+}
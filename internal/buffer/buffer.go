@@ -6,20 +6,72 @@ import (
 
 // Buffer collects entries within a transaction.
 type Buffer[T any] struct {
-	mu sync.Mutex
-	ts []T
+	mu   sync.Mutex
+	ts   []T
+	pool *Pool[T]
 }
 
 func NewBuffer[T any]() *Buffer[T] {
 	return &Buffer[T]{}
 }
 
+// Pool recycles the backing arrays of buffers across transactions.
+// The zero value is ready to use and must not be copied after first use.
+type Pool[T any] struct {
+	p sync.Pool
+}
+
+// NewBuffer returns an empty buffer whose backing array is taken from and returned to p.
+func (p *Pool[T]) NewBuffer() *Buffer[T] {
+	return &Buffer[T]{pool: p}
+}
+
+func (p *Pool[T]) get() []T {
+	if v, ok := p.p.Get().(*[]T); ok {
+		return (*v)[:0]
+	}
+	return nil
+}
+
+func (p *Pool[T]) put(ts []T) {
+	if cap(ts) == 0 {
+		return
+	}
+	clear(ts)
+	ts = ts[:0]
+	p.p.Put(&ts)
+}
+
 func (b *Buffer[T]) Add(t T) {
 	b.mu.Lock()
 	defer b.mu.Unlock()
+	if b.ts == nil && b.pool != nil {
+		b.ts = b.pool.get()
+	}
 	b.ts = append(b.ts, t)
 }
 
+// Len returns the number of buffered entries.
+func (b *Buffer[T]) Len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.ts)
+}
+
+// Snapshot returns a copy of the buffered entries, leaving the buffer unchanged. The copy has its
+// own backing array, so later Add, Drain, or Reset calls (including pool reuse) do not affect it and
+// writes to it do not reach the buffer; values referenced by the entries (maps, slices) are shared.
+func (b *Buffer[T]) Snapshot() []T {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.ts) == 0 {
+		return nil
+	}
+	return append([]T(nil), b.ts...)
+}
+
+// Drain removes and returns the buffered entries. The caller owns the returned slice;
+// pass it to Recycle once it is no longer used to let a pooled buffer reuse it.
 func (b *Buffer[T]) Drain() []T {
 	b.mu.Lock()
 	ts := b.ts
@@ -28,6 +80,18 @@ func (b *Buffer[T]) Drain() []T {
 	return ts
 }
 
+// Recycle returns a slice obtained from Drain to the buffer's pool. It is a no-op for unpooled buffers.
+func (b *Buffer[T]) Recycle(ts []T) {
+	if b.pool != nil {
+		b.pool.put(ts)
+	}
+}
+
+// Reset discards the buffered entries, returning the backing array to the pool if there is one.
 func (b *Buffer[T]) Reset() {
-	b.Drain()
+	b.mu.Lock()
+	ts := b.ts
+	b.ts = nil
+	b.mu.Unlock()
+	b.Recycle(ts)
 }
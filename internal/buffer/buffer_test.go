@@ -0,0 +1,89 @@
+package buffer_test
+
+import (
+	"testing"
+
+	"github.com/mickamy/gostry/internal/buffer"
+)
+
+func TestBuffer_Reset(t *testing.T) {
+	t.Parallel()
+
+	var pool buffer.Pool[int]
+	for _, b := range []*buffer.Buffer[int]{buffer.NewBuffer[int](), pool.NewBuffer()} {
+		b.Add(1)
+		b.Add(2)
+		if got := b.Len(); got != 2 {
+			t.Fatalf("Len() = %d, want 2", got)
+		}
+		b.Reset()
+		if got := b.Len(); got != 0 {
+			t.Fatalf("Len() after Reset() = %d, want 0", got)
+		}
+		if got := b.Drain(); len(got) != 0 {
+			t.Fatalf("Drain() after Reset() = %v, want empty", got)
+		}
+		b.Add(3)
+		if got := b.Drain(); len(got) != 1 || got[0] != 3 {
+			t.Fatalf("Drain() = %v, want [3]", got)
+		}
+	}
+}
+
+func TestBuffer_Snapshot(t *testing.T) {
+	t.Parallel()
+
+	var pool buffer.Pool[int]
+	for _, b := range []*buffer.Buffer[int]{buffer.NewBuffer[int](), pool.NewBuffer()} {
+		if got := b.Snapshot(); len(got) != 0 {
+			t.Fatalf("Snapshot() of empty buffer = %v, want empty", got)
+		}
+		b.Add(1)
+		b.Add(2)
+		snap := b.Snapshot()
+		if len(snap) != 2 || snap[0] != 1 || snap[1] != 2 {
+			t.Fatalf("Snapshot() = %v, want [1 2]", snap)
+		}
+
+		snap[0] = 100
+		b.Add(3)
+		if len(snap) != 2 || snap[1] != 2 {
+			t.Fatalf("Snapshot() after Add = %v, want [100 2]", snap)
+		}
+		got := b.Drain()
+		if len(got) != 3 || got[0] != 1 || got[2] != 3 {
+			t.Fatalf("Drain() = %v, want [1 2 3]", got)
+		}
+		b.Recycle(got)
+		b.Add(4)
+		if snap[0] != 100 || snap[1] != 2 {
+			t.Fatalf("Snapshot() after Recycle and Add = %v, want [100 2]", snap)
+		}
+	}
+}
+
+// BenchmarkBuffer simulates many short transactions that capture a few entries and roll back.
+func BenchmarkBuffer(b *testing.B) {
+	type entry struct {
+		table string
+		args  []any
+	}
+	run := func(b *testing.B, newBuffer func() *buffer.Buffer[entry]) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			buf := newBuffer()
+			for j := 0; j < 16; j++ {
+				buf.Add(entry{table: "orders"})
+			}
+			buf.Reset()
+		}
+	}
+
+	b.Run("unpooled", func(b *testing.B) {
+		run(b, buffer.NewBuffer[entry])
+	})
+	b.Run("pooled", func(b *testing.B) {
+		var pool buffer.Pool[entry]
+		run(b, pool.NewBuffer)
+	})
+}
@@ -0,0 +1,78 @@
+package canonjson_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/mickamy/gostry/internal/canonjson"
+)
+
+func TestCanonicalize(t *testing.T) {
+	t.Parallel()
+
+	tcs := []struct {
+		name    string
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "nested objects and arrays",
+			in:   `{"z": 1, "a": {"y": [ {"b": 2, "a": 1} ], "x": null}, "m": "<tag>"}`,
+			want: `{"a":{"x":null,"y":[{"a":1,"b":2}]},"m":"\u003ctag\u003e","z":1}`,
+		},
+		{
+			name: "numbers kept verbatim",
+			in:   `{"big": 12345678901234567890, "f": 1.50}`,
+			want: `{"big":12345678901234567890,"f":1.50}`,
+		},
+		{name: "null", in: `null`, want: `null`},
+		{name: "invalid", in: `{"a":`, wantErr: true},
+		{name: "trailing data", in: `{} {}`, wantErr: true},
+	}
+
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			got, err := canonjson.Canonicalize([]byte(tc.in))
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("Canonicalize() error = %v, wantErr %t", err, tc.wantErr)
+			}
+			if string(got) != tc.want {
+				t.Fatalf("Canonicalize() = %s, want %s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestCanonicalize_Stable(t *testing.T) {
+	t.Parallel()
+
+	doc := map[string]any{}
+	for _, k := range []string{"q", "w", "e", "r", "t", "y"} {
+		doc[k] = map[string]any{"k3": k, "k1": []any{map[string]any{"z": 1, "a": 2}}, "k2": nil}
+	}
+	first := ""
+	for i := 0; i < 50; i++ {
+		raw, err := json.Marshal(doc)
+		if err != nil {
+			t.Fatalf("json.Marshal() error = %v", err)
+		}
+		got, err := canonjson.Canonicalize(raw)
+		if err != nil {
+			t.Fatalf("Canonicalize() error = %v", err)
+		}
+		if i == 0 {
+			first = string(got)
+			continue
+		}
+		if string(got) != first {
+			t.Fatalf("run %d = %s, want %s", i, got, first)
+		}
+	}
+	want := `{"e":{"k1":[{"a":2,"z":1}],"k2":null,"k3":"e"},`
+	if first[:len(want)] != want {
+		t.Fatalf("Canonicalize() = %s, want prefix %s", first, want)
+	}
+}
@@ -0,0 +1,361 @@
+// Package cbor implements the subset of CBOR (RFC 8949) needed to store row images: null, booleans,
+// integers, floats, text and byte strings, arrays, and string-keyed maps. Maps are encoded with
+// their keys in deterministic (bytewise) order so equal images encode to equal bytes.
+package cbor
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	majorUint   = 0
+	majorNegInt = 1
+	majorBytes  = 2
+	majorText   = 3
+	majorArray  = 4
+	majorMap    = 5
+	majorTag    = 6
+	majorSimple = 7
+
+	tagDateTime = 0 // RFC 3339 date/time string
+	maxDepth    = 1000
+)
+
+// Marshal encodes v. Values of types outside the supported subset (e.g. structs) are encoded
+// through their encoding/json representation.
+func Marshal(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := encode(&buf, v, 0); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func encode(buf *bytes.Buffer, v any, depth int) error {
+	if depth > maxDepth {
+		return errors.New("cbor: value nested too deeply")
+	}
+	switch x := v.(type) {
+	case nil:
+		buf.WriteByte(0xf6)
+	case bool:
+		if x {
+			buf.WriteByte(0xf5)
+		} else {
+			buf.WriteByte(0xf4)
+		}
+	case string:
+		writeHead(buf, majorText, uint64(len(x)))
+		buf.WriteString(x)
+	case []byte:
+		writeHead(buf, majorBytes, uint64(len(x)))
+		buf.Write(x)
+	case int:
+		writeInt(buf, int64(x))
+	case int8:
+		writeInt(buf, int64(x))
+	case int16:
+		writeInt(buf, int64(x))
+	case int32:
+		writeInt(buf, int64(x))
+	case int64:
+		writeInt(buf, x)
+	case uint:
+		writeHead(buf, majorUint, uint64(x))
+	case uint8:
+		writeHead(buf, majorUint, uint64(x))
+	case uint16:
+		writeHead(buf, majorUint, uint64(x))
+	case uint32:
+		writeHead(buf, majorUint, uint64(x))
+	case uint64:
+		writeHead(buf, majorUint, x)
+	case float32:
+		writeFloat(buf, float64(x))
+	case float64:
+		writeFloat(buf, x)
+	case json.Number:
+		if n, err := strconv.ParseInt(x.String(), 10, 64); err == nil {
+			writeInt(buf, n)
+			return nil
+		}
+		f, err := x.Float64()
+		if err != nil {
+			return fmt.Errorf("cbor: invalid number %q", x)
+		}
+		writeFloat(buf, f)
+	case time.Time:
+		writeHead(buf, majorTag, tagDateTime)
+		s := x.Format(time.RFC3339Nano)
+		writeHead(buf, majorText, uint64(len(s)))
+		buf.WriteString(s)
+	case map[string]any:
+		keys := make([]string, 0, len(x))
+		for k := range x {
+			keys = append(keys, k)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			// Bytewise order of the encoded keys: shorter keys first, then lexicographic.
+			if len(keys[i]) != len(keys[j]) {
+				return len(keys[i]) < len(keys[j])
+			}
+			return keys[i] < keys[j]
+		})
+		writeHead(buf, majorMap, uint64(len(x)))
+		for _, k := range keys {
+			writeHead(buf, majorText, uint64(len(k)))
+			buf.WriteString(k)
+			if err := encode(buf, x[k], depth+1); err != nil {
+				return err
+			}
+		}
+	case []any:
+		writeHead(buf, majorArray, uint64(len(x)))
+		for _, elem := range x {
+			if err := encode(buf, elem, depth+1); err != nil {
+				return err
+			}
+		}
+	default:
+		return encodeViaJSON(buf, v, depth)
+	}
+	return nil
+}
+
+// encodeViaJSON encodes v through its encoding/json form, keeping numbers exact.
+func encodeViaJSON(buf *bytes.Buffer, v any, depth int) error {
+	if rv := reflect.ValueOf(v); rv.Kind() == reflect.Pointer && rv.IsNil() {
+		buf.WriteByte(0xf6)
+		return nil
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("cbor: unsupported value of type %T: %w", v, err)
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var generic any
+	if err := dec.Decode(&generic); err != nil {
+		return fmt.Errorf("cbor: unsupported value of type %T: %w", v, err)
+	}
+	return encode(buf, generic, depth)
+}
+
+func writeInt(buf *bytes.Buffer, n int64) {
+	if n >= 0 {
+		writeHead(buf, majorUint, uint64(n))
+		return
+	}
+	writeHead(buf, majorNegInt, uint64(-(n + 1)))
+}
+
+func writeFloat(buf *bytes.Buffer, f float64) {
+	buf.WriteByte(majorSimple<<5 | 27)
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], math.Float64bits(f))
+	buf.Write(b[:])
+}
+
+func writeHead(buf *bytes.Buffer, major byte, n uint64) {
+	switch {
+	case n < 24:
+		buf.WriteByte(major<<5 | byte(n))
+	case n <= math.MaxUint8:
+		buf.WriteByte(major<<5 | 24)
+		buf.WriteByte(byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(major<<5 | 25)
+		var b [2]byte
+		binary.BigEndian.PutUint16(b[:], uint16(n))
+		buf.Write(b[:])
+	case n <= math.MaxUint32:
+		buf.WriteByte(major<<5 | 26)
+		var b [4]byte
+		binary.BigEndian.PutUint32(b[:], uint32(n))
+		buf.Write(b[:])
+	default:
+		buf.WriteByte(major<<5 | 27)
+		var b [8]byte
+		binary.BigEndian.PutUint64(b[:], n)
+		buf.Write(b[:])
+	}
+}
+
+// Unmarshal decodes a single CBOR data item. Integers decode to int64 (uint64 when they do not
+// fit), floats to float64, text to string, byte strings to []byte, arrays to []any, and maps to
+// map[string]any. Tags are dropped, so date/time values decode to their RFC 3339 string.
+// Indefinite-length items are not supported.
+func Unmarshal(data []byte) (any, error) {
+	d := decoder{data: data}
+	v, err := d.value(0)
+	if err != nil {
+		return nil, err
+	}
+	if d.pos != len(d.data) {
+		return nil, errors.New("cbor: trailing data after item")
+	}
+	return v, nil
+}
+
+type decoder struct {
+	data []byte
+	pos  int
+}
+
+var errShort = errors.New("cbor: unexpected end of data")
+
+func (d *decoder) head() (major byte, info byte, n uint64, err error) {
+	if d.pos >= len(d.data) {
+		return 0, 0, 0, errShort
+	}
+	b := d.data[d.pos]
+	d.pos++
+	major, info = b>>5, b&0x1f
+	var size int
+	switch {
+	case info < 24:
+		return major, info, uint64(info), nil
+	case info == 24:
+		size = 1
+	case info == 25:
+		size = 2
+	case info == 26:
+		size = 4
+	case info == 27:
+		size = 8
+	default:
+		return 0, 0, 0, fmt.Errorf("cbor: unsupported additional information %d", info)
+	}
+	if d.pos+size > len(d.data) {
+		return 0, 0, 0, errShort
+	}
+	for _, c := range d.data[d.pos : d.pos+size] {
+		n = n<<8 | uint64(c)
+	}
+	d.pos += size
+	return major, info, n, nil
+}
+
+func (d *decoder) bytes(n uint64) ([]byte, error) {
+	if n > uint64(len(d.data)-d.pos) {
+		return nil, errShort
+	}
+	b := d.data[d.pos : d.pos+int(n)]
+	d.pos += int(n)
+	return b, nil
+}
+
+func (d *decoder) value(depth int) (any, error) {
+	if depth > maxDepth {
+		return nil, errors.New("cbor: value nested too deeply")
+	}
+	major, info, n, err := d.head()
+	if err != nil {
+		return nil, err
+	}
+	switch major {
+	case majorUint:
+		if n > math.MaxInt64 {
+			return n, nil
+		}
+		return int64(n), nil
+	case majorNegInt:
+		if n > math.MaxInt64 {
+			return nil, errors.New("cbor: negative integer out of range")
+		}
+		return -int64(n) - 1, nil
+	case majorBytes:
+		b, err := d.bytes(n)
+		if err != nil {
+			return nil, err
+		}
+		return append([]byte(nil), b...), nil
+	case majorText:
+		b, err := d.bytes(n)
+		if err != nil {
+			return nil, err
+		}
+		return string(b), nil
+	case majorArray:
+		if n > uint64(len(d.data)-d.pos) {
+			return nil, errShort
+		}
+		out := make([]any, 0, n)
+		for i := uint64(0); i < n; i++ {
+			v, err := d.value(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, v)
+		}
+		return out, nil
+	case majorMap:
+		if n > uint64(len(d.data)-d.pos) {
+			return nil, errShort
+		}
+		out := make(map[string]any, n)
+		for i := uint64(0); i < n; i++ {
+			k, err := d.value(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			v, err := d.value(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				key = fmt.Sprint(k)
+			}
+			out[key] = v
+		}
+		return out, nil
+	case majorTag:
+		return d.value(depth + 1)
+	default:
+		switch info {
+		case 20:
+			return false, nil
+		case 21:
+			return true, nil
+		case 22, 23:
+			return nil, nil
+		case 25:
+			return halfToFloat(uint16(n)), nil
+		case 26:
+			return float64(math.Float32frombits(uint32(n))), nil
+		case 27:
+			return math.Float64frombits(n), nil
+		}
+		return nil, fmt.Errorf("cbor: unsupported simple value %d", n)
+	}
+}
+
+// halfToFloat converts an IEEE 754 half-precision value.
+func halfToFloat(h uint16) float64 {
+	sign := 1.0
+	if h&0x8000 != 0 {
+		sign = -1
+	}
+	exp := int(h>>10) & 0x1f
+	frac := float64(h & 0x3ff)
+	switch exp {
+	case 0:
+		return sign * math.Ldexp(frac, -24)
+	case 0x1f:
+		if frac == 0 {
+			return math.Inf(int(sign))
+		}
+		return math.NaN()
+	}
+	return sign * math.Ldexp(frac+1024, exp-25)
+}
@@ -0,0 +1,104 @@
+package cbor_test
+
+import (
+	"encoding/hex"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/mickamy/gostry/internal/cbor"
+)
+
+func TestMarshal(t *testing.T) {
+	t.Parallel()
+
+	tcs := []struct {
+		name string
+		in   any
+		want string // hex
+	}{
+		{name: "null", in: nil, want: "f6"},
+		{name: "true", in: true, want: "f5"},
+		{name: "small int", in: 10, want: "0a"},
+		{name: "one byte int", in: int64(100), want: "1864"},
+		{name: "negative int", in: -1000, want: "3903e7"},
+		{name: "text", in: "IETF", want: "6449455446"},
+		{name: "bytes", in: []byte{1, 2}, want: "420102"},
+		{name: "float", in: 1.5, want: "fb3ff8000000000000"},
+		{name: "array", in: []any{int64(1), "a"}, want: "82016161"},
+		{name: "map keys in deterministic order", in: map[string]any{"bb": 2, "a": 1}, want: "a2616101626262" + "02"},
+		{name: "time", in: time.Date(2013, 3, 21, 20, 4, 0, 0, time.UTC), want: "c074323031332d30332d32315432303a30343a30305a"},
+		{name: "struct via json", in: struct {
+			N int `json:"n"`
+		}{N: 1}, want: "a1616e01"},
+	}
+
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			got, err := cbor.Marshal(tc.in)
+			if err != nil {
+				t.Fatalf("Marshal() error = %v", err)
+			}
+			if hex.EncodeToString(got) != tc.want {
+				t.Fatalf("Marshal() = %x, want %s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	t.Parallel()
+
+	in := map[string]any{
+		"id":      int64(42),
+		"neg":     int64(-7),
+		"big":     uint64(1 << 63),
+		"price":   12.25,
+		"name":    "widget",
+		"raw":     []byte("\x00\xff"),
+		"active":  true,
+		"deleted": nil,
+		"tags":    []any{"a", int64(1)},
+		"nested":  map[string]any{"k": "v"},
+	}
+	b, err := cbor.Marshal(in)
+	if err != nil {
+		t.Fatalf("Marshal() error = %v", err)
+	}
+	got, err := cbor.Unmarshal(b)
+	if err != nil {
+		t.Fatalf("Unmarshal() error = %v", err)
+	}
+	if !reflect.DeepEqual(got, in) {
+		t.Fatalf("Unmarshal() = %#v, want %#v", got, in)
+	}
+}
+
+func TestUnmarshal_Errors(t *testing.T) {
+	t.Parallel()
+
+	tcs := []struct {
+		name string
+		in   string // hex
+	}{
+		{name: "empty", in: ""},
+		{name: "truncated text", in: "6449"},
+		{name: "truncated map", in: "a261"},
+		{name: "trailing data", in: "0101"},
+		{name: "indefinite length", in: "9f01ff"},
+		{name: "oversized length", in: "5bffffffffffffffff"},
+	}
+
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			b, _ := hex.DecodeString(tc.in)
+			if _, err := cbor.Unmarshal(b); err == nil {
+				t.Fatalf("Unmarshal(%s) error = nil, want error", tc.in)
+			}
+		})
+	}
+}
@@ -78,12 +78,17 @@ func StripAlias(s string) string {
 }
 
 // QuoteQualified renders qualified identifier parts as a SQL identifier.
+// It returns "" when there are no parts or any part is empty, since PostgreSQL rejects
+// zero-length identifiers (e.g. "sales..orders").
 func QuoteQualified(parts []string) string {
 	if len(parts) == 0 {
 		return ""
 	}
 	quoted := make([]string, len(parts))
 	for i, p := range parts {
+		if p == "" {
+			return ""
+		}
 		quoted[i] = Quote(p)
 	}
 	return strings.Join(quoted, ".")
@@ -100,6 +100,8 @@ func TestQuoteQualified(t *testing.T) {
 		{name: "simple", in: []string{"orders_history"}, want: `"orders_history"`},
 		{name: "schema qualified", in: []string{"public", "orders_history"}, want: `"public"."orders_history"`},
 		{name: "needs escaping", in: []string{`Order"Detail`}, want: `"Order""Detail"`},
+		{name: "empty part", in: []string{"sales", "", "orders_history"}, want: ""},
+		{name: "no parts", in: nil, want: ""},
 	}
 
 	for _, tc := range tcs {
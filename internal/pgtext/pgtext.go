@@ -0,0 +1,190 @@
+package pgtext
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ParseArray parses a PostgreSQL array literal such as {a,"b c",NULL} or {{1,2},{3,4}} into nested
+// slices. Non-NULL elements are converted with elem; unquoted NULL becomes nil. Literals carrying
+// explicit bounds (e.g. [0:1]={a,b}) are rejected.
+func ParseArray(s string, elem func(string) (any, error)) ([]any, error) {
+	p := parser{s: s}
+	p.skipSpace()
+	out, err := p.array(elem)
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpace()
+	if !p.done() {
+		return nil, fmt.Errorf("pgtext: trailing data at offset %d", p.i)
+	}
+	return out, nil
+}
+
+// ParseHstore parses a PostgreSQL hstore literal such as "a"=>"1", "b"=>NULL into a map. NULL values
+// become nil.
+func ParseHstore(s string) (map[string]any, error) {
+	p := parser{s: s}
+	out := map[string]any{}
+	p.skipSpace()
+	for !p.done() {
+		key, quoted, err := p.hstoreToken()
+		if err != nil {
+			return nil, err
+		}
+		if !quoted && strings.EqualFold(key, "NULL") {
+			return nil, fmt.Errorf("pgtext: NULL hstore key at offset %d", p.i)
+		}
+		p.skipSpace()
+		if !strings.HasPrefix(p.s[p.i:], "=>") {
+			return nil, fmt.Errorf("pgtext: expected => at offset %d", p.i)
+		}
+		p.i += 2
+		p.skipSpace()
+		val, quoted, err := p.hstoreToken()
+		if err != nil {
+			return nil, err
+		}
+		if !quoted && strings.EqualFold(val, "NULL") {
+			out[key] = nil
+		} else {
+			out[key] = val
+		}
+		p.skipSpace()
+		if p.done() {
+			break
+		}
+		if p.s[p.i] != ',' {
+			return nil, fmt.Errorf("pgtext: expected , at offset %d", p.i)
+		}
+		p.i++
+		p.skipSpace()
+	}
+	return out, nil
+}
+
+type parser struct {
+	s string
+	i int
+}
+
+func (p *parser) done() bool { return p.i >= len(p.s) }
+
+func (p *parser) skipSpace() {
+	for !p.done() && (p.s[p.i] == ' ' || p.s[p.i] == '\t' || p.s[p.i] == '\n' || p.s[p.i] == '\r') {
+		p.i++
+	}
+}
+
+func (p *parser) array(elem func(string) (any, error)) ([]any, error) {
+	if p.done() || p.s[p.i] != '{' {
+		return nil, fmt.Errorf("pgtext: expected { at offset %d", p.i)
+	}
+	p.i++
+	out := []any{}
+	p.skipSpace()
+	if !p.done() && p.s[p.i] == '}' {
+		p.i++
+		return out, nil
+	}
+	for {
+		p.skipSpace()
+		if p.done() {
+			return nil, fmt.Errorf("pgtext: unterminated array")
+		}
+		switch p.s[p.i] {
+		case '{':
+			sub, err := p.array(elem)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, sub)
+		case '"':
+			raw, err := p.quoted()
+			if err != nil {
+				return nil, err
+			}
+			v, err := elem(raw)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, v)
+		default:
+			start := p.i
+			for !p.done() && p.s[p.i] != ',' && p.s[p.i] != '}' {
+				p.i++
+			}
+			raw := strings.TrimSpace(p.s[start:p.i])
+			if raw == "" {
+				return nil, fmt.Errorf("pgtext: empty array element at offset %d", start)
+			}
+			if strings.EqualFold(raw, "NULL") {
+				out = append(out, nil)
+				break
+			}
+			v, err := elem(raw)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, v)
+		}
+		p.skipSpace()
+		if p.done() {
+			return nil, fmt.Errorf("pgtext: unterminated array")
+		}
+		switch p.s[p.i] {
+		case ',':
+			p.i++
+		case '}':
+			p.i++
+			return out, nil
+		default:
+			return nil, fmt.Errorf("pgtext: unexpected %q at offset %d", p.s[p.i], p.i)
+		}
+	}
+}
+
+// quoted reads a double-quoted token starting at the current offset, resolving backslash escapes.
+func (p *parser) quoted() (string, error) {
+	start := p.i
+	p.i++
+	var b strings.Builder
+	for !p.done() {
+		c := p.s[p.i]
+		switch c {
+		case '\\':
+			p.i++
+			if p.done() {
+				return "", fmt.Errorf("pgtext: unterminated escape at offset %d", p.i)
+			}
+			b.WriteByte(p.s[p.i])
+		case '"':
+			p.i++
+			return b.String(), nil
+		default:
+			b.WriteByte(c)
+		}
+		p.i++
+	}
+	return "", fmt.Errorf("pgtext: unterminated quoted string at offset %d", start)
+}
+
+// hstoreToken reads a quoted or bare hstore key/value, reporting whether it was quoted.
+func (p *parser) hstoreToken() (string, bool, error) {
+	if p.done() {
+		return "", false, fmt.Errorf("pgtext: unexpected end of hstore")
+	}
+	if p.s[p.i] == '"' {
+		s, err := p.quoted()
+		return s, true, err
+	}
+	start := p.i
+	for !p.done() && p.s[p.i] != ',' && p.s[p.i] != '=' && p.s[p.i] != ' ' {
+		p.i++
+	}
+	if p.i == start {
+		return "", false, fmt.Errorf("pgtext: empty hstore token at offset %d", start)
+	}
+	return p.s[start:p.i], false, nil
+}
@@ -0,0 +1,79 @@
+package pgtext_test
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/mickamy/gostry/internal/pgtext"
+)
+
+func asString(s string) (any, error) { return s, nil }
+
+func asInt(s string) (any, error) { return strconv.ParseInt(s, 10, 64) }
+
+func TestParseArray(t *testing.T) {
+	t.Parallel()
+
+	tcs := []struct {
+		name    string
+		in      string
+		elem    func(string) (any, error)
+		want    []any
+		wantErr bool
+	}{
+		{name: "text", in: `{a,"b c",NULL,"NULL"}`, elem: asString, want: []any{"a", "b c", nil, "NULL"}},
+		{name: "escapes", in: `{"say \"hi\"","back\\slash","a,b"}`, elem: asString, want: []any{`say "hi"`, `back\slash`, "a,b"}},
+		{name: "int", in: `{1,-2,30}`, elem: asInt, want: []any{int64(1), int64(-2), int64(30)}},
+		{name: "multi dimensional", in: `{{1,2},{3,4}}`, elem: asInt, want: []any{[]any{int64(1), int64(2)}, []any{int64(3), int64(4)}}},
+		{name: "empty", in: `{}`, elem: asString, want: []any{}},
+		{name: "explicit bounds", in: `[0:1]={a,b}`, elem: asString, wantErr: true},
+		{name: "bad element", in: `{1,x}`, elem: asInt, wantErr: true},
+		{name: "unterminated", in: `{a,b`, elem: asString, wantErr: true},
+		{name: "trailing data", in: `{a} b`, elem: asString, wantErr: true},
+	}
+
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			got, err := pgtext.ParseArray(tc.in, tc.elem)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("ParseArray(%q) error = %v, wantErr %t", tc.in, err, tc.wantErr)
+			}
+			if !tc.wantErr && !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("ParseArray(%q) = %#v, want %#v", tc.in, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestParseHstore(t *testing.T) {
+	t.Parallel()
+
+	tcs := []struct {
+		name    string
+		in      string
+		want    map[string]any
+		wantErr bool
+	}{
+		{name: "pairs", in: `"a"=>"1", "b c"=>NULL, "q"=>"say \"hi\""`, want: map[string]any{"a": "1", "b c": nil, "q": `say "hi"`}},
+		{name: "empty", in: ``, want: map[string]any{}},
+		{name: "missing arrow", in: `"a" "1"`, wantErr: true},
+		{name: "unterminated", in: `"a"=>"1`, wantErr: true},
+	}
+
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			got, err := pgtext.ParseHstore(tc.in)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("ParseHstore(%q) error = %v, wantErr %t", tc.in, err, tc.wantErr)
+			}
+			if !tc.wantErr && !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("ParseHstore(%q) = %#v, want %#v", tc.in, got, tc.want)
+			}
+		})
+	}
+}
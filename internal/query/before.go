@@ -0,0 +1,325 @@
+package query
+
+import (
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// BeforeSelect is a SELECT statement that reads the rows a DML statement is about to change.
+type BeforeSelect struct {
+	SQL        string   // SELECT statement with placeholders renumbered from $1
+	ArgIndexes []int    // ArgIndexes[i] is the index into the original args bound to $(i+1)
+	ArgNames   []string // names of @name placeholders referenced by the SELECT, in order of first appearance
+}
+
+// BuildBeforeSelect derives a SELECT over the target rows of an UPDATE statement.
+// It reuses the UPDATE's target (including alias) and its top-level WHERE clause, and renumbers
+// positional placeholders so only the arguments referenced by the WHERE clause are bound.
+// Named placeholders (@name) are kept verbatim and reported in ArgNames.
+// For UPDATE ... FROM, the FROM list and the WHERE clause move into an EXISTS subquery
+// (SELECT * FROM target WHERE EXISTS (SELECT 1 FROM list WHERE ...)), so the join predicate still
+// decides which rows match and each target row is read once however many join rows it matches.
+// It returns false for statements it cannot rewrite safely (not an UPDATE, WITH prefix, WHERE CURRENT OF).
+func BuildBeforeSelect(q string) (BeforeSelect, bool) {
+	return BuildBeforeSelectColumns(q, nil)
+}
+
+// BuildBeforeSelectColumns is BuildBeforeSelect projecting only the quoted columns (all columns when empty).
+func BuildBeforeSelectColumns(q string, columns []string) (BeforeSelect, bool) {
+	dml, ok := ParseDML(q)
+	if !ok || dml.Op != "UPDATE" {
+		return BeforeSelect{}, false
+	}
+
+	words := topLevelWords(q)
+	if len(words) > 0 && strings.EqualFold(words[0].text, "with") {
+		return BeforeSelect{}, false
+	}
+	updateAt, setAt, fromAt, whereStart, whereAt, returningAt := -1, -1, -1, -1, -1, -1
+	for _, w := range words {
+		switch {
+		case updateAt < 0 && strings.EqualFold(w.text, "update"):
+			updateAt = w.end
+		case updateAt >= 0 && setAt < 0 && strings.EqualFold(w.text, "set"):
+			setAt = w.start
+		case setAt >= 0 && whereAt < 0 && returningAt < 0 && fromAt < 0 && strings.EqualFold(w.text, "from"):
+			fromAt = w.end
+		case setAt >= 0 && whereAt < 0 && strings.EqualFold(w.text, "where"):
+			whereStart, whereAt = w.start, w.end
+		case whereAt >= 0 && returningAt < 0 && strings.EqualFold(w.text, "returning"):
+			returningAt = w.start
+		case setAt >= 0 && whereAt < 0 && returningAt < 0 && strings.EqualFold(w.text, "returning"):
+			returningAt = w.start
+		}
+	}
+	if updateAt < 0 || setAt < 0 {
+		return BeforeSelect{}, false
+	}
+
+	target := strings.TrimSpace(q[updateAt:setAt])
+	if fromAt < 0 {
+		return buildSelect(q, quoteColumns(columns), target, whereAt, returningAt)
+	}
+	fromEnd := len(q)
+	switch {
+	case whereStart >= 0:
+		fromEnd = whereStart
+	case returningAt >= 0:
+		fromEnd = returningAt
+	}
+	list := strings.TrimSpace(strings.TrimRight(strings.TrimSpace(q[fromAt:fromEnd]), ";"))
+	if list == "" {
+		return BeforeSelect{}, false
+	}
+	return buildJoinSelect(q, quoteColumns(columns), target, list, whereAt, returningAt)
+}
+
+// BuildDeleteSelect derives a SELECT of the given columns over the target rows of a single-table
+// DELETE statement, binding placeholders the same way as BuildBeforeSelect. Columns are quoted.
+// It returns false for statements it cannot rewrite safely (not a DELETE, WITH prefix, DELETE ... USING, WHERE CURRENT OF).
+func BuildDeleteSelect(q string, columns []string) (BeforeSelect, bool) {
+	dml, ok := ParseDML(q)
+	if !ok || dml.Op != "DELETE" || len(columns) == 0 {
+		return BeforeSelect{}, false
+	}
+
+	words := topLevelWords(q)
+	if len(words) > 0 && strings.EqualFold(words[0].text, "with") {
+		return BeforeSelect{}, false
+	}
+	fromAt, targetEnd, usingAt, whereAt, returningAt := -1, -1, -1, -1, -1
+	for _, w := range words {
+		switch {
+		case fromAt < 0 && strings.EqualFold(w.text, "from"):
+			fromAt = w.end
+		case fromAt >= 0 && whereAt < 0 && usingAt < 0 && strings.EqualFold(w.text, "using"):
+			usingAt = w.start
+		case fromAt >= 0 && whereAt < 0 && strings.EqualFold(w.text, "where"):
+			targetEnd, whereAt = w.start, w.end
+		case fromAt >= 0 && returningAt < 0 && strings.EqualFold(w.text, "returning"):
+			returningAt = w.start
+			if targetEnd < 0 {
+				targetEnd = w.start
+			}
+		}
+	}
+	if fromAt < 0 || usingAt >= 0 {
+		return BeforeSelect{}, false
+	}
+	if targetEnd < 0 {
+		targetEnd = len(q)
+	}
+
+	target := strings.TrimSpace(strings.TrimRight(strings.TrimSpace(q[fromAt:targetEnd]), ";"))
+	return buildSelect(q, quoteColumns(columns), target, whereAt, returningAt)
+}
+
+// buildSelect renders SELECT columns FROM target followed by the WHERE clause of q that starts at
+// whereAt and ends at returningAt (or the end of q), with placeholders renumbered.
+func buildSelect(q, columns, target string, whereAt, returningAt int) (BeforeSelect, bool) {
+	if strings.HasPrefix(strings.ToLower(target), "only ") {
+		target = strings.TrimSpace(target[len("only "):])
+	}
+
+	var b strings.Builder
+	b.WriteString("SELECT ")
+	b.WriteString(columns)
+	b.WriteString(" FROM ")
+	b.WriteString(target)
+
+	var argIndexes []int
+	var argNames []string
+	if whereAt >= 0 {
+		where, ok := whereClause(q, whereAt, returningAt)
+		if !ok {
+			return BeforeSelect{}, false
+		}
+		var rebound string
+		rebound, argIndexes = renumberPlaceholders(where)
+		argNames = namedPlaceholders(where)
+		b.WriteString(" WHERE ")
+		b.WriteString(rebound)
+	}
+	return BeforeSelect{SQL: b.String(), ArgIndexes: argIndexes, ArgNames: argNames}, true
+}
+
+// buildJoinSelect renders SELECT columns FROM target WHERE EXISTS (SELECT 1 FROM list WHERE ...) for
+// an UPDATE ... FROM, keeping the join list and the WHERE clause of q together so they still select
+// the same target rows. Placeholders in both are renumbered.
+func buildJoinSelect(q, columns, target, list string, whereAt, returningAt int) (BeforeSelect, bool) {
+	if strings.HasPrefix(strings.ToLower(target), "only ") {
+		target = strings.TrimSpace(target[len("only "):])
+	}
+
+	cond := "EXISTS (SELECT 1 FROM " + list
+	if whereAt >= 0 {
+		where, ok := whereClause(q, whereAt, returningAt)
+		if !ok {
+			return BeforeSelect{}, false
+		}
+		cond += " WHERE " + where
+	}
+	cond += ")"
+	rebound, argIndexes := renumberPlaceholders(cond)
+	sql := "SELECT " + columns + " FROM " + target + " WHERE " + rebound
+	return BeforeSelect{SQL: sql, ArgIndexes: argIndexes, ArgNames: namedPlaceholders(cond)}, true
+}
+
+// whereClause returns the WHERE clause of q that starts at whereAt and ends at returningAt (or the end
+// of q). It reports false for WHERE CURRENT OF, whose cursor cannot be reused by another statement.
+func whereClause(q string, whereAt, returningAt int) (string, bool) {
+	end := len(q)
+	if returningAt > whereAt {
+		end = returningAt
+	}
+	where := strings.TrimSpace(strings.TrimRight(strings.TrimSpace(q[whereAt:end]), ";"))
+	if len(where) >= len("current of") && strings.EqualFold(where[:len("current of")], "current of") {
+		return "", false
+	}
+	return where, true
+}
+
+// namedPlaceholders returns the distinct @name placeholders in s, in order of first appearance.
+func namedPlaceholders(s string) []string {
+	var names []string
+	seen := map[string]bool{}
+	scanSQL(s, func(i int) int {
+		if s[i] != '@' || i+1 >= len(s) || !isWordStart(s[i+1]) || (i > 0 && isWordByte(s[i-1])) {
+			return i + 1
+		}
+		j := i + 1
+		for j < len(s) && (isWordStart(s[j]) || isDigit(s[j])) {
+			j++
+		}
+		if name := s[i+1 : j]; !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+		return j
+	}, func(string) {})
+	return names
+}
+
+// renumberPlaceholders rewrites $N placeholders in s to $1..$M in order of first appearance
+// and returns the zero-based original argument index for each new placeholder.
+func renumberPlaceholders(s string) (string, []int) {
+	var b strings.Builder
+	var indexes []int
+	seen := map[int]int{}
+	scanSQL(s, func(i int) int {
+		if s[i] != '$' || i+1 >= len(s) || !isDigit(s[i+1]) {
+			b.WriteByte(s[i])
+			return i + 1
+		}
+		j := i + 1
+		for j < len(s) && isDigit(s[j]) {
+			j++
+		}
+		n, _ := strconv.Atoi(s[i+1 : j])
+		pos, ok := seen[n]
+		if !ok {
+			indexes = append(indexes, n-1)
+			pos = len(indexes)
+			seen[n] = pos
+		}
+		b.WriteString("$" + strconv.Itoa(pos))
+		return j
+	}, func(lit string) {
+		b.WriteString(lit)
+	})
+	return b.String(), indexes
+}
+
+type word struct {
+	text       string
+	start, end int
+}
+
+// topLevelWords returns the bare words of q that are outside parentheses, literals, and comments.
+func topLevelWords(q string) []word {
+	var words []word
+	depth := 0
+	scanSQL(q, func(i int) int {
+		switch c := q[i]; {
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+		case isWordStart(c) && (i == 0 || !isWordByte(q[i-1])):
+			j := i
+			for j < len(q) && isWordByte(q[j]) {
+				j++
+			}
+			if depth == 0 {
+				words = append(words, word{text: q[i:j], start: i, end: j})
+			}
+			return j
+		}
+		return i + 1
+	}, func(string) {})
+	return words
+}
+
+// scanSQL walks s, passing quoted literals, quoted identifiers, dollar-quoted strings, and comments
+// to lit verbatim and every other position to code, which returns the next index to scan.
+func scanSQL(s string, code func(i int) int, lit func(string)) {
+	for i := 0; i < len(s); {
+		end := skipLiteral(s, i)
+		if end > i {
+			lit(s[i:end])
+			i = end
+			continue
+		}
+		i = code(i)
+	}
+}
+
+// skipLiteral returns the end of a literal or comment starting at i, or i when none starts there.
+func skipLiteral(s string, i int) int {
+	switch {
+	case s[i] == '\'' || s[i] == '"':
+		quote := s[i]
+		j := i + 1
+		for j < len(s) {
+			if s[j] == quote {
+				if j+1 < len(s) && s[j+1] == quote {
+					j += 2
+					continue
+				}
+				return j + 1
+			}
+			j++
+		}
+		return len(s)
+	case strings.HasPrefix(s[i:], "--"):
+		if nl := strings.IndexByte(s[i:], '\n'); nl >= 0 {
+			return i + nl + 1
+		}
+		return len(s)
+	case strings.HasPrefix(s[i:], "/*"):
+		if end := strings.Index(s[i+2:], "*/"); end >= 0 {
+			return i + 2 + end + 2
+		}
+		return len(s)
+	case s[i] == '$' && (i == 0 || !isWordByte(s[i-1])):
+		j := i + 1
+		for j < len(s) && !isDigit(s[i+1]) && (isWordStart(s[j]) || isDigit(s[j])) {
+			j++
+		}
+		if j < len(s) && s[j] == '$' {
+			tag := s[i : j+1]
+			if end := strings.Index(s[j+1:], tag); end >= 0 {
+				return j + 1 + end + len(tag)
+			}
+			return len(s)
+		}
+	}
+	return i
+}
+
+func isDigit(c byte) bool { return c >= '0' && c <= '9' }
+
+func isWordStart(c byte) bool { return c == '_' || unicode.IsLetter(rune(c)) }
+
+func isWordByte(c byte) bool { return isWordStart(c) || isDigit(c) || c == '$' }
@@ -0,0 +1,195 @@
+package query_test
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/mickamy/gostry/internal/query"
+)
+
+func TestBuildBeforeSelect(t *testing.T) {
+	t.Parallel()
+
+	tcs := []struct {
+		name      string
+		sql       string
+		wantSQL   string
+		wantArgs  []int
+		wantNames []string
+		wantOK    bool
+	}{
+		{
+			name:     "simple",
+			sql:      "UPDATE orders SET status = $1 WHERE id = $2",
+			wantSQL:  "SELECT * FROM orders WHERE id = $1",
+			wantArgs: []int{1},
+			wantOK:   true,
+		},
+		{
+			name:     "alias and returning",
+			sql:      "UPDATE public.orders AS o SET status = $1 WHERE o.id = $2 AND o.tenant_id = $3 RETURNING *;",
+			wantSQL:  "SELECT * FROM public.orders AS o WHERE o.id = $1 AND o.tenant_id = $2",
+			wantArgs: []int{1, 2},
+			wantOK:   true,
+		},
+		{
+			name:     "repeated and reordered placeholders",
+			sql:      "UPDATE orders SET a = $3 WHERE id = $2 OR parent_id = $2 OR owner = $1",
+			wantSQL:  "SELECT * FROM orders WHERE id = $1 OR parent_id = $1 OR owner = $2",
+			wantArgs: []int{1, 0},
+			wantOK:   true,
+		},
+		{
+			name:    "no where",
+			sql:     "UPDATE orders SET status = 'x' RETURNING id",
+			wantSQL: "SELECT * FROM orders",
+			wantOK:  true,
+		},
+		{
+			name:     "keywords inside literals and subqueries",
+			sql:      `UPDATE orders SET note = 'where from $9', total = (SELECT sum(x) FROM items) WHERE note <> 'returning' AND "from" = $2`,
+			wantSQL:  `SELECT * FROM orders WHERE note <> 'returning' AND "from" = $1`,
+			wantArgs: []int{1},
+			wantOK:   true,
+		},
+		{
+			name:     "dollar quoted literal",
+			sql:      "UPDATE orders SET note = $tag$ where $1 $tag$ WHERE id = $2",
+			wantSQL:  "SELECT * FROM orders WHERE id = $1",
+			wantArgs: []int{1},
+			wantOK:   true,
+		},
+		{
+			name:    "only keyword",
+			sql:     "UPDATE ONLY orders SET status = 'x' WHERE id = 1",
+			wantSQL: "SELECT * FROM orders WHERE id = 1",
+			wantOK:  true,
+		},
+		{
+			name:      "named placeholders",
+			sql:       "UPDATE orders SET status = @status WHERE id = @id AND tags @> @tags AND owner = @id",
+			wantSQL:   "SELECT * FROM orders WHERE id = @id AND tags @> @tags AND owner = @id",
+			wantNames: []string{"id", "tags"},
+			wantOK:    true,
+		},
+		{
+			name:    "update from",
+			sql:     "UPDATE orders o SET status = s.status FROM staging s WHERE s.id = o.id RETURNING o.*",
+			wantSQL: "SELECT * FROM orders o WHERE EXISTS (SELECT 1 FROM staging s WHERE s.id = o.id)",
+			wantOK:  true,
+		},
+		{
+			name:     "update from with placeholders in join list and where",
+			sql:      "UPDATE orders AS o SET total = v.total FROM (VALUES ($3, $4)) AS v(id, total) WHERE v.id = o.id AND o.tenant_id = $1",
+			wantSQL:  "SELECT * FROM orders AS o WHERE EXISTS (SELECT 1 FROM (VALUES ($1, $2)) AS v(id, total) WHERE v.id = o.id AND o.tenant_id = $3)",
+			wantArgs: []int{2, 3, 0},
+			wantOK:   true,
+		},
+		{
+			name:    "update from without where",
+			sql:     "UPDATE orders SET status = 'x' FROM flags;",
+			wantSQL: "SELECT * FROM orders WHERE EXISTS (SELECT 1 FROM flags)",
+			wantOK:  true,
+		},
+		{name: "update from current of", sql: "UPDATE orders SET status = 'x' FROM flags WHERE CURRENT OF cur", wantOK: false},
+		{name: "current of", sql: "UPDATE orders SET status = 'x' WHERE CURRENT OF cur", wantOK: false},
+		{name: "with prefix", sql: "WITH c AS (SELECT 1) UPDATE orders SET status = 'x'", wantOK: false},
+		{name: "delete", sql: "DELETE FROM orders WHERE id = $1", wantOK: false},
+	}
+
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			got, ok := query.BuildBeforeSelect(tc.sql)
+			if ok != tc.wantOK {
+				t.Fatalf("BuildBeforeSelect ok = %t, want %t", ok, tc.wantOK)
+			}
+			if !ok {
+				return
+			}
+			if got.SQL != tc.wantSQL {
+				t.Fatalf("BuildBeforeSelect(%q).SQL = %q, want %q", tc.sql, got.SQL, tc.wantSQL)
+			}
+			if !slices.Equal(got.ArgIndexes, tc.wantArgs) {
+				t.Fatalf("BuildBeforeSelect(%q).ArgIndexes = %v, want %v", tc.sql, got.ArgIndexes, tc.wantArgs)
+			}
+			if !slices.Equal(got.ArgNames, tc.wantNames) {
+				t.Fatalf("BuildBeforeSelect(%q).ArgNames = %v, want %v", tc.sql, got.ArgNames, tc.wantNames)
+			}
+		})
+	}
+}
+
+func TestBuildDeleteSelect(t *testing.T) {
+	t.Parallel()
+
+	tcs := []struct {
+		name     string
+		sql      string
+		wantSQL  string
+		wantArgs []int
+		wantOK   bool
+	}{
+		{
+			name:    "range predicate",
+			sql:     "DELETE FROM sessions WHERE expires_at < now()",
+			wantSQL: `SELECT "id" FROM sessions WHERE expires_at < now()`,
+			wantOK:  true,
+		},
+		{
+			name:     "alias placeholders and semicolon",
+			sql:      "DELETE FROM public.sessions AS s WHERE s.user_id = $2 AND s.expires_at < $1;",
+			wantSQL:  `SELECT "id" FROM public.sessions AS s WHERE s.user_id = $1 AND s.expires_at < $2`,
+			wantArgs: []int{1, 0},
+			wantOK:   true,
+		},
+		{
+			name:    "no where",
+			sql:     "DELETE FROM ONLY sessions;",
+			wantSQL: `SELECT "id" FROM sessions`,
+			wantOK:  true,
+		},
+		{
+			name:    "returning",
+			sql:     "DELETE FROM sessions WHERE id = 1 RETURNING id",
+			wantSQL: `SELECT "id" FROM sessions WHERE id = 1`,
+			wantOK:  true,
+		},
+		{name: "using", sql: "DELETE FROM sessions s USING users u WHERE s.user_id = u.id", wantOK: false},
+		{name: "with prefix", sql: "WITH c AS (SELECT 1) DELETE FROM sessions", wantOK: false},
+		{name: "update", sql: "UPDATE sessions SET expires_at = now()", wantOK: false},
+	}
+
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			got, ok := query.BuildDeleteSelect(tc.sql, []string{"id"})
+			if ok != tc.wantOK {
+				t.Fatalf("BuildDeleteSelect ok = %t, want %t", ok, tc.wantOK)
+			}
+			if !ok {
+				return
+			}
+			if got.SQL != tc.wantSQL {
+				t.Fatalf("BuildDeleteSelect(%q).SQL = %q, want %q", tc.sql, got.SQL, tc.wantSQL)
+			}
+			if !slices.Equal(got.ArgIndexes, tc.wantArgs) {
+				t.Fatalf("BuildDeleteSelect(%q).ArgIndexes = %v, want %v", tc.sql, got.ArgIndexes, tc.wantArgs)
+			}
+		})
+	}
+}
+
+func TestBuildBeforeSelectColumns(t *testing.T) {
+	t.Parallel()
+
+	got, ok := query.BuildBeforeSelectColumns("UPDATE orders o SET status = $1 WHERE o.id = $2", []string{"status", "id"})
+	if !ok {
+		t.Fatal("BuildBeforeSelectColumns() ok = false")
+	}
+	if want := `SELECT "status", "id" FROM orders o WHERE o.id = $1`; got.SQL != want {
+		t.Fatalf("BuildBeforeSelectColumns().SQL = %q, want %q", got.SQL, want)
+	}
+}
@@ -9,38 +9,352 @@ import (
 
 // DML describes a recognized data-changing statement.
 type DML struct {
-	Op           string // INSERT, UPDATE, DELETE
+	Op           string // INSERT, UPDATE, DELETE, or COPY (COPY ... FROM only)
 	Table        string // possibly schema-qualified
 	HasReturning bool
+	HasFrom      bool // UPDATE ... FROM joins other tables
+	HasUsing     bool // DELETE ... USING joins other tables
+	CurrentOf    bool // UPDATE/DELETE ... WHERE CURRENT OF cursor: rows are positioned by a cursor, not a predicate
+	// ReturningScoped reports that every RETURNING item is qualified by the target table or its alias
+	// (e.g. RETURNING o.* or RETURNING o.id, o.status), so the returned columns belong to the target only.
+	ReturningScoped bool
+}
+
+// IsMultiTable reports whether the statement joins tables other than its target.
+func (d DML) IsMultiTable() bool {
+	return d.HasFrom || d.HasUsing
 }
 
 var (
-	reInsert    = regexp.MustCompile(`(?is)^\s*(?:with\b.*?\)\s*)?insert\s+into\s+([^\s(]+)`)
-	reUpdate    = regexp.MustCompile(`(?is)^\s*(?:with\b.*?\)\s*)?update\s+([^\s]+(?:\s+(?:as\s+)?[^\s]+)?)\s+set\b`)
-	reDelete    = regexp.MustCompile(`(?is)^\s*(?:with\b.*?\)\s*)?delete\s+from\s+([^\s]+(?:\s+(?:as\s+)?[^\s]+)?)`)
+	reInsert    = regexp.MustCompile(`(?is)^\s*insert\s+into\s+([^\s(]+)`)
+	reUpdate    = regexp.MustCompile(`(?is)^\s*update\s+([^\s]+(?:\s+(?:as\s+)?[^\s]+)?)\s+set\b`)
+	reDelete    = regexp.MustCompile(`(?is)^\s*delete\s+from\s+([^\s]+(?:\s+(?:as\s+)?[^\s]+)?)`)
+	reCopyFrom  = regexp.MustCompile(`(?is)^\s*copy\s+([^\s(]+)\s*(?:\([^)]*\)\s*)?from\b`)
 	reReturning = regexp.MustCompile(`(?is)\breturning\b`)
 )
 
 // ParseDML attempts to recognize a single top-level DML and return its metadata.
+// A leading WITH [RECURSIVE] list is skipped; EXPLAIN statements are not recognized, since they
+// report a plan instead of returning the changed rows.
 func ParseDML(q string) (DML, bool) {
 	qs := strings.TrimSpace(q)
-	if m := reInsert.FindStringSubmatch(qs); len(m) == 2 {
+	body, ok := mainStatement(qs)
+	if !ok {
+		return DML{}, false
+	}
+	if m := reInsert.FindStringSubmatch(body); len(m) == 2 {
 		return DML{Op: "INSERT", Table: ident.StripAlias(m[1]), HasReturning: reReturning.MatchString(qs)}, true
 	}
-	if m := reUpdate.FindStringSubmatch(qs); len(m) == 2 {
-		return DML{Op: "UPDATE", Table: ident.StripAlias(m[1]), HasReturning: reReturning.MatchString(qs)}, true
+	if m := reUpdate.FindStringSubmatch(body); len(m) == 2 {
+		dml := DML{Op: "UPDATE", Table: ident.StripAlias(m[1]), HasReturning: reReturning.MatchString(qs)}
+		dml.HasFrom, dml.ReturningScoped = scanJoin(qs, "update", "set", "from")
+		dml.CurrentOf = whereCurrentOf(qs)
+		return dml, true
+	}
+	if m := reDelete.FindStringSubmatch(body); len(m) == 2 {
+		dml := DML{Op: "DELETE", Table: ident.StripAlias(m[1]), HasReturning: reReturning.MatchString(qs)}
+		dml.HasUsing, dml.ReturningScoped = scanJoin(qs, "from", "", "using")
+		dml.CurrentOf = whereCurrentOf(qs)
+		return dml, true
 	}
-	if m := reDelete.FindStringSubmatch(qs); len(m) == 2 {
-		return DML{Op: "DELETE", Table: ident.StripAlias(m[1]), HasReturning: reReturning.MatchString(qs)}, true
+	if m := reCopyFrom.FindStringSubmatch(body); len(m) == 2 {
+		return DML{Op: "COPY", Table: m[1]}, true
 	}
 	return DML{}, false
 }
 
+// mainStatement returns q from its main statement keyword on, skipping a leading WITH [RECURSIVE]
+// list. CTE bodies are skipped by balancing parentheses outside string literals, dollar-quoted
+// strings, quoted identifiers, and comments, so keywords and parentheses inside them are ignored.
+// It reports false for EXPLAIN statements and for WITH lists not followed by a top-level statement.
+func mainStatement(q string) (string, bool) {
+	words := topLevelWords(q)
+	if len(words) == 0 {
+		return q, true
+	}
+	switch strings.ToLower(words[0].text) {
+	case "explain":
+		return "", false
+	case "with":
+	default:
+		return q, true
+	}
+	for _, w := range words[1:] {
+		switch strings.ToLower(w.text) {
+		case "insert", "update", "delete", "select", "values", "merge":
+			return q[w.start:], true
+		}
+	}
+	return "", false
+}
+
+// scanJoin looks at the top-level clauses following the DML keyword opener and reports whether
+// the join keyword (FROM for UPDATE, USING for DELETE) is present and whether the RETURNING list
+// is scoped to the target. The target spans from opener to marker (SET), or to the first following
+// clause keyword when marker is empty.
+func scanJoin(q, opener, marker, join string) (joined, scoped bool) {
+	words := topLevelWords(q)
+	openAt := -1
+	for i, w := range words {
+		if strings.EqualFold(w.text, opener) {
+			openAt = i
+			break
+		}
+	}
+	if openAt < 0 {
+		return false, false
+	}
+
+	targetStart, targetEnd := words[openAt].end, len(q)
+	returningAt := -1
+	inTarget, inWhere := true, false
+	for _, w := range words[openAt+1:] {
+		clause := ""
+		switch {
+		case inTarget && marker != "" && strings.EqualFold(w.text, marker):
+			clause = marker
+		case !inWhere && returningAt < 0 && strings.EqualFold(w.text, join):
+			clause, joined = join, true
+		case !inWhere && returningAt < 0 && strings.EqualFold(w.text, "where"):
+			clause, inWhere = "where", true
+		case returningAt < 0 && strings.EqualFold(w.text, "returning"):
+			clause, returningAt = "returning", w.end
+		}
+		if clause != "" && inTarget {
+			targetEnd, inTarget = w.start, false
+		}
+	}
+	if returningAt < 0 {
+		return joined, false
+	}
+	return joined, returningScoped(q[returningAt:], targetQualifier(q[targetStart:targetEnd]))
+}
+
+// whereCurrentOf reports whether q has a top-level WHERE CURRENT OF clause.
+func whereCurrentOf(q string) bool {
+	words := topLevelWords(q)
+	for i := 0; i+2 < len(words); i++ {
+		if strings.EqualFold(words[i].text, "where") &&
+			strings.EqualFold(words[i+1].text, "current") &&
+			strings.EqualFold(words[i+2].text, "of") {
+			return true
+		}
+	}
+	return false
+}
+
+// targetQualifier returns the name RETURNING items must be qualified with: the alias when present,
+// otherwise the unqualified table name.
+func targetQualifier(target string) string {
+	fields := strings.Fields(target)
+	if len(fields) > 0 && strings.EqualFold(fields[0], "only") {
+		fields = fields[1:]
+	}
+	switch len(fields) {
+	case 0:
+		return ""
+	case 1:
+		return ident.BaseTableName(fields[0])
+	default:
+		return strings.Trim(fields[len(fields)-1], `"`)
+	}
+}
+
+// returningScoped reports whether every item of the RETURNING list starts with "qualifier.".
+func returningScoped(list, qualifier string) bool {
+	if qualifier == "" {
+		return false
+	}
+	items := splitTopLevel(strings.TrimRight(strings.TrimSpace(list), ";"))
+	if len(items) == 0 {
+		return false
+	}
+	for _, item := range items {
+		fields := strings.Fields(item)
+		if len(fields) == 0 {
+			return false
+		}
+		parts := ident.SplitQualified(fields[0])
+		if len(parts) < 2 || !strings.EqualFold(parts[len(parts)-2], qualifier) {
+			return false
+		}
+	}
+	return true
+}
+
+// splitTopLevel splits s on commas that are outside parentheses, literals, and comments.
+func splitTopLevel(s string) []string {
+	var items []string
+	var b strings.Builder
+	depth := 0
+	scanSQL(s, func(i int) int {
+		switch s[i] {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				items = append(items, strings.TrimSpace(b.String()))
+				b.Reset()
+				return i + 1
+			}
+		}
+		b.WriteByte(s[i])
+		return i + 1
+	}, func(lit string) {
+		b.WriteString(lit)
+	})
+	if last := strings.TrimSpace(b.String()); last != "" || len(items) > 0 {
+		items = append(items, last)
+	}
+	return items
+}
+
 // AppendReturningAll appends "RETURNING *" to the provided statement if non-empty.
-// It preserves trailing semicolons by re-attaching them after the RETURNING clause.
+// It preserves trailing semicolons by re-attaching them after the RETURNING clause, and reports false
+// when the clause cannot be appended safely (see CanAppendReturning).
 func AppendReturningAll(q string) (string, bool) {
+	return appendReturning(q, "*")
+}
+
+// AppendReturningColumns appends a RETURNING clause listing the quoted columns, or "RETURNING *"
+// when columns is empty, with the same trimming rules as AppendReturningAll.
+func AppendReturningColumns(q string, columns []string) (string, bool) {
+	return appendReturning(q, quoteColumns(columns))
+}
+
+// quoteColumns renders columns as a quoted, comma-separated list, or "*" when there are none.
+func quoteColumns(columns []string) string {
+	if len(columns) == 0 {
+		return "*"
+	}
+	quoted := make([]string, len(columns))
+	for i, c := range columns {
+		quoted[i] = ident.Quote(c)
+	}
+	return strings.Join(quoted, ", ")
+}
+
+// ExtendReturning adds the columns missing from the top-level RETURNING list of q, so a statement
+// such as "UPDATE orders SET status = $1 WHERE id = $2 RETURNING status" also returns its key.
+// Added columns are qualified like the existing items when they all share one qualifier. It reports
+// false when q has no RETURNING, when the list already returns every column (* or t.*), or when
+// nothing is missing.
+func ExtendReturning(q string, columns []string) (string, bool) {
+	returningAt := -1
+	for _, w := range topLevelWords(q) {
+		if strings.EqualFold(w.text, "returning") {
+			returningAt = w.end
+			break
+		}
+	}
+	if returningAt < 0 {
+		return q, false
+	}
+
+	end := len(strings.TrimRight(q, "; \t\r\n"))
+	if end <= returningAt {
+		return q, false
+	}
+	items := splitTopLevel(q[returningAt:end])
+	returned := make(map[string]bool, len(items))
+	qualifier, shared := "", true
+	for i, item := range items {
+		fields := strings.Fields(item)
+		if len(fields) == 0 {
+			return q, false
+		}
+		parts := ident.SplitQualified(fields[0])
+		if parts[len(parts)-1] == "*" {
+			return q, false
+		}
+		itemQualifier := ""
+		if len(parts) >= 2 {
+			itemQualifier = parts[len(parts)-2]
+		}
+		if i == 0 {
+			qualifier = itemQualifier
+		} else if itemQualifier != qualifier {
+			shared = false
+		}
+		name := parts[len(parts)-1]
+		if len(fields) > 1 {
+			name = strings.Trim(fields[len(fields)-1], `"`) // output alias, with or without AS
+		}
+		returned[strings.ToLower(name)] = true
+	}
+
+	var missing []string
+	for _, c := range columns {
+		if c == "" || returned[strings.ToLower(c)] {
+			continue
+		}
+		col := ident.Quote(c)
+		if shared && qualifier != "" {
+			col = ident.Quote(qualifier) + "." + col
+		}
+		missing = append(missing, col)
+		returned[strings.ToLower(c)] = true
+	}
+	if len(missing) == 0 {
+		return q, false
+	}
+	return q[:end] + ", " + strings.Join(missing, ", ") + q[end:], true
+}
+
+// CanAppendReturning reports whether a RETURNING clause can be appended to the end of q without
+// producing invalid SQL. It reports false for several statements in one string (or a statement
+// followed by a comment after its semicolon), for text ending inside an unterminated literal or
+// block comment, and for unbalanced parentheses.
+func CanAppendReturning(q string) bool {
+	depth := 0
+	terminated := false // a top-level ';' has been seen
+	ok := true
+	scanSQL(q, func(i int) int {
+		switch c := q[i]; {
+		case c == ';':
+			if depth == 0 {
+				terminated = true
+			}
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+		default:
+			if terminated {
+				ok = false // another statement follows
+			}
+		}
+		return i + 1
+	}, func(lit string) {
+		if terminated || !closedLiteral(lit) {
+			ok = false
+		}
+	})
+	return ok && depth == 0
+}
+
+// closedLiteral reports whether a literal or comment returned by skipLiteral is terminated.
+// Line comments always are, since the appended clause starts on a new line.
+func closedLiteral(lit string) bool {
+	switch {
+	case strings.HasPrefix(lit, "--"):
+		return true
+	case strings.HasPrefix(lit, "/*"):
+		return len(lit) >= 4 && strings.HasSuffix(lit, "*/")
+	case lit[0] == '\'' || lit[0] == '"':
+		return len(lit) >= 2 && lit[len(lit)-1] == lit[0]
+	default: // dollar-quoted
+		tag := lit[:strings.IndexByte(lit[1:], '$')+2]
+		return len(lit) >= 2*len(tag) && strings.HasSuffix(lit, tag)
+	}
+}
+
+func appendReturning(q, list string) (string, bool) {
 	trimmed := strings.TrimSpace(q)
-	if trimmed == "" {
+	if trimmed == "" || !CanAppendReturning(trimmed) {
 		return q, false
 	}
 
@@ -55,7 +369,8 @@ func AppendReturningAll(q string) (string, bool) {
 
 	var b strings.Builder
 	b.WriteString(trimmed)
-	b.WriteString("\nRETURNING *")
+	b.WriteString("\nRETURNING ")
+	b.WriteString(list)
 	if hasSemicolon {
 		b.WriteString(";")
 	}
@@ -1,6 +1,7 @@
 package query_test
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/mickamy/gostry/internal/query"
@@ -29,6 +30,12 @@ returning *`,
 			wantDML: query.DML{Op: "INSERT", Table: "public.orders", HasReturning: true},
 			wantOK:  true,
 		},
+		{
+			name:    "insert select with returning",
+			sql:     `INSERT INTO orders (status, id) SELECT status, id FROM staging RETURNING *`,
+			wantDML: query.DML{Op: "INSERT", Table: "orders", HasReturning: true},
+			wantOK:  true,
+		},
 		{
 			name:    "update with alias",
 			sql:     `UPDATE orders o SET amount = amount + 1 WHERE id = $1`,
@@ -66,6 +73,77 @@ returning *`,
 			wantDML: query.DML{Op: "DELETE", Table: "public.orders", HasReturning: false},
 			wantOK:  true,
 		},
+		{
+			name: "with recursive before update",
+			sql: `WITH RECURSIVE tree(id) AS (
+	SELECT id FROM categories WHERE id = $1
+	UNION ALL
+	SELECT c.id FROM categories c JOIN tree t ON c.parent_id = t.id
+) UPDATE categories SET archived = true WHERE id IN (SELECT id FROM tree) RETURNING *`,
+			wantDML: query.DML{Op: "UPDATE", Table: "categories", HasReturning: true},
+			wantOK:  true,
+		},
+		{
+			name:    "several nested ctes before delete",
+			sql:     `WITH a AS (SELECT id FROM (SELECT id FROM orders) s), b AS (SELECT id FROM a WHERE id IN (SELECT id FROM a)) DELETE FROM orders WHERE id IN (SELECT id FROM b)`,
+			wantDML: query.DML{Op: "DELETE", Table: "orders"},
+			wantOK:  true,
+		},
+		{
+			name:    "cte with function calls and subqueries",
+			sql:     `WITH totals AS (SELECT customer_id, coalesce(sum(amount), 0) AS total FROM (SELECT * FROM payments WHERE paid_at > now() - interval '1 day') p GROUP BY customer_id) UPDATE customers c SET balance = t.total FROM totals t WHERE c.id = t.customer_id`,
+			wantDML: query.DML{Op: "UPDATE", Table: "customers"},
+			wantOK:  true,
+		},
+		{
+			name:    "cte with parentheses and keywords inside literals",
+			sql:     `WITH fake AS (SELECT ') UPDATE decoy SET x = 1' AS s, $$ ) DELETE FROM decoy $$ AS d /* ) INSERT INTO decoy */) INSERT INTO audit_notes (note) SELECT s FROM fake RETURNING *`,
+			wantDML: query.DML{Op: "INSERT", Table: "audit_notes", HasReturning: true},
+			wantOK:  true,
+		},
+		{
+			name:    "materialized cte with column list",
+			sql:     `WITH ids (id) AS MATERIALIZED (SELECT id FROM orders WHERE status IN ('a', 'b')) DELETE FROM orders WHERE id IN (SELECT id FROM ids)`,
+			wantDML: query.DML{Op: "DELETE", Table: "orders"},
+			wantOK:  true,
+		},
+		{
+			name:   "with select is not dml",
+			sql:    `WITH a AS (UPDATE orders SET status = 'x' RETURNING id) SELECT * FROM a`,
+			wantOK: false,
+		},
+		{
+			name:   "explain analyze update",
+			sql:    `EXPLAIN ANALYZE UPDATE orders SET status = 'paid' WHERE id = $1`,
+			wantOK: false,
+		},
+		{
+			name:   "parenthesized select",
+			sql:    `(SELECT id FROM orders) UNION (SELECT id FROM archived_orders)`,
+			wantOK: false,
+		},
+		{
+			name:    "copy from stdin",
+			sql:     `COPY orders FROM STDIN`,
+			wantDML: query.DML{Op: "COPY", Table: "orders"},
+			wantOK:  true,
+		},
+		{
+			name:    "copy with column list",
+			sql:     `copy sales.orders (id, status) from '/tmp/orders.csv' with (format csv)`,
+			wantDML: query.DML{Op: "COPY", Table: "sales.orders"},
+			wantOK:  true,
+		},
+		{
+			name:   "copy to is not a change",
+			sql:    `COPY orders TO STDOUT`,
+			wantOK: false,
+		},
+		{
+			name:   "copy query to",
+			sql:    `COPY (SELECT * FROM orders) TO STDOUT`,
+			wantOK: false,
+		},
 	}
 
 	for _, tc := range tcs {
@@ -119,12 +197,63 @@ func TestAppendReturningAll(t *testing.T) {
 			want: "   ",
 			ok:   false,
 		},
+		{
+			name: "trailing line comment",
+			sql:  "DELETE FROM orders WHERE id=$1 -- cleanup",
+			want: "DELETE FROM orders WHERE id=$1 -- cleanup\nRETURNING *",
+			ok:   true,
+		},
+		{
+			name: "on conflict do nothing",
+			sql:  "INSERT INTO orders (id) VALUES ($1) ON CONFLICT DO NOTHING",
+			want: "INSERT INTO orders (id) VALUES ($1) ON CONFLICT DO NOTHING\nRETURNING *",
+			ok:   true,
+		},
+		{
+			name: "semicolons inside literals",
+			sql:  "UPDATE orders SET note = 'a; b', body = $$x; y$$",
+			want: "UPDATE orders SET note = 'a; b', body = $$x; y$$\nRETURNING *",
+			ok:   true,
+		},
+		{
+			name: "several statements",
+			sql:  "UPDATE orders SET status='x'; UPDATE items SET status='x'",
+			want: "UPDATE orders SET status='x'; UPDATE items SET status='x'",
+		},
+		{
+			name: "comment after semicolon",
+			sql:  "UPDATE orders SET status='x'; -- done",
+			want: "UPDATE orders SET status='x'; -- done",
+		},
+		{
+			name: "unterminated literal",
+			sql:  "UPDATE orders SET note = 'oops",
+			want: "UPDATE orders SET note = 'oops",
+		},
+		{
+			name: "unterminated block comment",
+			sql:  "UPDATE orders SET status='x' /* note",
+			want: "UPDATE orders SET status='x' /* note",
+		},
+		{
+			name: "unterminated dollar quote",
+			sql:  "UPDATE orders SET body = $tag$x",
+			want: "UPDATE orders SET body = $tag$x",
+		},
+		{
+			name: "unbalanced parentheses",
+			sql:  "INSERT INTO orders (id VALUES ($1)",
+			want: "INSERT INTO orders (id VALUES ($1)",
+		},
 	}
 
 	for _, tc := range tcs {
 		tc := tc
 		t.Run(tc.name, func(t *testing.T) {
 			t.Parallel()
+			if got := query.CanAppendReturning(tc.sql); got != tc.ok && strings.TrimSpace(tc.sql) != "" {
+				t.Fatalf("CanAppendReturning(%q) = %t, want %t", tc.sql, got, tc.ok)
+			}
 			got, ok := query.AppendReturningAll(tc.sql)
 			if ok != tc.ok {
 				t.Fatalf("AppendReturningAll ok = %t, want %t", ok, tc.ok)
@@ -135,3 +264,177 @@ func TestAppendReturningAll(t *testing.T) {
 		})
 	}
 }
+
+func TestParseDML_MultiTable(t *testing.T) {
+	t.Parallel()
+
+	tcs := []struct {
+		name       string
+		sql        string
+		wantFrom   bool
+		wantUsing  bool
+		wantScoped bool
+	}{
+		{
+			name: "single table update",
+			sql:  `UPDATE orders SET status = $1 WHERE id = $2 RETURNING *`,
+		},
+		{
+			name:     "update from with returning star",
+			sql:      `UPDATE a SET x = b.y FROM b WHERE a.id = b.a_id RETURNING *`,
+			wantFrom: true,
+		},
+		{
+			name:       "update from scoped to table",
+			sql:        `UPDATE a SET x = b.y FROM b WHERE a.id = b.a_id RETURNING a.*`,
+			wantFrom:   true,
+			wantScoped: true,
+		},
+		{
+			name:       "update from scoped to alias columns",
+			sql:        `UPDATE public.orders o SET total = s.total FROM staging s WHERE o.id = s.id RETURNING o.id, o.total;`,
+			wantFrom:   true,
+			wantScoped: true,
+		},
+		{
+			name:     "update from partially scoped",
+			sql:      `UPDATE orders o SET total = s.total FROM staging s WHERE o.id = s.id RETURNING o.id, s.total`,
+			wantFrom: true,
+		},
+		{
+			name: "from inside subquery",
+			sql:  `UPDATE orders SET total = (SELECT sum(v) FROM items WHERE items.order_id = orders.id) RETURNING *`,
+		},
+		{
+			name: "distinct from in where",
+			sql:  `UPDATE orders SET status = $1 WHERE status IS DISTINCT FROM $1`,
+		},
+		{
+			name: "from inside literal",
+			sql:  `UPDATE orders SET note = 'moved from b' WHERE id = $1`,
+		},
+		{
+			name:      "delete using",
+			sql:       `DELETE FROM orders o USING customers c WHERE o.customer_id = c.id AND c.banned RETURNING *`,
+			wantUsing: true,
+		},
+		{
+			name:       "delete using scoped to quoted alias",
+			sql:        `DELETE FROM "Sales"."Orders" "so" USING customers c WHERE "so".customer_id = c.id RETURNING "so".*`,
+			wantUsing:  true,
+			wantScoped: true,
+		},
+		{
+			name:       "single table delete with qualified returning",
+			sql:        `DELETE FROM public.orders WHERE id = $1 RETURNING orders.id`,
+			wantScoped: true,
+		},
+	}
+
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			got, ok := query.ParseDML(tc.sql)
+			if !ok {
+				t.Fatalf("ParseDML(%q) ok = false", tc.sql)
+			}
+			if got.HasFrom != tc.wantFrom || got.HasUsing != tc.wantUsing || got.ReturningScoped != tc.wantScoped {
+				t.Fatalf("ParseDML(%q) = %#v, want HasFrom=%t HasUsing=%t ReturningScoped=%t",
+					tc.sql, got, tc.wantFrom, tc.wantUsing, tc.wantScoped)
+			}
+			if got.IsMultiTable() != (tc.wantFrom || tc.wantUsing) {
+				t.Fatalf("IsMultiTable() = %t", got.IsMultiTable())
+			}
+		})
+	}
+}
+
+func TestParseDML_CurrentOf(t *testing.T) {
+	t.Parallel()
+
+	tcs := []struct {
+		name string
+		sql  string
+		want bool
+	}{
+		{name: "update where current of", sql: `UPDATE orders SET status = $1 WHERE CURRENT OF order_cursor RETURNING *`, want: true},
+		{name: "delete where current of", sql: `delete from orders where current of order_cursor`, want: true},
+		{name: "update with predicate", sql: `UPDATE orders SET status = $1 WHERE id = $2`},
+		{name: "current of inside literal", sql: `UPDATE orders SET note = 'where current of c' WHERE id = $1`},
+		{name: "current of in subquery", sql: `DELETE FROM orders WHERE id IN (SELECT id FROM t WHERE current_of = 1)`},
+		{name: "insert", sql: `INSERT INTO orders (note) VALUES ('where current of c')`},
+	}
+
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			got, ok := query.ParseDML(tc.sql)
+			if !ok {
+				t.Fatalf("ParseDML(%q) ok = false", tc.sql)
+			}
+			if got.CurrentOf != tc.want {
+				t.Fatalf("ParseDML(%q).CurrentOf = %t, want %t", tc.sql, got.CurrentOf, tc.want)
+			}
+		})
+	}
+}
+
+func TestAppendReturningColumns(t *testing.T) {
+	t.Parallel()
+
+	tcs := []struct {
+		name    string
+		sql     string
+		columns []string
+		want    string
+	}{
+		{name: "columns", sql: "UPDATE orders SET status = 'x';", columns: []string{"status", "id"}, want: "UPDATE orders SET status = 'x'\nRETURNING \"status\", \"id\";"},
+		{name: "no columns", sql: "DELETE FROM orders", want: "DELETE FROM orders\nRETURNING *"},
+	}
+
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			got, ok := query.AppendReturningColumns(tc.sql, tc.columns)
+			if !ok || got != tc.want {
+				t.Fatalf("AppendReturningColumns(%q) = %q, %t, want %q", tc.sql, got, ok, tc.want)
+			}
+		})
+	}
+}
+
+func TestExtendReturning(t *testing.T) {
+	t.Parallel()
+
+	tcs := []struct {
+		name    string
+		sql     string
+		columns []string
+		want    string
+		wantOK  bool
+	}{
+		{name: "adds missing key", sql: "UPDATE orders SET status = $1 WHERE id = $2 RETURNING status;", columns: []string{"id"}, want: "UPDATE orders SET status = $1 WHERE id = $2 RETURNING status, \"id\";", wantOK: true},
+		{name: "adds composite key", sql: "DELETE FROM order_items WHERE qty = 0 RETURNING qty", columns: []string{"order_id", "line_no"}, want: "DELETE FROM order_items WHERE qty = 0 RETURNING qty, \"order_id\", \"line_no\"", wantOK: true},
+		{name: "qualified like the list", sql: "UPDATE orders o SET status = c.status FROM changes c WHERE c.id = o.id RETURNING o.status", columns: []string{"id"}, want: "UPDATE orders o SET status = c.status FROM changes c WHERE c.id = o.id RETURNING o.status, \"o\".\"id\"", wantOK: true},
+		{name: "aliased item is not the key", sql: "UPDATE orders SET status = 'x' RETURNING status AS id_status", columns: []string{"id"}, want: "UPDATE orders SET status = 'x' RETURNING status AS id_status, \"id\"", wantOK: true},
+		{name: "key already returned", sql: `UPDATE orders SET status = 'x' RETURNING "id", status`, columns: []string{"id"}, want: `UPDATE orders SET status = 'x' RETURNING "id", status`},
+		{name: "returning star", sql: "UPDATE orders SET status = 'x' RETURNING *", columns: []string{"id"}, want: "UPDATE orders SET status = 'x' RETURNING *"},
+		{name: "returning qualified star", sql: "UPDATE orders o SET status = 'x' RETURNING o.*", columns: []string{"id"}, want: "UPDATE orders o SET status = 'x' RETURNING o.*"},
+		{name: "no returning", sql: "UPDATE orders SET status = 'x'", columns: []string{"id"}, want: "UPDATE orders SET status = 'x'"},
+		{name: "returning inside a literal", sql: "UPDATE orders SET note = 'returning status'", columns: []string{"id"}, want: "UPDATE orders SET note = 'returning status'"},
+	}
+
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			got, ok := query.ExtendReturning(tc.sql, tc.columns)
+			if ok != tc.wantOK || got != tc.want {
+				t.Fatalf("ExtendReturning(%q) = %q, %t, want %q, %t", tc.sql, got, ok, tc.want, tc.wantOK)
+			}
+		})
+	}
+}
@@ -0,0 +1,44 @@
+package gostry
+
+import (
+	"encoding/json"
+)
+
+// truncatedKey marks a captured value that was replaced because it exceeded Config.MaxValueBytes.
+const truncatedKey = "__truncated__"
+
+// applyLimits returns a copy of m in which every value whose JSON encoding exceeds cfg.MaxValueBytes
+// is replaced by a marker object {"__truncated__": true, "bytes": <encoded size>}.
+func (h *Handler) applyLimits(m map[string]any) map[string]any {
+	limit := h.cfg.MaxValueBytes
+	if m == nil || limit <= 0 {
+		return m
+	}
+	out := make(map[string]any, len(m))
+	for k, v := range m {
+		out[k] = v
+		if v == nil {
+			continue
+		}
+		if n := valueSize(v); n > limit {
+			out[k] = map[string]any{truncatedKey: true, "bytes": n}
+		}
+	}
+	return out
+}
+
+// valueSize returns the number of bytes v occupies once encoded into a history row image.
+// Values that cannot be encoded report 0 and are left to the marshaler to reject.
+func valueSize(v any) int {
+	switch x := v.(type) {
+	case string:
+		return len(x)
+	case []byte:
+		return len(x)
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return 0
+	}
+	return len(b)
+}
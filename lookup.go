@@ -0,0 +1,29 @@
+package gostry
+
+import (
+	"strings"
+
+	"github.com/mickamy/gostry/internal/ident"
+)
+
+// lookupTable finds the per-table setting for table in m.
+// It tries the identifier as written, then its unquoted qualified form, then the bare table name,
+// so "sales.orders" settings take precedence over "orders" ones.
+func lookupTable[T any](m map[string]T, table string) (T, bool) {
+	var zero T
+	if len(m) == 0 {
+		return zero, false
+	}
+	if v, ok := m[table]; ok {
+		return v, true
+	}
+	parts := ident.SplitQualified(table)
+	if len(parts) == 0 {
+		return zero, false
+	}
+	if v, ok := m[strings.Join(parts, ".")]; ok {
+		return v, true
+	}
+	v, ok := m[parts[len(parts)-1]]
+	return v, ok
+}
@@ -0,0 +1,108 @@
+package gostry
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// modelRegistry caches table names resolved from model types.
+type modelRegistry struct {
+	mu      sync.RWMutex
+	names   map[reflect.Type]string
+	tables  map[string]bool // string targets already registered
+	targets []any
+}
+
+// RegisterModels resolves and caches the table name of each target using the same rules as Migrate
+// (TableNamer, Config.TableNameFunc, then the snake_case type name, pluralized unless Config.SingularTableNames is set).
+// Strings are accepted and registered as-is. Registering a model twice is a no-op.
+func (h *Handler) RegisterModels(targets ...any) error {
+	resolved := make([]string, len(targets))
+	for i, t := range targets {
+		name, err := resolveTableName(t, h.cfg.TableNameFunc, h.cfg.SingularTableNames)
+		if err != nil {
+			return err
+		}
+		resolved[i] = name
+	}
+
+	h.models.mu.Lock()
+	defer h.models.mu.Unlock()
+	if h.models.names == nil {
+		h.models.names = map[reflect.Type]string{}
+		h.models.tables = map[string]bool{}
+	}
+	for i, t := range targets {
+		if _, ok := t.(string); ok {
+			if h.models.tables[resolved[i]] {
+				continue
+			}
+			h.models.tables[resolved[i]] = true
+			h.models.targets = append(h.models.targets, t)
+			continue
+		}
+		typ := modelType(t)
+		if _, ok := h.models.names[typ]; ok {
+			continue
+		}
+		h.models.names[typ] = resolved[i]
+		h.models.targets = append(h.models.targets, t)
+	}
+	return nil
+}
+
+// TableNameOf returns the cached table name of a registered model.
+// Values and pointers of the same struct type resolve to the same name.
+func (h *Handler) TableNameOf(model any) (string, error) {
+	h.models.mu.RLock()
+	defer h.models.mu.RUnlock()
+	if name, ok := h.models.names[modelType(model)]; ok {
+		return name, nil
+	}
+	return "", fmt.Errorf("gostry: model %T is not registered", model)
+}
+
+// KeyByModel returns a copy of m keyed by table name, resolving each key like Migrate and
+// RegisterModels (strings as written, structs through TableNamer, cfg.TableNameFunc, and
+// cfg.SingularTableNames). It lets per-table settings be attached by model type:
+//
+//	pk, err := gostry.KeyByModel(cfg, map[any]string{&Order{}: "order_no"})
+//	cfg.PrimaryKeyColumn = pk
+//
+// Use pointer keys for models that are not comparable. Two keys resolving to the same table are an error.
+func KeyByModel[T any](cfg Config, m map[any]T) (map[string]T, error) {
+	if m == nil {
+		return nil, nil
+	}
+	out := make(map[string]T, len(m))
+	from := make(map[string]any, len(m))
+	for model, v := range m {
+		name, err := resolveTableName(model, cfg.TableNameFunc, cfg.SingularTableNames)
+		if err != nil {
+			return nil, err
+		}
+		if prev, ok := from[name]; ok {
+			return nil, fmt.Errorf("gostry: %T and %T both resolve to table %q", prev, model, name)
+		}
+		from[name] = model
+		out[name] = v
+	}
+	return out, nil
+}
+
+// Models returns the registered targets in registration order, suitable for passing to Migrate.
+func (h *Handler) Models() []any {
+	h.models.mu.RLock()
+	defer h.models.mu.RUnlock()
+	return append([]any(nil), h.models.targets...)
+}
+
+// modelType normalizes pointer models to their element type.
+func modelType(model any) reflect.Type {
+	typ := reflect.TypeOf(model)
+	if typ != nil && typ.Kind() == reflect.Pointer {
+		typ = typ.Elem()
+	}
+	return typ
+}
@@ -0,0 +1,102 @@
+package gostry
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestHandler_RegisterModels(t *testing.T) {
+	t.Parallel()
+
+	nameFunc := func(typ reflect.Type) (string, bool) {
+		if typ == reflect.TypeOf(schemaTestAPIKey{}) {
+			return "auth.api_keys", true
+		}
+		return "", false
+	}
+	h := New(Config{TableNameFunc: nameFunc})
+	targets := []any{schemaTestUser{}, &schemaTestAPIKey{}, schemaTestNamed{}, "payments"}
+	if err := h.RegisterModels(targets...); err != nil {
+		t.Fatalf("RegisterModels() error = %v", err)
+	}
+	if err := h.RegisterModels(&schemaTestUser{}, "payments", " payments "); err != nil {
+		t.Fatalf("RegisterModels() duplicate error = %v", err)
+	}
+	if got := h.Models(); len(got) != len(targets) {
+		t.Fatalf("Models() = %v, want %d entries", got, len(targets))
+	}
+
+	for _, model := range []any{schemaTestUser{}, &schemaTestUser{}, schemaTestAPIKey{}, schemaTestNamed{}} {
+		got, err := h.TableNameOf(model)
+		if err != nil {
+			t.Fatalf("TableNameOf(%T) error = %v", model, err)
+		}
+		want, err := resolveTableName(model, nameFunc, false)
+		if err != nil {
+			t.Fatalf("resolveTableName(%T) error = %v", model, err)
+		}
+		if got != want {
+			t.Fatalf("TableNameOf(%T) = %q, want Migrate's %q", model, got, want)
+		}
+	}
+
+	if _, err := h.TableNameOf(struct{ X int }{}); err == nil {
+		t.Fatal("TableNameOf(unregistered) error = nil, want error")
+	}
+}
+
+func TestHandler_ModelsMatchMigrate(t *testing.T) {
+	t.Parallel()
+
+	h := New(Config{})
+	if err := h.RegisterModels(schemaTestUser{}, &schemaTestNamed{}); err != nil {
+		t.Fatalf("RegisterModels() error = %v", err)
+	}
+
+	catalog := &fakeCatalog{schema: "public", table: "x", columns: []string{"id"}}
+	db, state := openFakeDB(t, catalog.query)
+	if err := Migrate(context.Background(), db, SchemaConfig{}, h.Models()...); err != nil {
+		t.Fatalf("Migrate() error = %v", err)
+	}
+
+	var looked []any
+	for _, q := range state.Queries() {
+		if strings.Contains(q.query, "format_type") {
+			looked = append(looked, q.args[len(q.args)-1])
+		}
+	}
+	var want []any
+	for _, m := range []any{schemaTestUser{}, schemaTestNamed{}} {
+		name, _ := h.TableNameOf(m)
+		want = append(want, name)
+	}
+	if !reflect.DeepEqual(looked, want) {
+		t.Fatalf("Migrate looked up %v, want handler names %v", looked, want)
+	}
+}
+
+func TestKeyByModel(t *testing.T) {
+	t.Parallel()
+
+	cfg := Config{SingularTableNames: true}
+	pk, err := KeyByModel(cfg, map[any]string{&schemaTestUser{}: "user_no", schemaTestNamed{}: "code", "payments": "payment_no"})
+	if err != nil {
+		t.Fatalf("KeyByModel() error = %v", err)
+	}
+	want := map[string]string{"schema_test_user": "user_no", "named_things": "code", "payments": "payment_no"}
+	if !reflect.DeepEqual(pk, want) {
+		t.Fatalf("KeyByModel() = %v, want %v", pk, want)
+	}
+
+	cfg.PrimaryKeyColumn = pk
+	h := New(cfg)
+	if id, _, _ := h.resolveID("named_things", nil, map[string]any{"id": 1, "code": "A-1"}); id != "A-1" {
+		t.Errorf("resolveID(named_things) = %v, want the model-keyed primary key", id)
+	}
+
+	if _, err := KeyByModel(cfg, map[any]string{schemaTestNamed{}: "code", "named_things": "id"}); err == nil {
+		t.Error("KeyByModel(colliding keys) error = nil, want error")
+	}
+}
@@ -0,0 +1,43 @@
+package gostry
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"github.com/mickamy/gostry/internal/query"
+)
+
+// MultiTablePolicy controls how statements that join other tables (UPDATE ... FROM, DELETE ... USING)
+// are handled when their RETURNING clause is not scoped to the target table, since the returned
+// columns may then mix the target with the joined tables.
+type MultiTablePolicy int
+
+const (
+	// MultiTableSkip executes the statement without capturing history and logs a warning.
+	MultiTableSkip MultiTablePolicy = iota
+	// MultiTableError rejects the statement before it runs.
+	MultiTableError
+	// MultiTableCapture captures the returned rows as-is, even if they contain columns of joined tables.
+	MultiTableCapture
+)
+
+// ambiguous reports whether dml may return columns from tables other than its target.
+func ambiguous(dml query.DML) bool {
+	return dml.IsMultiTable() && !dml.ReturningScoped
+}
+
+// checkMultiTable applies Config.MultiTable to an ambiguous statement.
+// It returns capture=false when the statement should run without capture.
+func (h *Handler) checkMultiTable(ctx context.Context, dml query.DML, q string) (capture bool, err error) {
+	switch h.cfg.MultiTable {
+	case MultiTableCapture:
+		return true, nil
+	case MultiTableError:
+		return false, fmt.Errorf("gostry: ambiguous %s on %s: statement joins other tables and RETURNING is not scoped to the target table or its alias", dml.Op, dml.Table)
+	default:
+		h.warn(ctx, "gostry: statement joins other tables without a scoped RETURNING; skipping capture",
+			slog.String("table", dml.Table), slog.String("sql", q))
+		return false, nil
+	}
+}
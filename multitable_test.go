@@ -0,0 +1,74 @@
+package gostry
+
+import (
+	"context"
+	"database/sql/driver"
+	"strings"
+	"testing"
+)
+
+func TestTx_MultiTable(t *testing.T) {
+	t.Parallel()
+
+	const (
+		unscoped = `UPDATE orders o SET total = s.total FROM staging s WHERE o.id = s.id RETURNING *`
+		scoped   = `UPDATE orders o SET total = s.total FROM staging s WHERE o.id = s.id RETURNING o.*`
+	)
+
+	tcs := []struct {
+		name        string
+		policy      MultiTablePolicy
+		sql         string
+		wantErr     bool
+		wantQueries int
+		wantExecs   int // business statement passed through Exec plus history inserts
+	}{
+		{name: "skip unscoped", policy: MultiTableSkip, sql: unscoped, wantExecs: 1},
+		{name: "error unscoped", policy: MultiTableError, sql: unscoped, wantErr: true},
+		{name: "capture unscoped", policy: MultiTableCapture, sql: unscoped, wantQueries: 1, wantExecs: 1},
+		{name: "scoped with skip policy", policy: MultiTableSkip, sql: scoped, wantQueries: 1, wantExecs: 1},
+		{name: "scoped with error policy", policy: MultiTableError, sql: scoped, wantQueries: 1, wantExecs: 1},
+	}
+
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			db, state := openFakeDB(t, func(string, []any) (fakeResult, error) {
+				return fakeResult{cols: []string{"id", "total"}, rows: [][]driver.Value{{int64(1), int64(10)}}}, nil
+			})
+
+			ctx := context.Background()
+			tx, err := New(Config{MultiTable: tc.policy}).Wrap(db).BeginTx(ctx, nil)
+			if err != nil {
+				t.Fatalf("BeginTx() error = %v", err)
+			}
+			_, err = tx.ExecContext(ctx, tc.sql)
+			if tc.wantErr {
+				if err == nil || !strings.Contains(err.Error(), "ambiguous UPDATE on orders") {
+					t.Fatalf("ExecContext() error = %v, want ambiguous statement error", err)
+				}
+				if got := len(state.Queries()) + len(state.Execs()); got != 0 {
+					t.Fatalf("statements issued = %d, want 0", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ExecContext() error = %v", err)
+			}
+			if err := tx.Commit(); err != nil {
+				t.Fatalf("Commit() error = %v", err)
+			}
+			if got := len(state.Queries()); got != tc.wantQueries {
+				t.Fatalf("queries = %d, want %d", got, tc.wantQueries)
+			}
+			execs := state.Execs()
+			if len(execs) != tc.wantExecs {
+				t.Fatalf("execs = %d, want %d", len(execs), tc.wantExecs)
+			}
+			if tc.wantQueries == 0 && execs[0].query != tc.sql {
+				t.Fatalf("passed-through exec = %q, want %q", execs[0].query, tc.sql)
+			}
+		})
+	}
+}
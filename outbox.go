@@ -0,0 +1,328 @@
+package gostry
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/mickamy/gostry/internal/ident"
+)
+
+// OutboxTable is the table Config.OutboxMode writes captured history to. MigrateOutbox creates it.
+const OutboxTable = "gostry_outbox"
+
+// defaultOutboxBatchSize is the number of outbox rows DrainOutbox processes when no limit is given.
+const defaultOutboxBatchSize = 100
+
+// outboxRow is a history row as stored in an outbox payload: the history table, the layout its
+// INSERT was built from, and the bound values, plus the table, operation, and id of its record for
+// the notification sent when it is drained. No SQL is stored; DrainOutbox rebuilds the INSERT.
+type outboxRow struct {
+	Table     string       `json:"table"`
+	Operation string       `json:"op"`
+	ID        any          `json:"id"`
+	History   []string     `json:"history"`
+	Layout    outboxLayout `json:"layout"`
+	Args      []outboxArg  `json:"args"`
+}
+
+// outboxLayout is the part of historyDDLOptions that selects the columns of an outboxed history
+// INSERT. Under OutboxMode every written column is bound, and HashChain is rejected.
+type outboxLayout struct {
+	Composite     bool     `json:"composite,omitempty"`
+	Statement     bool     `json:"statement,omitempty"`
+	SchemaVersion bool     `json:"schema_version,omitempty"`
+	DBUser        bool     `json:"db_user,omitempty"`
+	TxLabel       bool     `json:"tx_label,omitempty"`
+	Compress      bool     `json:"compress,omitempty"`
+	HistoryID     bool     `json:"history_id,omitempty"`
+	Promoted      []string `json:"promoted,omitempty"`
+}
+
+// newOutboxLayout returns the outbox layout of a history row built from opts and promoted.
+func newOutboxLayout(opts historyDDLOptions, promoted []string) outboxLayout {
+	return outboxLayout{
+		Composite:     opts.composite,
+		Statement:     opts.statement,
+		SchemaVersion: opts.schemaVersion,
+		DBUser:        opts.dbUser,
+		TxLabel:       opts.txLabel,
+		Compress:      opts.compress,
+		HistoryID:     opts.bindHistoryID,
+		Promoted:      promoted,
+	}
+}
+
+// options returns the historyDDLOptions the outboxed INSERT was built from.
+func (l outboxLayout) options() historyDDLOptions {
+	return historyDDLOptions{
+		composite:      l.Composite,
+		statement:      l.Statement,
+		schemaVersion:  l.SchemaVersion,
+		dbUser:         l.DBUser,
+		txLabel:        l.TxLabel,
+		compress:       l.Compress,
+		bindHistoryID:  l.HistoryID,
+		bindOperatedAt: true,
+		bindDBUser:     true,
+	}
+}
+
+// outboxArg is a history INSERT argument. Byte values (encoded images) are kept apart from other
+// values so they survive the JSON round trip.
+type outboxArg struct {
+	Value any    `json:"v"`
+	Bytes []byte `json:"b,omitempty"`
+}
+
+// checkOutboxConfig reports options that cannot be combined with Config.OutboxMode.
+func (h *Handler) checkOutboxConfig() error {
+	switch {
+	case h.cfg.HistoryDB != nil:
+		return errors.New("gostry: OutboxMode cannot be combined with HistoryDB")
+	case h.cfg.HashChain:
+		return errors.New("gostry: OutboxMode cannot be combined with HashChain")
+	case h.cfg.ReturnHistoryIDs:
+		return errors.New("gostry: OutboxMode cannot be combined with ReturnHistoryIDs")
+	}
+	return nil
+}
+
+// writeOutbox stores the prepared rows as a single outbox row, to be expanded by DrainOutbox.
+func writeOutbox(ctx context.Context, exec execer, rows []historyRow) error {
+	payload := make([]outboxRow, len(rows))
+	for i, r := range rows {
+		args := make([]outboxArg, len(r.args))
+		for j, a := range r.args {
+			if b, ok := a.([]byte); ok {
+				args[j].Bytes = b
+				continue
+			}
+			args[j].Value = a
+		}
+		payload[i] = outboxRow{
+			Table:     r.record.Table,
+			Operation: r.record.Operation,
+			ID:        r.record.ID,
+			History:   r.history,
+			Layout:    newOutboxLayout(r.layout, r.promoted),
+			Args:      args,
+		}
+	}
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return withKind(ErrMarshal, fmt.Errorf("gostry: failed to marshal outbox payload: %w", err))
+	}
+	q := fmt.Sprintf(`INSERT INTO %s (payload) VALUES ($1)`, ident.Quote(OutboxTable))
+	if _, err := exec.ExecContext(ctx, q, b); err != nil {
+		return historyTableError(fmt.Errorf("gostry: failed to write outbox: %w", err))
+	}
+	return nil
+}
+
+// decodeOutbox parses an outbox payload back into its history rows. Integer arguments are restored as int64 and other numbers as float64.
+func decodeOutbox(b []byte) ([]outboxRow, error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var rows []outboxRow
+	if err := dec.Decode(&rows); err != nil {
+		return nil, err
+	}
+	for i, r := range rows {
+		rows[i].ID = outboxNumber(r.ID)
+		for j, a := range r.Args {
+			r.Args[j].Value = outboxNumber(a.Value)
+		}
+	}
+	return rows, nil
+}
+
+// outboxNumber converts a json.Number to int64, or float64 when it is not an integer.
+// Other values are returned unchanged.
+func outboxNumber(v any) any {
+	n, ok := v.(json.Number)
+	if !ok {
+		return v
+	}
+	if i, err := n.Int64(); err == nil {
+		return i
+	}
+	if f, err := n.Float64(); err == nil {
+		return f
+	}
+	return v
+}
+
+// historyRow rebuilds the history row of r under cfg with newHistoryInsert. Only the layout is taken
+// from the payload, so the INSERT writes the columns of historyLayout plus promoted columns that cfg
+// configures for the table, and nothing else; the payload must carry one value per bound column.
+func (r outboxRow) historyRow(cfg Config) (historyRow, error) {
+	if len(r.History) == 0 || len(r.History) > 2 || ident.QuoteQualified(r.History) == "" {
+		return historyRow{}, &InvalidIdentifierError{Table: r.Table}
+	}
+	configured := make(map[string]bool)
+	for _, p := range cfg.Promoted.lookup(r.Table) {
+		configured[p.Name] = true
+	}
+	for _, name := range r.Layout.Promoted {
+		if !configured[name] {
+			return historyRow{}, fmt.Errorf("gostry: outbox row for %s writes column %q, which is not a promoted column of the table", r.Table, name)
+		}
+	}
+	opts := r.Layout.options()
+	insert := newHistoryInsert(r.History, defaultHistoryColumns, opts, r.Layout.Promoted, cfg.SkipIfNotExists)
+	args := r.values()
+	if len(args) != len(insert.params) {
+		return historyRow{}, fmt.Errorf("gostry: outbox row for %s has %d values, want %d", r.Table, len(args), len(insert.params))
+	}
+	return historyRow{
+		record:   Record{Table: r.Table, Operation: r.Operation, ID: r.ID},
+		history:  r.History,
+		layout:   opts,
+		promoted: r.Layout.Promoted,
+		insert:   insert,
+		stmt:     insert.statement(),
+		args:     args,
+	}, nil
+}
+
+// values returns the arguments of r as bound by the history INSERT.
+func (r outboxRow) values() []any {
+	vals := make([]any, len(r.Args))
+	for i, a := range r.Args {
+		if a.Bytes != nil {
+			vals[i] = a.Bytes
+			continue
+		}
+		vals[i] = a.Value
+	}
+	return vals
+}
+
+// MigrateOutbox creates the outbox table used by Config.OutboxMode if it does not exist.
+func MigrateOutbox(ctx context.Context, db DBExecQuerier) error {
+	q := fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+    outbox_id  BIGSERIAL PRIMARY KEY,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    payload    JSONB NOT NULL
+)`, ident.Quote(OutboxTable))
+	if _, err := db.ExecContext(ctx, q); err != nil {
+		return fmt.Errorf("gostry: failed to create outbox table: %w", err)
+	}
+	return nil
+}
+
+// startDrainer runs DrainOutbox every interval in the background until Close cancels it. Each run
+// drains until the outbox is empty; errors are logged and retried at the next tick.
+func (db *DB) startDrainer(interval time.Duration) {
+	ctx, cancel := context.WithCancel(context.Background())
+	db.stopDrain = cancel
+	db.drainDone = make(chan struct{})
+	go func() {
+		defer close(db.drainDone)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			for ctx.Err() == nil {
+				n, err := db.DrainOutbox(ctx, 0)
+				if err != nil {
+					if ctx.Err() == nil {
+						db.h.warn(ctx, "gostry: failed to drain outbox", slog.Any("error", err))
+					}
+					break
+				}
+				if n == 0 {
+					break
+				}
+			}
+		}
+	}()
+}
+
+// DrainOutbox expands up to limit outbox rows into their history tables using the handler's Config;
+// see the package-level DrainOutbox.
+func (db *DB) DrainOutbox(ctx context.Context, limit int) (int, error) {
+	return DrainOutbox(ctx, db.DB, db.h.cfg, limit)
+}
+
+// DrainOutbox is the consumer side of Config.OutboxMode. It expands up to batchSize outbox rows
+// (default: 100), oldest first, into their history tables and deletes them, committing the batch
+// in one transaction, so each outbox row is applied exactly once. Rows are selected with
+// FOR UPDATE SKIP LOCKED, so concurrent workers never process the same row and do not wait on each
+// other. Each history INSERT is rebuilt from the layout stored in the payload, so cfg must configure
+// the same Promoted columns as the writer; a row naming any other column fails the batch.
+// When cfg.NotifyChannel is set, each history row is announced as a flush would.
+// It returns the number of outbox rows processed; a worker calls it until it returns 0.
+func DrainOutbox(ctx context.Context, db *sql.DB, cfg Config, batchSize int) (int, error) {
+	if batchSize <= 0 {
+		batchSize = defaultOutboxBatchSize
+	}
+	if err := cfg.Promoted.validate(); err != nil {
+		return 0, err
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("gostry: failed to begin outbox transaction: %w", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	type pending struct {
+		id      int64
+		payload []byte
+	}
+	q := fmt.Sprintf(`SELECT outbox_id, payload FROM %s ORDER BY outbox_id LIMIT $1 FOR UPDATE SKIP LOCKED`, ident.Quote(OutboxTable))
+	rows, err := tx.QueryContext(ctx, q, int64(batchSize))
+	if err != nil {
+		return 0, fmt.Errorf("gostry: failed to read outbox: %w", err)
+	}
+	var batch []pending
+	for rows.Next() {
+		var p pending
+		if err := rows.Scan(&p.id, &p.payload); err != nil {
+			_ = rows.Close()
+			return 0, withKind(ErrScan, fmt.Errorf("gostry: failed to scan outbox row: %w", err))
+		}
+		batch = append(batch, p)
+	}
+	_ = rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("gostry: failed to read outbox: %w", err)
+	}
+
+	del := fmt.Sprintf(`DELETE FROM %s WHERE outbox_id = $1`, ident.Quote(OutboxTable))
+	for _, p := range batch {
+		history, err := decodeOutbox(p.payload)
+		if err != nil {
+			return 0, withKind(ErrMarshal, fmt.Errorf("gostry: failed to decode outbox row %d: %w", p.id, err))
+		}
+		written := make([]historyRow, len(history))
+		for i, r := range history {
+			if written[i], err = r.historyRow(cfg); err != nil {
+				return 0, fmt.Errorf("gostry: invalid outbox row %d: %w", p.id, err)
+			}
+			if _, err := tx.ExecContext(ctx, written[i].stmt, written[i].args...); err != nil {
+				return 0, historyTableError(fmt.Errorf("gostry: failed to insert history table: %w", err))
+			}
+		}
+		if err := notifyHistory(ctx, tx, cfg.NotifyChannel, written); err != nil {
+			return 0, err
+		}
+		if _, err := tx.ExecContext(ctx, del, p.id); err != nil {
+			return 0, fmt.Errorf("gostry: failed to delete outbox row %d: %w", p.id, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("gostry: failed to commit outbox transaction: %w", err)
+	}
+	return len(batch), nil
+}
@@ -0,0 +1,397 @@
+package gostry
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// captureOutbox commits an UPDATE of two orders with OutboxMode and returns the outbox payload.
+func captureOutbox(t *testing.T, cfg Config) ([]byte, *fakeState) {
+	t.Helper()
+	db, state := openFakeDB(t, func(string, []any) (fakeResult, error) {
+		return fakeResult{cols: []string{"id", "status"}, rows: [][]driver.Value{{int64(1), "paid"}, {int64(2), "paid"}}}, nil
+	})
+	ctx := context.Background()
+	tx, err := New(cfg).Wrap(db).BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatalf("BeginTx() error = %v", err)
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE orders SET status = 'paid' RETURNING *`); err != nil {
+		t.Fatalf("ExecContext() error = %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Commit() error = %v", err)
+	}
+	execs := state.Execs()
+	if len(execs) != 1 || !strings.Contains(execs[0].query, `INSERT INTO "gostry_outbox"`) {
+		t.Fatalf("execs = %v, want one outbox insert", execs)
+	}
+	return execs[0].args[0].([]byte), state
+}
+
+func TestTx_OutboxMode(t *testing.T) {
+	t.Parallel()
+
+	payload, _ := captureOutbox(t, Config{OutboxMode: true})
+	rows, err := decodeOutbox(payload)
+	if err != nil {
+		t.Fatalf("decodeOutbox() error = %v", err)
+	}
+	if len(rows) != 2 {
+		t.Fatalf("outbox rows = %d, want 2", len(rows))
+	}
+	for i, r := range rows {
+		if strings.Contains(string(payload), "INSERT") {
+			t.Fatalf("payload = %s, want no SQL", payload)
+		}
+		row, err := r.historyRow(Config{})
+		if err != nil {
+			t.Fatalf("rows[%d].historyRow() error = %v", i, err)
+		}
+		if !strings.Contains(row.stmt, `INSERT INTO "orders_history"`) || !strings.Contains(row.stmt, `"operated_at"`) {
+			t.Errorf("rows[%d] stmt = %q, want an orders_history insert setting operated_at", i, row.stmt)
+		}
+		vals := row.args
+		if vals[0] != int64(i+1) || vals[1] != "UPDATE" || vals[3] != "" {
+			t.Errorf("rows[%d] id, op, operator = %v, %v, %v", i, vals[0], vals[1], vals[3])
+		}
+		if _, ok := vals[2].(string); !ok {
+			t.Errorf("rows[%d] operated_at = %T, want the flush time", i, vals[2])
+		}
+		after, ok := vals[7].([]byte)
+		if !ok {
+			t.Fatalf("rows[%d] after = %T, want []byte", i, vals[7])
+		}
+		var m map[string]any
+		if err := json.Unmarshal(after, &m); err != nil || m["status"] != "paid" {
+			t.Errorf("rows[%d] after = %s, want the captured row", i, after)
+		}
+	}
+
+	t.Run("incompatible options are rejected", func(t *testing.T) {
+		t.Parallel()
+
+		db, _ := openFakeDB(t, func(string, []any) (fakeResult, error) {
+			return fakeResult{cols: []string{"id"}, rows: [][]driver.Value{{int64(1)}}}, nil
+		})
+		ctx := context.Background()
+		tx, err := New(Config{OutboxMode: true, HashChain: true}).Wrap(db).BeginTx(ctx, nil)
+		if err != nil {
+			t.Fatalf("BeginTx() error = %v", err)
+		}
+		if _, err := tx.ExecContext(ctx, `DELETE FROM orders RETURNING id`); err != nil {
+			t.Fatalf("ExecContext() error = %v", err)
+		}
+		if err := tx.Commit(); err == nil || !strings.Contains(err.Error(), "HashChain") {
+			t.Fatalf("Commit() error = %v, want HashChain conflict", err)
+		}
+	})
+}
+
+func TestDB_DrainOutbox(t *testing.T) {
+	t.Parallel()
+
+	payload, _ := captureOutbox(t, Config{OutboxMode: true})
+	db, state := openFakeDB(t, func(q string, _ []any) (fakeResult, error) {
+		if strings.Contains(q, `FROM "gostry_outbox"`) {
+			return fakeResult{cols: []string{"outbox_id", "payload"}, rows: [][]driver.Value{{int64(42), payload}}}, nil
+		}
+		return fakeResult{}, nil
+	})
+
+	n, err := New(Config{}).Wrap(db).DrainOutbox(context.Background(), 0)
+	if err != nil {
+		t.Fatalf("DrainOutbox() error = %v", err)
+	}
+	if n != 1 {
+		t.Errorf("DrainOutbox() = %d, want 1", n)
+	}
+	if q := state.Queries(); len(q) != 1 || q[0].args[0] != int64(defaultOutboxBatchSize) {
+		t.Errorf("queries = %v, want one outbox read limited to %d", q, defaultOutboxBatchSize)
+	}
+
+	execs := state.Execs()
+	if len(execs) != 3 {
+		t.Fatalf("execs = %d, want 2 history inserts and 1 delete", len(execs))
+	}
+	for i, call := range execs[:2] {
+		if !strings.Contains(call.query, `INSERT INTO "orders_history"`) {
+			t.Errorf("execs[%d] = %q, want a history insert", i, call.query)
+		}
+		if call.args[0] != int64(i+1) {
+			t.Errorf("execs[%d] id = %v, want %d", i, call.args[0], i+1)
+		}
+		if _, ok := call.args[7].([]byte); !ok {
+			t.Errorf("execs[%d] after = %T, want []byte", i, call.args[7])
+		}
+	}
+	if del := execs[2]; !strings.HasPrefix(del.query, `DELETE FROM "gostry_outbox"`) || del.args[0] != int64(42) {
+		t.Errorf("execs[2] = %v, want the outbox row deleted", del)
+	}
+	if commits, _ := state.Outcome(); commits != 1 {
+		t.Errorf("commits = %d, want 1", commits)
+	}
+}
+
+func TestDB_DrainOutbox_RejectsPayload(t *testing.T) {
+	t.Parallel()
+
+	payload, _ := captureOutbox(t, Config{OutboxMode: true, Promoted: PromotedColumns{"orders": {{Name: "status"}}}})
+	tcs := []struct {
+		name   string
+		edit   func(rows []outboxRow) any
+		cfg    Config
+		errMsg string
+	}{
+		{
+			name:   "configured promoted column",
+			edit:   func(rows []outboxRow) any { return rows },
+			cfg:    Config{Promoted: PromotedColumns{"orders": {{Name: "status"}}}},
+			errMsg: "",
+		},
+		{
+			name:   "promoted column not configured",
+			edit:   func(rows []outboxRow) any { return rows },
+			errMsg: `writes column "status"`,
+		},
+		{
+			name: "extra value",
+			edit: func(rows []outboxRow) any {
+				rows[0].Args = append(rows[0].Args, outboxArg{Value: "x"})
+				return rows
+			},
+			cfg:    Config{Promoted: PromotedColumns{"orders": {{Name: "status"}}}},
+			errMsg: "has 10 values, want 9",
+		},
+		{
+			name: "empty history table",
+			edit: func(rows []outboxRow) any {
+				rows[0].History = []string{""}
+				return rows
+			},
+			cfg:    Config{Promoted: PromotedColumns{"orders": {{Name: "status"}}}},
+			errMsg: "invalid history table identifier",
+		},
+		{
+			name: "sql statement",
+			edit: func([]outboxRow) any {
+				return []map[string]any{{"table": "orders", "op": "UPDATE", "id": 1, "stmt": `DROP TABLE orders`, "args": []any{}}}
+			},
+			errMsg: "invalid history table identifier",
+		},
+	}
+
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			rows, err := decodeOutbox(payload)
+			if err != nil {
+				t.Fatalf("decodeOutbox() error = %v", err)
+			}
+			edited, err := json.Marshal(tc.edit(rows))
+			if err != nil {
+				t.Fatalf("json.Marshal() error = %v", err)
+			}
+			db, state := openFakeDB(t, func(q string, _ []any) (fakeResult, error) {
+				if strings.Contains(q, `FROM "gostry_outbox"`) {
+					return fakeResult{cols: []string{"outbox_id", "payload"}, rows: [][]driver.Value{{int64(42), edited}}}, nil
+				}
+				return fakeResult{}, nil
+			})
+
+			_, err = New(tc.cfg).Wrap(db).DrainOutbox(context.Background(), 0)
+			if tc.errMsg == "" {
+				if err != nil {
+					t.Fatalf("DrainOutbox() error = %v", err)
+				}
+				for _, call := range state.Execs()[:2] {
+					if !strings.Contains(call.query, `"status"`) {
+						t.Errorf("history insert = %q, want the promoted column", call.query)
+					}
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.errMsg) {
+				t.Fatalf("DrainOutbox() error = %v, want %q", err, tc.errMsg)
+			}
+			for _, call := range state.Execs() {
+				if strings.Contains(call.query, "DROP") {
+					t.Errorf("exec = %q, want no statement from the payload", call.query)
+				}
+			}
+			if commits, _ := state.Outcome(); commits != 0 {
+				t.Errorf("commits = %d, want 0", commits)
+			}
+		})
+	}
+}
+
+func TestDrainOutbox_Concurrent(t *testing.T) {
+	t.Parallel()
+
+	// The fake cannot lock rows, so this test checks the SQL that makes concurrent drains safe on
+	// PostgreSQL: every read locks its rows with FOR UPDATE SKIP LOCKED, every row read is deleted
+	// once, and each batch is committed in its own transaction. Reads that do not skip locked rows
+	// fail, and reads that do are handed rows no other reader has seen.
+	payload, _ := captureOutbox(t, Config{OutboxMode: true})
+	const (
+		outboxRows = 50
+		batchSize  = 3
+		wantRead   = `SELECT outbox_id, payload FROM "gostry_outbox" ORDER BY outbox_id LIMIT $1 FOR UPDATE SKIP LOCKED`
+	)
+	var (
+		mu     sync.Mutex
+		nextID int64
+	)
+	db, state := openFakeDB(t, func(q string, args []any) (fakeResult, error) {
+		if !strings.Contains(q, `FROM "gostry_outbox"`) {
+			return fakeResult{}, nil
+		}
+		if q != wantRead {
+			return fakeResult{}, fmt.Errorf("outbox read %q does not skip locked rows", q)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		res := fakeResult{cols: []string{"outbox_id", "payload"}}
+		for i := int64(0); i < args[0].(int64) && nextID < outboxRows; i++ {
+			nextID++
+			res.rows = append(res.rows, []driver.Value{nextID, payload})
+		}
+		return res, nil
+	})
+
+	const workers = 4
+	var (
+		wg          sync.WaitGroup
+		total, runs atomic.Int64
+	)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				n, err := DrainOutbox(context.Background(), db, Config{NotifyChannel: "history"}, batchSize)
+				if err != nil {
+					t.Errorf("DrainOutbox() error = %v", err)
+					return
+				}
+				runs.Add(1)
+				if n == 0 {
+					return
+				}
+				if n > batchSize {
+					t.Errorf("DrainOutbox() = %d, want at most %d", n, batchSize)
+				}
+				total.Add(int64(n))
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := total.Load(); got != outboxRows {
+		t.Errorf("processed = %d, want %d", got, outboxRows)
+	}
+	reads := state.Queries()
+	if int64(len(reads)) != runs.Load() {
+		t.Errorf("outbox reads = %d, want one per DrainOutbox call (%d)", len(reads), runs.Load())
+	}
+	for _, q := range reads {
+		if q.query != wantRead || q.args[0] != int64(batchSize) {
+			t.Errorf("outbox read = %q %v, want %q limited to %d", q.query, q.args, wantRead, batchSize)
+		}
+	}
+	if commits, rollbacks := state.Outcome(); int64(commits) != runs.Load() || rollbacks != 0 {
+		t.Errorf("commits, rollbacks = %d, %d, want one commit per batch (%d)", commits, rollbacks, runs.Load())
+	}
+
+	deleted := map[any]int{}
+	inserts, notifies := 0, 0
+	for _, call := range state.Execs() {
+		switch {
+		case strings.HasPrefix(call.query, `DELETE FROM "gostry_outbox"`):
+			if call.query != `DELETE FROM "gostry_outbox" WHERE outbox_id = $1` {
+				t.Errorf("delete = %q, want one row per statement", call.query)
+			}
+			deleted[call.args[0]]++
+		case strings.Contains(call.query, `INSERT INTO "orders_history"`):
+			inserts++
+		case strings.Contains(call.query, "pg_notify"):
+			notifies++
+		}
+	}
+	if len(deleted) != outboxRows {
+		t.Errorf("deleted %d distinct outbox rows, want %d", len(deleted), outboxRows)
+	}
+	for id, n := range deleted {
+		if n != 1 {
+			t.Errorf("outbox row %v deleted %d times", id, n)
+		}
+	}
+	if inserts != 2*outboxRows || notifies != 2*outboxRows {
+		t.Errorf("history inserts, notifications = %d, %d, want %d each", inserts, notifies, 2*outboxRows)
+	}
+}
+
+func TestDB_Close(t *testing.T) {
+	t.Parallel()
+
+	t.Run("stops the outbox drainer and closes the database", func(t *testing.T) {
+		t.Parallel()
+
+		var reads atomic.Int64
+		sqlDB, _ := openFakeDB(t, func(q string, _ []any) (fakeResult, error) {
+			if strings.Contains(q, `FROM "gostry_outbox"`) {
+				reads.Add(1)
+			}
+			return fakeResult{cols: []string{"outbox_id", "payload"}}, nil
+		})
+		db := New(Config{OutboxMode: true, DrainOutboxEvery: time.Millisecond}).Wrap(sqlDB)
+
+		deadline := time.Now().Add(5 * time.Second)
+		for reads.Load() == 0 {
+			if time.Now().After(deadline) {
+				t.Fatal("outbox drainer did not run")
+			}
+			time.Sleep(time.Millisecond)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatalf("Close() error = %v", err)
+		}
+		stopped := reads.Load()
+		time.Sleep(20 * time.Millisecond)
+		if got := reads.Load(); got != stopped {
+			t.Errorf("outbox reads after Close = %d, want %d", got, stopped)
+		}
+		if err := sqlDB.Ping(); err == nil {
+			t.Error("Ping() after Close succeeded, want the database closed")
+		}
+		if err := db.Close(); err != nil {
+			t.Errorf("second Close() error = %v", err)
+		}
+	})
+
+	t.Run("closes an owned history database", func(t *testing.T) {
+		t.Parallel()
+
+		for _, own := range []bool{true, false} {
+			sqlDB, _ := openFakeDB(t, nil)
+			historyDB, _ := openFakeDB(t, nil)
+			db := New(Config{HistoryDB: historyDB, OwnHistoryDB: own}).Wrap(sqlDB)
+			if err := db.Close(); err != nil {
+				t.Fatalf("Close() error = %v", err)
+			}
+			if closed := historyDB.Ping() != nil; closed != own {
+				t.Errorf("OwnHistoryDB = %v: history database closed = %v", own, closed)
+			}
+		}
+	})
+}
@@ -0,0 +1,121 @@
+package pgxadapter
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"testing"
+
+	"github.com/jackc/pgx/v5/stdlib"
+
+	"github.com/mickamy/gostry"
+)
+
+// TestConnector_Pgx runs Handler.Connector over the pgx database/sql connector, so the driver-level
+// capture is exercised with pgx's driver.Conn, not only the fake driver of the gostry package.
+func TestConnector_Pgx(t *testing.T) {
+	t.Parallel()
+
+	openDB := func(t *testing.T, server *pgServer, cfg gostry.Config) *sql.DB {
+		t.Helper()
+		db := sql.OpenDB(gostry.New(cfg).Connector(stdlib.GetConnector(*server.config(t))))
+		t.Cleanup(func() { _ = db.Close() })
+		return db
+	}
+
+	t.Run("commit writes history on the same connection", func(t *testing.T) {
+		t.Parallel()
+
+		server := startPGServer(t, returnOrders("7"))
+		db := openDB(t, server, gostry.Config{})
+
+		ctx := gostry.WithOperator(context.Background(), "alice")
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			t.Fatalf("BeginTx() error = %v", err)
+		}
+		res, err := tx.ExecContext(ctx, `UPDATE orders SET status = $1 WHERE id = $2 RETURNING *`, "paid", int64(7))
+		if err != nil {
+			t.Fatalf("ExecContext() error = %v", err)
+		}
+		if n, _ := res.RowsAffected(); n != 1 {
+			t.Errorf("RowsAffected() = %d, want 1", n)
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatalf("Commit() error = %v", err)
+		}
+
+		queries := server.Queries()
+		want := []string{"begin", "UPDATE orders", `INSERT INTO "orders_history"`, "commit"}
+		if len(queries) != len(want) {
+			t.Fatalf("queries = %q, want %d", queries, len(want))
+		}
+		for i, prefix := range want {
+			if !strings.HasPrefix(strings.TrimSpace(queries[i]), prefix) {
+				t.Errorf("queries[%d] = %q, want prefix %q", i, queries[i], prefix)
+			}
+		}
+		if !strings.Contains(queries[2], "'alice'") {
+			t.Errorf("history insert = %q, want the operator", queries[2])
+		}
+	})
+
+	t.Run("flush shares the bulk writer", func(t *testing.T) {
+		t.Parallel()
+
+		server := startPGServer(t, returnOrders("1", "2", "3"))
+		db := openDB(t, server, gostry.Config{BulkInsertThreshold: 2})
+
+		ctx := context.Background()
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			t.Fatalf("BeginTx() error = %v", err)
+		}
+		if _, err := tx.ExecContext(ctx, `UPDATE orders SET status = 'paid' RETURNING *`); err != nil {
+			t.Fatalf("ExecContext() error = %v", err)
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatalf("Commit() error = %v", err)
+		}
+		inserts := historyInserts(server.Queries())
+		if len(inserts) != 1 || strings.Count(inserts[0], "now()") != 3 {
+			t.Errorf("history inserts = %q, want one insert of 3 rows", inserts)
+		}
+	})
+
+	t.Run("queried rows are recorded", func(t *testing.T) {
+		t.Parallel()
+
+		server := startPGServer(t, returnOrders("1", "2"))
+		db := openDB(t, server, gostry.Config{})
+
+		ctx := context.Background()
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			t.Fatalf("BeginTx() error = %v", err)
+		}
+		var id int64
+		if err := tx.QueryRowContext(ctx, `DELETE FROM orders RETURNING id, status`).Scan(&id, new(string)); err != nil {
+			t.Fatalf("Scan() error = %v", err)
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatalf("Commit() error = %v", err)
+		}
+		if inserts := historyInserts(server.Queries()); len(inserts) != 2 {
+			t.Errorf("history inserts = %d, want both returned rows", len(inserts))
+		}
+	})
+
+	t.Run("ping reaches the server", func(t *testing.T) {
+		t.Parallel()
+
+		server := startPGServer(t, nil)
+		db := openDB(t, server, gostry.Config{})
+		if err := db.PingContext(context.Background()); err != nil {
+			t.Fatalf("PingContext() error = %v", err)
+		}
+		if server.Pings() == 0 {
+			t.Error("pings = 0, want the ping forwarded to the server")
+		}
+	})
+}
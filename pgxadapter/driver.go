@@ -0,0 +1,164 @@
+package pgxadapter
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// connector hands database/sql the single connection of a wrapped transaction.
+type connector struct {
+	conn *conn
+}
+
+func (c connector) Connect(context.Context) (driver.Conn, error) {
+	return c.conn, nil
+}
+
+func (c connector) Driver() driver.Driver {
+	return noDriver{}
+}
+
+// noDriver is the driver of a connector. Connections only come from WrapPgx, so Open fails.
+type noDriver struct{}
+
+func (noDriver) Open(string) (driver.Conn, error) {
+	return nil, errors.New("pgxadapter: connections are opened by WrapPgx")
+}
+
+// conn presents an open pgx.Tx as a driver connection, so a gostry.Tx can run on it through
+// database/sql. Results of the last statement are kept for Tx: the command tag, and the pgx rows of
+// a query.
+type conn struct {
+	tx   pgx.Tx
+	ctx  context.Context // context of the pending Commit or Rollback
+	tag  pgconn.CommandTag
+	rows *driverRows
+}
+
+var (
+	_ driver.ConnBeginTx       = (*conn)(nil)
+	_ driver.ExecerContext     = (*conn)(nil)
+	_ driver.QueryerContext    = (*conn)(nil)
+	_ driver.NamedValueChecker = (*conn)(nil)
+)
+
+// BeginTx returns the wrapped transaction, which pgx has already begun.
+func (c *conn) BeginTx(context.Context, driver.TxOptions) (driver.Tx, error) {
+	return driverTx{c}, nil
+}
+
+func (c *conn) Begin() (driver.Tx, error) {
+	return driverTx{c}, nil
+}
+
+func (c *conn) Prepare(string) (driver.Stmt, error) {
+	return nil, errors.New("pgxadapter: prepared statements are not supported")
+}
+
+func (c *conn) Close() error {
+	return nil
+}
+
+// CheckNamedValue accepts every value, leaving the encoding to pgx.
+func (c *conn) CheckNamedValue(*driver.NamedValue) error {
+	return nil
+}
+
+func (c *conn) ExecContext(ctx context.Context, q string, args []driver.NamedValue) (driver.Result, error) {
+	tag, err := c.tx.Exec(ctx, q, argValues(args)...)
+	if err != nil {
+		return nil, err
+	}
+	c.tag = tag
+	return driver.RowsAffected(tag.RowsAffected()), nil
+}
+
+func (c *conn) QueryContext(ctx context.Context, q string, args []driver.NamedValue) (driver.Rows, error) {
+	r, err := c.tx.Query(ctx, q, argValues(args)...)
+	if err != nil {
+		return nil, err
+	}
+	c.rows = &driverRows{Rows: r, conn: c}
+	return c.rows, nil
+}
+
+// argValues returns the values of args in order.
+func argValues(args []driver.NamedValue) []any {
+	vals := make([]any, len(args))
+	for i, a := range args {
+		vals[i] = a.Value
+	}
+	return vals
+}
+
+// driverTx ends the wrapped transaction with the context of the pending Tx.Commit or Tx.Rollback.
+type driverTx struct {
+	conn *conn
+}
+
+func (t driverTx) Commit() error {
+	return t.conn.tx.Commit(t.conn.ctx)
+}
+
+func (t driverTx) Rollback() error {
+	return t.conn.tx.Rollback(t.conn.ctx)
+}
+
+// driverRows reads pgx rows as driver rows, with values decoded by pgx.
+type driverRows struct {
+	pgx.Rows
+	conn *conn
+}
+
+var _ driver.RowsColumnTypeDatabaseTypeName = (*driverRows)(nil)
+
+func (r *driverRows) Columns() []string {
+	fields := r.FieldDescriptions()
+	cols := make([]string, len(fields))
+	for i, f := range fields {
+		cols[i] = f.Name
+	}
+	return cols
+}
+
+// ColumnTypeDatabaseTypeName reports the type name pgx knows for column i, or its OID.
+func (r *driverRows) ColumnTypeDatabaseTypeName(i int) string {
+	oid := r.FieldDescriptions()[i].DataTypeOID
+	if c := r.Rows.Conn(); c != nil {
+		if t, ok := c.TypeMap().TypeForOID(oid); ok {
+			return strings.ToUpper(t.Name)
+		}
+	}
+	return strconv.FormatUint(uint64(oid), 10)
+}
+
+func (r *driverRows) Next(dest []driver.Value) error {
+	if !r.Rows.Next() {
+		if err := r.Rows.Err(); err != nil {
+			return err
+		}
+		return io.EOF
+	}
+	vals, err := r.Values()
+	if err != nil {
+		return err
+	}
+	for i, v := range vals {
+		dest[i] = v
+	}
+	return nil
+}
+
+// Close closes the pgx rows and keeps their command tag for Tx.Exec.
+func (r *driverRows) Close() error {
+	r.Rows.Close()
+	r.conn.tag = r.CommandTag()
+	return r.Err()
+}
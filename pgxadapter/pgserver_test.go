@@ -0,0 +1,209 @@
+package pgxadapter
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgproto3"
+)
+
+// pgResult is the reply of a pgServer to one query. Columns named "id" are reported as int8 and
+// other columns as text.
+type pgResult struct {
+	cols []string
+	rows [][]string
+	err  string // reported as an ERROR response when set
+}
+
+// pgHandler answers a query received by a pgServer.
+type pgHandler func(query string) pgResult
+
+// pgServer speaks enough of the PostgreSQL wire protocol for pgx in simple protocol mode: it accepts
+// any startup, records every query it receives, and answers it with its handler.
+type pgServer struct {
+	ln      net.Listener
+	handle  pgHandler
+	mu      sync.Mutex
+	queries []string
+	pings   int // empty queries, as sent by pgconn.Ping
+	conns   []net.Conn
+}
+
+func startPGServer(t *testing.T, handle pgHandler) *pgServer {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen() error = %v", err)
+	}
+	s := &pgServer{ln: ln, handle: handle}
+	var wg sync.WaitGroup
+	t.Cleanup(func() {
+		_ = ln.Close()
+		s.mu.Lock()
+		for _, c := range s.conns {
+			_ = c.Close()
+		}
+		s.mu.Unlock()
+		wg.Wait()
+	})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.conns = append(s.conns, c)
+			s.mu.Unlock()
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer func() { _ = c.Close() }()
+				_ = s.serve(c)
+			}()
+		}
+	}()
+	return s
+}
+
+// config returns a pgx configuration for the server that uses the simple protocol.
+func (s *pgServer) config(t *testing.T) *pgx.ConnConfig {
+	t.Helper()
+	addr := s.ln.Addr().(*net.TCPAddr)
+	cfg, err := pgx.ParseConfig(fmt.Sprintf("host=127.0.0.1 port=%d user=app dbname=app sslmode=disable", addr.Port))
+	if err != nil {
+		t.Fatalf("pgx.ParseConfig() error = %v", err)
+	}
+	cfg.DefaultQueryExecMode = pgx.QueryExecModeSimpleProtocol
+	return cfg
+}
+
+// connect opens a pgx connection to the server, closed when the test ends.
+func (s *pgServer) connect(t *testing.T) *pgx.Conn {
+	t.Helper()
+	conn, err := pgx.ConnectConfig(context.Background(), s.config(t))
+	if err != nil {
+		t.Fatalf("pgx.ConnectConfig() error = %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close(context.Background()) })
+	return conn
+}
+
+// Pings returns the number of pings received so far.
+func (s *pgServer) Pings() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.pings
+}
+
+// Queries returns the queries received so far, in order.
+func (s *pgServer) Queries() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.queries...)
+}
+
+func (s *pgServer) serve(c net.Conn) error {
+	be := pgproto3.NewBackend(c, c)
+	if _, err := be.ReceiveStartupMessage(); err != nil {
+		return err
+	}
+	be.Send(&pgproto3.AuthenticationOk{})
+	be.Send(&pgproto3.ParameterStatus{Name: "client_encoding", Value: "UTF8"})
+	be.Send(&pgproto3.ParameterStatus{Name: "standard_conforming_strings", Value: "on"})
+	be.Send(&pgproto3.BackendKeyData{ProcessID: 1, SecretKey: 1})
+	be.Send(&pgproto3.ReadyForQuery{TxStatus: 'I'})
+	if err := be.Flush(); err != nil {
+		return err
+	}
+
+	status := byte('I')
+	for {
+		msg, err := be.Receive()
+		if err != nil {
+			return err
+		}
+		switch m := msg.(type) {
+		case *pgproto3.Terminate:
+			return nil
+		case *pgproto3.Query:
+			status = s.reply(be, m.String, status)
+		default:
+			be.Send(&pgproto3.ErrorResponse{Severity: "ERROR", Code: "0A000", Message: fmt.Sprintf("unsupported message %T", msg)})
+			be.Send(&pgproto3.ReadyForQuery{TxStatus: status})
+		}
+		if err := be.Flush(); err != nil {
+			return err
+		}
+	}
+}
+
+// reply answers q and returns the transaction status after it.
+func (s *pgServer) reply(be *pgproto3.Backend, q string, status byte) byte {
+	trimmed := strings.TrimSpace(q)
+	if trimmed == "" || strings.HasPrefix(trimmed, "--") {
+		s.mu.Lock()
+		s.pings++
+		s.mu.Unlock()
+		be.Send(&pgproto3.EmptyQueryResponse{})
+		be.Send(&pgproto3.ReadyForQuery{TxStatus: status})
+		return status
+	}
+	s.mu.Lock()
+	s.queries = append(s.queries, q)
+	s.mu.Unlock()
+
+	verb := strings.ToUpper(strings.Fields(trimmed)[0])
+	switch verb {
+	case "BEGIN":
+		status = 'T'
+	case "COMMIT", "ROLLBACK":
+		status = 'I'
+	}
+	var res pgResult
+	if s.handle != nil && verb != "BEGIN" && verb != "COMMIT" && verb != "ROLLBACK" {
+		res = s.handle(q)
+	}
+	if res.err != "" {
+		be.Send(&pgproto3.ErrorResponse{Severity: "ERROR", Code: "XX000", Message: res.err})
+		if status == 'T' {
+			status = 'E'
+		}
+		be.Send(&pgproto3.ReadyForQuery{TxStatus: status})
+		return status
+	}
+	if len(res.cols) > 0 {
+		fields := make([]pgproto3.FieldDescription, len(res.cols))
+		for i, name := range res.cols {
+			fields[i] = pgproto3.FieldDescription{Name: []byte(name), DataTypeOID: 25, DataTypeSize: -1, TypeModifier: -1}
+			if name == "id" {
+				fields[i].DataTypeOID, fields[i].DataTypeSize = 20, 8
+			}
+		}
+		be.Send(&pgproto3.RowDescription{Fields: fields})
+		for _, row := range res.rows {
+			vals := make([][]byte, len(row))
+			for i, v := range row {
+				vals[i] = []byte(v)
+			}
+			be.Send(&pgproto3.DataRow{Values: vals})
+		}
+	}
+	tag := verb
+	switch verb {
+	case "INSERT":
+		tag = fmt.Sprintf("INSERT 0 %d", max(len(res.rows), 1))
+	case "UPDATE", "DELETE", "SELECT":
+		tag = fmt.Sprintf("%s %d", verb, len(res.rows))
+	}
+	be.Send(&pgproto3.CommandComplete{CommandTag: []byte(tag)})
+	be.Send(&pgproto3.ReadyForQuery{TxStatus: status})
+	return status
+}
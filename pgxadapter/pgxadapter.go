@@ -0,0 +1,198 @@
+// Package pgxadapter records gostry history for transactions run through the pgx-native API.
+// It lives in its own module so that github.com/mickamy/gostry does not depend on pgx.
+package pgxadapter
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+
+	"github.com/mickamy/gostry"
+)
+
+// Tx is a pgx.Tx whose Exec calls are captured like gostry.Tx.ExecContext, with the history rows
+// written on the same transaction right before it commits.
+//
+// Query and QueryRow behave like gostry.Tx.QueryContext: DML run through them is not captured and a
+// warning is logged, so run DML with RETURNING through Exec. Begin, CopyFrom, and SendBatch return
+// an error and Conn returns nil, since statements run through them would bypass capture.
+type Tx struct {
+	pgx.Tx
+	conn *conn
+	db   *sql.DB
+	sc   *sql.Conn
+	tx   *gostry.Tx
+	done bool
+}
+
+// WrapPgx starts recording the DML of tx, an open pgx transaction, with h. Commit and Rollback must be
+// called on the returned Tx rather than on tx. If WrapPgx fails, tx may already be rolled back; the
+// caller should still call its Rollback.
+func WrapPgx(ctx context.Context, h *gostry.Handler, tx pgx.Tx) (*Tx, error) {
+	c := &conn{tx: tx, ctx: ctx}
+	db := sql.OpenDB(connector{c})
+	sc, err := db.Conn(ctx)
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	gtx, err := h.WrapConn(sc).BeginTx(ctx, nil)
+	if err != nil {
+		_ = sc.Close()
+		_ = db.Close()
+		return nil, err
+	}
+	return &Tx{Tx: tx, conn: c, db: db, sc: sc, tx: gtx}, nil
+}
+
+// Exec runs sql on the transaction, capturing it like gostry.Tx.ExecContext.
+func (tx *Tx) Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error) {
+	tx.conn.tag = pgconn.CommandTag{}
+	if _, err := tx.tx.ExecContext(ctx, sql, args...); err != nil {
+		return pgconn.CommandTag{}, err
+	}
+	return tx.conn.tag, nil
+}
+
+// Query runs sql on the transaction like gostry.Tx.QueryContext.
+func (tx *Tx) Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error) {
+	tx.conn.rows = nil
+	next, err := tx.tx.QueryContext(ctx, sql, args...)
+	if err != nil {
+		return nil, err
+	}
+	return &rows{Rows: tx.conn.rows.Rows, next: next}, nil
+}
+
+// QueryRow runs sql on the transaction like Query and returns its first row.
+func (tx *Tx) QueryRow(ctx context.Context, sql string, args ...any) pgx.Row {
+	r, err := tx.Query(ctx, sql, args...)
+	return &row{rows: r, err: err}
+}
+
+// Commit writes the captured history rows on the transaction and commits it. If the history cannot be
+// written, the transaction is rolled back and the error is returned.
+func (tx *Tx) Commit(ctx context.Context) error {
+	if tx.done {
+		return pgx.ErrTxClosed
+	}
+	defer tx.release()
+	tx.conn.ctx = ctx
+	if err := tx.tx.CommitContext(ctx); err != nil {
+		_ = tx.tx.Rollback()
+		return err
+	}
+	return nil
+}
+
+// Rollback discards the captured changes and rolls back the transaction. Like pgx, it returns an
+// error matching pgx.ErrTxClosed once the transaction has ended.
+func (tx *Tx) Rollback(ctx context.Context) error {
+	if tx.done {
+		return pgx.ErrTxClosed
+	}
+	defer tx.release()
+	tx.conn.ctx = ctx
+	return tx.tx.Rollback()
+}
+
+// release closes the database/sql view of the transaction once it has ended.
+func (tx *Tx) release() {
+	tx.done = true
+	_ = tx.sc.Close()
+	_ = tx.db.Close()
+}
+
+// errBypass is returned by the pgx.Tx methods whose statements gostry cannot capture.
+var errBypass = errors.New("pgxadapter: statements run this way would not be recorded; use Exec")
+
+// Begin returns an error: statements run in a savepoint would not be captured.
+func (tx *Tx) Begin(context.Context) (pgx.Tx, error) {
+	return nil, errBypass
+}
+
+// CopyFrom returns an error: rows copied with COPY FROM STDIN are not captured.
+func (tx *Tx) CopyFrom(context.Context, pgx.Identifier, []string, pgx.CopyFromSource) (int64, error) {
+	return 0, errBypass
+}
+
+// SendBatch returns batch results that fail with an error: batched statements are not captured.
+func (tx *Tx) SendBatch(context.Context, *pgx.Batch) pgx.BatchResults {
+	return errBatchResults{err: errBypass}
+}
+
+// Conn returns nil: statements run on the connection directly would not be captured.
+func (tx *Tx) Conn() *pgx.Conn {
+	return nil
+}
+
+// rows is the pgx.Rows returned by Tx.Query. Each Next advances the *sql.Rows returned by gostry,
+// which read the current row of the wrapped pgx.Rows, so Scan and Values see that row.
+type rows struct {
+	pgx.Rows
+	next *sql.Rows
+}
+
+func (r *rows) Next() bool {
+	return r.next.Next()
+}
+
+func (r *rows) Close() {
+	_ = r.next.Close()
+}
+
+func (r *rows) Err() error {
+	if err := r.next.Err(); err != nil {
+		return err
+	}
+	return r.Rows.Err()
+}
+
+// row is the pgx.Row returned by Tx.QueryRow.
+type row struct {
+	rows pgx.Rows
+	err  error
+}
+
+// Scan reads the first row into dest like pgx does, returning pgx.ErrNoRows when there is none.
+func (r *row) Scan(dest ...any) error {
+	if r.err != nil {
+		return r.err
+	}
+	defer r.rows.Close()
+	if !r.rows.Next() {
+		if err := r.rows.Err(); err != nil {
+			return err
+		}
+		return pgx.ErrNoRows
+	}
+	if err := r.rows.Scan(dest...); err != nil {
+		return err
+	}
+	r.rows.Close()
+	return r.rows.Err()
+}
+
+// errBatchResults is the pgx.BatchResults returned by Tx.SendBatch.
+type errBatchResults struct {
+	err error
+}
+
+func (b errBatchResults) Exec() (pgconn.CommandTag, error) {
+	return pgconn.CommandTag{}, b.err
+}
+
+func (b errBatchResults) Query() (pgx.Rows, error) {
+	return nil, b.err
+}
+
+func (b errBatchResults) QueryRow() pgx.Row {
+	return &row{err: b.err}
+}
+
+func (b errBatchResults) Close() error {
+	return b.err
+}
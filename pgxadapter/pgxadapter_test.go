@@ -0,0 +1,274 @@
+package pgxadapter
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/jackc/pgx/v5"
+
+	"github.com/mickamy/gostry"
+)
+
+// returnOrders answers DML with RETURNING with the orders with the given ids, all paid.
+func returnOrders(ids ...string) pgHandler {
+	return func(q string) pgResult {
+		if !strings.Contains(q, "RETURNING") {
+			return pgResult{}
+		}
+		res := pgResult{cols: []string{"id", "status"}}
+		for _, id := range ids {
+			res.rows = append(res.rows, []string{id, "paid"})
+		}
+		return res
+	}
+}
+
+// beginWrapped begins a pgx transaction on a connection to server and wraps it with h.
+func beginWrapped(t *testing.T, server *pgServer, h *gostry.Handler) *Tx {
+	t.Helper()
+	ctx := context.Background()
+	ptx, err := server.connect(t).Begin(ctx)
+	if err != nil {
+		t.Fatalf("Begin() error = %v", err)
+	}
+	tx, err := WrapPgx(ctx, h, ptx)
+	if err != nil {
+		t.Fatalf("WrapPgx() error = %v", err)
+	}
+	return tx
+}
+
+// historyInserts returns the history INSERTs among queries.
+func historyInserts(queries []string) []string {
+	var inserts []string
+	for _, q := range queries {
+		if strings.Contains(q, `INSERT INTO "orders_history"`) {
+			inserts = append(inserts, q)
+		}
+	}
+	return inserts
+}
+
+func TestWrapPgx(t *testing.T) {
+	t.Parallel()
+
+	t.Run("commit writes history on the same transaction", func(t *testing.T) {
+		t.Parallel()
+
+		server := startPGServer(t, returnOrders("7"))
+		var flushed []gostry.Record
+		h := gostry.New(gostry.Config{OnFlush: func(_ context.Context, records []gostry.Record) { flushed = append(flushed, records...) }})
+		tx := beginWrapped(t, server, h)
+
+		ctx := gostry.WithOperator(context.Background(), "alice")
+		tag, err := tx.Exec(ctx, `UPDATE orders SET status = $1 WHERE id = $2 RETURNING *`, "paid", int64(7))
+		if err != nil {
+			t.Fatalf("Exec() error = %v", err)
+		}
+		if tag.String() != "UPDATE 1" {
+			t.Errorf("Exec() tag = %q, want UPDATE 1", tag)
+		}
+		if inserts := historyInserts(server.Queries()); len(inserts) != 0 {
+			t.Fatalf("history written before commit: %v", inserts)
+		}
+		if err := tx.Commit(ctx); err != nil {
+			t.Fatalf("Commit() error = %v", err)
+		}
+
+		queries := server.Queries()
+		want := []string{"begin", "UPDATE orders", `INSERT INTO "orders_history"`, "commit"}
+		if len(queries) != len(want) {
+			t.Fatalf("queries = %q, want %d", queries, len(want))
+		}
+		for i, prefix := range want {
+			if !strings.HasPrefix(strings.TrimSpace(queries[i]), prefix) {
+				t.Errorf("queries[%d] = %q, want prefix %q", i, queries[i], prefix)
+			}
+		}
+		if !strings.Contains(queries[2], "'alice'") || !strings.Contains(queries[2], "'UPDATE'") {
+			t.Errorf("history insert = %q, want the operation and operator", queries[2])
+		}
+		if len(flushed) != 1 || flushed[0].ID != int64(7) {
+			t.Errorf("flushed = %+v, want order 7", flushed)
+		}
+	})
+
+	t.Run("auto attach returning", func(t *testing.T) {
+		t.Parallel()
+
+		server := startPGServer(t, returnOrders("1", "2"))
+		tx := beginWrapped(t, server, gostry.New(gostry.Config{AutoAttachReturning: true}))
+
+		ctx := context.Background()
+		tag, err := tx.Exec(ctx, `UPDATE orders SET status = 'paid'`)
+		if err != nil {
+			t.Fatalf("Exec() error = %v", err)
+		}
+		if tag.RowsAffected() != 2 {
+			t.Errorf("RowsAffected() = %d, want 2", tag.RowsAffected())
+		}
+		if err := tx.Commit(ctx); err != nil {
+			t.Fatalf("Commit() error = %v", err)
+		}
+		if q := server.Queries()[1]; !strings.Contains(q, "RETURNING") {
+			t.Errorf("statement = %q, want RETURNING appended", q)
+		}
+		if inserts := historyInserts(server.Queries()); len(inserts) != 2 {
+			t.Errorf("history inserts = %d, want 2", len(inserts))
+		}
+	})
+
+	t.Run("query passes other statements through", func(t *testing.T) {
+		t.Parallel()
+
+		server := startPGServer(t, func(string) pgResult {
+			return pgResult{cols: []string{"id"}, rows: [][]string{{"3"}, {"4"}}}
+		})
+		tx := beginWrapped(t, server, gostry.New(gostry.Config{}))
+
+		ctx := context.Background()
+		rows, err := tx.Query(ctx, `SELECT id FROM orders`)
+		if err != nil {
+			t.Fatalf("Query() error = %v", err)
+		}
+		ids, err := pgx.CollectRows(rows, pgx.RowTo[int64])
+		if err != nil {
+			t.Fatalf("CollectRows() error = %v", err)
+		}
+		if len(ids) != 2 || ids[0] != 3 || ids[1] != 4 {
+			t.Errorf("ids = %v, want [3 4]", ids)
+		}
+		if err := tx.Commit(ctx); err != nil {
+			t.Fatalf("Commit() error = %v", err)
+		}
+		if inserts := historyInserts(server.Queries()); len(inserts) != 0 {
+			t.Errorf("history inserts = %v, want none", inserts)
+		}
+	})
+
+	t.Run("rollback discards captured changes", func(t *testing.T) {
+		t.Parallel()
+
+		server := startPGServer(t, returnOrders("7"))
+		tx := beginWrapped(t, server, gostry.New(gostry.Config{}))
+
+		ctx := context.Background()
+		if _, err := tx.Exec(ctx, `DELETE FROM orders WHERE id = 7 RETURNING *`); err != nil {
+			t.Fatalf("Exec() error = %v", err)
+		}
+		if err := tx.Rollback(ctx); err != nil {
+			t.Fatalf("Rollback() error = %v", err)
+		}
+		queries := server.Queries()
+		if len(queries) != 3 || queries[2] != "rollback" {
+			t.Errorf("queries = %q, want begin, delete, rollback", queries)
+		}
+	})
+
+	t.Run("failed history write rolls back", func(t *testing.T) {
+		t.Parallel()
+
+		server := startPGServer(t, func(q string) pgResult {
+			if strings.Contains(q, `"orders_history"`) {
+				return pgResult{err: `relation "orders_history" does not exist`}
+			}
+			return returnOrders("7")(q)
+		})
+		tx := beginWrapped(t, server, gostry.New(gostry.Config{}))
+
+		ctx := context.Background()
+		if _, err := tx.Exec(ctx, `UPDATE orders SET status = 'paid' WHERE id = 7 RETURNING *`); err != nil {
+			t.Fatalf("Exec() error = %v", err)
+		}
+		if err := tx.Commit(ctx); err == nil || !strings.Contains(err.Error(), "orders_history") {
+			t.Fatalf("Commit() error = %v, want the history error", err)
+		}
+		queries := server.Queries()
+		if last := queries[len(queries)-1]; last != "rollback" {
+			t.Errorf("last query = %q, want rollback", last)
+		}
+	})
+
+	t.Run("before images are read on the transaction", func(t *testing.T) {
+		t.Parallel()
+
+		server := startPGServer(t, func(q string) pgResult {
+			if strings.HasPrefix(strings.TrimSpace(q), "SELECT") {
+				return pgResult{cols: []string{"id", "status"}, rows: [][]string{{"7", "pending"}}}
+			}
+			return returnOrders("7")(q)
+		})
+		tx := beginWrapped(t, server, gostry.New(gostry.Config{CaptureBefore: true}))
+
+		ctx := context.Background()
+		if _, err := tx.Exec(ctx, `UPDATE orders SET status = 'paid' WHERE id = 7 RETURNING *`); err != nil {
+			t.Fatalf("Exec() error = %v", err)
+		}
+		if err := tx.Commit(ctx); err != nil {
+			t.Fatalf("Commit() error = %v", err)
+		}
+		inserts := historyInserts(server.Queries())
+		if len(inserts) != 1 || !strings.Contains(inserts[0], hexJSON(`"status":"pending"`)) {
+			t.Errorf("history inserts = %q, want the before-image", inserts)
+		}
+	})
+
+	t.Run("ended transaction", func(t *testing.T) {
+		t.Parallel()
+
+		server := startPGServer(t, nil)
+		tx := beginWrapped(t, server, gostry.New(gostry.Config{}))
+
+		ctx := context.Background()
+		if err := tx.Commit(ctx); err != nil {
+			t.Fatalf("Commit() error = %v", err)
+		}
+		if err := tx.Rollback(ctx); !errors.Is(err, pgx.ErrTxClosed) {
+			t.Errorf("Rollback() error = %v, want pgx.ErrTxClosed", err)
+		}
+		if err := tx.Commit(ctx); !errors.Is(err, pgx.ErrTxClosed) {
+			t.Errorf("Commit() error = %v, want pgx.ErrTxClosed", err)
+		}
+	})
+
+	t.Run("uncaptured paths are refused", func(t *testing.T) {
+		t.Parallel()
+
+		server := startPGServer(t, nil)
+		tx := beginWrapped(t, server, gostry.New(gostry.Config{}))
+		t.Cleanup(func() { _ = tx.Rollback(context.Background()) })
+
+		ctx := context.Background()
+		if _, err := tx.Begin(ctx); err == nil {
+			t.Error("Begin() error = nil, want an error")
+		}
+		if _, err := tx.CopyFrom(ctx, pgx.Identifier{"orders"}, []string{"id"}, pgx.CopyFromRows(nil)); err == nil {
+			t.Error("CopyFrom() error = nil, want an error")
+		}
+		batch := &pgx.Batch{}
+		batch.Queue(`UPDATE orders SET status = 'paid'`)
+		results := tx.SendBatch(ctx, batch)
+		if _, err := results.Exec(); err == nil {
+			t.Error("SendBatch().Exec() error = nil, want an error")
+		}
+		if err := results.Close(); err == nil {
+			t.Error("SendBatch().Close() error = nil, want an error")
+		}
+		if tx.Conn() != nil {
+			t.Error("Conn() != nil, want nil")
+		}
+		for _, q := range server.Queries() {
+			if strings.Contains(q, "orders") {
+				t.Errorf("query %q reached the server", q)
+			}
+		}
+	})
+}
+
+// hexJSON returns s as it appears in a history image bound as bytea text by the simple protocol.
+func hexJSON(s string) string {
+	return hex.EncodeToString([]byte(s))
+}
@@ -0,0 +1,74 @@
+package gostry
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// PromotedColumn describes a row field copied into its own typed history column.
+type PromotedColumn struct {
+	Name  string // key in the captured row and name of the history column
+	Type  string // SQL type of the history column (default: TEXT)
+	Index bool   // create an index on the history column (Migrate only)
+}
+
+// PromotedColumns maps table names to the columns promoted out of before/after.
+// Keys may be schema-qualified ("sales.orders") or bare ("orders"); qualified keys take precedence.
+type PromotedColumns map[string][]PromotedColumn
+
+// lookup returns the promoted columns configured for table.
+func (p PromotedColumns) lookup(table string) []PromotedColumn {
+	cols, _ := lookupTable(p, table)
+	return cols
+}
+
+// validate reports promoted columns that are unnamed, repeated for a table, or named like a built-in
+// history column (history_id, operation, before, ...), which would duplicate that column.
+func (p PromotedColumns) validate() error {
+	builtin := historyLayoutNames(defaultHistoryColumns)
+	for table, cols := range p {
+		seen := make(map[string]bool, len(cols))
+		for _, c := range cols {
+			switch {
+			case c.Name == "":
+				return fmt.Errorf("gostry: promoted column of %s has no name", table)
+			case builtin[c.Name]:
+				return fmt.Errorf("gostry: promoted column %q of %s collides with a built-in history column", c.Name, table)
+			case seen[c.Name]:
+				return fmt.Errorf("gostry: promoted column %q of %s is configured twice", c.Name, table)
+			}
+			seen[c.Name] = true
+		}
+	}
+	return nil
+}
+
+// promotedValues extracts promoted column values from the captured row images.
+// The after image is preferred; before is used when after is absent (e.g. DELETE).
+// Columns whose key is missing from the row are skipped.
+func promotedValues(cols []PromotedColumn, before, after map[string]any) ([]string, []any) {
+	if len(cols) == 0 {
+		return nil, nil
+	}
+	src := after
+	if src == nil {
+		src = before
+	}
+	var names []string
+	var values []any
+	for _, c := range cols {
+		v, ok := src[c.Name]
+		if !ok {
+			continue
+		}
+		switch v.(type) {
+		case map[string]any, []any:
+			if b, err := json.Marshal(v); err == nil {
+				v = string(b)
+			}
+		}
+		names = append(names, c.Name)
+		values = append(values, v)
+	}
+	return names, values
+}
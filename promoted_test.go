@@ -0,0 +1,158 @@
+package gostry
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPromotedColumns_Lookup(t *testing.T) {
+	t.Parallel()
+
+	status := []PromotedColumn{{Name: "status"}}
+	region := []PromotedColumn{{Name: "region"}}
+	p := PromotedColumns{
+		"orders":       status,
+		"sales.orders": region,
+	}
+
+	tcs := []struct {
+		name  string
+		table string
+		want  []PromotedColumn
+	}{
+		{name: "bare", table: "orders", want: status},
+		{name: "qualified match", table: "sales.orders", want: region},
+		{name: "quoted qualified match", table: `"sales"."orders"`, want: region},
+		{name: "qualified falls back to bare", table: "public.orders", want: status},
+		{name: "unknown", table: "users", want: nil},
+	}
+
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			if got := p.lookup(tc.table); !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("lookup(%q) = %#v, want %#v", tc.table, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestPromotedValues(t *testing.T) {
+	t.Parallel()
+
+	cols := []PromotedColumn{{Name: "status"}, {Name: "amount", Type: "NUMERIC"}, {Name: "tags", Type: "JSONB"}}
+
+	tcs := []struct {
+		name       string
+		before     map[string]any
+		after      map[string]any
+		wantNames  []string
+		wantValues []any
+	}{
+		{
+			name:       "from after",
+			before:     map[string]any{"status": "pending"},
+			after:      map[string]any{"status": "paid", "amount": 10},
+			wantNames:  []string{"status", "amount"},
+			wantValues: []any{"paid", 10},
+		},
+		{
+			name:       "from before on delete",
+			before:     map[string]any{"status": "cancelled"},
+			wantNames:  []string{"status"},
+			wantValues: []any{"cancelled"},
+		},
+		{
+			name:       "nested values marshaled",
+			after:      map[string]any{"tags": []any{"a", "b"}},
+			wantNames:  []string{"tags"},
+			wantValues: []any{`["a","b"]`},
+		},
+		{
+			name:  "absent keys skipped",
+			after: map[string]any{"id": 1},
+		},
+	}
+
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			names, values := promotedValues(cols, tc.before, tc.after)
+			if !reflect.DeepEqual(names, tc.wantNames) {
+				t.Fatalf("promotedValues() names = %#v, want %#v", names, tc.wantNames)
+			}
+			if !reflect.DeepEqual(values, tc.wantValues) {
+				t.Fatalf("promotedValues() values = %#v, want %#v", values, tc.wantValues)
+			}
+		})
+	}
+}
+
+func TestPromotedColumns_Statements(t *testing.T) {
+	t.Parallel()
+
+	promoted := []PromotedColumn{{Name: "status", Index: true}, {Name: "amount", Type: "NUMERIC"}}
+
+	ddl := buildHistoryDDL(`"orders_history"`, "", defaultHistoryColumns, historyDDLOptions{promoted: promoted})
+	for _, want := range []string{`"status" TEXT`, `"amount" NUMERIC`} {
+		if !strings.Contains(ddl, want) {
+			t.Fatalf("buildHistoryDDL() = %s, want to contain %q", ddl, want)
+		}
+	}
+
+	stmt := newHistoryInsert([]string{"orders_history"}, defaultHistoryColumns, historyDDLOptions{}, []string{"status", "amount"}, false).statement()
+	for _, want := range []string{`"after", "status", "amount")`, `$7, $8, $9)`} {
+		if !strings.Contains(stmt, want) {
+			t.Fatalf("statement() = %s, want to contain %q", stmt, want)
+		}
+	}
+}
+
+func TestPromotedColumns_Collision(t *testing.T) {
+	t.Parallel()
+
+	tcs := []struct {
+		name    string
+		cols    []PromotedColumn
+		wantErr string
+	}{
+		{name: "built-in column", cols: []PromotedColumn{{Name: "operation"}}, wantErr: "built-in"},
+		{name: "optional built-in column", cols: []PromotedColumn{{Name: "history_id"}}, wantErr: "built-in"},
+		{name: "image column", cols: []PromotedColumn{{Name: "before"}}, wantErr: "built-in"},
+		{name: "repeated", cols: []PromotedColumn{{Name: "status"}, {Name: "status", Type: "TEXT"}}, wantErr: "twice"},
+		{name: "unnamed", cols: []PromotedColumn{{Type: "TEXT"}}, wantErr: "no name"},
+	}
+
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			promoted := PromotedColumns{"orders": tc.cols}
+
+			db, state := openFakeDB(t, nil)
+			err := Migrate(context.Background(), db, SchemaConfig{Promoted: promoted}, "orders")
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Fatalf("Migrate() error = %v, want %q", err, tc.wantErr)
+			}
+			if execs := state.Execs(); len(execs) != 0 {
+				t.Fatalf("Migrate() ran %v, want no DDL", execs)
+			}
+
+			_, err = New(Config{Promoted: promoted}).Wrap(db).BeginTx(context.Background(), nil)
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Fatalf("BeginTx() error = %v, want %q", err, tc.wantErr)
+			}
+			if _, rollbacks := state.Outcome(); rollbacks != 1 {
+				t.Errorf("rollbacks = %d, want the transaction rolled back", rollbacks)
+			}
+		})
+	}
+
+	if err := (PromotedColumns{"orders": {{Name: "status"}}, "sales.orders": {{Name: "status"}}}).validate(); err != nil {
+		t.Fatalf("validate() error = %v, want per-table names to be independent", err)
+	}
+}
@@ -0,0 +1,259 @@
+package gostry
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mickamy/gostry/internal/ident"
+)
+
+// defaultHistoryBatchSize is the page size used by HistoryIterator when HistoryOptions.BatchSize is unset.
+const defaultHistoryBatchSize = 500
+
+// HistoryRecord is a row read back from a history table.
+type HistoryRecord struct {
+	HistoryID  any // int64 for HistoryIDBigserial, string for HistoryIDUUID and HistoryIDText
+	ID         any
+	Operation  string
+	OperatedAt time.Time
+	Operator   string         // operated_by ("" when NULL)
+	TraceID    string         // trace_id ("" when NULL)
+	Reason     string         // reason ("" when NULL)
+	Before     map[string]any // decoded with Config.Encoding, decompressed when needed
+	After      map[string]any
+}
+
+// HistoryOptions controls how history rows are read.
+type HistoryOptions struct {
+	BatchSize      int // rows fetched per round trip, and the page size of HistoryPage (default: 500)
+	AfterHistoryID any // keyset cursor: read only rows with a greater history_id (nil reads from the start)
+}
+
+// HistoryPage is one page of history rows returned by DB.HistoryPage.
+type HistoryPage struct {
+	Records []HistoryRecord
+	// LastHistoryID is the history_id of the last record, to pass as HistoryOptions.AfterHistoryID
+	// for the next page. It equals the requested AfterHistoryID when the page is empty.
+	LastHistoryID any
+}
+
+// storedHistoryRow is a history table row whose images are not decoded yet.
+type storedHistoryRow struct {
+	historyID                 any
+	id                        any
+	operation                 string
+	operatedAt                time.Time
+	operator, traceID, reason sql.NullString
+	before, after             []byte
+	beforeGzip, afterGzip     []byte // set when Config.CompressThreshold is enabled
+}
+
+// HistoryIterator streams the rows of a history table in history_id order, whatever its
+// SchemaConfig.HistoryIDType. Rows are fetched in batches with keyset pagination
+// (WHERE history_id > last ORDER BY history_id LIMIT n), so memory
+// stays bounded and no row is returned twice. history_id is taken from the sequence when a row is
+// inserted, not when its transaction commits, so a row committed after the cursor has passed its
+// history_id is not returned. Before and after images are decoded only when Scan is called.
+type HistoryIterator struct {
+	ctx   context.Context
+	db    DBExecQuerier
+	cfg   Config
+	first string // query of the first page, when no cursor is set
+	after string // query of the pages following the cursor
+	batch int
+
+	rows []storedHistoryRow
+	pos  int
+	last any
+	done bool
+	err  error
+	cur  *storedHistoryRow
+}
+
+// HistoryIterator returns an iterator over the history rows of table, starting after
+// opts.AfterHistoryID. Call Next until it returns false, then check Err; Close releases the
+// iterator early.
+func (db *DB) HistoryIterator(ctx context.Context, table string, opts HistoryOptions) (*HistoryIterator, error) {
+	return newHistoryIterator(ctx, db.DB, db.h.cfg, table, opts)
+}
+
+func newHistoryIterator(ctx context.Context, db DBExecQuerier, cfg Config, table string, opts HistoryOptions) (*HistoryIterator, error) {
+	historyIdent := ident.QuoteQualified(cfg.HistoryTableIdentifier(table))
+	if historyIdent == "" {
+		return nil, &InvalidIdentifierError{Table: table}
+	}
+	batch := opts.BatchSize
+	if batch <= 0 {
+		batch = defaultHistoryBatchSize
+	}
+	return &HistoryIterator{
+		ctx:   ctx,
+		db:    db,
+		cfg:   cfg,
+		first: buildHistorySelect(historyIdent, cfg.CompressThreshold > 0, false),
+		after: buildHistorySelect(historyIdent, cfg.CompressThreshold > 0, true),
+		batch: batch,
+		last:  opts.AfterHistoryID,
+	}, nil
+}
+
+// HistoryPage reads up to opts.BatchSize history rows of table whose history_id is greater than
+// opts.AfterHistoryID, in history_id order. Keyset pagination returns no row twice and costs the
+// same on every page, but like HistoryIterator it misses rows whose transaction commits after a
+// later page has moved the cursor past their history_id.
+func (db *DB) HistoryPage(ctx context.Context, table string, opts HistoryOptions) (HistoryPage, error) {
+	it, err := newHistoryIterator(ctx, db.DB, db.h.cfg, table, opts)
+	if err != nil {
+		return HistoryPage{}, err
+	}
+	page := HistoryPage{LastHistoryID: opts.AfterHistoryID}
+	if err := it.fetch(); err != nil {
+		return HistoryPage{}, err
+	}
+	page.Records = make([]HistoryRecord, len(it.rows))
+	for i := range it.rows {
+		if err := it.rows[i].decode(db.h.cfg.Encoding, &page.Records[i]); err != nil {
+			return HistoryPage{}, err
+		}
+	}
+	if n := len(page.Records); n > 0 {
+		page.LastHistoryID = page.Records[n-1].HistoryID
+	}
+	return page, nil
+}
+
+// buildHistorySelect renders the keyset page query over historyIdent. With after, $1 is the last
+// history_id already read and $2 the page size; otherwise the query reads the first page and $1 is
+// the page size.
+func buildHistorySelect(historyIdent string, compressed, after bool) string {
+	q := defaultHistoryColumns.quoted()
+	columns := []string{q.historyID, q.id, q.operation, q.operatedAt, q.operatedBy, q.traceID, q.reason, q.before, q.after}
+	if compressed {
+		columns = append(columns, q.beforeGzip, q.afterGzip)
+	}
+	if !after {
+		return fmt.Sprintf(`SELECT %s FROM %s ORDER BY %s LIMIT $1`, strings.Join(columns, ", "), historyIdent, q.historyID)
+	}
+	return fmt.Sprintf(`SELECT %s FROM %s WHERE %s > $1 ORDER BY %s LIMIT $2`,
+		strings.Join(columns, ", "), historyIdent, q.historyID, q.historyID)
+}
+
+// Next advances to the next row, fetching another batch when the current one is exhausted.
+func (it *HistoryIterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+	if it.pos >= len(it.rows) {
+		if it.done {
+			it.cur = nil
+			return false
+		}
+		if err := it.fetch(); err != nil {
+			it.err = err
+			return false
+		}
+		if len(it.rows) == 0 {
+			it.cur = nil
+			return false
+		}
+	}
+	it.cur = &it.rows[it.pos]
+	it.pos++
+	return true
+}
+
+// fetch reads the batch following the last history_id seen.
+func (it *HistoryIterator) fetch() error {
+	q, args := it.first, []any{int64(it.batch)}
+	if it.last != nil {
+		q, args = it.after, []any{it.last, int64(it.batch)}
+	}
+	rows, err := it.db.QueryContext(it.ctx, q, args...)
+	if err != nil {
+		return historyTableError(fmt.Errorf("gostry: failed to read history: %w", err))
+	}
+	defer func(rows *sql.Rows) {
+		_ = rows.Close()
+	}(rows)
+
+	it.rows, it.pos = it.rows[:0], 0
+	compressed := it.cfg.CompressThreshold > 0
+	for rows.Next() {
+		var r storedHistoryRow
+		dest := []any{&r.historyID, &r.id, &r.operation, &r.operatedAt, &r.operator, &r.traceID, &r.reason, &r.before, &r.after}
+		if compressed {
+			dest = append(dest, &r.beforeGzip, &r.afterGzip)
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return withKind(ErrScan, fmt.Errorf("gostry: failed to scan history: %w", err))
+		}
+		r.historyID = historyIDValue(r.historyID)
+		it.rows = append(it.rows, r)
+	}
+	if err := rows.Err(); err != nil {
+		return withKind(ErrScan, fmt.Errorf("gostry: failed to scan history: %w", err))
+	}
+	if len(it.rows) < it.batch {
+		it.done = true
+	}
+	if n := len(it.rows); n > 0 {
+		it.last = it.rows[n-1].historyID
+	}
+	return nil
+}
+
+// historyIDValue normalizes a scanned history_id: drivers may return UUID and TEXT ids as []byte,
+// which would not bind back as a keyset cursor.
+func historyIDValue(v any) any {
+	if b, ok := v.([]byte); ok {
+		return string(b)
+	}
+	return v
+}
+
+// Scan decodes the current row into r.
+func (it *HistoryIterator) Scan(r *HistoryRecord) error {
+	if it.cur == nil {
+		return errors.New("gostry: Scan called without a successful Next")
+	}
+	return it.cur.decode(it.cfg.Encoding, r)
+}
+
+// Err returns the error that stopped iteration, if any.
+func (it *HistoryIterator) Err() error {
+	return it.err
+}
+
+// Close releases the buffered batch; Next returns false afterwards.
+func (it *HistoryIterator) Close() error {
+	it.rows, it.cur, it.done = nil, nil, true
+	return nil
+}
+
+// decode converts a stored row into r, decompressing and decoding its images.
+func (s *storedHistoryRow) decode(enc Encoding, r *HistoryRecord) error {
+	before, err := ReadImage(enc, s.before, s.beforeGzip)
+	if err != nil {
+		return err
+	}
+	after, err := ReadImage(enc, s.after, s.afterGzip)
+	if err != nil {
+		return err
+	}
+	*r = HistoryRecord{
+		HistoryID:  s.historyID,
+		ID:         s.id,
+		Operation:  s.operation,
+		OperatedAt: s.operatedAt,
+		Operator:   s.operator.String,
+		TraceID:    s.traceID.String,
+		Reason:     s.reason.String,
+		Before:     before,
+		After:      after,
+	}
+	return nil
+}
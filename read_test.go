@@ -0,0 +1,230 @@
+package gostry
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeHistoryTable serves keyset pages of an in-memory history table.
+type fakeHistoryTable struct {
+	mu      sync.Mutex
+	rows    [][]driver.Value
+	fetches int
+	onFetch func(t *fakeHistoryTable) // optional hook run after each page is served (mu held)
+}
+
+func (h *fakeHistoryTable) add(id int64) {
+	h.addRow(id, id)
+}
+
+// addRow appends a row with the given history_id, which sorts after the rows already added.
+func (h *fakeHistoryTable) addRow(historyID any, id int64) {
+	at := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC).Add(time.Duration(id) * time.Minute)
+	after := []byte(fmt.Sprintf(`{"id":%d,"status":"paid"}`, id))
+	h.rows = append(h.rows, []driver.Value{historyID, id, "INSERT", at, "alice", nil, nil, nil, after})
+}
+
+func (h *fakeHistoryTable) query(q string, args []any) (fakeResult, error) {
+	var last any
+	var limit int64
+	switch {
+	case strings.Contains(q, `FROM "orders_history" WHERE "history_id" > $1 ORDER BY "history_id" LIMIT $2`):
+		last, limit = args[0], args[1].(int64)
+	case strings.Contains(q, `FROM "orders_history" ORDER BY "history_id" LIMIT $1`):
+		limit = args[0].(int64)
+	default:
+		return fakeResult{}, fmt.Errorf("unexpected query %q", q)
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	res := fakeResult{cols: []string{"history_id", "id", "operation", "operated_at", "operated_by", "trace_id", "reason", "before", "after"}}
+	for _, r := range h.rows {
+		if (last == nil || fakeHistoryIDLess(last, r[0])) && int64(len(res.rows)) < limit {
+			res.rows = append(res.rows, r)
+		}
+	}
+	h.fetches++
+	if h.onFetch != nil {
+		h.onFetch(h)
+	}
+	return res, nil
+}
+
+// fakeHistoryIDLess orders BIGSERIAL ids numerically and UUID/TEXT ids (string or []byte) as text.
+func fakeHistoryIDLess(a, b any) bool {
+	if a, ok := a.(int64); ok {
+		return a < b.(int64)
+	}
+	str := func(v any) string {
+		if b, ok := v.([]byte); ok {
+			return string(b)
+		}
+		return v.(string)
+	}
+	return str(a) < str(b)
+}
+
+func TestDB_HistoryIterator(t *testing.T) {
+	t.Parallel()
+
+	table := &fakeHistoryTable{}
+	for id := int64(1); id <= 7; id++ {
+		table.add(id)
+	}
+	// A row inserted while iterating lands after the cursor and is yielded once.
+	table.onFetch = func(h *fakeHistoryTable) {
+		if h.fetches == 1 {
+			h.add(8)
+		}
+	}
+	db, _ := openFakeDB(t, table.query)
+	it, err := New(Config{}).Wrap(db).HistoryIterator(context.Background(), "orders", HistoryOptions{BatchSize: 3})
+	if err != nil {
+		t.Fatalf("HistoryIterator() error = %v", err)
+	}
+	defer func() { _ = it.Close() }()
+
+	seen := map[int64]int{}
+	var prev int64
+	for it.Next() {
+		var r HistoryRecord
+		if err := it.Scan(&r); err != nil {
+			t.Fatalf("Scan() error = %v", err)
+		}
+		id := r.HistoryID.(int64)
+		if id <= prev {
+			t.Fatalf("history_id %d after %d, want increasing order", id, prev)
+		}
+		prev = id
+		seen[id]++
+		if r.Operator != "alice" || r.Before != nil || r.After["status"] != "paid" {
+			t.Fatalf("record = %#v, want decoded INSERT by alice", r)
+		}
+	}
+	if err := it.Err(); err != nil {
+		t.Fatalf("Err() = %v", err)
+	}
+	if len(seen) != 8 {
+		t.Fatalf("yielded %d distinct rows, want 8", len(seen))
+	}
+	for id, n := range seen {
+		if n != 1 {
+			t.Fatalf("history_id %d yielded %d times, want once", id, n)
+		}
+	}
+	if table.fetches != 3 {
+		t.Fatalf("fetches = %d, want 3 (pages of 3, 3, and 2 rows)", table.fetches)
+	}
+}
+
+func TestHistoryIterator_ScanBeforeNext(t *testing.T) {
+	t.Parallel()
+
+	db, _ := openFakeDB(t, (&fakeHistoryTable{}).query)
+	it, err := New(Config{}).Wrap(db).HistoryIterator(context.Background(), "orders", HistoryOptions{})
+	if err != nil {
+		t.Fatalf("HistoryIterator() error = %v", err)
+	}
+	var r HistoryRecord
+	if err := it.Scan(&r); err == nil {
+		t.Fatal("Scan() before Next error = nil, want error")
+	}
+	if it.Next() || it.Err() != nil {
+		t.Fatalf("Next() on empty table = true or Err() = %v, want false and nil", it.Err())
+	}
+}
+
+func TestDB_HistoryPage(t *testing.T) {
+	t.Parallel()
+
+	table := &fakeHistoryTable{}
+	for id := int64(1); id <= 5; id++ {
+		table.add(id)
+	}
+	// Rows inserted between pages sort after the cursor.
+	table.onFetch = func(h *fakeHistoryTable) {
+		if h.fetches == 2 {
+			h.add(6)
+			h.add(7)
+		}
+	}
+	db, _ := openFakeDB(t, table.query)
+	wrapped := New(Config{}).Wrap(db)
+	ctx := context.Background()
+
+	var got []any
+	var cursor any
+	for pages := 0; ; pages++ {
+		if pages > 10 {
+			t.Fatal("pagination did not terminate")
+		}
+		page, err := wrapped.HistoryPage(ctx, "orders", HistoryOptions{BatchSize: 2, AfterHistoryID: cursor})
+		if err != nil {
+			t.Fatalf("HistoryPage() error = %v", err)
+		}
+		if len(page.Records) == 0 {
+			if page.LastHistoryID != cursor {
+				t.Fatalf("empty page LastHistoryID = %v, want cursor %v", page.LastHistoryID, cursor)
+			}
+			break
+		}
+		for _, r := range page.Records {
+			got = append(got, r.HistoryID)
+		}
+		cursor = page.LastHistoryID
+	}
+	want := []int64{1, 2, 3, 4, 5, 6, 7}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("paged history ids = %v, want %v", got, want)
+	}
+}
+
+func TestDB_HistoryPage_UUID(t *testing.T) {
+	t.Parallel()
+
+	ids := []string{
+		"01890a5d-ac96-774b-bcce-b302099a8057",
+		"01890a5d-ac96-774b-bcce-b302099a8058",
+		"01890a5e-0000-7000-8000-000000000000",
+	}
+	table := &fakeHistoryTable{}
+	for i, id := range ids {
+		// Drivers such as lib/pq return UUID columns as []byte.
+		table.addRow([]byte(id), int64(i+1))
+	}
+	db, _ := openFakeDB(t, table.query)
+	wrapped := New(Config{}).Wrap(db)
+	ctx := context.Background()
+
+	var got []any
+	var cursor any
+	for pages := 0; ; pages++ {
+		if pages > 10 {
+			t.Fatal("pagination did not terminate")
+		}
+		page, err := wrapped.HistoryPage(ctx, "orders", HistoryOptions{BatchSize: 2, AfterHistoryID: cursor})
+		if err != nil {
+			t.Fatalf("HistoryPage() error = %v", err)
+		}
+		if len(page.Records) == 0 {
+			break
+		}
+		for _, r := range page.Records {
+			got = append(got, r.HistoryID)
+		}
+		cursor = page.LastHistoryID
+	}
+	if fmt.Sprint(got) != fmt.Sprint(ids) {
+		t.Fatalf("paged history ids = %v, want %v", got, ids)
+	}
+	for i, id := range got {
+		if _, ok := id.(string); !ok {
+			t.Fatalf("history id %d = %T, want string", i, id)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package gostry
+
+import (
+	"context"
+
+	"github.com/mickamy/gostry/internal/buffer"
+)
+
+// Record is a captured change as exposed to hooks.
+type Record struct {
+	Table     string         // base table as written in the statement (possibly schema-qualified)
+	Operation string         // INSERT, UPDATE, DELETE, or COPY (statement-level only)
+	ID        any            // history id chosen by pickID (nil when unknown)
+	Before    map[string]any // row image before the change (redacted)
+	After     map[string]any // row image after the change (redacted)
+	Operator  string         // from WithOperator
+	TraceID   string         // from WithTraceID
+	Reason    string         // from WithReason
+	TxLabel   string         // from WithTxLabel on the BeginTx context
+	SQL       string         // originating statement text
+	HistoryID int64          // history_id of the written row, once flushed with Config.ReturnHistoryIDs (0 otherwise)
+
+	// RowsAffected is the number of rows changed by a statement captured without row images
+	// (no RETURNING), or -1 when the driver does not report it. It is 0 for per-row records.
+	RowsAffected int64
+}
+
+// CaptureFunc observes a change as soon as it is captured by ExecContext.
+type CaptureFunc func(ctx context.Context, r Record)
+
+// FlushFunc observes the records written (or, in dry-run mode, skipped) by a flush.
+type FlushFunc func(ctx context.Context, records []Record)
+
+// AfterCommitFunc runs after a successful commit with the records flushed by the transaction.
+// A returned error is reported by Commit, but the transaction remains committed.
+type AfterCommitFunc func(ctx context.Context, records []Record) error
+
+// record converts an entry into its public form using already redacted row images.
+func (e entry) record(id any, before, after map[string]any) Record {
+	return Record{
+		Table:     e.table,
+		Operation: e.op,
+		ID:        id,
+		Before:    before,
+		After:     after,
+		Operator:  e.meta.operator,
+		TraceID:   e.meta.traceID,
+		Reason:    e.meta.reason,
+		TxLabel:   e.meta.txLabel,
+		SQL:       e.sql,
+
+		RowsAffected: e.rowsAffected,
+	}
+}
+
+// capture buffers e and notifies cfg.OnCapture.
+func (tx *Tx) capture(ctx context.Context, e entry) {
+	tx.h.capture(ctx, tx.buf, tx.label, e)
+}
+
+// capture adds e, labeled with the transaction's label, to buf and notifies cfg.OnCapture.
+func (h *Handler) capture(ctx context.Context, buf *buffer.Buffer[entry], label string, e entry) {
+	e.meta.txLabel = label
+	e.history = extractHistoryOverride(ctx, e.table)
+	buf.Add(e)
+	if h.cfg.OnCapture == nil {
+		return
+	}
+	before, after := h.images(e)
+	id, _, _ := h.resolveID(e.table, before, after)
+	before, after = h.withholdImages(e.table, before, after)
+	h.cfg.OnCapture(ctx, e.record(id, before, after))
+}
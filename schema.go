@@ -16,46 +16,136 @@ import (
 
 // SchemaConfig controls history table generation behaviour.
 type SchemaConfig struct {
-	HistorySuffix string // suffix appended to base table name (default: _history)
-	CreateIDIndex bool   // create an index on the history table id column
+	HistorySuffix      string              // suffix appended to base table name (default: _history)
+	HistoryIDType      HistoryIDType       // history_id column type (default: HistoryIDBigserial)
+	CreateIDIndex      bool                // create an index on the history table id column
+	DefaultIDType      string              // id column type when the base table has none to copy (default: UUID)
+	RequireIDType      bool                // fail instead of falling back to DefaultIDType
+	TableNameFunc      TableNameFunc       // optional naming hook consulted before the built-in derivation
+	SingularTableNames bool                // derive table names without pluralizing
+	Promoted           PromotedColumns     // optional per-table fields stored in their own typed columns
+	CompositeKey       map[string][]string // optional table -> key columns; adds a composite_id column
+	RecordStatement    bool                // add statement_text and arg_count columns
+	SchemaVersion      bool                // add a schema_version column
+	RecordDBUser       bool                // add a db_user column
+	RecordTxLabel      bool                // add a tx_label column
+	HashChain          bool                // add prev_hash and row_hash columns
+	CompressImages     bool                // add before_gz and after_gz columns
+	Encoding           Encoding            // before/after column encoding (default: EncodingJSON)
+	PrimaryKeyColumn   map[string]string   // optional table -> id column checked by Validate
+	Validate           bool                // check the base tables before creating anything
+	CreateFlatView     bool                // create a <history table>_flat view
+	RecordColumnTypes  bool                // record base table column types in gostry_table_meta
+	UseTriggers        bool                // create PL/pgSQL triggers writing history
 }
 
+// DBExecQuerier is the subset of *sql.DB and *sql.Tx used by Migrate.
+// *sql.DB, *sql.Tx, *sql.Conn, and the gostry *DB wrapper all satisfy it, so migrations can run
+// inside a caller-owned transaction.
+type DBExecQuerier interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// TableNameFunc resolves a table name for a struct type.
+// It returns false to defer to the built-in derivation. Set the same hook in Config.TableNameFunc and
+// SchemaConfig.TableNameFunc so that RegisterModels and Migrate agree on table names.
+type TableNameFunc func(typ reflect.Type) (string, bool)
+
 // TableNamer provides a custom table name for a model.
 type TableNamer interface {
 	TableName() string
 }
 
+// MigrateResult describes what Migrate did for each target, in target order.
+type MigrateResult struct {
+	Tables []MigratedTable
+}
+
+// MigratedTable reports the outcome of Migrate for a single target.
+type MigratedTable struct {
+	Base           string   // quoted base table identifier
+	History        string   // quoted history table identifier
+	Created        bool     // the history table did not exist before this run
+	ColumnsAdded   []string // optional columns added to an existing history table by this run
+	IndexesCreated []string // quoted identifiers of indexes created by this run
+	Trigger        string   // quoted name of the history trigger (and its function) when UseTriggers is set
+	View           string   // quoted identifier of the flat view when CreateFlatView is set
+}
+
 // Migrate resolves table identifiers from the provided targets and creates history tables.
-func Migrate(ctx context.Context, db *sql.DB, cfg SchemaConfig, targets ...any) error {
+func Migrate(ctx context.Context, db DBExecQuerier, cfg SchemaConfig, targets ...any) error {
+	_, err := MigrateWithResult(ctx, db, cfg, targets...)
+	return err
+}
+
+// MigrateWithResult behaves like Migrate and additionally reports, per target, which history
+// tables and indexes were created and which already existed.
+func MigrateWithResult(ctx context.Context, db DBExecQuerier, cfg SchemaConfig, targets ...any) (MigrateResult, error) {
 	if cfg.HistorySuffix == "" {
-		cfg.HistorySuffix = "_history"
+		cfg.HistorySuffix = defaultHistorySuffix
+	}
+	if cfg.UseTriggers && cfg.Encoding == EncodingCBOR {
+		return MigrateResult{}, errors.New("gostry: UseTriggers writes JSONB images and cannot be combined with EncodingCBOR")
+	}
+	if _, err := historyIDColumnType(cfg.HistoryIDType); err != nil {
+		return MigrateResult{}, err
+	}
+	if cfg.UseTriggers && cfg.HistoryIDType != "" && cfg.HistoryIDType != HistoryIDBigserial {
+		return MigrateResult{}, errors.New("gostry: UseTriggers relies on the history_id sequence and requires HistoryIDBigserial")
+	}
+	if cfg.HashChain && cfg.HistoryIDType != "" && cfg.HistoryIDType != HistoryIDBigserial {
+		return MigrateResult{}, errors.New("gostry: HashChain orders the chain by the history_id sequence and requires HistoryIDBigserial")
+	}
+	if cfg.UseTriggers && cfg.HashChain {
+		return MigrateResult{}, errors.New("gostry: UseTriggers does not extend the hash chain and cannot be combined with HashChain")
+	}
+	if cfg.CreateFlatView && cfg.Encoding == EncodingCBOR {
+		return MigrateResult{}, errors.New("gostry: CreateFlatView reads JSONB images and cannot be combined with EncodingCBOR")
+	}
+	if err := cfg.Promoted.validate(); err != nil {
+		return MigrateResult{}, err
 	}
 	if len(targets) == 0 {
-		return nil
+		return MigrateResult{}, nil
 	}
 	names := make([]string, 0, len(targets))
 	for _, t := range targets {
-		name, err := resolveTableName(t)
+		name, err := resolveTableName(t, cfg.TableNameFunc, cfg.SingularTableNames)
 		if err != nil {
-			return err
+			return MigrateResult{}, err
 		}
 		names = append(names, name)
 	}
 
+	bases := make([]tableInfo, 0, len(names))
 	for _, name := range names {
 		parts := ident.SplitQualified(name)
 		if len(parts) == 0 {
-			return fmt.Errorf("gostry: invalid table identifier %q", name)
+			return MigrateResult{}, withKind(ErrInvalidIdentifier, fmt.Errorf("gostry: invalid table identifier %q", name))
 		}
 		base, err := selectBaseTable(ctx, db, parts)
 		if err != nil {
-			return err
+			return MigrateResult{}, err
 		}
-		if err := createHistoryTable(ctx, db, cfg, base); err != nil {
-			return err
+		if cfg.Validate {
+			if err := validateBaseTable(ctx, db, cfg, base, name); err != nil {
+				return MigrateResult{}, err
+			}
 		}
+		bases = append(bases, base)
 	}
-	return nil
+
+	result := MigrateResult{Tables: make([]MigratedTable, 0, len(bases))}
+	for i, base := range bases {
+		table, err := createHistoryTable(ctx, db, cfg, base, names[i])
+		if err != nil {
+			return result, err
+		}
+		result.Tables = append(result.Tables, table)
+	}
+	return result, nil
 }
 
 type tableInfo struct {
@@ -65,20 +155,11 @@ type tableInfo struct {
 	idType string
 }
 
-func selectBaseTable(ctx context.Context, db *sql.DB, parts []string) (tableInfo, error) {
-	var schemaName, tableName string
-	switch len(parts) {
-	case 1:
-		schemaName = "public"
-		tableName = parts[0]
-	case 2:
-		schemaName = parts[0]
-		tableName = parts[1]
-	default:
-		return tableInfo{}, fmt.Errorf("gostry: unsupported identifier %q", strings.Join(parts, "."))
-	}
-
-	row := db.QueryRowContext(ctx, `
+// selectBaseTable resolves parts to a base table and the type of its id column. Unqualified names
+// are resolved through the session search_path, like PostgreSQL itself does, so a table living in a
+// schema other than public is found when that schema is on the search_path.
+func selectBaseTable(ctx context.Context, db DBExecQuerier, parts []string) (tableInfo, error) {
+	const selectTable = `
         SELECT
             n.nspname,
             r.relname,
@@ -92,14 +173,34 @@ func selectBaseTable(ctx context.Context, db *sql.DB, parts []string) (tableInfo
               AND attnum > 0
               AND NOT attisdropped
         ) AS a ON a.attrelid = r.oid
+    `
+	var row *sql.Row
+	var name string
+	switch len(parts) {
+	case 1:
+		name = parts[0]
+		row = db.QueryRowContext(ctx, selectTable+`
+        WHERE r.relname = $1 AND pg_catalog.pg_table_is_visible(r.oid)
+        ORDER BY array_position(pg_catalog.current_schemas(true), n.nspname::text)
+        LIMIT 1
+    `, parts[0])
+	case 2:
+		name = parts[0] + "." + parts[1]
+		row = db.QueryRowContext(ctx, selectTable+`
         WHERE n.nspname = $1 AND r.relname = $2
-    `, schemaName, tableName)
+    `, parts[0], parts[1])
+	default:
+		return tableInfo{}, withKind(ErrInvalidIdentifier, fmt.Errorf("gostry: unsupported identifier %q", strings.Join(parts, ".")))
+	}
 
 	var info tableInfo
 	var idType sql.NullString
 	if err := row.Scan(&info.schema, &info.table, &idType); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			return tableInfo{}, fmt.Errorf("gostry: table %s.%s not found", schemaName, tableName)
+			if len(parts) == 1 {
+				return tableInfo{}, fmt.Errorf("gostry: table %s not found on the search_path", name)
+			}
+			return tableInfo{}, fmt.Errorf("gostry: table %s not found", name)
 		}
 		return tableInfo{}, err
 	}
@@ -110,52 +211,326 @@ func selectBaseTable(ctx context.Context, db *sql.DB, parts []string) (tableInfo
 	return info, nil
 }
 
-func createHistoryTable(ctx context.Context, db *sql.DB, cfg SchemaConfig, base tableInfo) error {
+// selectColumns returns the live column names of schema.table in ordinal order.
+func selectColumns(ctx context.Context, db DBExecQuerier, schemaName, tableName string) ([]string, error) {
+	rows, err := db.QueryContext(ctx, `
+        SELECT a.attname
+        FROM pg_attribute a
+        JOIN pg_class r ON r.oid = a.attrelid
+        JOIN pg_namespace n ON n.oid = r.relnamespace
+        WHERE n.nspname = $1 AND r.relname = $2
+          AND a.attnum > 0
+          AND NOT a.attisdropped
+        ORDER BY a.attnum
+    `, schemaName, tableName)
+	if err != nil {
+		return nil, err
+	}
+	defer func(rows *sql.Rows) {
+		_ = rows.Close()
+	}(rows)
+
+	var cols []string
+	for rows.Next() {
+		var col string
+		if err := rows.Scan(&col); err != nil {
+			return nil, err
+		}
+		cols = append(cols, col)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return cols, nil
+}
+
+// validateBaseTable checks that base has a key pickID can discover and every column configured for it.
+func validateBaseTable(ctx context.Context, db DBExecQuerier, cfg SchemaConfig, base tableInfo, name string) error {
+	cols, err := selectColumns(ctx, db, base.schema, base.table)
+	if err != nil {
+		return fmt.Errorf("gostry: failed to read columns of %s: %w", base.ident, err)
+	}
+	have := make(map[string]bool, len(cols))
+	for _, c := range cols {
+		have[c] = true
+	}
+
+	var missing []string
+	require := func(col string) {
+		if !have[col] {
+			missing = append(missing, col)
+		}
+	}
+	pk, hasPK := lookupTable(cfg.PrimaryKeyColumn, name)
+	keyCols, hasComposite := lookupTable(cfg.CompositeKey, name)
+	if hasPK {
+		require(pk)
+	}
+	for _, c := range keyCols {
+		require(c)
+	}
+	for _, p := range cfg.Promoted.lookup(name) {
+		require(p.Name)
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("gostry: table %s is missing configured columns: %s", base.ident, strings.Join(missing, ", "))
+	}
+
+	if !hasPK && !hasComposite {
+		singularID := inflection.Singular(base.table) + "_id"
+		if !have["id"] && !have[singularID] {
+			return fmt.Errorf("gostry: table %s has no discoverable primary key (expected id or %s, or configure PrimaryKeyColumn/CompositeKey)", base.ident, singularID)
+		}
+	}
+	return nil
+}
+
+func createHistoryTable(ctx context.Context, db DBExecQuerier, cfg SchemaConfig, base tableInfo, name string) (MigratedTable, error) {
 	historyParts := ident.HistoryParts(base.ident, cfg.HistorySuffix)
 	historyIdent := ident.QuoteQualified(historyParts)
 	if historyIdent == "" {
-		return fmt.Errorf("gostry: invalid history identifier for %s", base.ident)
-	}
-	columns := []string{
-		"history_id BIGSERIAL PRIMARY KEY",
-	}
-	if base.idType != "" {
-		columns = append(columns, fmt.Sprintf("id %s", base.idType))
-	} else {
-		columns = append(columns, "id UUID")
-	}
-	columns = append(columns,
-		"operation TEXT NOT NULL",
-		"operated_at TIMESTAMPTZ NOT NULL",
-		"operated_by TEXT",
-		"trace_id TEXT",
-		"reason TEXT",
-		"before JSONB",
-		"after JSONB",
-	)
-
-	ddl := fmt.Sprintf(`
+		return MigratedTable{}, &InvalidIdentifierError{Table: name}
+	}
+	result := MigratedTable{Base: base.ident, History: historyIdent}
+	idType, err := historyIDType(cfg, base)
+	if err != nil {
+		return MigratedTable{}, err
+	}
+	cols := defaultHistoryColumns
+	promoted := cfg.Promoted.lookup(name)
+	enc, err := encoderFor(cfg.Encoding)
+	if err != nil {
+		return MigratedTable{}, err
+	}
+	historyIDType, err := historyIDColumnType(cfg.HistoryIDType)
+	if err != nil {
+		return MigratedTable{}, err
+	}
+	opts := cfg.historyFeatures().options(name)
+	opts.promoted = promoted
+	opts.imageType = enc.columnType()
+	opts.historyIDType = historyIDType
+
+	exists, err := relationExists(ctx, db, historyParts)
+	if err != nil {
+		return MigratedTable{}, err
+	}
+	if _, err := db.ExecContext(ctx, buildHistoryDDL(historyIdent, idType, cols, opts)); err != nil {
+		return MigratedTable{}, err
+	}
+	result.Created = !exists
+	if exists && len(historyParts) == 2 {
+		existing, err := selectColumns(ctx, db, historyParts[0], historyParts[1])
+		if err != nil {
+			return MigratedTable{}, fmt.Errorf("gostry: failed to read columns of %s: %w", historyIdent, err)
+		}
+		stmts, added := buildAddColumns(historyIdent, historyColumnDefs(idType, cols, opts), existing)
+		for _, stmt := range stmts {
+			if _, err := db.ExecContext(ctx, stmt); err != nil {
+				return MigratedTable{}, err
+			}
+		}
+		result.ColumnsAdded = added
+	}
+
+	if cfg.CreateFlatView {
+		if _, err := db.ExecContext(ctx, buildFlatViewDDL(historyParts, cols, promoted)); err != nil {
+			return MigratedTable{}, fmt.Errorf("gostry: failed to create flat view of %s: %w", historyIdent, err)
+		}
+		result.View = ident.QuoteQualified(flatViewParts(historyParts))
+	}
+	if cfg.RecordColumnTypes {
+		if err := recordColumnTypes(ctx, db, base, historyIdent); err != nil {
+			return MigratedTable{}, err
+		}
+	}
+
+	var indexed []string
+	if cfg.CreateIDIndex {
+		indexed = append(indexed, cols.id)
+	}
+	for _, p := range promoted {
+		if p.Index {
+			indexed = append(indexed, p.Name)
+		}
+	}
+	if cfg.UseTriggers {
+		row := triggerRow{layout: opts}
+		row.idColumn, _ = lookupTable(cfg.PrimaryKeyColumn, name)
+		row.keyCols, _ = lookupTable(cfg.CompositeKey, name)
+		for _, stmt := range buildTriggerDDL(base.ident, historyParts, cols, row) {
+			if _, err := db.ExecContext(ctx, stmt); err != nil {
+				return MigratedTable{}, fmt.Errorf("gostry: failed to create history trigger on %s: %w", base.ident, err)
+			}
+		}
+		result.Trigger = ident.Quote(triggerName(historyParts))
+	}
+
+	for _, col := range indexed {
+		indexName := fmt.Sprintf("idx_%s_%s", historyParts[len(historyParts)-1], col)
+		indexParts := append(append([]string{}, historyParts[:len(historyParts)-1]...), indexName)
+		exists, err := relationExists(ctx, db, indexParts)
+		if err != nil {
+			return MigratedTable{}, err
+		}
+		stmt := fmt.Sprintf(`CREATE INDEX IF NOT EXISTS %s ON %s (%s);`, ident.Quote(indexName), historyIdent, ident.Quote(col))
+		if _, err := db.ExecContext(ctx, stmt); err != nil {
+			return MigratedTable{}, err
+		}
+		if !exists {
+			result.IndexesCreated = append(result.IndexesCreated, ident.QuoteQualified(indexParts))
+		}
+	}
+	return result, nil
+}
+
+// relationExists reports whether the (possibly qualified) relation resolves via to_regclass.
+func relationExists(ctx context.Context, db DBExecQuerier, parts []string) (bool, error) {
+	var exists bool
+	if err := db.QueryRowContext(ctx, `SELECT to_regclass($1) IS NOT NULL`, ident.QuoteQualified(parts)).Scan(&exists); err != nil {
+		return false, fmt.Errorf("gostry: failed to check relation %s: %w", ident.QuoteQualified(parts), err)
+	}
+	return exists, nil
+}
+
+// historyIDType returns the type of the history id column: the base table's id column type when it
+// has one, otherwise cfg.DefaultIDType (UUID when unset), or an error when cfg.RequireIDType is set.
+func historyIDType(cfg SchemaConfig, base tableInfo) (string, error) {
+	switch {
+	case base.idType != "":
+		return base.idType, nil
+	case cfg.RequireIDType:
+		return "", fmt.Errorf("gostry: cannot resolve the id column type of %s (no id column); set SchemaConfig.DefaultIDType", base.ident)
+	case cfg.DefaultIDType != "":
+		return cfg.DefaultIDType, nil
+	}
+	return "UUID", nil
+}
+
+// HistoryIDType selects the type of the history_id primary key created by Migrate. HistoryIDUUID and
+// HistoryIDText have no default, so pair them with Config.HistoryIDGenerator; UseTriggers, HashChain,
+// and Config.ReturnHistoryIDs rely on the sequence of HistoryIDBigserial.
+type HistoryIDType string
+
+const (
+	// HistoryIDBigserial numbers history rows from a sequence (the default).
+	HistoryIDBigserial HistoryIDType = "bigserial"
+	// HistoryIDUUID stores application-generated UUIDs (e.g. UUIDv7) from Config.HistoryIDGenerator.
+	HistoryIDUUID HistoryIDType = "uuid"
+	// HistoryIDText stores application-generated text ids (e.g. ULIDs) from Config.HistoryIDGenerator.
+	HistoryIDText HistoryIDType = "text"
+)
+
+// historyIDColumnType returns the column definition of the history_id column for t.
+// The UUID and text types have no DEFAULT; Config.HistoryIDGenerator must supply every id.
+func historyIDColumnType(t HistoryIDType) (string, error) {
+	switch t {
+	case "", HistoryIDBigserial:
+		return "BIGSERIAL PRIMARY KEY", nil
+	case HistoryIDUUID:
+		return "UUID PRIMARY KEY", nil
+	case HistoryIDText:
+		return "TEXT PRIMARY KEY", nil
+	}
+	return "", fmt.Errorf("gostry: unsupported HistoryIDType %q", t)
+}
+
+// historyDDLOptions selects the optional columns of a history table. Migrate, the history triggers,
+// and flush all derive it through historyFeatures.options; historyLayout turns it into the DDL, the
+// trigger INSERT, and the flush INSERT. Migrate adds a column for each SchemaConfig flag, and flush
+// writes it for the Config flag of the same name (CompressImages pairs with Config.CompressThreshold),
+// so the two configurations must agree.
+type historyDDLOptions struct {
+	composite     bool             // composite_id JSONB
+	statement     bool             // statement_text TEXT, arg_count INTEGER, and rows_affected BIGINT
+	schemaVersion bool             // schema_version INTEGER
+	dbUser        bool             // db_user TEXT
+	txLabel       bool             // tx_label TEXT
+	hashChain     bool             // prev_hash TEXT and row_hash TEXT
+	compress      bool             // before_gz BYTEA and after_gz BYTEA
+	idType        string           // id column type (default: UUID)
+	imageType     string           // before/after column type (default: JSONB)
+	historyIDType string           // history_id column type and constraints (default: BIGSERIAL PRIMARY KEY)
+	promoted      []PromotedColumn // promoted typed columns
+
+	bindHistoryID  bool // flush binds history_id (Config.HistoryIDGenerator) instead of leaving it to the sequence
+	bindOperatedAt bool // flush binds operated_at (Config.OutboxMode) instead of writing now()
+	bindDBUser     bool // flush binds db_user read on the business transaction (Config.OutboxMode, Config.HistoryDB) instead of writing current_user
+}
+
+// columnDef is a single history table column definition.
+type columnDef struct {
+	name     string // unquoted column name
+	typ      string // SQL type and constraints
+	optional bool   // enabled by configuration; may be added to an existing table
+}
+
+// historyColumnDefs lists the columns of a history table in DDL order: historyLayout, then the
+// promoted columns.
+func historyColumnDefs(idType string, cols historyColumns, opts historyDDLOptions) []columnDef {
+	opts.idType = idType
+	if opts.idType == "" {
+		opts.idType = "UUID"
+	}
+	if opts.imageType == "" {
+		opts.imageType = "JSONB"
+	}
+	if opts.historyIDType == "" {
+		opts.historyIDType = "BIGSERIAL PRIMARY KEY"
+	}
+	defs := make([]columnDef, 0, len(historyLayout)+len(opts.promoted))
+	for _, c := range historyLayoutColumns(opts) {
+		defs = append(defs, columnDef{name: c.name(cols), typ: c.typ(opts), optional: c.enabled != nil})
+	}
+	for _, p := range opts.promoted {
+		typ := p.Type
+		if typ == "" {
+			typ = "TEXT"
+		}
+		defs = append(defs, columnDef{name: p.Name, typ: typ, optional: true})
+	}
+	return defs
+}
+
+// buildHistoryDDL renders the CREATE TABLE statement for a history table with quoted column identifiers.
+func buildHistoryDDL(historyIdent, idType string, cols historyColumns, opts historyDDLOptions) string {
+	defs := historyColumnDefs(idType, cols, opts)
+	columns := make([]string, 0, len(defs))
+	for _, d := range defs {
+		columns = append(columns, fmt.Sprintf("%s %s", ident.Quote(d.name), d.typ))
+	}
+
+	return fmt.Sprintf(`
     CREATE TABLE IF NOT EXISTS %s (
         %s
     );
     `, historyIdent, strings.Join(columns, ",\n\t"))
+}
 
-	if _, err := db.ExecContext(ctx, ddl); err != nil {
-		return err
+// buildAddColumns renders ALTER TABLE statements for the optional columns missing from an existing history table.
+func buildAddColumns(historyIdent string, defs []columnDef, existing []string) ([]string, []string) {
+	have := make(map[string]bool, len(existing))
+	for _, c := range existing {
+		have[c] = true
 	}
-	if cfg.CreateIDIndex {
-		indexName := fmt.Sprintf("idx_%s_id", historyParts[len(historyParts)-1])
-		stmt := fmt.Sprintf(`CREATE INDEX IF NOT EXISTS %s ON %s (id);`, ident.Quote(indexName), historyIdent)
-		if _, err := db.ExecContext(ctx, stmt); err != nil {
-			return err
+	var stmts, added []string
+	for _, d := range defs {
+		if !d.optional || have[d.name] {
+			continue
 		}
+		stmts = append(stmts, fmt.Sprintf(`ALTER TABLE %s ADD COLUMN IF NOT EXISTS %s %s;`, historyIdent, ident.Quote(d.name), d.typ))
+		added = append(added, d.name)
 	}
-	return nil
+	return stmts, added
 }
 
 var tableNamerType = reflect.TypeOf((*TableNamer)(nil)).Elem()
 
-func resolveTableName(target any) (string, error) {
+// resolveTableName derives the table name of a migration or registration target. Struct types
+// without a TableName method or TableNameFunc result use their snake_case type name, pluralized
+// unless singular is set (SchemaConfig.SingularTableNames for Migrate, Config.SingularTableNames for
+// RegisterModels; keep the two in sync).
+func resolveTableName(target any, nameFunc TableNameFunc, singular bool) (string, error) {
 	switch v := target.(type) {
 	case nil:
 		return "", errors.New("gostry: nil table target")
@@ -204,27 +579,60 @@ func resolveTableName(target any) (string, error) {
 				return name, nil
 			}
 		}
+		if nameFunc != nil {
+			if name, ok := nameFunc(typ); ok {
+				name = strings.TrimSpace(name)
+				if name == "" {
+					return "", fmt.Errorf("gostry: TableNameFunc returned empty string. %T", target)
+				}
+				return name, nil
+			}
+		}
 		if typ.Name() == "" {
 			return "", fmt.Errorf("gostry: cannot derive table name for anonymous struct of type %v", typ)
 		}
+		if singular {
+			return toSnakeCase(typ.Name()), nil
+		}
 		return inflection.Plural(toSnakeCase(typ.Name())), nil
 	}
 
 	return "", fmt.Errorf("gostry: unsupported table target %T", target)
 }
 
+// toSnakeCase converts a Go identifier into snake_case.
+// Word boundaries are placed:
+//   - before an upper-case letter that follows a lower-case letter or digit (UserName -> user_name, S3Bucket -> s3_bucket);
+//   - before the last letter of an upper-case run that is followed by a lower-case letter (HTTPServer -> http_server).
+//
+// Digits stay attached to the word they follow (S3Bucket -> s3_bucket, OAuth2Token -> o_auth2_token), and a trailing
+// lower-case "s" after an acronym is treated as its plural (UserIDs -> user_ids).
 func toSnakeCase(s string) string {
 	runes := []rune(s)
 	var b strings.Builder
 	for i, r := range runes {
-		if unicode.IsUpper(r) {
-			if i > 0 && (unicode.IsLower(runes[i-1]) || (i+1 < len(runes) && unicode.IsLower(runes[i+1]))) {
+		if !unicode.IsUpper(r) {
+			b.WriteRune(r)
+			continue
+		}
+		if i > 0 {
+			prev := runes[i-1]
+			switch {
+			case unicode.IsLower(prev), unicode.IsDigit(prev):
+				b.WriteByte('_')
+			case unicode.IsUpper(prev) && i+1 < len(runes) && unicode.IsLower(runes[i+1]) && !isAcronymPlural(runes, i+1):
 				b.WriteByte('_')
 			}
-			b.WriteRune(unicode.ToLower(r))
-		} else {
-			b.WriteRune(r)
 		}
+		b.WriteRune(unicode.ToLower(r))
 	}
 	return b.String()
 }
+
+// isAcronymPlural reports whether runes[i] is a lone "s" closing an acronym (e.g. the "s" in IDs).
+func isAcronymPlural(runes []rune, i int) bool {
+	if runes[i] != 's' {
+		return false
+	}
+	return i+1 == len(runes) || !unicode.IsLower(runes[i+1])
+}
@@ -0,0 +1,746 @@
+package gostry
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/mickamy/gostry/internal/ident"
+)
+
+type schemaTestUser struct{}
+
+type schemaTestAPIKey struct{}
+
+type schemaTestNamed struct{}
+
+func (schemaTestNamed) TableName() string { return "named_things" }
+
+func TestResolveTableName_TableNameFunc(t *testing.T) {
+	t.Parallel()
+
+	nameFunc := func(typ reflect.Type) (string, bool) {
+		if typ == reflect.TypeOf(schemaTestAPIKey{}) {
+			return "auth.api_keys", true
+		}
+		return "", false
+	}
+
+	tcs := []struct {
+		name   string
+		target any
+		want   string
+	}{
+		{name: "override", target: schemaTestAPIKey{}, want: "auth.api_keys"},
+		{name: "override pointer", target: &schemaTestAPIKey{}, want: "auth.api_keys"},
+		{name: "defer to derivation", target: schemaTestUser{}, want: "schema_test_users"},
+		{name: "table namer wins", target: schemaTestNamed{}, want: "named_things"},
+		{name: "string passthrough", target: "public.orders", want: "public.orders"},
+	}
+
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			got, err := resolveTableName(tc.target, nameFunc, false)
+			if err != nil {
+				t.Fatalf("resolveTableName(%T) error = %v", tc.target, err)
+			}
+			if got != tc.want {
+				t.Fatalf("resolveTableName(%T) = %q, want %q", tc.target, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestResolveTableName_TableNameFuncEmpty(t *testing.T) {
+	t.Parallel()
+
+	nameFunc := func(reflect.Type) (string, bool) { return " ", true }
+	if _, err := resolveTableName(schemaTestUser{}, nameFunc, false); err == nil {
+		t.Fatal("resolveTableName() error = nil, want error for empty name")
+	}
+}
+
+type Order struct{}
+
+func TestResolveTableName_Singular(t *testing.T) {
+	t.Parallel()
+
+	tcs := []struct {
+		name     string
+		singular bool
+		target   any
+		want     string
+	}{
+		{name: "pluralized by default", target: Order{}, want: "orders"},
+		{name: "singular", singular: true, target: Order{}, want: "order"},
+		{name: "singular pointer", singular: true, target: &Order{}, want: "order"},
+		{name: "table namer unaffected", singular: true, target: schemaTestNamed{}, want: "named_things"},
+	}
+
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			got, err := resolveTableName(tc.target, nil, tc.singular)
+			if err != nil {
+				t.Fatalf("resolveTableName(%T) error = %v", tc.target, err)
+			}
+			if got != tc.want {
+				t.Fatalf("resolveTableName(%T) = %q, want %q", tc.target, got, tc.want)
+			}
+		})
+	}
+
+	h := New(Config{SingularTableNames: true})
+	if err := h.RegisterModels(Order{}); err != nil {
+		t.Fatalf("RegisterModels() error = %v", err)
+	}
+	if got, _ := h.TableNameOf(Order{}); got != "order" {
+		t.Fatalf("TableNameOf(Order{}) = %q, want order", got)
+	}
+}
+
+func TestToSnakeCase(t *testing.T) {
+	t.Parallel()
+
+	tcs := []struct {
+		in   string
+		want string
+	}{
+		{in: "", want: ""},
+		{in: "Order", want: "order"},
+		{in: "OrderItem", want: "order_item"},
+		{in: "order", want: "order"},
+		{in: "orderItem", want: "order_item"},
+		{in: "HTTPServer", want: "http_server"},
+		{in: "APIKey", want: "api_key"},
+		{in: "OAuthToken", want: "o_auth_token"},
+		{in: "UserID", want: "user_id"},
+		{in: "UserIDs", want: "user_ids"},
+		{in: "IDsByUser", want: "ids_by_user"},
+		{in: "HTML", want: "html"},
+		{in: "S3Bucket", want: "s3_bucket"},
+		{in: "OAuth2Token", want: "o_auth2_token"},
+		{in: "Version2", want: "version2"},
+		{in: "Route53Record", want: "route53_record"},
+		{in: "MD5Sum", want: "md5_sum"},
+		{in: "A", want: "a"},
+		{in: "AB", want: "ab"},
+		{in: "ABc", want: "a_bc"},
+		{in: "already_snake", want: "already_snake"},
+	}
+
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.in, func(t *testing.T) {
+			t.Parallel()
+			if got := toSnakeCase(tc.in); got != tc.want {
+				t.Fatalf("toSnakeCase(%q) = %q, want %q", tc.in, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestBuildHistoryDDL_QuotesColumns(t *testing.T) {
+	t.Parallel()
+
+	cols := defaultHistoryColumns
+	cols.id = "order"
+
+	ddl := buildHistoryDDL(`"public"."orders_history"`, "bigint", cols, historyDDLOptions{})
+	for _, want := range []string{
+		`"history_id" BIGSERIAL PRIMARY KEY`,
+		`"order" bigint`,
+		`"operation" TEXT NOT NULL`,
+		`"operated_at" TIMESTAMPTZ NOT NULL`,
+		`"before" JSONB`,
+		`"after" JSONB`,
+	} {
+		if !strings.Contains(ddl, want) {
+			t.Fatalf("buildHistoryDDL() = %s, want to contain %q", ddl, want)
+		}
+	}
+}
+
+func TestBuildHistoryDDL_CompositeID(t *testing.T) {
+	t.Parallel()
+
+	ddl := buildHistoryDDL(`"order_lines_history"`, "", defaultHistoryColumns, historyDDLOptions{composite: true})
+	if !strings.Contains(ddl, `"composite_id" JSONB`) {
+		t.Fatalf("buildHistoryDDL() = %s, want composite_id column", ddl)
+	}
+	if ddl := buildHistoryDDL(`"orders_history"`, "", defaultHistoryColumns, historyDDLOptions{}); strings.Contains(ddl, "composite_id") {
+		t.Fatalf("buildHistoryDDL() = %s, want no composite_id column", ddl)
+	}
+}
+
+func TestHistoryLayout_DDLMatchesInsert(t *testing.T) {
+	t.Parallel()
+
+	full := New(Config{
+		RecordStatement:    true,
+		SchemaVersion:      1,
+		RecordDBUser:       true,
+		RecordTxLabel:      true,
+		HashChain:          true,
+		CompressThreshold:  1,
+		CompositeKey:       map[string][]string{"orders": {"tenant_id", "id"}},
+		HistoryIDGenerator: func() any { return "id" },
+	}).historyLayoutOptions("orders")
+	full.promoted = []PromotedColumn{{Name: "status"}, {Name: "amount", Type: "NUMERIC"}}
+
+	tcs := []struct {
+		name string
+		opts historyDDLOptions
+	}{
+		{name: "default", opts: historyDDLOptions{}},
+		{name: "composite", opts: historyDDLOptions{composite: true}},
+		{name: "statement", opts: historyDDLOptions{statement: true}},
+		{name: "schema version", opts: historyDDLOptions{schemaVersion: true}},
+		{name: "db user", opts: historyDDLOptions{dbUser: true}},
+		{name: "tx label", opts: historyDDLOptions{txLabel: true}},
+		{name: "hash chain", opts: historyDDLOptions{hashChain: true}},
+		{name: "compress", opts: historyDDLOptions{compress: true}},
+		{name: "outbox", opts: historyDDLOptions{bindOperatedAt: true}},
+		{name: "promoted", opts: historyDDLOptions{promoted: full.promoted}},
+		{name: "every column", opts: full},
+	}
+
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			var ddl []string
+			for _, d := range historyColumnDefs("", defaultHistoryColumns, tc.opts) {
+				// history_id is left to its sequence unless flush binds it.
+				if d.name == defaultHistoryColumns.historyID && !tc.opts.bindHistoryID {
+					continue
+				}
+				ddl = append(ddl, ident.Quote(d.name))
+			}
+			promoted := make([]string, len(tc.opts.promoted))
+			for i, p := range tc.opts.promoted {
+				promoted[i] = p.Name
+			}
+			hi := newHistoryInsert([]string{"orders_history"}, defaultHistoryColumns, tc.opts, promoted, false)
+			if !reflect.DeepEqual(hi.columns, ddl) {
+				t.Fatalf("INSERT columns = %v, want the DDL columns %v", hi.columns, ddl)
+			}
+			if got := len(historyArgs(tc.opts, &historyValues{promoted: make([]any, len(promoted))})); got != len(hi.params) {
+				t.Fatalf("historyArgs() = %d args, want %d placeholders", got, len(hi.params))
+			}
+		})
+	}
+
+	t.Run("config enables every layout column", func(t *testing.T) {
+		t.Parallel()
+		for _, c := range historyLayout {
+			if c.enabled != nil && !c.enabled(full) {
+				t.Errorf("column %q is not written by any Config", c.name(defaultHistoryColumns))
+			}
+		}
+	})
+}
+
+func TestHistoryFeatures_ConfigMatchesSchemaConfig(t *testing.T) {
+	t.Parallel()
+
+	composite := map[string][]string{"orders": {"tenant_id", "id"}}
+	tcs := []struct {
+		name   string
+		cfg    Config
+		schema SchemaConfig
+	}{
+		{name: "default"},
+		{name: "statement", cfg: Config{RecordStatement: true}, schema: SchemaConfig{RecordStatement: true}},
+		{name: "schema version", cfg: Config{SchemaVersion: 3}, schema: SchemaConfig{SchemaVersion: true}},
+		{name: "db user", cfg: Config{RecordDBUser: true}, schema: SchemaConfig{RecordDBUser: true}},
+		{name: "tx label", cfg: Config{RecordTxLabel: true}, schema: SchemaConfig{RecordTxLabel: true}},
+		{name: "hash chain", cfg: Config{HashChain: true}, schema: SchemaConfig{HashChain: true}},
+		{name: "compress", cfg: Config{CompressThreshold: 1}, schema: SchemaConfig{CompressImages: true}},
+		{name: "composite", cfg: Config{CompositeKey: composite}, schema: SchemaConfig{CompositeKey: composite}},
+	}
+
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			flush := New(tc.cfg).historyLayoutOptions("orders")
+			migrate := tc.schema.historyFeatures().options("orders")
+			if !reflect.DeepEqual(flush, migrate) {
+				t.Fatalf("flush layout = %+v, want the Migrate layout %+v", flush, migrate)
+			}
+		})
+	}
+}
+
+func TestBuildHistoryDDL_Statement(t *testing.T) {
+	t.Parallel()
+
+	ddl := buildHistoryDDL(`"orders_history"`, "", defaultHistoryColumns, historyDDLOptions{statement: true})
+	for _, want := range []string{`"statement_text" TEXT`, `"arg_count" INTEGER`, `"rows_affected" BIGINT`} {
+		if !strings.Contains(ddl, want) {
+			t.Fatalf("buildHistoryDDL() = %s, want to contain %q", ddl, want)
+		}
+	}
+}
+
+func TestBuildHistoryDDL_SchemaVersion(t *testing.T) {
+	t.Parallel()
+
+	ddl := buildHistoryDDL(`"orders_history"`, "", defaultHistoryColumns, historyDDLOptions{schemaVersion: true})
+	if want := `"schema_version" INTEGER`; !strings.Contains(ddl, want) {
+		t.Fatalf("buildHistoryDDL() = %s, want to contain %q", ddl, want)
+	}
+	if ddl := buildHistoryDDL(`"orders_history"`, "", defaultHistoryColumns, historyDDLOptions{}); strings.Contains(ddl, "schema_version") {
+		t.Fatalf("buildHistoryDDL() = %s, want no schema_version column", ddl)
+	}
+}
+
+func TestBuildHistoryDDL_DBUser(t *testing.T) {
+	t.Parallel()
+
+	ddl := buildHistoryDDL(`"orders_history"`, "", defaultHistoryColumns, historyDDLOptions{dbUser: true})
+	if want := `"db_user" TEXT`; !strings.Contains(ddl, want) {
+		t.Fatalf("buildHistoryDDL() = %s, want to contain %q", ddl, want)
+	}
+	if ddl := buildHistoryDDL(`"orders_history"`, "", defaultHistoryColumns, historyDDLOptions{}); strings.Contains(ddl, "db_user") {
+		t.Fatalf("buildHistoryDDL() = %s, want no db_user column", ddl)
+	}
+}
+
+func TestBuildHistoryDDL_TxLabel(t *testing.T) {
+	t.Parallel()
+
+	ddl := buildHistoryDDL(`"orders_history"`, "", defaultHistoryColumns, historyDDLOptions{txLabel: true})
+	if want := `"tx_label" TEXT`; !strings.Contains(ddl, want) {
+		t.Fatalf("buildHistoryDDL() = %s, want to contain %q", ddl, want)
+	}
+	if ddl := buildHistoryDDL(`"orders_history"`, "", defaultHistoryColumns, historyDDLOptions{}); strings.Contains(ddl, "tx_label") {
+		t.Fatalf("buildHistoryDDL() = %s, want no tx_label column", ddl)
+	}
+}
+
+func TestBuildHistoryDDL_HashChain(t *testing.T) {
+	t.Parallel()
+
+	ddl := buildHistoryDDL(`"orders_history"`, "", defaultHistoryColumns, historyDDLOptions{hashChain: true})
+	for _, want := range []string{`"prev_hash" TEXT`, `"row_hash" TEXT`} {
+		if !strings.Contains(ddl, want) {
+			t.Fatalf("buildHistoryDDL() = %s, want to contain %q", ddl, want)
+		}
+	}
+}
+
+// fakeCatalog answers Migrate's catalog queries for a single base table.
+type fakeCatalog struct {
+	schema  string
+	table   string
+	idType  string
+	columns []string
+	types   []string // data types of columns, reported to RecordColumnTypes
+	history []string // columns of the existing history table
+
+	mu       sync.Mutex
+	existing map[string]bool // quoted relation identifiers reported by to_regclass
+}
+
+func (c *fakeCatalog) setExisting(rels ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.existing = map[string]bool{}
+	for _, r := range rels {
+		c.existing[r] = true
+	}
+}
+
+func (c *fakeCatalog) query(q string, args []any) (fakeResult, error) {
+	switch {
+	case strings.Contains(q, "AS ordinal"):
+		res := fakeResult{cols: []string{"attname", "data_type", "ordinal"}}
+		for i, col := range c.columns {
+			res.rows = append(res.rows, []driver.Value{col, c.types[i], int64(i + 1)})
+		}
+		return res, nil
+	case strings.Contains(q, "format_type"):
+		var id driver.Value
+		if c.idType != "" {
+			id = c.idType
+		}
+		return fakeResult{cols: []string{"nspname", "relname", "id_type"}, rows: [][]driver.Value{{c.schema, c.table, id}}}, nil
+	case strings.Contains(q, "a.attname"):
+		res := fakeResult{cols: []string{"attname"}}
+		cols := c.columns
+		if args[1] != c.table {
+			cols = c.history
+		}
+		for _, col := range cols {
+			res.rows = append(res.rows, []driver.Value{col})
+		}
+		return res, nil
+	case strings.Contains(q, "to_regclass"):
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return fakeResult{cols: []string{"exists"}, rows: [][]driver.Value{{c.existing[args[0].(string)]}}}, nil
+	}
+	return fakeResult{}, nil
+}
+
+func TestMigrate_Validate(t *testing.T) {
+	t.Parallel()
+
+	tcs := []struct {
+		name    string
+		cfg     SchemaConfig
+		columns []string
+		wantErr string
+	}{
+		{
+			name:    "missing promoted and primary key columns",
+			cfg:     SchemaConfig{Validate: true, Promoted: PromotedColumns{"orders": {{Name: "status"}, {Name: "region"}}}, PrimaryKeyColumn: map[string]string{"orders": "order_no"}},
+			columns: []string{"id", "status"},
+			wantErr: "missing configured columns: order_no, region",
+		},
+		{
+			name:    "missing composite key column",
+			cfg:     SchemaConfig{Validate: true, CompositeKey: map[string][]string{"orders": {"tenant_id", "order_no"}}},
+			columns: []string{"tenant_id"},
+			wantErr: "missing configured columns: order_no",
+		},
+		{
+			name:    "no discoverable key",
+			cfg:     SchemaConfig{Validate: true},
+			columns: []string{"status"},
+			wantErr: "no discoverable primary key",
+		},
+		{
+			name:    "singular id column",
+			cfg:     SchemaConfig{Validate: true},
+			columns: []string{"order_id", "status"},
+		},
+		{
+			name:    "validation disabled",
+			cfg:     SchemaConfig{},
+			columns: []string{"status"},
+		},
+		{
+			name:    "triggers with hash chain",
+			cfg:     SchemaConfig{UseTriggers: true, HashChain: true},
+			columns: []string{"id", "status"},
+			wantErr: "cannot be combined with HashChain",
+		},
+		{
+			name:    "uuid history ids with hash chain",
+			cfg:     SchemaConfig{HistoryIDType: HistoryIDUUID, HashChain: true},
+			columns: []string{"id", "status"},
+			wantErr: "HashChain orders the chain by the history_id sequence",
+		},
+	}
+
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			catalog := &fakeCatalog{schema: "public", table: "orders", idType: "bigint", columns: tc.columns}
+			db, state := openFakeDB(t, catalog.query)
+			err := Migrate(context.Background(), db, tc.cfg, "orders")
+			if tc.wantErr == "" {
+				if err != nil {
+					t.Fatalf("Migrate() error = %v", err)
+				}
+				if len(state.Execs()) == 0 {
+					t.Fatal("Migrate() executed no DDL")
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Fatalf("Migrate() error = %v, want containing %q", err, tc.wantErr)
+			}
+			if execs := state.Execs(); len(execs) != 0 {
+				t.Fatalf("Migrate() executed %d statements, want none before validation passes", len(execs))
+			}
+		})
+	}
+}
+
+func TestMigrateWithResult(t *testing.T) {
+	t.Parallel()
+
+	catalog := &fakeCatalog{
+		schema:  "sales",
+		table:   "orders",
+		idType:  "bigint",
+		columns: []string{"id", "status"},
+		history: []string{"history_id", "id", "operation", "operated_at", "operated_by", "trace_id", "reason", "before", "after", "status"},
+	}
+	db, _ := openFakeDB(t, catalog.query)
+	cfg := SchemaConfig{CreateIDIndex: true, Promoted: PromotedColumns{"orders": {{Name: "status", Index: true}}}}
+
+	first, err := MigrateWithResult(context.Background(), db, cfg, "sales.orders")
+	if err != nil {
+		t.Fatalf("MigrateWithResult() error = %v", err)
+	}
+	want := MigrateResult{Tables: []MigratedTable{{
+		Base:           `"sales"."orders"`,
+		History:        `"sales"."orders_history"`,
+		Created:        true,
+		IndexesCreated: []string{`"sales"."idx_orders_history_id"`, `"sales"."idx_orders_history_status"`},
+	}}}
+	if !reflect.DeepEqual(first, want) {
+		t.Fatalf("first MigrateWithResult() = %#v, want %#v", first, want)
+	}
+
+	catalog.setExisting(`"sales"."orders_history"`, `"sales"."idx_orders_history_id"`, `"sales"."idx_orders_history_status"`)
+	second, err := MigrateWithResult(context.Background(), db, cfg, "sales.orders")
+	if err != nil {
+		t.Fatalf("MigrateWithResult() rerun error = %v", err)
+	}
+	want.Tables[0].Created = false
+	want.Tables[0].IndexesCreated = nil
+	if !reflect.DeepEqual(second, want) {
+		t.Fatalf("rerun MigrateWithResult() = %#v, want %#v", second, want)
+	}
+}
+
+func TestMigrateWithResult_AddsMissingColumns(t *testing.T) {
+	t.Parallel()
+
+	catalog := &fakeCatalog{
+		schema:  "public",
+		table:   "orders",
+		idType:  "bigint",
+		columns: []string{"id", "status"},
+		history: []string{"history_id", "id", "operation", "operated_at", "operated_by", "trace_id", "reason", "before", "after", "status"},
+	}
+	catalog.setExisting(`"public"."orders_history"`)
+	db, state := openFakeDB(t, catalog.query)
+
+	cfg := SchemaConfig{RecordStatement: true, Promoted: PromotedColumns{"orders": {{Name: "status"}}}}
+	res, err := MigrateWithResult(context.Background(), db, cfg, "orders")
+	if err != nil {
+		t.Fatalf("MigrateWithResult() error = %v", err)
+	}
+	if got, want := res.Tables[0].ColumnsAdded, []string{"statement_text", "arg_count", "rows_affected"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("ColumnsAdded = %v, want %v", got, want)
+	}
+
+	var alters []string
+	for _, call := range state.Execs() {
+		if strings.HasPrefix(call.query, "ALTER TABLE") {
+			alters = append(alters, call.query)
+		}
+	}
+	want := []string{
+		`ALTER TABLE "public"."orders_history" ADD COLUMN IF NOT EXISTS "statement_text" TEXT;`,
+		`ALTER TABLE "public"."orders_history" ADD COLUMN IF NOT EXISTS "arg_count" INTEGER;`,
+		`ALTER TABLE "public"."orders_history" ADD COLUMN IF NOT EXISTS "rows_affected" BIGINT;`,
+	}
+	if !reflect.DeepEqual(alters, want) {
+		t.Fatalf("ALTER statements = %#v, want %#v", alters, want)
+	}
+}
+
+func TestMigrate_InsideTransaction(t *testing.T) {
+	t.Parallel()
+
+	catalog := &fakeCatalog{schema: "public", table: "orders", idType: "bigint", columns: []string{"id"}}
+	db, state := openFakeDB(t, catalog.query)
+	ctx := context.Background()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatalf("BeginTx() error = %v", err)
+	}
+	if err := Migrate(ctx, tx, SchemaConfig{}, "orders"); err != nil {
+		t.Fatalf("Migrate() error = %v", err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatalf("Rollback() error = %v", err)
+	}
+
+	execs := state.Execs()
+	if len(execs) != 1 || !strings.Contains(execs[0].query, `CREATE TABLE IF NOT EXISTS "public"."orders_history"`) {
+		t.Fatalf("execs = %#v, want the history DDL", execs)
+	}
+	if commits, rollbacks := state.Outcome(); commits != 0 || rollbacks != 1 {
+		t.Fatalf("commits, rollbacks = %d, %d, want 0, 1", commits, rollbacks)
+	}
+}
+
+var (
+	_ DBExecQuerier = (*sql.DB)(nil)
+	_ DBExecQuerier = (*sql.Tx)(nil)
+	_ DBExecQuerier = (*sql.Conn)(nil)
+	_ DBExecQuerier = (*DB)(nil)
+)
+
+func TestMigrate_RecordColumnTypes(t *testing.T) {
+	t.Parallel()
+
+	catalog := &fakeCatalog{
+		schema:  "sales",
+		table:   "orders",
+		idType:  "bigint",
+		columns: []string{"id", "status", "placed_at"},
+		types:   []string{"bigint", "text", "timestamp with time zone"},
+	}
+	db, state := openFakeDB(t, catalog.query)
+	if err := Migrate(context.Background(), db, SchemaConfig{RecordColumnTypes: true}, "sales.orders"); err != nil {
+		t.Fatalf("Migrate() error = %v", err)
+	}
+
+	var created, cleared bool
+	var inserted [][]any
+	for _, call := range state.Execs() {
+		switch {
+		case strings.Contains(call.query, `CREATE TABLE IF NOT EXISTS "gostry_table_meta"`):
+			created = true
+		case strings.HasPrefix(call.query, `DELETE FROM "gostry_table_meta"`):
+			cleared = !created || len(inserted) == 0
+		case strings.HasPrefix(call.query, `INSERT INTO "gostry_table_meta"`):
+			inserted = append(inserted, call.args)
+		}
+	}
+	if !created || !cleared {
+		t.Fatalf("created = %t, cleared = %t, want gostry_table_meta created and cleared before inserts", created, cleared)
+	}
+	want := [][]any{
+		{`"sales"."orders_history"`, "id", "bigint", int64(1)},
+		{`"sales"."orders_history"`, "status", "text", int64(2)},
+		{`"sales"."orders_history"`, "placed_at", "timestamp with time zone", int64(3)},
+	}
+	if !reflect.DeepEqual(inserted, want) {
+		t.Fatalf("metadata rows = %v, want %v", inserted, want)
+	}
+}
+
+func TestMigrate_IDTypeFallback(t *testing.T) {
+	t.Parallel()
+
+	tcs := []struct {
+		name    string
+		idType  string
+		cfg     SchemaConfig
+		want    string
+		wantErr string
+	}{
+		{name: "copied from id column", idType: "bigint", cfg: SchemaConfig{DefaultIDType: "TEXT"}, want: `"id" bigint`},
+		{name: "uuid by default", want: `"id" UUID`},
+		{name: "configured default for integer keys", cfg: SchemaConfig{DefaultIDType: "BIGINT"}, want: `"id" BIGINT`},
+		{name: "required", cfg: SchemaConfig{RequireIDType: true, DefaultIDType: "BIGINT"}, wantErr: "cannot resolve the id column type"},
+	}
+
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			catalog := &fakeCatalog{schema: "public", table: "order_items", idType: tc.idType, columns: []string{"order_id", "line_no"}}
+			db, state := openFakeDB(t, catalog.query)
+			err := Migrate(context.Background(), db, tc.cfg, "order_items")
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("Migrate() error = %v, want containing %q", err, tc.wantErr)
+				}
+				if execs := state.Execs(); len(execs) != 0 {
+					t.Fatalf("Migrate() executed %d statements, want none", len(execs))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Migrate() error = %v", err)
+			}
+			if ddl := state.Execs()[0].query; !strings.Contains(ddl, tc.want) {
+				t.Fatalf("history DDL = %s, want to contain %q", ddl, tc.want)
+			}
+		})
+	}
+}
+
+func TestMigrate_SearchPathResolution(t *testing.T) {
+	t.Parallel()
+
+	tcs := []struct {
+		name        string
+		table       string
+		wantArgs    []any
+		wantVisible bool
+	}{
+		{name: "unqualified resolved through search_path", table: "orders", wantArgs: []any{"orders"}, wantVisible: true},
+		{name: "qualified looked up directly", table: "app.orders", wantArgs: []any{"app", "orders"}},
+	}
+
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			catalog := &fakeCatalog{schema: "app", table: "orders", idType: "bigint", columns: []string{"id"}}
+			db, state := openFakeDB(t, catalog.query)
+			if err := Migrate(context.Background(), db, SchemaConfig{}, tc.table); err != nil {
+				t.Fatalf("Migrate() error = %v", err)
+			}
+			for _, q := range state.Queries() {
+				if !strings.Contains(q.query, "format_type") {
+					continue
+				}
+				if !reflect.DeepEqual(q.args, tc.wantArgs) {
+					t.Fatalf("table lookup args = %v, want %v", q.args, tc.wantArgs)
+				}
+				if got := strings.Contains(q.query, "pg_table_is_visible"); got != tc.wantVisible {
+					t.Fatalf("table lookup uses pg_table_is_visible = %v, want %v", got, tc.wantVisible)
+				}
+			}
+			if ddl := state.Execs()[0].query; !strings.Contains(ddl, `"app"."orders_history"`) {
+				t.Fatalf("history DDL = %s, want table in schema app", ddl)
+			}
+		})
+	}
+}
+
+func TestMigrate_HistoryIDType(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		cfg     SchemaConfig
+		want    string
+		wantErr string
+	}{
+		{name: "default", want: `"history_id" BIGSERIAL PRIMARY KEY`},
+		{name: "uuid", cfg: SchemaConfig{HistoryIDType: HistoryIDUUID}, want: `"history_id" UUID PRIMARY KEY`},
+		{name: "text", cfg: SchemaConfig{HistoryIDType: HistoryIDText}, want: `"history_id" TEXT PRIMARY KEY`},
+		{name: "unknown", cfg: SchemaConfig{HistoryIDType: "serial"}, wantErr: "unsupported HistoryIDType"},
+		{name: "triggers", cfg: SchemaConfig{HistoryIDType: HistoryIDUUID, UseTriggers: true}, wantErr: "requires HistoryIDBigserial"},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			catalog := &fakeCatalog{schema: "public", table: "orders", idType: "bigint", columns: []string{"id"}}
+			db, state := openFakeDB(t, catalog.query)
+			err := Migrate(context.Background(), db, tt.cfg, "orders")
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Migrate() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Migrate() error = %v", err)
+			}
+			ddl := state.Execs()[0].query
+			if !strings.Contains(ddl, tt.want) {
+				t.Fatalf("DDL = %s, want to contain %q", ddl, tt.want)
+			}
+			if tt.cfg.HistoryIDType != "" && (strings.Contains(ddl, "BIGSERIAL") || strings.Contains(ddl, "DEFAULT")) {
+				t.Fatalf("DDL = %s, want no sequence default", ddl)
+			}
+		})
+	}
+}
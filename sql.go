@@ -2,72 +2,234 @@ package gostry
 
 import (
 	"database/sql"
+	"database/sql/driver"
+	"encoding/hex"
 	"encoding/json"
-	"errors"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mickamy/gostry/internal/pgtext"
 )
 
 // affectedResult implements sql.Result for Exec-like semantics.
-type affectedResult struct{ n int64 }
+type affectedResult struct {
+	n      int64
+	lastID int64
+}
 
 func newAffectedRows(n int) sql.Result {
 	return affectedResult{n: int64(n)}
 }
 
+// newInsertResult returns a result whose LastInsertId reports id, mirroring MySQL,
+// which reports the id of the first row inserted by a multi-row INSERT.
+func newInsertResult(n int, id int64) sql.Result {
+	return affectedResult{n: int64(n), lastID: id}
+}
+
+// LastInsertId reports the id of a captured INSERT, or 0 when it is unknown (not an INSERT, no
+// integer id returned), following the database/sql convention for drivers without the feature.
 func (r affectedResult) LastInsertId() (int64, error) {
-	return 0, errors.New("not supported")
+	return r.lastID, nil
 }
 
 func (r affectedResult) RowsAffected() (int64, error) {
 	return r.n, nil
 }
 
+// integerID converts an integer id value to int64, reporting false for non-integer ids (e.g. UUIDs).
+func integerID(v any) (int64, bool) {
+	switch id := v.(type) {
+	case int64:
+		return id, true
+	case int32:
+		return int64(id), true
+	case int:
+		return int64(id), true
+	case int16:
+		return int64(id), true
+	case int8:
+		return int64(id), true
+	case uint32:
+		return int64(id), true
+	case uint16:
+		return int64(id), true
+	case uint8:
+		return int64(id), true
+	case float64:
+		// JSON-decoded []byte values arrive as float64.
+		if id == float64(int64(id)) {
+			return int64(id), true
+		}
+	}
+	return 0, false
+}
+
 // scanAll consumes all rows from *sql.Rows and returns them as slice of maps.
 func scanAll(rows *sql.Rows) ([]map[string]any, int, error) {
+	var out []map[string]any
+	n, err := scanEach(rows, func(m map[string]any) error {
+		out = append(out, m)
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return out, n, nil
+}
+
+// scanEach consumes rows one at a time, passing each as a map to fn before reading the next,
+// and returns the number of rows scanned. It stops at the first error from the driver or fn.
+func scanEach(rows *sql.Rows, fn func(map[string]any) error) (int, error) {
 	defer func(rows *sql.Rows) {
 		_ = rows.Close()
 	}(rows)
 
 	cols, err := rows.Columns()
 	if err != nil {
-		return nil, 0, err
+		return 0, err
+	}
+	dbTypes := make([]string, len(cols))
+	if types, err := rows.ColumnTypes(); err == nil && len(types) == len(cols) {
+		for i, ct := range types {
+			dbTypes[i] = ct.DatabaseTypeName()
+		}
+	}
+	n := 0
+	vals := make([]any, len(cols))
+	ptrs := make([]any, len(cols))
+	for i := range vals {
+		ptrs[i] = &vals[i]
 	}
-	var out []map[string]any
 	for rows.Next() {
-		vals := make([]any, len(cols))
-		ptrs := make([]any, len(cols))
 		for i := range vals {
-			ptrs[i] = &vals[i]
+			vals[i] = nil
 		}
 		if err := rows.Scan(ptrs...); err != nil {
-			return nil, 0, err
+			return n, err
+		}
+		if err := fn(rowToMap(cols, dbTypes, vals)); err != nil {
+			return n, err
 		}
-		out = append(out, rowToMap(cols, vals))
+		n++
 	}
 	if err := rows.Err(); err != nil {
-		return nil, 0, err
-	}
-	if len(out) == 0 {
-		return nil, 0, sql.ErrNoRows
+		return n, err
 	}
-	return out, len(out), nil
+	return n, nil
 }
 
 // rowToMap converts a single row (columns + values) to a map.
-func rowToMap(cols []string, vals []any) map[string]any {
+// Byte values are decoded as JSON only for JSON/JSONB columns; other typed columns (e.g. NUMERIC or
+// generated columns returned as text) keep their textual value. When the driver does not report
+// database type names, byte values that parse as JSON are decoded and the rest are kept as strings.
+func rowToMap(cols, dbTypes []string, vals []any) map[string]any {
 	m := make(map[string]any, len(cols))
 	for i, c := range cols {
 		v := vals[i]
 		if b, ok := v.([]byte); ok {
-			// Try JSON decoding; if it fails, keep as string
-			var js any
-			if json.Unmarshal(b, &js) == nil {
-				m[c] = js
-				continue
-			}
-			m[c] = string(b)
+			m[c] = decodeBytes(dbTypes[i], b)
 			continue
 		}
-		m[c] = v
+		m[c] = logicalValue(v)
 	}
 	return m
 }
+
+// logicalValue renders driver-specific values in their canonical string form, so they are stored
+// as e.g. "10.0.0.0/8" instead of a nested JSON object. It covers the types pgx scans inet, cidr,
+// macaddr, and uuid columns into, and any driver.Valuer (pgtype.Numeric, pgtype.Interval, ...),
+// whose Value is its textual form. Other values are returned unchanged.
+func logicalValue(v any) any {
+	switch x := v.(type) {
+	case nil, string, int64, float64, bool, time.Time:
+		return v
+	case [16]byte:
+		return formatUUID(x)
+	case net.IP:
+		return x.String()
+	case net.IPNet:
+		return x.String()
+	case *net.IPNet:
+		return x.String()
+	case net.HardwareAddr:
+		return x.String()
+	case netip.Addr:
+		return x.String()
+	case netip.Prefix:
+		return x.String()
+	case driver.Valuer:
+		if val, err := x.Value(); err == nil {
+			if b, ok := val.([]byte); ok {
+				return string(b)
+			}
+			return val
+		}
+	}
+	return v
+}
+
+// formatUUID renders a UUID in its canonical 8-4-4-4-12 hexadecimal form.
+func formatUUID(u [16]byte) string {
+	var b [36]byte
+	hex.Encode(b[0:8], u[0:4])
+	b[8] = '-'
+	hex.Encode(b[9:13], u[4:6])
+	b[13] = '-'
+	hex.Encode(b[14:18], u[6:8])
+	b[18] = '-'
+	hex.Encode(b[19:23], u[8:10])
+	b[23] = '-'
+	hex.Encode(b[24:], u[10:])
+	return string(b[:])
+}
+
+// decodeBytes returns the logical value of a byte column of the given database type.
+func decodeBytes(dbType string, b []byte) any {
+	switch strings.ToUpper(dbType) {
+	case "JSON", "JSONB", "":
+		var js any
+		if json.Unmarshal(b, &js) == nil {
+			return js
+		}
+		return string(b)
+	case "BYTEA":
+		return append([]byte(nil), b...)
+	case "HSTORE":
+		if m, err := pgtext.ParseHstore(string(b)); err == nil {
+			return m
+		}
+		return string(b)
+	default:
+		if elemType, ok := strings.CutPrefix(strings.ToUpper(dbType), "_"); ok {
+			if arr, err := pgtext.ParseArray(string(b), arrayElem(elemType)); err == nil {
+				return arr
+			}
+		}
+		return string(b)
+	}
+}
+
+// arrayElem returns the converter for elements of an array whose element type is elemType.
+// Integers, floats, and booleans become JSON scalars; NUMERIC stays a string like its scalar form.
+func arrayElem(elemType string) func(string) (any, error) {
+	switch elemType {
+	case "INT2", "INT4", "INT8":
+		return func(s string) (any, error) { return strconv.ParseInt(s, 10, 64) }
+	case "FLOAT4", "FLOAT8":
+		return func(s string) (any, error) { return strconv.ParseFloat(s, 64) }
+	case "BOOL":
+		return func(s string) (any, error) { return s == "t" || s == "true", nil }
+	case "JSON", "JSONB":
+		return func(s string) (any, error) {
+			var js any
+			err := json.Unmarshal([]byte(s), &js)
+			return js, err
+		}
+	default:
+		return func(s string) (any, error) { return s, nil }
+	}
+}
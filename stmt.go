@@ -0,0 +1,95 @@
+package gostry
+
+import (
+	"context"
+	"database/sql"
+)
+
+// Stmt is a prepared statement that keeps its SQL text, so executions are captured like those of
+// DB.ExecContext and Tx.ExecContext. Executions that gostry captures run the statement text through
+// the capturing path instead of the prepared statement, since capture may rewrite it (RETURNING);
+// queries use the prepared statement and, like QueryContext, are not captured.
+type Stmt struct {
+	*sql.Stmt
+	query string
+	db    *DB // set for statements prepared on a DB
+	tx    *Tx // set for statements prepared on, or bound to, a Tx
+}
+
+// PrepareContext prepares q on the pool. Use Tx.Stmt to run the statement inside a transaction.
+func (db *DB) PrepareContext(ctx context.Context, q string) (*Stmt, error) {
+	stmt, err := db.DB.PrepareContext(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	return &Stmt{Stmt: stmt, query: q, db: db}, nil
+}
+
+// Prepare is PrepareContext with context.Background.
+func (db *DB) Prepare(q string) (*Stmt, error) {
+	return db.PrepareContext(context.Background(), q)
+}
+
+// PrepareContext prepares q in the transaction.
+func (tx *Tx) PrepareContext(ctx context.Context, q string) (*Stmt, error) {
+	stmt, err := tx.Tx.PrepareContext(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	return &Stmt{Stmt: stmt, query: q, tx: tx}, nil
+}
+
+// Prepare is PrepareContext with the context of the transaction's latest call.
+func (tx *Tx) Prepare(q string) (*Stmt, error) {
+	return tx.PrepareContext(tx.ctx, q)
+}
+
+// StmtContext returns a transaction-specific statement from one prepared on the DB (or another
+// transaction), keeping its SQL text so executions through it are captured.
+func (tx *Tx) StmtContext(ctx context.Context, stmt *Stmt) *Stmt {
+	return &Stmt{Stmt: tx.Tx.StmtContext(ctx, stmt.Stmt), query: stmt.query, tx: tx}
+}
+
+// Stmt is StmtContext with the context of the transaction's latest call.
+func (tx *Tx) Stmt(stmt *Stmt) *Stmt {
+	return tx.StmtContext(tx.ctx, stmt)
+}
+
+// Unwrap returns the underlying *sql.Stmt. Executions through it are not captured.
+func (s *Stmt) Unwrap() *sql.Stmt {
+	return s.Stmt
+}
+
+// ExecContext executes the statement with args, capturing it like Tx.ExecContext (or, for a
+// statement prepared on a DB, like DB.ExecContext).
+func (s *Stmt) ExecContext(ctx context.Context, args ...any) (sql.Result, error) {
+	if s.tx != nil {
+		return s.tx.ExecContext(ctx, s.query, args...)
+	}
+	return s.db.ExecContext(ctx, s.query, args...)
+}
+
+// Exec is ExecContext with context.Background.
+func (s *Stmt) Exec(args ...any) (sql.Result, error) {
+	return s.ExecContext(context.Background(), args...)
+}
+
+// QueryContext runs the prepared query. Like DB.QueryContext, it does not capture data-changing
+// statements and logs a warning for them; use ExecContext instead.
+func (s *Stmt) QueryContext(ctx context.Context, args ...any) (*sql.Rows, error) {
+	s.handler().warnUncapturedQuery(ctx, s.query)
+	return s.Stmt.QueryContext(ctx, args...)
+}
+
+// Query is QueryContext with context.Background.
+func (s *Stmt) Query(args ...any) (*sql.Rows, error) {
+	return s.QueryContext(context.Background(), args...)
+}
+
+// handler returns the Handler the statement was prepared with.
+func (s *Stmt) handler() *Handler {
+	if s.tx != nil {
+		return s.tx.h
+	}
+	return s.db.h
+}
@@ -0,0 +1,86 @@
+package gostry
+
+import (
+	"context"
+	"database/sql/driver"
+	"strings"
+	"testing"
+)
+
+func TestStmt_Capture(t *testing.T) {
+	t.Parallel()
+
+	const q = `UPDATE orders SET status = $1 WHERE id = $2 RETURNING *`
+	tcs := []struct {
+		name string
+		exec func(ctx context.Context, db *DB) error
+	}{
+		{
+			name: "prepared on the DB, bound with Tx.Stmt",
+			exec: func(ctx context.Context, db *DB) error {
+				stmt, err := db.PrepareContext(ctx, q)
+				if err != nil {
+					return err
+				}
+				defer func() { _ = stmt.Close() }()
+				tx, err := db.BeginTx(ctx, nil)
+				if err != nil {
+					return err
+				}
+				if _, err := tx.Stmt(stmt).ExecContext(ctx, "paid", int64(1)); err != nil {
+					return err
+				}
+				return tx.Commit()
+			},
+		},
+		{
+			name: "prepared in the Tx",
+			exec: func(ctx context.Context, db *DB) error {
+				tx, err := db.BeginTx(ctx, nil)
+				if err != nil {
+					return err
+				}
+				stmt, err := tx.PrepareContext(ctx, q)
+				if err != nil {
+					return err
+				}
+				if _, err := stmt.ExecContext(ctx, "paid", int64(1)); err != nil {
+					return err
+				}
+				return tx.Commit()
+			},
+		},
+		{
+			name: "prepared on the DB, executed directly",
+			exec: func(ctx context.Context, db *DB) error {
+				stmt, err := db.PrepareContext(ctx, q)
+				if err != nil {
+					return err
+				}
+				defer func() { _ = stmt.Close() }()
+				_, err = stmt.ExecContext(ctx, "paid", int64(1))
+				return err
+			},
+		},
+	}
+
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			sqlDB, state := openFakeDB(t, func(string, []any) (fakeResult, error) {
+				return fakeResult{cols: []string{"id", "status"}, rows: [][]driver.Value{{int64(1), "paid"}}}, nil
+			})
+			if err := tc.exec(context.Background(), New(Config{}).Wrap(sqlDB)); err != nil {
+				t.Fatalf("exec error = %v", err)
+			}
+			execs := state.Execs()
+			if len(execs) != 1 || !strings.Contains(execs[0].query, `INSERT INTO "orders_history"`) {
+				t.Fatalf("execs = %v, want one history insert", execs)
+			}
+			if commits, _ := state.Outcome(); commits != 1 {
+				t.Errorf("commits = %d, want 1", commits)
+			}
+		})
+	}
+}
@@ -0,0 +1,84 @@
+package gostry
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// tableMetaName is the companion table written by SchemaConfig.RecordColumnTypes.
+const tableMetaName = "gostry_table_meta"
+
+// tableMetaDDL creates the companion table holding the base table columns of each history table.
+const tableMetaDDL = `
+CREATE TABLE IF NOT EXISTS "gostry_table_meta" (
+    "history_table" TEXT NOT NULL,
+    "column_name" TEXT NOT NULL,
+    "data_type" TEXT NOT NULL,
+    "ordinal" INTEGER NOT NULL,
+    "recorded_at" TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY ("history_table", "column_name")
+);`
+
+// columnType is a base table column and its formatted PostgreSQL type.
+type columnType struct {
+	name    string
+	typ     string
+	ordinal int64
+}
+
+// selectColumnTypes lists the columns of schemaName.tableName with their types, in attribute order.
+func selectColumnTypes(ctx context.Context, db DBExecQuerier, schemaName, tableName string) ([]columnType, error) {
+	rows, err := db.QueryContext(ctx, `
+        SELECT a.attname, pg_catalog.format_type(a.atttypid, a.atttypmod) AS data_type, a.attnum AS ordinal
+        FROM pg_attribute a
+        JOIN pg_class r ON r.oid = a.attrelid
+        JOIN pg_namespace n ON n.oid = r.relnamespace
+        WHERE n.nspname = $1 AND r.relname = $2
+          AND a.attnum > 0
+          AND NOT a.attisdropped
+        ORDER BY a.attnum
+    `, schemaName, tableName)
+	if err != nil {
+		return nil, err
+	}
+	defer func(rows *sql.Rows) {
+		_ = rows.Close()
+	}(rows)
+
+	var cols []columnType
+	for rows.Next() {
+		var c columnType
+		if err := rows.Scan(&c.name, &c.typ, &c.ordinal); err != nil {
+			return nil, err
+		}
+		cols = append(cols, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return cols, nil
+}
+
+// recordColumnTypes replaces the gostry_table_meta rows of historyIdent with the current columns
+// and types of base, so readers of before/after know how to interpret each value.
+func recordColumnTypes(ctx context.Context, db DBExecQuerier, base tableInfo, historyIdent string) error {
+	cols, err := selectColumnTypes(ctx, db, base.schema, base.table)
+	if err != nil {
+		return fmt.Errorf("gostry: failed to read column types of %s: %w", base.ident, err)
+	}
+	if _, err := db.ExecContext(ctx, tableMetaDDL); err != nil {
+		return fmt.Errorf("gostry: failed to create %s: %w", tableMetaName, err)
+	}
+	if _, err := db.ExecContext(ctx, `DELETE FROM "gostry_table_meta" WHERE "history_table" = $1`, historyIdent); err != nil {
+		return fmt.Errorf("gostry: failed to clear %s for %s: %w", tableMetaName, historyIdent, err)
+	}
+	for _, c := range cols {
+		if _, err := db.ExecContext(ctx,
+			`INSERT INTO "gostry_table_meta" ("history_table", "column_name", "data_type", "ordinal") VALUES ($1, $2, $3, $4)`,
+			historyIdent, c.name, c.typ, c.ordinal); err != nil {
+			return fmt.Errorf("gostry: failed to record column types of %s: %w", base.ident, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package gostry
+
+import (
+	"context"
+	"strings"
+
+	"github.com/mickamy/gostry/internal/ident"
+)
+
+type tenantKey struct{}
+
+// WithTenant scopes subsequent statements to the tenant schema: unqualified target tables are
+// resolved within schema, so a write to "orders" is recorded for schema.orders and its history
+// goes to schema.orders_history. Statements that already qualify their target keep their schema.
+// The statement itself is not rewritten; the connection's search_path must point at the same schema.
+func WithTenant(ctx context.Context, schema string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, strings.TrimSpace(schema))
+}
+
+// extractTenant returns the tenant schema attached by WithTenant, or "".
+func extractTenant(ctx context.Context) string {
+	if v, ok := ctx.Value(tenantKey{}).(string); ok {
+		return v
+	}
+	return ""
+}
+
+// tenantTable qualifies an unqualified table with the tenant schema of ctx, if any.
+func tenantTable(ctx context.Context, table string) string {
+	tenant := extractTenant(ctx)
+	if tenant == "" || len(ident.SplitQualified(table)) != 1 {
+		return table
+	}
+	return ident.Quote(tenant) + "." + table
+}
+
+// MigrateTenants runs MigrateWithResult once per tenant schema, resolving every unqualified target
+// within that schema. Targets that already carry a schema are migrated as-is for each tenant, so
+// they are usually left out. Results are reported in schema order, then target order.
+func MigrateTenants(ctx context.Context, db DBExecQuerier, cfg SchemaConfig, schemas []string, targets ...any) (MigrateResult, error) {
+	names := make([]string, 0, len(targets))
+	for _, t := range targets {
+		name, err := resolveTableName(t, cfg.TableNameFunc, cfg.SingularTableNames)
+		if err != nil {
+			return MigrateResult{}, err
+		}
+		names = append(names, name)
+	}
+
+	var result MigrateResult
+	for _, schema := range schemas {
+		tenantCtx := WithTenant(ctx, schema)
+		scoped := make([]any, len(names))
+		for i, name := range names {
+			scoped[i] = tenantTable(tenantCtx, name)
+		}
+		res, err := MigrateWithResult(ctx, db, cfg, scoped...)
+		result.Tables = append(result.Tables, res.Tables...)
+		if err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
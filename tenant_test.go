@@ -0,0 +1,99 @@
+package gostry
+
+import (
+	"context"
+	"database/sql/driver"
+	"strings"
+	"testing"
+)
+
+func TestTx_WithTenant(t *testing.T) {
+	t.Parallel()
+
+	tcs := []struct {
+		name      string
+		sql       string
+		wantTable string
+		wantInto  string
+	}{
+		{
+			name:      "unqualified table resolves in tenant schema",
+			sql:       `UPDATE orders SET status = 'paid' WHERE id = 1 RETURNING *`,
+			wantTable: `"tenant_123".orders`,
+			wantInto:  `INSERT INTO "tenant_123"."orders_history"`,
+		},
+		{
+			name:      "qualified table keeps its schema",
+			sql:       `UPDATE shared.orders SET status = 'paid' WHERE id = 1 RETURNING *`,
+			wantTable: `shared.orders`,
+			wantInto:  `INSERT INTO "shared"."orders_history"`,
+		},
+	}
+
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			db, state := openFakeDB(t, func(string, []any) (fakeResult, error) {
+				return fakeResult{cols: []string{"id"}, rows: [][]driver.Value{{int64(1)}}}, nil
+			})
+			var captured []Record
+			h := New(Config{OnCapture: func(_ context.Context, r Record) { captured = append(captured, r) }})
+
+			ctx := WithTenant(context.Background(), "tenant_123")
+			tx, err := h.Wrap(db).BeginTx(ctx, nil)
+			if err != nil {
+				t.Fatalf("BeginTx() error = %v", err)
+			}
+			if _, err := tx.ExecContext(ctx, tc.sql); err != nil {
+				t.Fatalf("ExecContext() error = %v", err)
+			}
+			if err := tx.Commit(); err != nil {
+				t.Fatalf("Commit() error = %v", err)
+			}
+
+			if len(captured) != 1 || captured[0].Table != tc.wantTable {
+				t.Fatalf("captured = %#v, want table %s", captured, tc.wantTable)
+			}
+			execs := state.Execs()
+			if len(execs) != 1 || !strings.Contains(execs[0].query, tc.wantInto) {
+				t.Fatalf("history inserts = %#v, want %s", execs, tc.wantInto)
+			}
+		})
+	}
+}
+
+func TestMigrateTenants(t *testing.T) {
+	t.Parallel()
+
+	db, state := openFakeDB(t, func(q string, args []any) (fakeResult, error) {
+		switch {
+		case strings.Contains(q, "format_type"):
+			return fakeResult{cols: []string{"nspname", "relname", "id_type"}, rows: [][]driver.Value{{args[0], args[1], "bigint"}}}, nil
+		case strings.Contains(q, "to_regclass"):
+			return fakeResult{cols: []string{"exists"}, rows: [][]driver.Value{{false}}}, nil
+		}
+		return fakeResult{}, nil
+	})
+
+	res, err := MigrateTenants(context.Background(), db, SchemaConfig{}, []string{"tenant_1", "tenant_2"}, "orders", "payments")
+	if err != nil {
+		t.Fatalf("MigrateTenants() error = %v", err)
+	}
+	var got []string
+	for _, tbl := range res.Tables {
+		got = append(got, tbl.History)
+	}
+	want := []string{
+		`"tenant_1"."orders_history"`,
+		`"tenant_1"."payments_history"`,
+		`"tenant_2"."orders_history"`,
+		`"tenant_2"."payments_history"`,
+	}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("MigrateTenants() history tables = %v, want %v", got, want)
+	}
+	if execs := state.Execs(); len(execs) != len(want) {
+		t.Fatalf("DDL statements = %d, want %d", len(execs), len(want))
+	}
+}
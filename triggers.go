@@ -0,0 +1,133 @@
+package gostry
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/mickamy/gostry/internal/ident"
+)
+
+// Session settings read by the history triggers created with SchemaConfig.UseTriggers and
+// published by BeginTx when Config.SessionSettings or Config.TriggerCapture is set, e.g. for RLS
+// policies. Pair UseTriggers with TriggerCapture, under which Tx.ExecContext no longer captures DML.
+const (
+	settingOperator = "gostry.operator"
+	settingTraceID  = "gostry.trace_id"
+	settingReason   = "gostry.reason"
+)
+
+// triggerRow describes the history row a trigger writes: the table layout and the base table
+// columns it reads the key from.
+type triggerRow struct {
+	layout   historyDDLOptions // history table layout (see historyFeatures); promoted columns are copied from the row
+	idColumn string            // base table column stored in the history id column
+	keyCols  []string          // composite key columns rendered into composite_id
+}
+
+// triggerImage is the record one branch of a trigger reads (OLD or NEW) and the before/after images it writes.
+type triggerImage struct {
+	record string
+	before string
+	after  string
+}
+
+// triggerSetting returns the expression reading a gostry.* session setting, NULL when unset.
+func triggerSetting(name string) string {
+	return fmt.Sprintf("NULLIF(current_setting('%s', true), '')", name)
+}
+
+// triggerCompositeID renders composite_id from the composite key columns of the record.
+func triggerCompositeID(r triggerRow, img triggerImage) string {
+	pairs := make([]string, 0, len(r.keyCols)*2)
+	for _, k := range r.keyCols {
+		pairs = append(pairs, "'"+strings.ReplaceAll(k, "'", "''")+"'", img.record+"."+ident.Quote(k))
+	}
+	return "jsonb_build_object(" + strings.Join(pairs, ", ") + ")"
+}
+
+// triggerName returns the name shared by the trigger function and the trigger of a history table.
+func triggerName(historyParts []string) string {
+	return historyParts[len(historyParts)-1] + "_capture"
+}
+
+// buildTriggerDDL renders the PL/pgSQL function and the AFTER INSERT/UPDATE/DELETE row trigger that
+// write changes of baseIdent into its history table. The trigger writes the historyLayout columns
+// it can fill; the others keep their column default. Operator, trace id, and reason are read from
+// the gostry.* session settings, so they are NULL unless the writer sets them (see Config.TriggerCapture).
+func buildTriggerDDL(baseIdent string, historyParts []string, cols historyColumns, r triggerRow) []string {
+	historyIdent := ident.QuoteQualified(historyParts)
+	name := triggerName(historyParts)
+	fnParts := append(append([]string{}, historyParts[:len(historyParts)-1]...), name)
+	fnIdent := ident.QuoteQualified(fnParts)
+
+	if r.idColumn == "" {
+		r.idColumn = "id"
+	}
+	var layout []historyColumn
+	for _, c := range historyLayoutColumns(r.layout) {
+		if c.trigger != nil {
+			layout = append(layout, c)
+		}
+	}
+	columns := make([]string, 0, len(layout)+len(r.layout.promoted))
+	for _, c := range layout {
+		columns = append(columns, ident.Quote(c.name(cols)))
+	}
+	for _, p := range r.layout.promoted {
+		columns = append(columns, ident.Quote(p.Name))
+	}
+
+	insert := func(record, before, after string) string {
+		img := triggerImage{record: record, before: before, after: after}
+		values := make([]string, 0, len(columns))
+		for _, c := range layout {
+			values = append(values, c.trigger(r, img))
+		}
+		for _, p := range r.layout.promoted {
+			typ := p.Type
+			if typ == "" {
+				typ = "TEXT"
+			}
+			values = append(values, fmt.Sprintf("(%s.%s)::%s", record, ident.Quote(p.Name), typ))
+		}
+		return fmt.Sprintf("INSERT INTO %s (%s)\n        VALUES (%s);", historyIdent, strings.Join(columns, ", "), strings.Join(values, ", "))
+	}
+
+	fn := fmt.Sprintf(`CREATE OR REPLACE FUNCTION %s() RETURNS trigger
+LANGUAGE plpgsql AS $gostry$
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        %s
+    ELSIF TG_OP = 'UPDATE' THEN
+        %s
+    ELSE
+        %s
+    END IF;
+    RETURN NULL;
+END;
+$gostry$;`,
+		fnIdent,
+		insert("OLD", "to_jsonb(OLD)", "NULL"),
+		insert("NEW", "to_jsonb(OLD)", "to_jsonb(NEW)"),
+		insert("NEW", "NULL", "to_jsonb(NEW)"),
+	)
+	return []string{
+		fn,
+		fmt.Sprintf(`DROP TRIGGER IF EXISTS %s ON %s;`, ident.Quote(name), baseIdent),
+		fmt.Sprintf(`CREATE TRIGGER %s AFTER INSERT OR UPDATE OR DELETE ON %s FOR EACH ROW EXECUTE FUNCTION %s();`,
+			ident.Quote(name), baseIdent, fnIdent),
+	}
+}
+
+// setSessionMeta publishes the operator, trace id, and reason in m as transaction-local
+// gostry.* settings. Values are bound through set_config, never interpolated into SQL.
+func setSessionMeta(ctx context.Context, tx execer, m meta) error {
+	_, err := tx.ExecContext(ctx,
+		`SELECT set_config($1, $2, true), set_config($3, $4, true), set_config($5, $6, true)`,
+		settingOperator, m.operator, settingTraceID, m.traceID, settingReason, m.reason)
+	if err != nil {
+		return fmt.Errorf("gostry: failed to set session settings: %w", err)
+	}
+	return nil
+}
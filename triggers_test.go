@@ -0,0 +1,166 @@
+package gostry
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestBuildTriggerDDL(t *testing.T) {
+	t.Parallel()
+
+	stmts := buildTriggerDDL(`"sales"."orders"`, []string{"sales", "orders_history"}, defaultHistoryColumns, triggerRow{
+		layout: historyDDLOptions{
+			composite: true,
+			statement: true,
+			promoted:  []PromotedColumn{{Name: "status"}, {Name: "total", Type: "NUMERIC"}},
+		},
+		idColumn: "order_no",
+		keyCols:  []string{"tenant_id", "order_no"},
+	})
+	if len(stmts) != 3 {
+		t.Fatalf("buildTriggerDDL() = %d statements, want 3", len(stmts))
+	}
+
+	fn := stmts[0]
+	for _, want := range []string{
+		`CREATE OR REPLACE FUNCTION "sales"."orders_history_capture"() RETURNS trigger`,
+		`INSERT INTO "sales"."orders_history" ("id", "operation", "operated_at", "operated_by", "trace_id", "reason", "before", "after", "composite_id", "statement_text", "status", "total")`,
+		`VALUES (OLD."order_no", TG_OP, now(), NULLIF(current_setting('gostry.operator', true), ''), NULLIF(current_setting('gostry.trace_id', true), ''), NULLIF(current_setting('gostry.reason', true), ''), to_jsonb(OLD), NULL, jsonb_build_object('tenant_id', OLD."tenant_id", 'order_no', OLD."order_no"), current_query(), (OLD."status")::TEXT, (OLD."total")::NUMERIC);`,
+		`to_jsonb(OLD), to_jsonb(NEW)`,
+		`NULL, to_jsonb(NEW)`,
+		`RETURN NULL;`,
+	} {
+		if !strings.Contains(fn, want) {
+			t.Fatalf("trigger function = %s\nwant to contain %s", fn, want)
+		}
+	}
+	if want := `DROP TRIGGER IF EXISTS "orders_history_capture" ON "sales"."orders";`; stmts[1] != want {
+		t.Fatalf("drop = %s, want %s", stmts[1], want)
+	}
+	if want := `CREATE TRIGGER "orders_history_capture" AFTER INSERT OR UPDATE OR DELETE ON "sales"."orders" FOR EACH ROW EXECUTE FUNCTION "sales"."orders_history_capture"();`; stmts[2] != want {
+		t.Fatalf("create = %s, want %s", stmts[2], want)
+	}
+}
+
+func TestMigrateWithResult_UseTriggers(t *testing.T) {
+	t.Parallel()
+
+	catalog := &fakeCatalog{schema: "public", table: "orders", idType: "bigint", columns: []string{"id", "status"}}
+	db, state := openFakeDB(t, catalog.query)
+
+	res, err := MigrateWithResult(context.Background(), db, SchemaConfig{UseTriggers: true}, "orders")
+	if err != nil {
+		t.Fatalf("MigrateWithResult() error = %v", err)
+	}
+	if got, want := res.Tables[0].Trigger, `"orders_history_capture"`; got != want {
+		t.Fatalf("Trigger = %q, want %q", got, want)
+	}
+	var got []string
+	for _, call := range state.Execs() {
+		switch {
+		case strings.HasPrefix(call.query, "CREATE OR REPLACE FUNCTION"):
+			got = append(got, "function")
+		case strings.HasPrefix(call.query, "DROP TRIGGER"):
+			got = append(got, "drop")
+		case strings.HasPrefix(call.query, "CREATE TRIGGER"):
+			got = append(got, "trigger")
+		}
+	}
+	if want := []string{"function", "drop", "trigger"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("trigger statements = %v, want %v", got, want)
+	}
+}
+
+func TestTx_TriggerCapture(t *testing.T) {
+	t.Parallel()
+
+	db, state := openFakeDB(t, func(string, []any) (fakeResult, error) {
+		return fakeResult{cols: []string{"id"}, rows: [][]driver.Value{{int64(1)}}}, nil
+	})
+	ctx := WithReason(WithTraceID(WithOperator(context.Background(), "alice"), "trace-1"), "refund")
+
+	tx, err := New(Config{TriggerCapture: true}).Wrap(db).BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatalf("BeginTx() error = %v", err)
+	}
+	const update = `UPDATE orders SET status = 'paid' WHERE id = 1 RETURNING *`
+	if _, err := tx.ExecContext(ctx, update); err != nil {
+		t.Fatalf("ExecContext() error = %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Commit() error = %v", err)
+	}
+
+	execs := state.Execs()
+	if len(execs) != 2 {
+		t.Fatalf("execs = %#v, want set_config then the UPDATE", execs)
+	}
+	if !strings.Contains(execs[0].query, "set_config($1, $2, true)") {
+		t.Fatalf("session statement = %s", execs[0].query)
+	}
+	want := []any{"gostry.operator", "alice", "gostry.trace_id", "trace-1", "gostry.reason", "refund"}
+	if !reflect.DeepEqual(execs[0].args, want) {
+		t.Fatalf("session args = %v, want %v", execs[0].args, want)
+	}
+	if execs[1].query != update {
+		t.Fatalf("exec = %s, want pass-through UPDATE", execs[1].query)
+	}
+	if got := len(state.Queries()); got != 0 {
+		t.Fatalf("queries = %d, want 0 (no application capture)", got)
+	}
+}
+
+func TestTx_SessionSettings(t *testing.T) {
+	t.Parallel()
+
+	tcs := []struct {
+		name string
+		cfg  Config
+		want string
+	}{
+		{name: "enabled", cfg: Config{SessionSettings: true}, want: "alice"},
+		{name: "disabled", cfg: Config{}, want: ""},
+	}
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			// Emulates current_setting by reading back the settings bound by BeginTx.
+			var state *fakeState
+			db, state := openFakeDB(t, func(q string, args []any) (fakeResult, error) {
+				var value driver.Value
+				for _, call := range state.Execs() {
+					if !strings.Contains(call.query, "set_config") {
+						continue
+					}
+					for i := 0; i+1 < len(call.args); i += 2 {
+						if call.args[i] == args[0] {
+							value = call.args[i+1]
+						}
+					}
+				}
+				return fakeResult{cols: []string{"current_setting"}, rows: [][]driver.Value{{value}}}, nil
+			})
+
+			ctx := WithOperator(context.Background(), "alice")
+			tx, err := New(tc.cfg).Wrap(db).BeginTx(ctx, nil)
+			if err != nil {
+				t.Fatalf("BeginTx() error = %v", err)
+			}
+			defer func() { _ = tx.Rollback() }()
+
+			var got sql.NullString
+			if err := tx.QueryRowContext(ctx, `SELECT current_setting($1, true)`, settingOperator).Scan(&got); err != nil {
+				t.Fatalf("QueryRowContext() error = %v", err)
+			}
+			if got.String != tc.want {
+				t.Fatalf("current_setting(%s) = %q, want %q", settingOperator, got.String, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,39 @@
+package gostry
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/mickamy/gostry/internal/ident"
+)
+
+// flatViewParts returns the identifier parts of the flat view of a history table: <history table>_flat
+// in the history table's schema.
+func flatViewParts(historyParts []string) []string {
+	parts := append([]string{}, historyParts...)
+	parts[len(parts)-1] += "_flat"
+	return parts
+}
+
+// buildFlatViewDDL renders the CREATE OR REPLACE VIEW statement exposing the metadata columns of a
+// history table together with each promoted column extracted from before and after as
+// before_<name> / after_<name>, cast to the promoted column type when one is configured.
+func buildFlatViewDDL(historyParts []string, cols historyColumns, promoted []PromotedColumn) string {
+	q := cols.quoted()
+	columns := []string{q.historyID, q.id, q.operation, q.operatedAt, q.operatedBy + ` AS "operator"`}
+	for _, p := range promoted {
+		key := "'" + strings.ReplaceAll(p.Name, "'", "''") + "'"
+		for _, image := range []struct{ prefix, column string }{{"before_", q.before}, {"after_", q.after}} {
+			expr := fmt.Sprintf("(%s->>%s)", image.column, key)
+			if p.Type != "" && !strings.EqualFold(p.Type, "TEXT") {
+				expr += "::" + p.Type
+			}
+			columns = append(columns, expr+" AS "+ident.Quote(image.prefix+p.Name))
+		}
+	}
+	return fmt.Sprintf(`
+CREATE OR REPLACE VIEW %s AS
+SELECT %s
+FROM %s;
+`, ident.QuoteQualified(flatViewParts(historyParts)), strings.Join(columns, ",\n       "), ident.QuoteQualified(historyParts))
+}
@@ -0,0 +1,88 @@
+package gostry
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestBuildFlatViewDDL(t *testing.T) {
+	t.Parallel()
+
+	tcs := []struct {
+		name     string
+		parts    []string
+		promoted []PromotedColumn
+		want     string
+	}{
+		{
+			name:  "metadata only",
+			parts: []string{"orders_history"},
+			want: `
+CREATE OR REPLACE VIEW "orders_history_flat" AS
+SELECT "history_id",
+       "id",
+       "operation",
+       "operated_at",
+       "operated_by" AS "operator"
+FROM "orders_history";
+`,
+		},
+		{
+			name:     "promoted columns with casts",
+			parts:    []string{"sales", "orders_history"},
+			promoted: []PromotedColumn{{Name: "status"}, {Name: "total", Type: "NUMERIC(10,2)"}, {Name: "it's", Type: "text"}},
+			want: `
+CREATE OR REPLACE VIEW "sales"."orders_history_flat" AS
+SELECT "history_id",
+       "id",
+       "operation",
+       "operated_at",
+       "operated_by" AS "operator",
+       ("before"->>'status') AS "before_status",
+       ("after"->>'status') AS "after_status",
+       ("before"->>'total')::NUMERIC(10,2) AS "before_total",
+       ("after"->>'total')::NUMERIC(10,2) AS "after_total",
+       ("before"->>'it''s') AS "before_it's",
+       ("after"->>'it''s') AS "after_it's"
+FROM "sales"."orders_history";
+`,
+		},
+	}
+
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			if got := buildFlatViewDDL(tc.parts, defaultHistoryColumns, tc.promoted); got != tc.want {
+				t.Fatalf("buildFlatViewDDL() = %s, want %s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestMigrateWithResult_CreateFlatView(t *testing.T) {
+	t.Parallel()
+
+	catalog := &fakeCatalog{schema: "public", table: "orders", idType: "bigint", columns: []string{"id", "status"}}
+	db, state := openFakeDB(t, catalog.query)
+	cfg := SchemaConfig{CreateFlatView: true, Promoted: PromotedColumns{"orders": {{Name: "status"}}}}
+	res, err := MigrateWithResult(context.Background(), db, cfg, "orders")
+	if err != nil {
+		t.Fatalf("MigrateWithResult() error = %v", err)
+	}
+	if got := res.Tables[0].View; got != `"public"."orders_history_flat"` {
+		t.Fatalf("View = %q, want %q", got, `"public"."orders_history_flat"`)
+	}
+	var found bool
+	for _, call := range state.Execs() {
+		found = found || strings.Contains(call.query, `("after"->>'status') AS "after_status"`)
+	}
+	if !found {
+		t.Fatal("Migrate did not create the flat view")
+	}
+
+	if _, err := MigrateWithResult(context.Background(), db, SchemaConfig{CreateFlatView: true, Encoding: EncodingCBOR}, "orders"); err == nil {
+		t.Fatal("MigrateWithResult() with EncodingCBOR error = nil, want error")
+	}
+}
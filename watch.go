@@ -0,0 +1,36 @@
+package gostry
+
+// watchedColumns returns the columns watched for table in cfg.WatchColumns, or nil when the table
+// is not watched.
+func (h *Handler) watchedColumns(table string) []string {
+	cols, _ := lookupTable(h.cfg.WatchColumns, table)
+	return cols
+}
+
+// pruneWatched trims m to the watched columns of table plus the columns identifying the row
+// (id and composite key). Rows of unwatched tables are returned unchanged.
+func (h *Handler) pruneWatched(table string, m map[string]any) map[string]any {
+	watched := h.watchedColumns(table)
+	if len(watched) == 0 || m == nil {
+		return m
+	}
+	cols := append([]string{h.idColumn(table)}, h.keyColumns(table)...)
+	return projectRow(append(cols, watched...), m)
+}
+
+// dropUnwatchedUpdates removes UPDATE entries of watched tables in which none of the watched columns
+// changed (Config.SkipUnwatchedUpdates, which needs Config.CaptureBefore). Values are compared by their
+// JSON encoding, like SkipNoOpUpdates does. Entries without both images are kept, since the change
+// cannot be told.
+func (h *Handler) dropUnwatchedUpdates(entries []entry) []entry {
+	kept := make([]entry, 0, len(entries))
+	for _, e := range entries {
+		watched := h.watchedColumns(e.table)
+		if e.op == "UPDATE" && len(watched) > 0 && e.before != nil && e.after != nil &&
+			sameImage(projectRow(watched, e.before), projectRow(watched, e.after)) {
+			continue
+		}
+		kept = append(kept, e)
+	}
+	return kept
+}
@@ -0,0 +1,92 @@
+package gostry
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// RetryPolicy controls how WithinTx retries transactions aborted by PostgreSQL
+// serialization failures (40001) or deadlocks (40P01).
+type RetryPolicy struct {
+	MaxAttempts int                             // total attempts including the first; values <= 1 disable retries
+	Backoff     func(attempt int) time.Duration // optional delay before retry attempt n (starting at 1)
+}
+
+// WithinTx runs fn inside a capturing transaction with default options. See WithinTxOptions.
+func (db *DB) WithinTx(ctx context.Context, fn func(tx *Tx) error) error {
+	return db.WithinTxOptions(ctx, nil, fn)
+}
+
+// WithinTxOptions begins a capturing transaction, runs fn, and commits (flushing history) when fn
+// returns nil; otherwise it rolls back and returns fn's error. If fn panics, the transaction is
+// rolled back and the panic propagates.
+// When Config.RetryOnSerializationFailure allows it, the whole function is re-run on a fresh
+// transaction after a serialization failure or deadlock, so fn must be safe to repeat.
+func (db *DB) WithinTxOptions(ctx context.Context, opts *sql.TxOptions, fn func(tx *Tx) error) error {
+	policy := db.h.cfg.RetryOnSerializationFailure
+	for attempt := 1; ; attempt++ {
+		err := db.runTx(ctx, opts, fn)
+		if err == nil || attempt >= policy.MaxAttempts || !isRetryable(err) {
+			return err
+		}
+		if policy.Backoff != nil {
+			if err := sleepContext(ctx, policy.Backoff(attempt)); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// runTx executes a single attempt of WithinTxOptions.
+// A panic in fn rolls the transaction back (discarding captured history) and is re-raised.
+func (db *DB) runTx(ctx context.Context, opts *sql.TxOptions, fn func(tx *Tx) error) (err error) {
+	tx, err := db.BeginTx(ctx, opts)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			_ = tx.Rollback()
+			panic(p)
+		}
+	}()
+	if err := fn(tx); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	if err := tx.CommitContext(ctx); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return nil
+}
+
+// sqlStateError is implemented by driver errors exposing a SQLSTATE code (pgx, lib/pq).
+type sqlStateError interface {
+	SQLState() string
+}
+
+// isRetryable reports whether err carries SQLSTATE 40001 (serialization_failure) or 40P01 (deadlock_detected).
+func isRetryable(err error) bool {
+	switch sqlState(err) {
+	case "40001", "40P01":
+		return true
+	}
+	return false
+}
+
+// sleepContext waits for d or until ctx is done.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
@@ -0,0 +1,161 @@
+package gostry
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakePgError mimics driver errors exposing a SQLSTATE code.
+type fakePgError struct{ code string }
+
+func (e fakePgError) Error() string    { return "pg error " + e.code }
+func (e fakePgError) SQLState() string { return e.code }
+
+func TestDB_WithinTx_RetryOnSerializationFailure(t *testing.T) {
+	t.Parallel()
+
+	tcs := []struct {
+		name        string
+		code        string
+		maxAttempts int
+		wantErr     bool
+		wantCalls   int32
+		wantCommits int
+	}{
+		{name: "serialization failure retried", code: "40001", maxAttempts: 3, wantCalls: 2, wantCommits: 1},
+		{name: "deadlock retried", code: "40P01", maxAttempts: 3, wantCalls: 2, wantCommits: 1},
+		{name: "retry disabled", code: "40001", maxAttempts: 0, wantErr: true, wantCalls: 1},
+		{name: "other errors not retried", code: "23505", maxAttempts: 3, wantErr: true, wantCalls: 1},
+	}
+
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			db, state := openFakeDB(t, nil)
+			var failed atomic.Bool
+			state.execErr = func(q string) error {
+				if strings.HasPrefix(q, "UPDATE") && failed.CompareAndSwap(false, true) {
+					return fakePgError{code: tc.code}
+				}
+				return nil
+			}
+
+			var backoffs []int
+			h := New(Config{RetryOnSerializationFailure: RetryPolicy{
+				MaxAttempts: tc.maxAttempts,
+				Backoff: func(attempt int) time.Duration {
+					backoffs = append(backoffs, attempt)
+					return time.Millisecond
+				},
+			}})
+
+			var calls atomic.Int32
+			err := h.Wrap(db).WithinTx(context.Background(), func(tx *Tx) error {
+				calls.Add(1)
+				_, err := tx.ExecContext(context.Background(), `UPDATE orders SET status = 'paid' WHERE id = 1`)
+				return err
+			})
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("WithinTx() error = %v, wantErr %t", err, tc.wantErr)
+			}
+			if tc.wantErr {
+				var pgErr fakePgError
+				if !errors.As(err, &pgErr) || pgErr.code != tc.code {
+					t.Fatalf("WithinTx() error = %v, want SQLSTATE %s", err, tc.code)
+				}
+			}
+			if got := calls.Load(); got != tc.wantCalls {
+				t.Fatalf("fn calls = %d, want %d", got, tc.wantCalls)
+			}
+			if commits, _ := state.Outcome(); commits != tc.wantCommits {
+				t.Fatalf("commits = %d, want %d", commits, tc.wantCommits)
+			}
+			if !tc.wantErr && len(backoffs) != 1 {
+				t.Fatalf("backoff calls = %v, want one", backoffs)
+			}
+		})
+	}
+}
+
+func TestDB_WithinTx(t *testing.T) {
+	t.Parallel()
+
+	returning := func(string, []any) (fakeResult, error) {
+		return fakeResult{cols: []string{"id"}, rows: [][]driver.Value{{int64(1)}}}, nil
+	}
+	update := func(tx *Tx) error {
+		_, err := tx.ExecContext(context.Background(), `UPDATE orders SET status = 'paid' WHERE id = 1 RETURNING *`)
+		return err
+	}
+
+	t.Run("commit", func(t *testing.T) {
+		t.Parallel()
+		db, state := openFakeDB(t, returning)
+		if err := New(Config{}).Wrap(db).WithinTx(context.Background(), update); err != nil {
+			t.Fatalf("WithinTx() error = %v", err)
+		}
+		if got := len(state.Execs()); got != 1 {
+			t.Fatalf("history inserts = %d, want 1", got)
+		}
+		if commits, rollbacks := state.Outcome(); commits != 1 || rollbacks != 0 {
+			t.Fatalf("commits, rollbacks = %d, %d, want 1, 0", commits, rollbacks)
+		}
+	})
+
+	t.Run("error rolls back", func(t *testing.T) {
+		t.Parallel()
+		db, state := openFakeDB(t, returning)
+		wantErr := errors.New("boom")
+		err := New(Config{}).Wrap(db).WithinTx(context.Background(), func(tx *Tx) error {
+			if err := update(tx); err != nil {
+				return err
+			}
+			return wantErr
+		})
+		if !errors.Is(err, wantErr) {
+			t.Fatalf("WithinTx() error = %v, want %v", err, wantErr)
+		}
+		if got := len(state.Execs()); got != 0 {
+			t.Fatalf("history inserts = %d, want 0", got)
+		}
+		if commits, rollbacks := state.Outcome(); commits != 0 || rollbacks != 1 {
+			t.Fatalf("commits, rollbacks = %d, %d, want 0, 1", commits, rollbacks)
+		}
+	})
+
+	t.Run("panic rolls back and re-panics", func(t *testing.T) {
+		t.Parallel()
+		db, state := openFakeDB(t, returning)
+		var captured *Tx
+		func() {
+			defer func() {
+				if p := recover(); p != "boom" {
+					t.Fatalf("recover() = %v, want boom", p)
+				}
+			}()
+			_ = New(Config{}).Wrap(db).WithinTx(context.Background(), func(tx *Tx) error {
+				captured = tx
+				if err := update(tx); err != nil {
+					return err
+				}
+				panic("boom")
+			})
+			t.Fatal("WithinTx() returned, want panic")
+		}()
+		if got := len(state.Execs()); got != 0 {
+			t.Fatalf("history inserts = %d, want 0", got)
+		}
+		if commits, rollbacks := state.Outcome(); commits != 0 || rollbacks != 1 {
+			t.Fatalf("commits, rollbacks = %d, %d, want 0, 1", commits, rollbacks)
+		}
+		if n := len(captured.buf.Drain()); n != 0 {
+			t.Fatalf("buffered entries after panic = %d, want 0", n)
+		}
+	})
+}